@@ -6,6 +6,8 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"sort"
+	"strings"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/pkg/errors"
@@ -72,7 +74,79 @@ func AssignPrincipals(awsRoles []*AWSRole, awsAccounts []*AWSAccount) {
 
 }
 
-// LocateRole locate role by name
+// GroupAWSRolesByAccount group the roles from the assertion by the account ID in the role ARN, each group
+// is headed by the configured alias for the account, then the account name from the AWS sign in page when
+// the account is listed there, otherwise by the account ID. Groups are sorted by name and the roles in each
+// group by role name.
+func GroupAWSRolesByAccount(awsRoles []*AWSRole, awsAccounts []*AWSAccount, aliases map[string]string) []*AWSAccount {
+	accountNames := make(map[string]string)
+	roleNames := make(map[string]string)
+	for _, awsAccount := range awsAccounts {
+		for _, awsRole := range awsAccount.Roles {
+			accountNames[roleAccountID(awsRole.RoleARN)] = awsAccount.Name
+			roleNames[awsRole.RoleARN] = awsRole.Name
+		}
+	}
+
+	grouped := []*AWSAccount{}
+	byID := make(map[string]*AWSAccount)
+	for _, awsRole := range awsRoles {
+		accountID := roleAccountID(awsRole.RoleARN)
+
+		account, ok := byID[accountID]
+		if !ok {
+			account = &AWSAccount{Name: accountNames[accountID]}
+			if alias := aliases[accountID]; alias != "" {
+				account.Name = fmt.Sprintf("Account: %s (%s)", alias, accountID)
+			} else if account.Name == "" {
+				account.Name = fmt.Sprintf("Account: %s", accountID)
+			}
+			byID[accountID] = account
+			grouped = append(grouped, account)
+		}
+
+		name := roleNames[awsRole.RoleARN]
+		if name == "" {
+			name = awsRole.RoleARN[strings.LastIndex(awsRole.RoleARN, "/")+1:]
+		}
+		account.Roles = append(account.Roles, &AWSRole{
+			RoleARN:      awsRole.RoleARN,
+			PrincipalARN: awsRole.PrincipalARN,
+			Name:         name,
+		})
+	}
+
+	sort.SliceStable(grouped, func(i, j int) bool { return grouped[i].Name < grouped[j].Name })
+	for _, account := range grouped {
+		roles := account.Roles
+		sort.SliceStable(roles, func(i, j int) bool { return roles[i].Name < roles[j].Name })
+	}
+
+	return grouped
+}
+
+// AliasesCoverRoles report whether every account the roles belong to has a configured alias, in which case
+// the AWS sign in page doesn't need to be fetched to label them
+func AliasesCoverRoles(awsRoles []*AWSRole, aliases map[string]string) bool {
+	for _, awsRole := range awsRoles {
+		if aliases[roleAccountID(awsRole.RoleARN)] == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// roleAccountID return the account ID portion of a role ARN such as arn:aws:iam::000000000001:role/Development
+func roleAccountID(roleARN string) string {
+	parts := strings.SplitN(roleARN, ":", 6)
+	if len(parts) < 6 {
+		return ""
+	}
+	return parts[4]
+}
+
+// LocateRole locate role by name, this is either the full role ARN or a part of it such as the role
+// name or account ID, a partial match must identify a single role
 func LocateRole(awsRoles []*AWSRole, roleName string) (*AWSRole, error) {
 	for _, awsRole := range awsRoles {
 		if awsRole.RoleARN == roleName {
@@ -80,5 +154,24 @@ func LocateRole(awsRoles []*AWSRole, roleName string) (*AWSRole, error) {
 		}
 	}
 
-	return nil, fmt.Errorf("Supplied RoleArn not found in saml assertion: %s", roleName)
+	search := strings.ToLower(roleName)
+	matches := []*AWSRole{}
+	for _, awsRole := range awsRoles {
+		if strings.Contains(strings.ToLower(awsRole.RoleARN), search) || (awsRole.Name != "" && strings.Contains(strings.ToLower(awsRole.Name), search)) {
+			matches = append(matches, awsRole)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("Supplied RoleArn not found in saml assertion: %s", roleName)
+	case 1:
+		return matches[0], nil
+	}
+
+	candidates := make([]string, len(matches))
+	for i, awsRole := range matches {
+		candidates[i] = awsRole.RoleARN
+	}
+	return nil, fmt.Errorf("Supplied RoleArn %s matches more than one role in saml assertion: %s", roleName, strings.Join(candidates, ", "))
 }
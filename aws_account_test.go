@@ -76,3 +76,121 @@ func TestLocateRole(t *testing.T) {
 
 	assert.Equal(t, "arn:aws:iam::000000000001:role/Development", role.RoleARN)
 }
+
+func TestLocateRolePartial(t *testing.T) {
+	awsRoles := []*AWSRole{
+		{
+			PrincipalARN: "arn:aws:iam::000000000001:saml-provider/test-idp",
+			RoleARN:      "arn:aws:iam::000000000001:role/Development",
+		},
+		{
+			PrincipalARN: "arn:aws:iam::000000000001:saml-provider/test-idp",
+			RoleARN:      "arn:aws:iam::000000000001:role/ReadOnly",
+		},
+		{
+			PrincipalARN: "arn:aws:iam::000000000002:saml-provider/test-idp",
+			RoleARN:      "arn:aws:iam::000000000002:role/Development",
+			Name:         "Admin",
+		},
+	}
+
+	role, err := LocateRole(awsRoles, "readonly")
+	assert.Nil(t, err)
+	assert.Equal(t, "arn:aws:iam::000000000001:role/ReadOnly", role.RoleARN)
+
+	role, err = LocateRole(awsRoles, "000000000002")
+	assert.Nil(t, err)
+	assert.Equal(t, "arn:aws:iam::000000000002:role/Development", role.RoleARN)
+
+	role, err = LocateRole(awsRoles, "Admin")
+	assert.Nil(t, err)
+	assert.Equal(t, "arn:aws:iam::000000000002:role/Development", role.RoleARN)
+
+	_, err = LocateRole(awsRoles, "Development")
+	assert.EqualError(t, err, "Supplied RoleArn Development matches more than one role in saml assertion: arn:aws:iam::000000000001:role/Development, arn:aws:iam::000000000002:role/Development")
+
+	_, err = LocateRole(awsRoles, "Production")
+	assert.EqualError(t, err, "Supplied RoleArn not found in saml assertion: Production")
+}
+
+func TestGroupAWSRolesByAccount(t *testing.T) {
+	data, err := os.ReadFile("testdata/assertion_multi_account.xml")
+	assert.Nil(t, err)
+
+	roles, err := ExtractAwsRoles(data)
+	assert.Nil(t, err)
+	assert.Len(t, roles, 4)
+
+	awsRoles, err := ParseAWSRoles(roles)
+	assert.Nil(t, err)
+
+	page, err := os.ReadFile("testdata/saml.html")
+	assert.Nil(t, err)
+
+	awsAccounts, err := ExtractAWSAccounts(page)
+	assert.Nil(t, err)
+
+	grouped := GroupAWSRolesByAccount(awsRoles, awsAccounts, nil)
+	assert.Len(t, grouped, 3)
+
+	assert.Equal(t, "Account: 000000000002", grouped[0].Name)
+	assert.Len(t, grouped[0].Roles, 1)
+	assert.Equal(t, "arn:aws:iam::000000000002:role/Production", grouped[0].Roles[0].RoleARN)
+	assert.Equal(t, "arn:aws:iam::000000000002:saml-provider/ExampleADFS", grouped[0].Roles[0].PrincipalARN)
+
+	// the third account isn't on the sign in page so it is headed by the account ID
+	assert.Equal(t, "Account: 000000000003", grouped[1].Name)
+	assert.Len(t, grouped[1].Roles, 1)
+	assert.Equal(t, "ReadOnly", grouped[1].Roles[0].Name)
+	assert.Equal(t, "arn:aws:iam::000000000003:role/ReadOnly", grouped[1].Roles[0].RoleARN)
+
+	assert.Equal(t, "Account: account-alias (000000000001)", grouped[2].Name)
+	assert.Len(t, grouped[2].Roles, 2)
+	assert.Equal(t, "Development", grouped[2].Roles[0].Name)
+	assert.Equal(t, "arn:aws:iam::000000000001:role/Development", grouped[2].Roles[0].RoleARN)
+	assert.Equal(t, "arn:aws:iam::000000000001:saml-provider/ExampleADFS", grouped[2].Roles[0].PrincipalARN)
+	assert.Equal(t, "Production", grouped[2].Roles[1].Name)
+	assert.Equal(t, "arn:aws:iam::000000000001:role/Production", grouped[2].Roles[1].RoleARN)
+}
+
+func TestGroupAWSRolesByAccountAliases(t *testing.T) {
+	data, err := os.ReadFile("testdata/assertion_multi_account.xml")
+	assert.Nil(t, err)
+
+	roles, err := ExtractAwsRoles(data)
+	assert.Nil(t, err)
+
+	awsRoles, err := ParseAWSRoles(roles)
+	assert.Nil(t, err)
+
+	page, err := os.ReadFile("testdata/saml.html")
+	assert.Nil(t, err)
+
+	awsAccounts, err := ExtractAWSAccounts(page)
+	assert.Nil(t, err)
+
+	aliases := map[string]string{
+		"000000000001": "production",
+		"000000000003": "sandbox",
+	}
+	assert.False(t, AliasesCoverRoles(awsRoles, aliases))
+
+	grouped := GroupAWSRolesByAccount(awsRoles, awsAccounts, aliases)
+	assert.Len(t, grouped, 3)
+
+	// the configured alias wins over the name on the sign in page
+	assert.Equal(t, "Account: 000000000002", grouped[0].Name)
+	assert.Equal(t, "Account: production (000000000001)", grouped[1].Name)
+	assert.Len(t, grouped[1].Roles, 2)
+	assert.Equal(t, "Account: sandbox (000000000003)", grouped[2].Name)
+	assert.Equal(t, "ReadOnly", grouped[2].Roles[0].Name)
+
+	aliases["000000000002"] = "staging"
+	assert.True(t, AliasesCoverRoles(awsRoles, aliases))
+
+	// without the sign in page the role names come from the ARN
+	grouped = GroupAWSRolesByAccount(awsRoles, nil, aliases)
+	assert.Len(t, grouped, 3)
+	assert.Equal(t, "Account: staging (000000000002)", grouped[2].Name)
+	assert.Equal(t, "Production", grouped[2].Roles[0].Name)
+}
@@ -0,0 +1,41 @@
+package saml2aws
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/versent/saml2aws/v2/pkg/awspartition"
+)
+
+// AWSPartition where to sign in with SAML for one of the AWS partitions
+type AWSPartition = awspartition.Partition
+
+// ResolvePartition use the configured partition when set, otherwise the partition of the role ARN
+func ResolvePartition(configured string, roleARN string) (*AWSPartition, error) {
+	id := configured
+	if id == "" {
+		parts := strings.SplitN(roleARN, ":", 3)
+		if len(parts) < 3 || parts[0] != "arn" {
+			return nil, fmt.Errorf("unable to determine the aws partition of role %s", roleARN)
+		}
+		id = parts[1]
+	}
+
+	if partition := awspartition.Lookup(id); partition != nil {
+		return partition, nil
+	}
+
+	return nil, fmt.Errorf("unknown aws partition %s", id)
+}
+
+// PartitionForDestination the partition whose sign in endpoint the assertion is addressed to, nil when the
+// destination isn't an AWS sign in endpoint
+func PartitionForDestination(destination string) *AWSPartition {
+	u, err := url.Parse(destination)
+	if err != nil {
+		return nil
+	}
+
+	return awspartition.ForHost(u.Host)
+}
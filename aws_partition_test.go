@@ -0,0 +1,63 @@
+package saml2aws
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolvePartition(t *testing.T) {
+	tests := []struct {
+		name       string
+		configured string
+		roleARN    string
+		want       string
+		wantErr    string
+	}{
+		{name: "standard role", roleARN: "arn:aws:iam::000000000001:role/Development", want: "aws"},
+		{name: "china role", roleARN: "arn:aws-cn:iam::000000000001:role/Development", want: "aws-cn"},
+		{name: "govcloud role", roleARN: "arn:aws-us-gov:iam::000000000001:role/Development", want: "aws-us-gov"},
+		{name: "configured", configured: "aws-cn", roleARN: "arn:aws:iam::000000000001:role/Development", want: "aws-cn"},
+		{name: "unknown", roleARN: "arn:aws-iso:iam::000000000001:role/Development", wantErr: "unknown aws partition aws-iso"},
+		{name: "not an arn", roleARN: "Development", wantErr: "unable to determine the aws partition of role Development"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ResolvePartition(tt.configured, tt.roleARN)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, got.ID)
+		})
+	}
+}
+
+func TestPartitionForDestination(t *testing.T) {
+	assert.Equal(t, "aws", PartitionForDestination("https://signin.aws.amazon.com/saml").ID)
+	assert.Equal(t, "aws", PartitionForDestination("https://us-east-1.signin.aws.amazon.com/saml").ID)
+	assert.Equal(t, "aws-cn", PartitionForDestination("https://signin.amazonaws.cn/saml").ID)
+	assert.Equal(t, "aws-us-gov", PartitionForDestination("https://signin.amazonaws-us-gov.com/saml").ID)
+	assert.Nil(t, PartitionForDestination("https://sp.example.com/acs"))
+}
+
+func TestPartitionSTSEndpoint(t *testing.T) {
+	china, err := ResolvePartition("", "arn:aws-cn:iam::000000000001:role/Development")
+	assert.Nil(t, err)
+
+	// a region outside of china falls back to the partition default
+	assert.Equal(t, "cn-north-1", china.Region(""))
+	assert.Equal(t, "cn-north-1", china.Region("us-east-1"))
+	assert.Equal(t, "cn-northwest-1", china.Region("cn-northwest-1"))
+
+	endpoint, err := endpoints.DefaultResolver().EndpointFor("sts", china.Region("ap-southeast-2"))
+	assert.Nil(t, err)
+	assert.Equal(t, "https://sts.cn-north-1.amazonaws.com.cn", endpoint.URL)
+
+	standard, err := ResolvePartition("", "arn:aws:iam::000000000001:role/Development")
+	assert.Nil(t, err)
+	assert.Equal(t, "ap-southeast-2", standard.Region("ap-southeast-2"))
+	assert.Equal(t, "", standard.Region(""))
+}
@@ -29,22 +29,25 @@ func ParseAWSRoles(roles []string) ([]*AWSRole, error) {
 	return awsRoles, nil
 }
 
+// roleARNRegexp an ARN in a role attribute value, the sixth group is the resource type which tells the role apart
+// from the principal whichever order the pair is in
+var roleARNRegexp = regexp.MustCompile("arn:([^:\n]*):([^:\n]*):([^:\n]*):([^:\n]*):(([^:/\n]*)[:/])?([^:,\n]*)")
+
 func parseRole(role string) (*AWSRole, error) {
-	r, _ := regexp.Compile("arn:([^:\n]*):([^:\n]*):([^:\n]*):([^:\n]*):(([^:/\n]*)[:/])?([^:,\n]*)")
-	tokens := r.FindAllString(role, -1)
+	matches := roleARNRegexp.FindAllStringSubmatch(role, -1)
 
-	if len(tokens) != 2 {
-		return nil, fmt.Errorf("Invalid role string only %d tokens", len(tokens))
+	if len(matches) != 2 {
+		return nil, fmt.Errorf("Invalid role string only %d tokens", len(matches))
 	}
 
 	awsRole := &AWSRole{}
 
-	for _, token := range tokens {
-		if strings.Contains(token, ":saml-provider") {
-			awsRole.PrincipalARN = strings.TrimSpace(token)
-		}
-		if strings.Contains(token, ":role") {
-			awsRole.RoleARN = strings.TrimSpace(token)
+	for _, match := range matches {
+		switch match[6] {
+		case "saml-provider":
+			awsRole.PrincipalARN = strings.TrimSpace(match[0])
+		case "role":
+			awsRole.RoleARN = strings.TrimSpace(match[0])
 		}
 	}
 
@@ -58,3 +61,20 @@ func parseRole(role string) (*AWSRole, error) {
 
 	return awsRole, nil
 }
+
+// GrantedRole find the role with exactly the role and principal ARN among the role attribute values, this checks
+// a configured pair without parsing or grouping the other roles of the assertion
+func GrantedRole(roles []string, roleARN string, principalARN string) (*AWSRole, error) {
+	for _, role := range roles {
+		if !strings.Contains(role, roleARN) || !strings.Contains(role, principalARN) {
+			continue
+		}
+
+		awsRole, err := parseRole(role)
+		if err == nil && awsRole.RoleARN == roleARN && awsRole.PrincipalARN == principalARN {
+			return awsRole, nil
+		}
+	}
+
+	return nil, fmt.Errorf("The SAML assertion doesn't grant role %s with principal %s", roleARN, principalARN)
+}
@@ -30,3 +30,45 @@ func TestParseRoles(t *testing.T) {
 	assert.Nil(t, awsRoles)
 
 }
+
+func TestParseRolesWhitespace(t *testing.T) {
+	roles := []string{
+		"  arn:aws:iam::456456456456:role/admin ,\tarn:aws:iam::456456456456:saml-provider/example-idp\n",
+		"arn:aws:iam::456456456456:saml-provider/example-idp\r\n,\r\narn:aws:iam::456456456456:role/admin",
+		"arn:aws:iam::456456456456:role/saml-provider,arn:aws:iam::456456456456:saml-provider/example-idp",
+	}
+
+	awsRoles, err := ParseAWSRoles(roles)
+	assert.Nil(t, err)
+	assert.Equal(t, "arn:aws:iam::456456456456:role/admin", awsRoles[0].RoleARN)
+	assert.Equal(t, "arn:aws:iam::456456456456:saml-provider/example-idp", awsRoles[0].PrincipalARN)
+	assert.Equal(t, "arn:aws:iam::456456456456:role/admin", awsRoles[1].RoleARN)
+	assert.Equal(t, "arn:aws:iam::456456456456:saml-provider/example-idp", awsRoles[1].PrincipalARN)
+	// the resource type tells them apart, not a substring of the name
+	assert.Equal(t, "arn:aws:iam::456456456456:role/saml-provider", awsRoles[2].RoleARN)
+	assert.Equal(t, "arn:aws:iam::456456456456:saml-provider/example-idp", awsRoles[2].PrincipalARN)
+
+	_, err = ParseAWSRoles([]string{"arn:aws:iam::456456456456:role/admin,arn:aws:iam::456456456456:role/other"})
+	assert.EqualError(t, err, "Unable to locate PrincipalARN in: arn:aws:iam::456456456456:role/admin,arn:aws:iam::456456456456:role/other")
+}
+
+func TestGrantedRole(t *testing.T) {
+	roles := []string{
+		"arn:aws:iam::456456456456:saml-provider/example-idp,arn:aws:iam::456456456456:role/admin-readonly",
+		"arn:aws:iam::456456456456:role/admin,arn:aws:iam::456456456456:saml-provider/example-idp",
+		"not a role",
+	}
+
+	awsRole, err := GrantedRole(roles, "arn:aws:iam::456456456456:role/admin", "arn:aws:iam::456456456456:saml-provider/example-idp")
+	assert.Nil(t, err)
+	assert.Equal(t, &AWSRole{
+		RoleARN:      "arn:aws:iam::456456456456:role/admin",
+		PrincipalARN: "arn:aws:iam::456456456456:saml-provider/example-idp",
+	}, awsRole)
+
+	_, err = GrantedRole(roles, "arn:aws:iam::456456456456:role/admin", "arn:aws:iam::456456456456:saml-provider/other-idp")
+	assert.EqualError(t, err, "The SAML assertion doesn't grant role arn:aws:iam::456456456456:role/admin with principal arn:aws:iam::456456456456:saml-provider/other-idp")
+
+	_, err = GrantedRole(roles, "arn:aws:iam::456456456456:role/admin-read", "arn:aws:iam::456456456456:saml-provider/example-idp")
+	assert.NotNil(t, err)
+}
@@ -9,18 +9,26 @@ import (
 	"github.com/versent/saml2aws/v2"
 	"github.com/versent/saml2aws/v2/helper/credentials"
 	"github.com/versent/saml2aws/v2/pkg/cfg"
+	"github.com/versent/saml2aws/v2/pkg/creds"
 	"github.com/versent/saml2aws/v2/pkg/flags"
 	"github.com/versent/saml2aws/v2/pkg/prompter"
+	"github.com/versent/saml2aws/v2/pkg/provider/aad"
 	"github.com/versent/saml2aws/v2/pkg/provider/onelogin"
 )
 
 // OneLoginOAuthPath is the path used to generate OAuth token in order to access OneLogin's API.
 const OneLoginOAuthPath = "/auth/oauth2/v2/token"
 
+// defaultIdpAccountName the account configured and used when none is named
+const defaultIdpAccountName = "default"
+
 // Configure configure account profiles
 func Configure(configFlags *flags.CommonFlags) error {
 
 	idpAccountName := configFlags.IdpAccount
+	if idpAccountName == "" {
+		idpAccountName = defaultIdpAccountName
+	}
 
 	// pass in alternative location of saml2aws config file, if set.
 	cfgm, err := cfg.NewConfigManager(configFlags.ConfigFile)
@@ -48,6 +56,19 @@ func Configure(configFlags *flags.CommonFlags) error {
 				return err
 			}
 		}
+
+		if configFlags.SelectMFA {
+			if err := selectMFAMethod(configFlags, account); err != nil {
+				return err
+			}
+		}
+	}
+
+	if account.Provider == "AzureAD" {
+		aliases, _ := account.MFAAliasMap()
+		if err := aad.ValidateMFA(account.MFA, aliases); err != nil {
+			log.Printf("Check the mfa setting, %v", err)
+		}
 	}
 
 	err = cfgm.SaveIDPAccount(idpAccountName, account)
@@ -97,3 +118,58 @@ func storeCredentials(configFlags *flags.CommonFlags, account *cfg.IDPAccount) e
 	}
 	return nil
 }
+
+// mfaMethodLister a client which can list the MFA methods offered to the user without completing MFA
+type mfaMethodLister interface {
+	ListMFAMethods(loginDetails *creds.LoginDetails) ([]aad.MFAMethod, error)
+}
+
+// selectMFAMethod sign in to Azure AD up to MFA so the user can pick the method, and phone number, used by
+// default rather than finding the right mfa setting by trial and error
+func selectMFAMethod(configFlags *flags.CommonFlags, account *cfg.IDPAccount) error {
+	if account.Provider != "AzureAD" {
+		return errors.Errorf("selecting the MFA method isn't supported by the %s provider", account.Provider)
+	}
+
+	client, err := aad.New(account)
+	if err != nil {
+		return errors.Wrap(err, "error building login client")
+	}
+
+	loginDetails, err := resolveLoginDetails(account, &flags.LoginExecFlags{CommonFlags: configFlags})
+	if err != nil {
+		return errors.Wrap(err, "error resolving login details")
+	}
+
+	return chooseMFAMethod(client, loginDetails, account)
+}
+
+// chooseMFAMethod prompt for one of the listed MFA methods and set it on the account, mfa_phone is only set
+// when several proofs share the chosen method
+func chooseMFAMethod(lister mfaMethodLister, loginDetails *creds.LoginDetails, account *cfg.IDPAccount) error {
+	methods, err := lister.ListMFAMethods(loginDetails)
+	if err != nil {
+		return errors.Wrap(err, "error listing MFA methods")
+	}
+	if len(methods) == 0 {
+		log.Println("MFA wasn't requested, the MFA method is left unchanged")
+		return nil
+	}
+
+	options := make([]string, len(methods))
+	for i, m := range methods {
+		options[i] = m.String()
+	}
+	chosen := methods[prompter.Choose("Please choose the default MFA method", options)]
+
+	account.MFA = chosen.Method
+	account.MFAPhone = ""
+	for _, m := range methods {
+		if m != chosen && m.Method == chosen.Method {
+			account.MFAPhone = chosen.Display
+			break
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,76 @@
+package commands
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/versent/saml2aws/v2/mocks"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
+	"github.com/versent/saml2aws/v2/pkg/creds"
+	"github.com/versent/saml2aws/v2/pkg/prompter"
+	"github.com/versent/saml2aws/v2/pkg/provider/aad"
+)
+
+type fakeMFAMethodLister struct {
+	methods []aad.MFAMethod
+	err     error
+}
+
+func (l *fakeMFAMethodLister) ListMFAMethods(loginDetails *creds.LoginDetails) ([]aad.MFAMethod, error) {
+	return l.methods, l.err
+}
+
+func TestChooseMFAMethod(t *testing.T) {
+	lister := &fakeMFAMethodLister{methods: []aad.MFAMethod{
+		{Method: "PhoneAppNotification", Display: "+XX XXXXXXXX55", Default: true},
+		{Method: "OneWaySMS", Display: "+XX XXXXXXXX55"},
+		{Method: "OneWaySMS", Display: "+XX XXXXXXXX89"},
+	}}
+	options := []string{
+		"PhoneAppNotification: +XX XXXXXXXX55 (default)",
+		"OneWaySMS: +XX XXXXXXXX55",
+		"OneWaySMS: +XX XXXXXXXX89",
+	}
+
+	t.Run("method shared by several phones", func(t *testing.T) {
+		pr := &mocks.Prompter{}
+		prompter.SetPrompter(pr)
+		pr.Mock.On("Choose", "Please choose the default MFA method", options).Return(2)
+
+		configFile := filepath.Join(t.TempDir(), "saml2aws.ini")
+		cfgm, err := cfg.NewConfigManager(configFile)
+		assert.Nil(t, err)
+
+		account := &cfg.IDPAccount{Provider: "AzureAD", MFA: "Auto", URL: "https://account.activedirectory.windowsazure.com", Username: "user@example.com", AppID: "app", Profile: "saml"}
+		err = chooseMFAMethod(lister, &creds.LoginDetails{}, account)
+		assert.Nil(t, err)
+		pr.Mock.AssertExpectations(t)
+
+		err = cfgm.SaveIDPAccount("default", account)
+		assert.Nil(t, err)
+		saved, err := cfgm.LoadIDPAccount("default")
+		assert.Nil(t, err)
+		assert.Equal(t, "OneWaySMS", saved.MFA)
+		assert.Equal(t, "+XX XXXXXXXX89", saved.MFAPhone)
+	})
+
+	t.Run("unique method", func(t *testing.T) {
+		pr := &mocks.Prompter{}
+		prompter.SetPrompter(pr)
+		pr.Mock.On("Choose", "Please choose the default MFA method", options).Return(0)
+
+		account := &cfg.IDPAccount{Provider: "AzureAD", MFA: "Auto", MFAPhone: "89"}
+		err := chooseMFAMethod(lister, &creds.LoginDetails{}, account)
+		assert.Nil(t, err)
+		assert.Equal(t, "PhoneAppNotification", account.MFA)
+		assert.Equal(t, "", account.MFAPhone)
+	})
+
+	t.Run("MFA not requested", func(t *testing.T) {
+		account := &cfg.IDPAccount{Provider: "AzureAD", MFA: "Auto"}
+		err := chooseMFAMethod(&fakeMFAMethodLister{}, &creds.LoginDetails{}, account)
+		assert.Nil(t, err)
+		assert.Equal(t, "Auto", account.MFA)
+	})
+}
@@ -0,0 +1,95 @@
+package commands
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/versent/saml2aws/v2/pkg/awsconfig"
+)
+
+// ServeCredentialSocket serve the credentials in the credential_process JSON format on the Unix domain socket
+// at the path until they expire, each connection is sent the JSON and closed. Point a profile at it with e.g.
+// credential_process = nc -U /path/to/socket. Only the current user may connect to the socket.
+func ServeCredentialSocket(path string, awsCreds *awsconfig.AWSCredentials) error {
+	l, err := listenCredentialSocket(path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+
+	log.Printf("Serving credentials on %s until %s", path, awsCreds.Expires.Local().Format(time.RFC1123))
+
+	// the credentials are of no use once expired, stop serving them then
+	timer := time.AfterFunc(time.Until(awsCreds.Expires), func() { l.Close() })
+	defer timer.Stop()
+
+	return serveCredentials(l, awsCreds)
+}
+
+// listenCredentialSocket listen on the socket at the path, the socket is created in a private directory and
+// restricted to the current user before it's moved in place so nobody else can connect in the meantime
+func listenCredentialSocket(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, errors.Errorf("Unable to serve credentials on %s, the file exists and isn't a socket.", path)
+		}
+		// left behind by an earlier login which was interrupted
+		if err := os.Remove(path); err != nil {
+			return nil, errors.Wrap(err, "Unable to remove the previous credential socket.")
+		}
+	}
+
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".saml2aws-socket-")
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to create the credential socket.")
+	}
+	defer os.RemoveAll(dir)
+
+	tmpPath := filepath.Join(dir, "socket")
+	l, err := net.Listen("unix", tmpPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to create the credential socket.")
+	}
+	// the socket is moved, so closing the listener mustn't remove the file at its old path
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	if err := os.Chmod(tmpPath, 0600); err != nil {
+		l.Close()
+		return nil, errors.Wrap(err, "Unable to restrict access to the credential socket.")
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		l.Close()
+		return nil, errors.Wrap(err, "Unable to create the credential socket.")
+	}
+
+	return l, nil
+}
+
+// serveCredentials send the credentials to each connection until the listener is closed
+func serveCredentials(l net.Listener, awsCreds *awsconfig.AWSCredentials) error {
+	jsonData, err := CredentialsToCredentialProcess(awsCreds)
+	if err != nil {
+		return err
+	}
+
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "Error accepting a connection on the credential socket.")
+		}
+
+		_ = conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.WriteString(conn, jsonData+"\n"); err != nil {
+			log.Println("Unable to send the credentials:", err)
+		}
+		conn.Close()
+	}
+}
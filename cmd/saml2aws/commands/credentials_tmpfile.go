@@ -0,0 +1,83 @@
+package commands
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/versent/saml2aws/v2/pkg/awsconfig"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
+	"github.com/versent/saml2aws/v2/pkg/shell"
+)
+
+// minCredentialsTmpfileTTL the shortest time the credentials file is kept, credentials which have already expired,
+// or don't say when they do, would otherwise never have it removed
+const minCredentialsTmpfileTTL = time.Minute
+
+// ExportCredentialsTmpfile write the export lines for the credentials to a new file and print its path, for
+// source "$(saml2aws login --creds-tmpfile)". The file is removed once the ttl has passed, or when the credentials
+// expire if that's sooner or no ttl is given.
+func ExportCredentialsTmpfile(account *cfg.IDPAccount, awsCreds *awsconfig.AWSCredentials, ttl time.Duration) error {
+	path, err := writeCredentialsTmpfile(credentialsTmpfileDir(), account, awsCreds)
+	if err != nil {
+		return err
+	}
+
+	if err := shell.RemoveAfter(path, credentialsTmpfileTTL(ttl, awsCreds.Expires)); err != nil {
+		log.Printf("Unable to schedule the removal of %s, remove it once done: %v", path, err)
+	}
+
+	fmt.Println(path)
+	return nil
+}
+
+// credentialsTmpfileTTL how long to keep the credentials file, the ttl or until the credentials expire, whichever is
+// sooner, but never less than minCredentialsTmpfileTTL
+func credentialsTmpfileTTL(ttl time.Duration, expires time.Time) time.Duration {
+	if !expires.IsZero() {
+		if untilExpiry := time.Until(expires); ttl <= 0 || ttl > untilExpiry {
+			ttl = untilExpiry
+		}
+	}
+	if ttl < minCredentialsTmpfileTTL {
+		ttl = minCredentialsTmpfileTTL
+	}
+	return ttl
+}
+
+// credentialsTmpfileDir the directory to write the credentials file to, $XDG_RUNTIME_DIR or /dev/shm which are
+// kept in memory and only last until a reboot, or else the temp directory
+func credentialsTmpfileDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return dir
+	}
+	if fi, err := os.Stat("/dev/shm"); err == nil && fi.IsDir() {
+		return "/dev/shm"
+	}
+	return os.TempDir()
+}
+
+// writeCredentialsTmpfile write the export lines to a file with a name of its own in the directory, which only
+// the current user may read
+func writeCredentialsTmpfile(dir string, account *cfg.IDPAccount, awsCreds *awsconfig.AWSCredentials) (string, error) {
+	f, err := os.CreateTemp(dir, "saml2aws-*.sh")
+	if err != nil {
+		return "", errors.Wrap(err, "Unable to create the credentials file.")
+	}
+	defer f.Close()
+
+	// CreateTemp already restricts the file to the current user, this makes sure of it before the secrets are written
+	if err := f.Chmod(0600); err != nil {
+		os.Remove(f.Name())
+		return "", errors.Wrap(err, "Unable to restrict access to the credentials file.")
+	}
+
+	if err := printEval(f, account, awsCreds); err != nil {
+		os.Remove(f.Name())
+		return "", errors.Wrap(err, "Unable to write the credentials file.")
+	}
+
+	return f.Name(), nil
+}
@@ -0,0 +1,102 @@
+package commands
+
+import (
+	b64 "encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/versent/saml2aws/v2"
+)
+
+// Inspect decode a base64 encoded SAML response and print a summary of the assertion,
+// the response is read from stdin when no file is supplied
+func Inspect(inputFile string) error {
+
+	var raw []byte
+	var err error
+
+	if inputFile == "" || inputFile == "-" {
+		raw, err = io.ReadAll(os.Stdin)
+	} else {
+		raw, err = os.ReadFile(inputFile)
+	}
+	if err != nil {
+		return errors.Wrap(err, "error reading SAML response")
+	}
+
+	return inspectAssertion(string(raw), os.Stdout)
+}
+
+func inspectAssertion(samlAssertion string, w io.Writer) error {
+
+	// tolerate the line wrapping added when copying the response out of a browser or terminal
+	samlAssertion = strings.Join(strings.Fields(samlAssertion), "")
+
+	data, err := b64.StdEncoding.DecodeString(samlAssertion)
+	if err != nil {
+		return errors.Wrap(err, "error decoding SAML assertion")
+	}
+
+	issuer, err := saml2aws.ExtractIssuer(data)
+	if err != nil {
+		return errors.Wrap(err, "error parsing issuer")
+	}
+
+	audiences, err := saml2aws.ExtractAudiences(data)
+	if err != nil {
+		return errors.Wrap(err, "error parsing audience")
+	}
+
+	notOnOrAfter := "-"
+	if expires, err := saml2aws.ExtractMFATokenExpiryTime(data); err == nil {
+		notOnOrAfter = expires.Format(time.RFC3339)
+	}
+
+	authnInstant := "-"
+	if instant, err := saml2aws.ExtractAuthnInstant(data); err == nil && !instant.IsZero() {
+		authnInstant = instant.Format(time.RFC3339)
+	}
+
+	roles, err := saml2aws.ExtractAwsRoles(data)
+	if err != nil {
+		return errors.Wrap(err, "error parsing aws roles")
+	}
+
+	attributes, err := saml2aws.ExtractAttributes(data)
+	if err != nil {
+		return errors.Wrap(err, "error parsing attributes")
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "Issuer\t%s\n", issuer)
+	fmt.Fprintf(tw, "Audience\t%s\n", strings.Join(audiences, ", "))
+	fmt.Fprintf(tw, "NotOnOrAfter\t%s\n", notOnOrAfter)
+	fmt.Fprintf(tw, "AuthnInstant\t%s\n", authnInstant)
+
+	fmt.Fprintln(tw, "")
+	fmt.Fprintln(tw, "Role\tPrincipal")
+	for _, role := range roles {
+		awsRole, err := saml2aws.ParseAWSRoles([]string{role})
+		if err != nil {
+			fmt.Fprintf(tw, "%s\t(unparsable)\n", role)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\n", awsRole[0].RoleARN, awsRole[0].PrincipalARN)
+	}
+
+	fmt.Fprintln(tw, "")
+	fmt.Fprintln(tw, "Attribute\tValue")
+	for _, attr := range attributes {
+		for _, value := range attr.Values {
+			fmt.Fprintf(tw, "%s\t%s\n", attr.Name, value)
+		}
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,55 @@
+package commands
+
+import (
+	"bytes"
+	b64 "encoding/base64"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInspectAssertion(t *testing.T) {
+	data, err := os.ReadFile("../../../testdata/assertion.xml")
+	assert.Nil(t, err)
+
+	var out bytes.Buffer
+	err = inspectAssertion(b64.StdEncoding.EncodeToString(data), &out)
+	assert.Nil(t, err)
+
+	expected := `Issuer        http://id.example.com/adfs/services/trust
+Audience      urn:amazon:webservices
+NotOnOrAfter  2016-09-10T02:59:39Z
+AuthnInstant  2016-09-10T02:54:39Z
+
+Role                                                      Principal
+arn:aws:iam::123123123123:role/AWS-Admin-CloudOPSBuild    arn:aws:iam::123123123123:saml-provider/ExampleADFS
+arn:aws:iam::123123123123:role/AWS-Admin-CloudOPSNonProd  arn:aws:iam::123123123123:saml-provider/ExampleADFS
+
+Attribute                                               Value
+https://aws.amazon.com/SAML/Attributes/RoleSessionName  wolfeidau@example.com
+https://aws.amazon.com/SAML/Attributes/Role             arn:aws:iam::123123123123:saml-provider/ExampleADFS,arn:aws:iam::123123123123:role/AWS-Admin-CloudOPSBuild
+https://aws.amazon.com/SAML/Attributes/Role             arn:aws:iam::123123123123:saml-provider/ExampleADFS,arn:aws:iam::123123123123:role/AWS-Admin-CloudOPSNonProd
+https://aws.amazon.com/SAML/Attributes/SessionDuration  28800
+`
+	assert.Equal(t, expected, out.String())
+}
+
+func TestInspectAssertionWrapped(t *testing.T) {
+	data, err := os.ReadFile("../../../testdata/assertion.xml")
+	assert.Nil(t, err)
+
+	encoded := b64.StdEncoding.EncodeToString(data)
+	wrapped := encoded[:76] + "\n" + encoded[76:] + "\n"
+
+	var out bytes.Buffer
+	err = inspectAssertion(wrapped, &out)
+	assert.Nil(t, err)
+	assert.Contains(t, out.String(), "urn:amazon:webservices")
+}
+
+func TestInspectAssertionInvalid(t *testing.T) {
+	var out bytes.Buffer
+	err := inspectAssertion("not base64!", &out)
+	assert.Error(t, err)
+}
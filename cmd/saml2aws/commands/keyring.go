@@ -0,0 +1,72 @@
+package commands
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/versent/saml2aws/v2/helper/credentials"
+)
+
+// keyringTestURL the made up server URL the test secret is stored under, it can't clash with an IdP
+const keyringTestURL = "https://keyring-test.saml2aws.invalid"
+
+// newKeyringHelper open the keyring with the given backend, only set on platforms offering several backends
+var newKeyringHelper func(backend string) (credentials.Helper, error)
+
+// KeyringTest store a dummy secret in the keyring, read it back and remove it again, this shows whether the
+// keyring works, and brings up any keyring prompts, before a real login relies on it
+func KeyringTest(backend string) error {
+	helper := credentials.CurrentHelper
+	if backend != "" {
+		if newKeyringHelper == nil {
+			return errors.New("Choosing the keyring backend is only supported on Linux.")
+		}
+		var err error
+		helper, err = newKeyringHelper(backend)
+		if err != nil {
+			return errors.Wrapf(err, "Unable to open the %s keyring backend.", backend)
+		}
+	}
+
+	return testKeyring(os.Stdout, helper)
+}
+
+func testKeyring(w io.Writer, helper credentials.Helper) error {
+	fmt.Fprintf(w, "Keyring: %T\n", helper)
+
+	if !helper.SupportsCredentialStorage() {
+		return errors.New("No keyring is available, the password can't be stored.")
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return errors.Wrap(err, "Unable to generate the test secret.")
+	}
+	secret := hex.EncodeToString(b)
+
+	err := helper.Add(&credentials.Credentials{ServerURL: keyringTestURL, Username: "saml2aws", Secret: secret})
+	if err != nil {
+		return errors.Wrap(err, "Unable to write to the keyring.")
+	}
+	fmt.Fprintln(w, "Write: ok")
+
+	_, got, err := helper.Get(keyringTestURL)
+	if err != nil {
+		return errors.Wrap(err, "Unable to read from the keyring.")
+	}
+	if got != secret {
+		return errors.New("The keyring returned a different secret than the one stored.")
+	}
+	fmt.Fprintln(w, "Read: ok")
+
+	if err := helper.Delete(keyringTestURL); err != nil {
+		return errors.Wrap(err, "Unable to remove the test secret from the keyring.")
+	}
+	fmt.Fprintln(w, "Delete: ok")
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package commands
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/versent/saml2aws/v2/helper/credentials"
+)
+
+// memoryHelper a keyring kept in memory
+type memoryHelper struct {
+	secrets map[string]string
+	corrupt bool
+}
+
+func (h *memoryHelper) Add(c *credentials.Credentials) error {
+	h.secrets[c.ServerURL] = c.Secret
+	return nil
+}
+
+func (h *memoryHelper) Delete(serverURL string) error {
+	delete(h.secrets, serverURL)
+	return nil
+}
+
+func (h *memoryHelper) Get(serverURL string) (string, string, error) {
+	secret, ok := h.secrets[serverURL]
+	if !ok {
+		return "", "", credentials.ErrCredentialsNotFound
+	}
+	if h.corrupt {
+		secret = "corrupt"
+	}
+	return "saml2aws", secret, nil
+}
+
+func (h *memoryHelper) SupportsCredentialStorage() bool {
+	return h.secrets != nil
+}
+
+func TestTestKeyring(t *testing.T) {
+	t.Run("round trip", func(t *testing.T) {
+		helper := &memoryHelper{secrets: map[string]string{}}
+		var buf bytes.Buffer
+		err := testKeyring(&buf, helper)
+		assert.Nil(t, err)
+		assert.Equal(t, "Keyring: *commands.memoryHelper\nWrite: ok\nRead: ok\nDelete: ok\n", buf.String())
+		assert.Empty(t, helper.secrets)
+	})
+
+	t.Run("different secret read back", func(t *testing.T) {
+		helper := &memoryHelper{secrets: map[string]string{}, corrupt: true}
+		err := testKeyring(&bytes.Buffer{}, helper)
+		assert.EqualError(t, err, "The keyring returned a different secret than the one stored.")
+	})
+
+	t.Run("no keyring", func(t *testing.T) {
+		err := testKeyring(&bytes.Buffer{}, &memoryHelper{})
+		assert.EqualError(t, err, "No keyring is available, the password can't be stored.")
+	})
+}
+
+func TestKeyringTestBackend(t *testing.T) {
+	defer func(f func(string) (credentials.Helper, error)) { newKeyringHelper = f }(newKeyringHelper)
+
+	var opened string
+	newKeyringHelper = func(backend string) (credentials.Helper, error) {
+		opened = backend
+		if backend == "kwallet" {
+			return nil, errors.New("kwallet isn't running")
+		}
+		return &memoryHelper{secrets: map[string]string{}}, nil
+	}
+
+	assert.Nil(t, KeyringTest("pass"))
+	assert.Equal(t, "pass", opened)
+
+	err := KeyringTest("kwallet")
+	assert.EqualError(t, err, "Unable to open the kwallet keyring backend.: kwallet isn't running")
+}
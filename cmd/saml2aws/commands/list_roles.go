@@ -10,6 +10,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/versent/saml2aws/v2"
 	"github.com/versent/saml2aws/v2/helper/credentials"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
 	"github.com/versent/saml2aws/v2/pkg/flags"
 	"github.com/versent/saml2aws/v2/pkg/samlcache"
 )
@@ -26,7 +27,7 @@ func ListRoles(loginFlags *flags.LoginExecFlags) error {
 
 	// creates a cacheProvider, only used when --cache is set
 	cacheProvider := &samlcache.SAMLCacheProvider{
-		Account:  account.Name,
+		Account:  account.CacheName(),
 		Filename: account.SAMLCacheFile,
 	}
 
@@ -57,14 +58,18 @@ func ListRoles(loginFlags *flags.LoginExecFlags) error {
 			}
 		} else {
 			logger.Debug("Cache is invalid")
-			log.Printf("Authenticating as %s ...", loginDetails.Username)
+			log.Printf("Authenticating as %s ...", loginDetails.DisplayUsername())
 		}
 	}
 
 	if samlAssertion == "" {
 		// samlAssertion was not cached
+		if err := runPreAuthCommand(account); err != nil {
+			return err
+		}
 		samlAssertion, err = provider.Authenticate(loginDetails)
 		if err != nil {
+			writeFailureReport(loginFlags.CommonFlags.FailureReport, account, loginDetails, err)
 			return errors.Wrap(err, "error authenticating to IdP")
 		}
 		if account.SAMLCache {
@@ -94,7 +99,7 @@ func ListRoles(loginFlags *flags.LoginExecFlags) error {
 		return errors.Wrap(err, "error decoding saml assertion")
 	}
 
-	roles, err := saml2aws.ExtractAwsRoles(data)
+	roles, err := saml2aws.ExtractAwsRolesWithAttribute(data, account.RoleAttribute)
 	if err != nil {
 		return errors.Wrap(err, "error parsing aws roles")
 	}
@@ -109,14 +114,14 @@ func ListRoles(loginFlags *flags.LoginExecFlags) error {
 		return errors.Wrap(err, "error parsing aws roles")
 	}
 
-	if err := listRoles(awsRoles, samlAssertion, loginFlags); err != nil {
+	if err := listRoles(awsRoles, samlAssertion, account); err != nil {
 		return errors.Wrap(err, "Failed to list roles")
 	}
 
 	return nil
 }
 
-func listRoles(awsRoles []*saml2aws.AWSRole, samlAssertion string, loginFlags *flags.LoginExecFlags) error {
+func listRoles(awsRoles []*saml2aws.AWSRole, samlAssertion string, account *cfg.IDPAccount) error {
 	if len(awsRoles) == 1 {
 		log.Println("")
 		log.Println("Only one role to assume. Will be automatically assumed on login")
@@ -126,27 +131,15 @@ func listRoles(awsRoles []*saml2aws.AWSRole, samlAssertion string, loginFlags *f
 		return errors.New("no roles available")
 	}
 
-	samlAssertionData, err := b64.StdEncoding.DecodeString(samlAssertion)
-	if err != nil {
-		return errors.Wrap(err, "error decoding saml assertion")
-	}
-
-	aud, err := saml2aws.ExtractDestinationURL(samlAssertionData)
+	awsAccounts, err := groupAWSRoles(awsRoles, samlAssertion, account)
 	if err != nil {
-		return errors.Wrap(err, "error parsing destination url")
+		return err
 	}
 
-	awsAccounts, err := saml2aws.ParseAWSAccounts(aud, samlAssertion)
-	if err != nil {
-		return errors.Wrap(err, "error parsing aws role accounts")
-	}
-
-	saml2aws.AssignPrincipals(awsRoles, awsAccounts)
-
 	log.Println("")
-	for _, account := range awsAccounts {
-		fmt.Println(account.Name)
-		for _, role := range account.Roles {
+	for _, awsAccount := range awsAccounts {
+		fmt.Println(awsAccount.Name)
+		for _, role := range awsAccount.Roles {
 			fmt.Println(role.RoleARN)
 		}
 		fmt.Println("")
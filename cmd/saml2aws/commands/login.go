@@ -4,14 +4,21 @@ import (
 	b64 "encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	awscredentials "github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/iam/iamiface"
 	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/versent/saml2aws/v2"
@@ -20,7 +27,11 @@ import (
 	"github.com/versent/saml2aws/v2/pkg/cfg"
 	"github.com/versent/saml2aws/v2/pkg/creds"
 	"github.com/versent/saml2aws/v2/pkg/flags"
+	"github.com/versent/saml2aws/v2/pkg/progress"
+	"github.com/versent/saml2aws/v2/pkg/prompter"
+	"github.com/versent/saml2aws/v2/pkg/provider"
 	"github.com/versent/saml2aws/v2/pkg/samlcache"
+	"github.com/versent/saml2aws/v2/pkg/shell"
 )
 
 // Login login to ADFS
@@ -28,18 +39,44 @@ func Login(loginFlags *flags.LoginExecFlags) error {
 
 	logger := logrus.WithField("command", "login")
 
+	if loginFlags.Eval && loginFlags.CredentialProcess {
+		return errors.New("--eval and --credential-process can't be used together.")
+	}
+	if loginFlags.CredsTmpfile && (loginFlags.Eval || loginFlags.CredentialProcess) {
+		return errors.New("--creds-tmpfile can't be used with --eval or --credential-process.")
+	}
+	if loginFlags.CredentialSocket != "" && (loginFlags.CredsTmpfile || loginFlags.CLICache) {
+		return errors.New("--credential-socket can't be used with --creds-tmpfile or --cli-cache.")
+	}
+
+	// with --eval STDOUT is kept for the export lines, everything else written to it goes to STDERR
+	stdout := os.Stdout
+	if loginFlags.Eval {
+		defer redirectStdout()()
+	}
+
 	account, err := buildIdpAccount(loginFlags)
 	if err != nil {
 		return errors.Wrap(err, "Error building login details.")
 	}
 
-	sharedCreds := awsconfig.NewSharedCredentials(account.Profile, account.CredentialsFile)
-	// creates a cacheProvider, only used when --cache is set
-	cacheProvider := &samlcache.SAMLCacheProvider{
-		Account:  account.Name,
-		Filename: account.SAMLCacheFile,
+	if loginFlags.PrintCredsProcess {
+		if account.RoleARN == "" {
+			log.Println("No role is configured, the credential process only works when the assertion grants a single role.")
+		}
+		fmt.Println(CredentialProcessConfigLine(account, loginFlags.CommonFlags))
+		return nil
 	}
 
+	// the credentials served on the socket are only kept in memory, nothing is read from or written to disk
+	if loginFlags.CredentialSocket != "" {
+		return serveLogin(account, loginFlags)
+	}
+
+	sharedCreds := awsconfig.NewSharedCredentials(account.Profile, account.CredentialsFile)
+	sharedCreds.OverwriteRegion = loginFlags.OverwriteRegion
+	sharedCreds.SkipRegion = account.SkipProfileRegion
+
 	logger.Debug("Check if creds exist.")
 
 	// this checks if the credentials file has been created yet
@@ -64,90 +101,450 @@ func Login(loginFlags *flags.LoginExecFlags) error {
 				return err
 			}
 		}
+		if loginFlags.Eval && previousCreds != nil {
+			if err := printEval(stdout, account, previousCreds); err != nil {
+				return err
+			}
+		}
+		if loginFlags.CredsTmpfile && previousCreds != nil {
+			if err := ExportCredentialsTmpfile(account, previousCreds, loginFlags.CredsTmpfileTTL); err != nil {
+				return err
+			}
+		}
+		if loginFlags.CLICache && previousCreds != nil {
+			saveCLICache(previousCreds)
+		}
+		if loginFlags.PrintRoleARN && previousCreds != nil {
+			if err := printRoleARN(expiryWriter(loginFlags), previousCreds); err != nil {
+				return err
+			}
+		}
+		if loginFlags.PrintExpiry && previousCreds != nil {
+			if err := printExpiry(expiryWriter(loginFlags), previousCreds.Expires, loginFlags.ExpiryFormat); err != nil {
+				return err
+			}
+		}
 		return nil
 	}
 
+	awsCreds, err := authenticate(account, loginFlags)
+	if err != nil {
+		return err
+	}
+
+	// print credential process if needed
+	if loginFlags.CredentialProcess {
+		err = PrintCredentialProcess(awsCreds)
+		if err != nil {
+			return err
+		}
+	}
+	err = saveCredentials(awsCreds, sharedCreds, account)
+	if err != nil {
+		return err
+	}
+	if loginFlags.Eval {
+		if err := printEval(stdout, account, awsCreds); err != nil {
+			return err
+		}
+	}
+	if loginFlags.CredsTmpfile {
+		if err := ExportCredentialsTmpfile(account, awsCreds, loginFlags.CredsTmpfileTTL); err != nil {
+			return err
+		}
+	}
+	if loginFlags.CLICache {
+		saveCLICache(awsCreds)
+	}
+	if loginFlags.PrintRoleARN {
+		if err := printRoleARN(expiryWriter(loginFlags), awsCreds); err != nil {
+			return err
+		}
+	}
+	if loginFlags.PrintExpiry {
+		if err := printExpiry(expiryWriter(loginFlags), awsCreds.Expires, loginFlags.ExpiryFormat); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serveLogin log in and serve the credentials on the credential socket without saving them anywhere
+func serveLogin(account *cfg.IDPAccount, loginFlags *flags.LoginExecFlags) error {
+	awsCreds, err := authenticate(account, loginFlags)
+	if err != nil {
+		return err
+	}
+
+	if loginFlags.PrintRoleARN {
+		if err := printRoleARN(expiryWriter(loginFlags), awsCreds); err != nil {
+			return err
+		}
+	}
+	if loginFlags.PrintExpiry {
+		if err := printExpiry(expiryWriter(loginFlags), awsCreds.Expires, loginFlags.ExpiryFormat); err != nil {
+			return err
+		}
+	}
+
+	return ServeCredentialSocket(loginFlags.CredentialSocket, awsCreds)
+}
+
+// refreshCredentials obtains new credentials for EnsureFresh, replaced in tests
+var refreshCredentials = loginToAws
+
+// newSAMLClient build the client of the configured IdP, replaced in tests
+var newSAMLClient = saml2aws.NewSAMLClient
+
+// loginToSts assume the role with the assertion, replaced in tests
+var loginToSts = loginToStsUsingRole
+
+// EnsureFresh return the credentials saved for the account, logging in again first when they are missing
+// or expire within the skew. This is login without the command line, for use when embedding saml2aws, so nothing
+// is prompted for and the keychain is neither read nor written, the account must hold all the login needs.
+func EnsureFresh(account *cfg.IDPAccount, skew time.Duration) (*awsconfig.AWSCredentials, error) {
+	logger := logrus.WithField("command", "login")
+
+	sharedCreds := awsconfig.NewSharedCredentials(account.Profile, account.CredentialsFile)
+	awsCreds, err := sharedCreds.Load()
+	if err == nil && time.Until(awsCreds.Expires) > skew {
+		logger.WithField("expires", awsCreds.Expires).Debug("Credentials are fresh. Skipping.")
+		return awsCreds, nil
+	}
+	if err != nil {
+		logger.WithError(err).Debug("Unable to load cached credentials.")
+	}
+
+	loginFlags := &flags.LoginExecFlags{CommonFlags: &flags.CommonFlags{IdpAccount: account.Name, SkipPrompt: true, DisableKeychain: true}}
+	awsCreds, err = refreshCredentials(account, loginFlags)
+	if err != nil {
+		return nil, err
+	}
+
+	err = saveCredentials(awsCreds, sharedCreds, account)
+	if err != nil {
+		return nil, err
+	}
+
+	return awsCreds, nil
+}
+
+// loginToAws authenticate to the IdP, or reuse the cached SAML assertion, then exchange the assertion for
+// credentials of the selected role
+func loginToAws(account *cfg.IDPAccount, loginFlags *flags.LoginExecFlags) (*awsconfig.AWSCredentials, error) {
+	logger := logrus.WithField("command", "login")
+
+	// creates a cacheProvider, only used when --cache is set
+	cacheProvider := &samlcache.SAMLCacheProvider{
+		Account:  account.CacheName(),
+		Filename: account.SAMLCacheFile,
+	}
+
 	loginDetails, err := resolveLoginDetails(account, loginFlags)
 	if err != nil {
-		log.Printf("%+v", err)
-		os.Exit(1)
+		return nil, err
 	}
 
 	logger.WithField("idpAccount", account).Debug("building provider")
 
-	provider, err := saml2aws.NewSAMLClient(account)
+	provider, err := newSAMLClient(account)
 	if err != nil {
-		return errors.Wrap(err, "Error building IdP client.")
+		return nil, errors.Wrap(err, "Error building IdP client.")
 	}
 
 	err = provider.Validate(loginDetails)
 	if err != nil {
-		return errors.Wrap(err, "Error validating login details.")
+		return nil, errors.Wrap(err, "Error validating login details.")
 	}
 
 	var samlAssertion string
+	// a cached assertion, or a provider which can't tell, counts as no MFA
+	var mfaPerformed bool
 	if account.SAMLCache {
 		if cacheProvider.IsValid() {
 			samlAssertion, err = cacheProvider.ReadRaw()
 			if err != nil {
-				return errors.Wrap(err, "Could not read SAML cache.")
+				return nil, errors.Wrap(err, "Could not read SAML cache.")
 			}
 		} else {
 			logger.Debug("Cache is invalid")
-			log.Printf("Authenticating as %s ...", loginDetails.Username)
+			log.Printf("Authenticating as %s ...", loginDetails.DisplayUsername())
 		}
 	} else {
-		log.Printf("Authenticating as %s ...", loginDetails.Username)
+		log.Printf("Authenticating as %s ...", loginDetails.DisplayUsername())
 	}
 
 	if samlAssertion == "" {
 		// samlAssertion was not cached
+		discoverAppID := account.Provider == "AzureAD" && account.AppID == ""
+		if err := runPreAuthCommand(account); err != nil {
+			return nil, err
+		}
+		progress.Step("Authenticating to the IdP")
 		samlAssertion, err = provider.Authenticate(loginDetails)
 		if err != nil {
-			return errors.Wrap(err, "Error authenticating to IdP.")
+			writeFailureReport(loginFlags.CommonFlags.FailureReport, account, loginDetails, err)
+			return nil, errors.Wrap(err, "Error authenticating to IdP.")
+		}
+		if reporter, ok := provider.(saml2aws.MFAReporter); ok {
+			mfaPerformed = reporter.MFAPerformed()
+			logger.WithField("mfaPerformed", mfaPerformed).Debug("Authenticated to IdP.")
+		}
+		if discoverAppID && account.AppID != "" {
+			err = saveDiscoveredAppID(loginFlags.CommonFlags.ConfigFile, account)
+			if err != nil {
+				log.Println("Unable to save the discovered app ID:", err)
+			}
 		}
 		if account.SAMLCache {
 			err = cacheProvider.WriteRaw(samlAssertion)
 			if err != nil {
-				return errors.Wrap(err, "Could not write SAML cache.")
+				return nil, errors.Wrap(err, "Could not write SAML cache.")
 			}
 		}
 	}
 
 	if samlAssertion == "" {
-		log.Println("Response did not contain a valid SAML assertion.")
 		log.Println("Please check that your username and password is correct.")
 		log.Println("To see the output follow the instructions in https://github.com/versent/saml2aws#debugging-issues-with-idps")
-		os.Exit(1)
+		return nil, errors.New("Response did not contain a valid SAML assertion.")
+	}
+
+	if err := verifyAudience(samlAssertion, account); err != nil {
+		return nil, err
 	}
 
 	if !loginFlags.CommonFlags.DisableKeychain {
 		err = credentials.SaveCredentials(loginDetails.URL, loginDetails.Username, loginDetails.Password)
 		if err != nil {
-			return errors.Wrap(err, "Error storing password in keychain.")
+			return nil, errors.Wrap(err, "Error storing password in keychain.")
 		}
 	}
 
 	role, err := selectAwsRole(samlAssertion, account)
 	if err != nil {
-		return errors.Wrap(err, "Failed to assume role. Please check whether you are permitted to assume the given role for the AWS service.")
+		return nil, errors.Wrap(err, "Failed to assume role. Please check whether you are permitted to assume the given role for the AWS service.")
 	}
 
 	log.Println("Selected role:", role.RoleARN)
 
-	awsCreds, err := loginToStsUsingRole(account, role, samlAssertion)
+	refreshedAssertion, role, err := refreshExpiredAssertion(provider, loginDetails, account, role, samlAssertion)
 	if err != nil {
-		return errors.Wrap(err, "Error logging into AWS role using SAML assertion.")
+		return nil, err
 	}
+	if refreshedAssertion != samlAssertion {
+		if err := verifyAudience(refreshedAssertion, account); err != nil {
+			return nil, err
+		}
+		if reporter, ok := provider.(saml2aws.MFAReporter); ok {
+			mfaPerformed = reporter.MFAPerformed()
+		}
+		if account.SAMLCache {
+			if err := cacheProvider.WriteRaw(refreshedAssertion); err != nil {
+				return nil, errors.Wrap(err, "Could not write SAML cache.")
+			}
+		}
+	}
+	samlAssertion = refreshedAssertion
 
-	// print credential process if needed
-	if loginFlags.CredentialProcess {
-		err = PrintCredentialProcess(awsCreds)
+	// the age is checked on the assertion given to STS, which may come from authenticating again
+	if err := verifyAuthnInstant(samlAssertion, account); err != nil {
+		return nil, err
+	}
+
+	roleSessionName, err := verifyRoleSessionName(samlAssertion)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error checking the role session name.")
+	}
+	if roleSessionName != "" {
+		if account.MaskUsername {
+			roleSessionName = creds.MaskUsername(roleSessionName)
+		}
+		logger.WithField("roleSessionName", roleSessionName).Debug("Role session name from the assertion.")
+	}
+
+	progress.Step("Requesting AWS credentials")
+	awsCreds, err := loginToSts(account, role, samlAssertion)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error logging into AWS role using SAML assertion.")
+	}
+	awsCreds.MFAPerformed = mfaPerformed
+
+	return awsCreds, nil
+}
+
+// authenticate log in to the IdP and AWS, when STDOUT isn't a terminal the prompts are written to STDERR
+// instead so they can't end up in a pipe or the output captured by $(...). With --show-progress the steps are
+// shown on STDERR as they're reached.
+func authenticate(account *cfg.IDPAccount, loginFlags *flags.LoginExecFlags) (*awsconfig.AWSCredentials, error) {
+	if !stdoutIsTerminal() {
+		defer redirectStdout()()
+	}
+	if loginFlags.ShowProgress {
+		defer startProgress(os.Stderr)()
+	}
+	return refreshCredentials(account, loginFlags)
+}
+
+// stdoutIsTerminal report whether STDOUT is a terminal, replaced in tests
+var stdoutIsTerminal = func() bool {
+	fi, err := os.Stdout.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// redirectStdout point os.Stdout, which the prompts are written to, at STDERR along with the loggers when they
+// write to STDOUT as they do on windows, the returned func puts them back
+func redirectStdout() func() {
+	stdout, logOut, logrusOut := os.Stdout, log.Writer(), logrus.StandardLogger().Out
+
+	os.Stdout = os.Stderr
+	if logOut == io.Writer(stdout) {
+		log.SetOutput(os.Stderr)
+	}
+	if logrusOut == io.Writer(stdout) {
+		logrus.SetOutput(os.Stderr)
+	}
+
+	return func() {
+		os.Stdout = stdout
+		log.SetOutput(logOut)
+		logrus.SetOutput(logrusOut)
+	}
+}
+
+// printEval write the credentials as the bash export lines of the script command, for eval "$(saml2aws login --eval)"
+func printEval(w io.Writer, account *cfg.IDPAccount, awsCreds *awsconfig.AWSCredentials) error {
+	data := struct {
+		ProfileName string
+		*awsconfig.AWSCredentials
+	}{
+		account.Profile,
+		awsCreds,
+	}
+
+	out, err := buildTmpl("bash", data)
+	if err != nil {
+		return errors.Wrap(err, "Error generating the export lines.")
+	}
+	_, err = io.WriteString(w, out)
+	return err
+}
+
+// expiryWriter keep STDOUT clean for the credential process JSON, the export lines or the path of the credentials
+// file, the role ARN is written here too
+func expiryWriter(loginFlags *flags.LoginExecFlags) io.Writer {
+	if loginFlags.CredentialProcess || loginFlags.Eval || loginFlags.CredsTmpfile {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// printExpiry write the credentials expiry as rfc3339, unix epoch seconds or a human readable duration
+func printExpiry(w io.Writer, expires time.Time, format string) error {
+	var out string
+	switch format {
+	case "", "rfc3339":
+		out = expires.Format(time.RFC3339)
+	case "epoch":
+		out = strconv.FormatInt(expires.Unix(), 10)
+	case "human":
+		out = humanizeExpiry(time.Until(expires))
+	default:
+		return fmt.Errorf("unknown expiry format %q", format)
+	}
+
+	_, err := fmt.Fprintln(w, out)
+	return err
+}
+
+// printRoleARN write the ARN of the role the credentials are for, credentials saved before the role ARN was
+// recorded only have the assumed role ARN STS returned, which is what sts get-caller-identity reports
+func printRoleARN(w io.Writer, awsCreds *awsconfig.AWSCredentials) error {
+	arn := awsCreds.RoleARN
+	if arn == "" {
+		arn = awsCreds.PrincipalARN
+	}
+	if arn == "" {
+		return errors.New("The role ARN of the credentials is unknown.")
+	}
+
+	_, err := fmt.Fprintln(w, arn)
+	return err
+}
+
+func humanizeExpiry(d time.Duration) string {
+	if d <= 0 {
+		return "expired"
+	}
+	d = d.Round(time.Minute)
+	return fmt.Sprintf("in %dh%dm", int(d.Hours()), int(d.Minutes())%60)
+}
+
+// saveDiscoveredAppID persist the app ID found by the provider so it doesn't have to be looked up again,
+// the account is reloaded so command line overrides don't end up in the configuration
+func saveDiscoveredAppID(configFile string, account *cfg.IDPAccount) error {
+	cfgm, err := cfg.NewConfigManager(configFile)
+	if err != nil {
+		return errors.Wrap(err, "Failed to load configuration.")
+	}
+
+	stored, err := cfgm.LoadIDPAccount(account.Name)
+	if err != nil {
+		return errors.Wrap(err, "Failed to load IdP account.")
+	}
+
+	stored.AppID = account.AppID
+
+	return cfgm.SaveIDPAccount(account.Name, stored)
+}
+
+// defaultPreAuthTimeout how long the pre_auth_command may run when pre_auth_timeout isn't set
+const defaultPreAuthTimeout = 60 * time.Second
+
+// runPreAuthCommand run the configured pre_auth_command, e.g. to connect the VPN the IdP is only reachable
+// through, authentication is aborted unless it succeeds within the timeout
+func runPreAuthCommand(account *cfg.IDPAccount) error {
+	if account.PreAuthCommand == "" {
+		return nil
+	}
+
+	timeout := defaultPreAuthTimeout
+	if account.PreAuthTimeout > 0 {
+		timeout = time.Duration(account.PreAuthTimeout) * time.Second
+	}
+
+	logger := logrus.WithField("command", "pre-auth")
+	logger.WithField("cmdline", account.PreAuthCommand).Debug("running pre-auth command")
+	output, err := shell.RunCommand(account.PreAuthCommand, timeout)
+	logger.WithField("output", output).Debug("pre-auth command finished")
+	if err != nil {
+		return errors.Wrapf(err, "Pre-auth command failed: %s", strings.TrimSpace(output))
+	}
+
+	return nil
+}
+
+// writeFailureReport write the JSON report of the failed authentication to the file, - for stderr, nothing is
+// written when no file is given
+func writeFailureReport(filename string, account *cfg.IDPAccount, loginDetails *creds.LoginDetails, authErr error) {
+	if filename == "" {
+		return
+	}
+
+	var w io.Writer = os.Stderr
+	if filename != "-" {
+		f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
 		if err != nil {
-			return err
+			log.Println("Unable to write the failure report:", err)
+			return
 		}
+		defer f.Close()
+		w = f
+	}
+
+	if err := saml2aws.NewFailureReport(account.Provider, authErr, loginDetails).Write(w); err != nil {
+		log.Println("Unable to write the failure report:", err)
 	}
-	return saveCredentials(awsCreds, sharedCreds)
 }
 
 func buildIdpAccount(loginFlags *flags.LoginExecFlags) (*cfg.IDPAccount, error) {
@@ -156,11 +553,21 @@ func buildIdpAccount(loginFlags *flags.LoginExecFlags) (*cfg.IDPAccount, error)
 		return nil, errors.Wrap(err, "Failed to load configuration.")
 	}
 
-	account, err := cfgm.LoadIDPAccount(loginFlags.CommonFlags.IdpAccount)
+	idpAccountName, err := resolveIdpAccountName(cfgm, loginFlags.CommonFlags)
+	if err != nil {
+		return nil, err
+	}
+	loginFlags.CommonFlags.IdpAccount = idpAccountName
+
+	account, err := cfgm.LoadIDPAccount(idpAccountName)
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to load IdP account.")
 	}
 
+	if loginFlags.CommonFlags.NoSession && loginFlags.CommonFlags.SessionDuration != 0 {
+		return nil, errors.New("--no-session and --session-duration can't be used together.")
+	}
+
 	// update username and hostname if supplied
 	flags.ApplyFlagOverrides(loginFlags.CommonFlags, account)
 
@@ -172,11 +579,41 @@ func buildIdpAccount(loginFlags *flags.LoginExecFlags) (*cfg.IDPAccount, error)
 	return account, nil
 }
 
+// resolveIdpAccountName pick the idp account to use when none was named, the default account is used if it
+// exists, a lone account is selected automatically and otherwise the user is asked to choose one
+func resolveIdpAccountName(cfgm *cfg.ConfigManager, commonFlags *flags.CommonFlags) (string, error) {
+	if commonFlags.IdpAccount != "" {
+		return commonFlags.IdpAccount, nil
+	}
+
+	names, err := cfgm.IDPAccountNames()
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to list IdP accounts.")
+	}
+
+	for _, name := range names {
+		if name == defaultIdpAccountName {
+			return name, nil
+		}
+	}
+
+	switch {
+	case len(names) == 0:
+		return defaultIdpAccountName, nil
+	case len(names) == 1:
+		return names[0], nil
+	case commonFlags.SkipPrompt:
+		return "", fmt.Errorf("Several IdP accounts are configured, select one with --idp-account: %s", strings.Join(names, ", "))
+	}
+
+	return names[prompter.Choose("Please choose the IdP account", names)], nil
+}
+
 func resolveLoginDetails(account *cfg.IDPAccount, loginFlags *flags.LoginExecFlags) (*creds.LoginDetails, error) {
 
 	// log.Printf("loginFlags %+v", loginFlags)
 
-	loginDetails := &creds.LoginDetails{URL: account.URL, Username: account.Username, MFAToken: loginFlags.CommonFlags.MFAToken, DuoMFAOption: loginFlags.DuoMFAOption}
+	loginDetails := &creds.LoginDetails{URL: account.URL, Username: account.Username, MFAToken: loginFlags.CommonFlags.MFAToken, MFATOTPSecret: loginFlags.CommonFlags.MFATOTPSecret, DuoMFAOption: loginFlags.DuoMFAOption, MaskUsername: account.MaskUsername, SkipPrompt: loginFlags.CommonFlags.SkipPrompt, ConfigScope: account.ConfigScope()}
 
 	log.Printf("Using IdP Account %s to access %s %s", loginFlags.CommonFlags.IdpAccount, account.Provider, account.URL)
 
@@ -253,7 +690,7 @@ func selectAwsRole(samlAssertion string, account *cfg.IDPAccount) (*saml2aws.AWS
 		return nil, errors.Wrap(err, "Error decoding SAML assertion.")
 	}
 
-	roles, err := saml2aws.ExtractAwsRoles(data)
+	roles, err := saml2aws.ExtractAwsRolesWithAttribute(data, account.RoleAttribute)
 	if err != nil {
 		return nil, errors.Wrap(err, "Error parsing AWS roles.")
 	}
@@ -264,17 +701,122 @@ func selectAwsRole(samlAssertion string, account *cfg.IDPAccount) (*saml2aws.AWS
 		os.Exit(1)
 	}
 
+	// with both ARNs configured the role is assumed directly, as long as the assertion grants it
+	if strings.HasPrefix(account.RoleARN, "arn:") && account.PrincipalARN != "" {
+		return saml2aws.GrantedRole(roles, account.RoleARN, account.PrincipalARN)
+	}
+
 	awsRoles, err := saml2aws.ParseAWSRoles(roles)
 	if err != nil {
 		return nil, errors.Wrap(err, "Error parsing AWS roles.")
 	}
 
+	if account.PrincipalARN != "" {
+		awsRoles = rolesWithPrincipal(awsRoles, account.PrincipalARN)
+		if len(awsRoles) == 0 {
+			return nil, fmt.Errorf("The SAML assertion doesn't grant any role with principal %s", account.PrincipalARN)
+		}
+	}
+
 	return resolveRole(awsRoles, samlAssertion, account)
 }
 
-func resolveRole(awsRoles []*saml2aws.AWSRole, samlAssertion string, account *cfg.IDPAccount) (*saml2aws.AWSRole, error) {
-	var role = new(saml2aws.AWSRole)
+// assertionExpiryMargin how long before it expires the assertion is replaced, leaving the time to call STS
+const assertionExpiryMargin = 30 * time.Second
+
+// verifyAuthnInstant check the user authenticated at the IdP recently enough when max_auth_age is set, an IdP
+// session or the SAML cache can otherwise hand out assertions from an authentication long ago
+func verifyAuthnInstant(samlAssertion string, account *cfg.IDPAccount) error {
+	data, err := b64.StdEncoding.DecodeString(samlAssertion)
+	if err != nil {
+		return errors.Wrap(err, "Error decoding SAML assertion.")
+	}
+
+	if authnInstant, err := saml2aws.ExtractAuthnInstant(data); err == nil && !authnInstant.IsZero() {
+		logrus.WithField("command", "login").Debugf("SAML assertion AuthnInstant: %s", authnInstant.Format(time.RFC3339))
+	}
+
+	if account.MaxAuthAge <= 0 {
+		return nil
+	}
+
+	if err := saml2aws.VerifyAuthnInstant(data, time.Duration(account.MaxAuthAge)*time.Second, time.Now()); err != nil {
+		return errors.Wrap(err, "The authentication is older than max_auth_age, clear the IdP session or run with --force to authenticate again.")
+	}
+
+	return nil
+}
+
+// verifyAudience check the assertion is for AWS, or the configured expected_audience, an IdP app set up with the
+// wrong identifier otherwise only shows as an InvalidIdentityToken from STS
+func verifyAudience(samlAssertion string, account *cfg.IDPAccount) error {
+	data, err := b64.StdEncoding.DecodeString(samlAssertion)
+	if err != nil {
+		return errors.Wrap(err, "Error decoding SAML assertion.")
+	}
 
+	if err := saml2aws.VerifyAudience(data, account.ExpectedAudience); err != nil {
+		return errors.Wrap(err, "The SAML assertion isn't for AWS, check the identifier of the AWS app at the IdP or set expected_audience.")
+	}
+
+	return nil
+}
+
+// refreshExpiredAssertion authenticate again when the assertion has expired, or is about to, by the time the
+// role has been chosen, e.g. because the role prompt was left open. The IdP session from the first authentication
+// usually means this needs no input. The chosen role is looked up in the new assertion, unless on_assertion_expiry
+// is fail in which case the login fails instead
+func refreshExpiredAssertion(provider saml2aws.SAMLClient, loginDetails *creds.LoginDetails, account *cfg.IDPAccount, role *saml2aws.AWSRole, samlAssertion string) (string, *saml2aws.AWSRole, error) {
+	data, err := b64.StdEncoding.DecodeString(samlAssertion)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "Error decoding SAML assertion.")
+	}
+
+	// an assertion without NotOnOrAfter is left for STS to judge
+	notOnOrAfter, err := saml2aws.ExtractMFATokenExpiryTime(data)
+	if err != nil || time.Until(notOnOrAfter) > assertionExpiryMargin {
+		return samlAssertion, role, nil
+	}
+
+	if account.OnAssertionExpiry == "fail" {
+		return "", nil, fmt.Errorf("The SAML assertion expired at %s before the role was assumed, login again.", notOnOrAfter.Local().Format(time.RFC1123))
+	}
+
+	log.Println("The SAML assertion has expired, authenticating again ...")
+	samlAssertion, err = provider.Authenticate(loginDetails)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "Error authenticating to IdP.")
+	}
+
+	data, err = b64.StdEncoding.DecodeString(samlAssertion)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "Error decoding SAML assertion.")
+	}
+	roles, err := saml2aws.ExtractAwsRolesWithAttribute(data, account.RoleAttribute)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "Error parsing AWS roles.")
+	}
+	role, err = saml2aws.GrantedRole(roles, role.RoleARN, role.PrincipalARN)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return samlAssertion, role, nil
+}
+
+// rolesWithPrincipal the roles which are assumed with the principal, so a role given by name only is looked
+// up among the roles of that SAML provider
+func rolesWithPrincipal(awsRoles []*saml2aws.AWSRole, principalARN string) []*saml2aws.AWSRole {
+	matches := []*saml2aws.AWSRole{}
+	for _, awsRole := range awsRoles {
+		if awsRole.PrincipalARN == principalARN {
+			matches = append(matches, awsRole)
+		}
+	}
+	return matches
+}
+
+func resolveRole(awsRoles []*saml2aws.AWSRole, samlAssertion string, account *cfg.IDPAccount) (*saml2aws.AWSRole, error) {
 	if len(awsRoles) == 1 {
 		if account.RoleARN != "" {
 			return saml2aws.LocateRole(awsRoles, account.RoleARN)
@@ -284,6 +826,30 @@ func resolveRole(awsRoles []*saml2aws.AWSRole, samlAssertion string, account *cf
 		return nil, errors.New("No roles available.")
 	}
 
+	awsAccounts, err := groupAWSRoles(awsRoles, samlAssertion, account)
+	if err != nil {
+		return nil, err
+	}
+
+	if account.RoleARN != "" {
+		return saml2aws.LocateRole(awsRoles, account.RoleARN)
+	}
+
+	return saml2aws.SelectAWSRole(awsAccounts)
+}
+
+// groupAWSRoles group the roles from the assertion by account, the accounts are labelled with the configured
+// aliases and the AWS sign in page is only fetched when some account has no alias
+func groupAWSRoles(awsRoles []*saml2aws.AWSRole, samlAssertion string, account *cfg.IDPAccount) ([]*saml2aws.AWSAccount, error) {
+	aliases, err := account.AccountAliasMap()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error parsing account aliases.")
+	}
+
+	if saml2aws.AliasesCoverRoles(awsRoles, aliases) {
+		return saml2aws.GroupAWSRolesByAccount(awsRoles, nil, aliases), nil
+	}
+
 	samlAssertionData, err := b64.StdEncoding.DecodeString(samlAssertion)
 	if err != nil {
 		return nil, errors.Wrap(err, "Error decoding SAML assertion.")
@@ -298,48 +864,80 @@ func resolveRole(awsRoles []*saml2aws.AWSRole, samlAssertion string, account *cf
 	if err != nil {
 		return nil, errors.Wrap(err, "Error parsing AWS role accounts.")
 	}
-	if len(awsAccounts) == 0 {
-		return nil, errors.New("No accounts available.")
+
+	// the sign in page only supplies the account names, the roles come from the assertion
+	return saml2aws.GroupAWSRolesByAccount(awsRoles, awsAccounts, aliases), nil
+}
+
+// verifyRoleSessionName check the RoleSessionName attribute of the assertion, which STS takes the session name of
+// the assumed role from as AssumeRoleWithSAML has no parameter for it. AWS rejects an invalid one so this is
+// validated up front to give a clearer error than the one returned by STS, a missing one is left to STS to report.
+func verifyRoleSessionName(samlAssertion string) (string, error) {
+	data, err := b64.StdEncoding.DecodeString(samlAssertion)
+	if err != nil {
+		return "", errors.Wrap(err, "Error decoding SAML assertion.")
+	}
+
+	roleSessionName, err := saml2aws.ExtractRoleSessionName(data)
+	if err != nil {
+		return "", errors.Wrap(err, "Error parsing role session name.")
 	}
 
-	saml2aws.AssignPrincipals(awsRoles, awsAccounts)
+	if roleSessionName == "" {
+		return "", nil
+	}
 
-	if account.RoleARN != "" {
-		return saml2aws.LocateRole(awsRoles, account.RoleARN)
+	if err := saml2aws.ValidateRoleSessionName(roleSessionName); err != nil {
+		return "", err
 	}
 
-	for {
-		role, err = saml2aws.PromptForAWSRoleSelection(awsAccounts)
-		if err == nil {
-			break
+	return roleSessionName, nil
+}
+
+// awsSessionConfig the configuration of the session for the STS and IAM calls, with aws_use_idp_transport these go
+// through the proxy and trust the CA bundle configured for the IdP rather than the defaults of the SDK
+func awsSessionConfig(account *cfg.IDPAccount, region string) (*aws.Config, error) {
+	awsConfig := &aws.Config{
+		Region: aws.String(region),
+	}
+
+	if account.AWSUseIDPTransport {
+		httpClient, err := provider.NewAWSHTTPClient(account)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to create the HTTP client for AWS.")
 		}
-		log.Println("Error selecting role. Try again.")
+		awsConfig.HTTPClient = httpClient
 	}
 
-	return role, nil
+	return awsConfig, nil
 }
 
 func loginToStsUsingRole(account *cfg.IDPAccount, role *saml2aws.AWSRole, samlAssertion string) (*awsconfig.AWSCredentials, error) {
 
-	sess, err := session.NewSession(&aws.Config{
-		Region: &account.Region,
-	})
+	partition, err := resolvePartition(account, role, samlAssertion)
+	if err != nil {
+		return nil, err
+	}
+
+	awsConfig, err := awsSessionConfig(account, partition.Region(account.Region))
+	if err != nil {
+		return nil, err
+	}
+
+	sess, err := session.NewSession(awsConfig)
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to create session.")
 	}
 
 	svc := sts.New(sess)
-
-	params := &sts.AssumeRoleWithSAMLInput{
-		PrincipalArn:    aws.String(role.PrincipalARN), // Required
-		RoleArn:         aws.String(role.RoleARN),      // Required
-		SAMLAssertion:   aws.String(samlAssertion),     // Required
-		DurationSeconds: aws.Int64(int64(account.SessionDuration)),
+	iamClient := func(creds *sts.Credentials) iamiface.IAMAPI {
+		return iam.New(sess, &aws.Config{Credentials: awscredentials.NewStaticCredentials(
+			aws.StringValue(creds.AccessKeyId), aws.StringValue(creds.SecretAccessKey), aws.StringValue(creds.SessionToken))})
 	}
 
 	log.Println("Requesting AWS credentials using SAML assertion.")
 
-	resp, err := svc.AssumeRoleWithSAML(params)
+	resp, err := assumeRoleWithSAML(svc, iamClient, role, samlAssertion, sessionDuration(account.SessionDuration, samlAssertion))
 	if err != nil {
 		return nil, errors.Wrap(err, "Error retrieving STS credentials using SAML.")
 	}
@@ -350,18 +948,125 @@ func loginToStsUsingRole(account *cfg.IDPAccount, role *saml2aws.AWSRole, samlAs
 		AWSSessionToken:  aws.StringValue(resp.Credentials.SessionToken),
 		AWSSecurityToken: aws.StringValue(resp.Credentials.SessionToken),
 		PrincipalARN:     aws.StringValue(resp.AssumedRoleUser.Arn),
+		RoleARN:          role.RoleARN,
 		Expires:          resp.Credentials.Expiration.Local(),
 		Region:           account.Region,
 	}, nil
 }
 
-func saveCredentials(awsCreds *awsconfig.AWSCredentials, sharedCreds *awsconfig.CredentialsProvider) error {
+// resolvePartition work out the partition the role is in and check the assertion is addressed to the sign in
+// endpoint of that partition, STS rejects an assertion meant for another partition with a less helpful error
+func resolvePartition(account *cfg.IDPAccount, role *saml2aws.AWSRole, samlAssertion string) (*saml2aws.AWSPartition, error) {
+	partition, err := saml2aws.ResolvePartition(account.AWSPartition, role.RoleARN)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error resolving AWS partition.")
+	}
+
+	data, err := b64.StdEncoding.DecodeString(samlAssertion)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error decoding SAML assertion.")
+	}
+
+	// without an expected destination any AWS sign in endpoint passes, the partition is checked below
+	if account.VerifyDestination {
+		if err := saml2aws.VerifyDestination(data, account.ExpectedDestination); err != nil {
+			return nil, errors.Wrap(err, "Error verifying SAML assertion destination.")
+		}
+	}
+
+	// not every IdP sets a destination, and some use one which isn't an AWS sign in endpoint
+	destination, err := saml2aws.ExtractDestinationURL(data)
+	if err != nil {
+		return partition, nil
+	}
+	if other := saml2aws.PartitionForDestination(destination); other != nil && other.ID != partition.ID {
+		return nil, fmt.Errorf("SAML assertion is addressed to %s but the role is in the %s partition which signs in at %s", destination, partition.ID, partition.SignInURL)
+	}
+
+	logrus.WithField("partition", partition.ID).Debug("Resolved AWS partition.")
+
+	return partition, nil
+}
+
+// sessionDuration the duration to request, shortened to the SessionNotOnOrAfter of the assertion when the IdP
+// ends the session sooner than requested as STS wouldn't issue credentials lasting any longer
+func sessionDuration(requested int, samlAssertion string) int {
+	data, err := b64.StdEncoding.DecodeString(samlAssertion)
+	if err != nil {
+		return requested
+	}
+
+	sessionNotOnOrAfter, err := saml2aws.ExtractSessionNotOnOrAfter(data)
+	if err != nil || sessionNotOnOrAfter.IsZero() {
+		return requested
+	}
+
+	remaining := int(time.Until(sessionNotOnOrAfter).Seconds())
+	if remaining >= requested {
+		return requested
+	}
+	if remaining < cfg.MinSessionDuration {
+		remaining = cfg.MinSessionDuration
+	}
+
+	log.Printf("The SAML assertion limits the session to %ds, shorter than the %ds requested.", remaining, requested)
+	return remaining
+}
+
+// assumeRoleWithSAML assume the role for the requested duration, when that is longer than the role allows the
+// role's MaxSessionDuration is looked up with credentials for the default duration and used instead
+func assumeRoleWithSAML(svc stsiface.STSAPI, iamClient func(*sts.Credentials) iamiface.IAMAPI, role *saml2aws.AWSRole, samlAssertion string, duration int) (*sts.AssumeRoleWithSAMLOutput, error) {
+	assume := func(duration int) (*sts.AssumeRoleWithSAMLOutput, error) {
+		return svc.AssumeRoleWithSAML(&sts.AssumeRoleWithSAMLInput{
+			PrincipalArn:    aws.String(role.PrincipalARN), // Required
+			RoleArn:         aws.String(role.RoleARN),      // Required
+			SAMLAssertion:   aws.String(samlAssertion),     // Required
+			DurationSeconds: aws.Int64(int64(duration)),
+		})
+	}
+
+	resp, err := assume(duration)
+	if err == nil || duration <= cfg.DefaultSessionDuration || !isMaxSessionDurationError(err) {
+		return resp, err
+	}
+
+	// every role allows at least the default duration
+	resp, err = assume(cfg.DefaultSessionDuration)
+	if err != nil {
+		return nil, err
+	}
+
+	maxDuration := cfg.DefaultSessionDuration
+	roleName := role.RoleARN[strings.LastIndex(role.RoleARN, "/")+1:]
+	out, err := iamClient(resp.Credentials).GetRole(&iam.GetRoleInput{RoleName: aws.String(roleName)})
+	if err != nil {
+		logrus.WithError(err).Debug("Unable to look up the maximum session duration of the role.")
+	} else if out.Role != nil && aws.Int64Value(out.Role.MaxSessionDuration) > 0 {
+		maxDuration = int(aws.Int64Value(out.Role.MaxSessionDuration))
+	}
+
+	log.Printf("Requested session duration of %ds exceeds the maximum allowed by the role, using %ds instead.", duration, maxDuration)
+
+	if maxDuration <= cfg.DefaultSessionDuration {
+		return resp, nil
+	}
+
+	return assume(maxDuration)
+}
+
+// isMaxSessionDurationError STS refuses durations longer than the role's MaxSessionDuration with a validation error
+func isMaxSessionDurationError(err error) bool {
+	var awsErr awserr.Error
+	return errors.As(err, &awsErr) && awsErr.Code() == "ValidationError" && strings.Contains(awsErr.Message(), "MaxSessionDuration")
+}
+
+func saveCredentials(awsCreds *awsconfig.AWSCredentials, sharedCreds *awsconfig.CredentialsProvider, account *cfg.IDPAccount) error {
 	err := sharedCreds.Save(awsCreds)
 	if err != nil {
 		return errors.Wrap(err, "Error saving credentials.")
 	}
 
-	log.Println("Logged in as:", awsCreds.PrincipalARN)
+	log.Println("Logged in as:", displayPrincipalARN(awsCreds.PrincipalARN, account.MaskUsername))
 	log.Println("")
 	log.Println("Your new access key pair has been stored in the AWS configuration.")
 	log.Printf("Note that it will expire at %v", awsCreds.Expires)
@@ -372,6 +1077,31 @@ func saveCredentials(awsCreds *awsconfig.AWSCredentials, sharedCreds *awsconfig.
 	return nil
 }
 
+// displayPrincipalARN the assumed role ARN as it may be shown, the role session name at its end is usually the
+// username so it is masked along with it
+func displayPrincipalARN(principalARN string, mask bool) string {
+	if !mask {
+		return principalARN
+	}
+	i := strings.LastIndex(principalARN, "/")
+	return principalARN[:i+1] + creds.MaskUsername(principalARN[i+1:])
+}
+
+// saveCLICache also store the credentials in the AWS CLI cache, failing to do so doesn't fail the login as the
+// credentials have already been saved
+func saveCLICache(awsCreds *awsconfig.AWSCredentials) {
+	dir, err := awsconfig.LocateCLICacheDir()
+	if err == nil {
+		var filename string
+		filename, err = awsconfig.SaveCLICache(dir, awsCreds)
+		if err == nil {
+			log.Println("Credentials cached for the AWS CLI in", filename)
+			return
+		}
+	}
+	log.Println("Unable to write the AWS CLI cache:", err)
+}
+
 // CredentialsToCredentialProcess
 // Returns a Json output that is compatible with the AWS credential_process
 // https://github.com/awslabs/awsprocesscreds
@@ -401,6 +1131,39 @@ func CredentialsToCredentialProcess(awsCreds *awsconfig.AWSCredentials) (string,
 
 }
 
+// CredentialProcessConfigLine the credential_process setting for a profile in ~/.aws/config which logs in with
+// the account, e.g. credential_process = saml2aws login --skip-prompt --quiet --credential-process ...
+func CredentialProcessConfigLine(account *cfg.IDPAccount, commonFlags *flags.CommonFlags) string {
+	args := []string{"saml2aws"}
+	if commonFlags.ConfigFile != "" {
+		args = append(args, "--config", commonFlags.ConfigFile)
+	}
+	args = append(args, "login", "--skip-prompt", "--quiet", "--credential-process", "--idp-account", commonFlags.IdpAccount)
+	if account.RoleARN != "" {
+		args = append(args, "--role", account.RoleARN)
+	}
+	if account.PrincipalARN != "" {
+		args = append(args, "--principal", account.PrincipalARN)
+	}
+	args = append(args, "--profile", account.Profile)
+	if account.CredentialsFile != "" {
+		args = append(args, "--credentials-file", account.CredentialsFile)
+	}
+
+	for i, arg := range args {
+		args[i] = credentialProcessArg(arg)
+	}
+	return "credential_process = " + strings.Join(args, " ")
+}
+
+// credentialProcessArg quote the argument when the AWS CLI would otherwise split it
+func credentialProcessArg(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\"'") {
+		return arg
+	}
+	return `"` + strings.ReplaceAll(arg, `"`, `\"`) + `"`
+}
+
 // PrintCredentialProcess Prints a Json output that is compatible with the AWS credential_process
 // https://github.com/awslabs/awsprocesscreds
 func PrintCredentialProcess(awsCreds *awsconfig.AWSCredentials) error {
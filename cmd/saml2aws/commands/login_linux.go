@@ -9,6 +9,10 @@ import (
 )
 
 func init() {
+	newKeyringHelper = func(backend string) (credentials.Helper, error) {
+		return linuxkeyring.NewKeyringHelper(linuxkeyring.Configuration{Backend: backend})
+	}
+
 	c := linuxkeyring.Configuration{
 		Backend: os.Getenv(cfg.KeyringBackEnvironmentVariableName),
 	}
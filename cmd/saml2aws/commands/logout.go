@@ -0,0 +1,89 @@
+package commands
+
+import (
+	"log"
+	"path"
+
+	"github.com/pkg/errors"
+	"github.com/versent/saml2aws/v2/helper/credentials"
+	"github.com/versent/saml2aws/v2/pkg/awsconfig"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
+	"github.com/versent/saml2aws/v2/pkg/flags"
+	"github.com/versent/saml2aws/v2/pkg/samlcache"
+)
+
+// Logout will remove the cached credentials and sessions for one or all of the idp accounts
+func Logout(logoutFlags *flags.LogoutFlags) error {
+	cfgm, err := cfg.NewConfigManager(logoutFlags.CommonFlags.ConfigFile)
+	if err != nil {
+		return errors.Wrap(err, "Failed to load configuration.")
+	}
+
+	var names []string
+	if logoutFlags.AllAccounts {
+		names, err = cfgm.IDPAccountNames()
+		if err != nil {
+			return errors.Wrap(err, "Failed to list IdP accounts.")
+		}
+	} else {
+		name, err := resolveIdpAccountName(cfgm, logoutFlags.CommonFlags)
+		if err != nil {
+			return err
+		}
+		names = []string{name}
+	}
+
+	for _, name := range names {
+		account, err := cfgm.LoadIDPAccount(name)
+		if err != nil {
+			return errors.Wrap(err, "Failed to load IdP account.")
+		}
+
+		// a single account can be overridden from the command line, all of them can't
+		if !logoutFlags.AllAccounts {
+			flags.ApplyFlagOverrides(logoutFlags.CommonFlags, account)
+		}
+
+		err = clearAccount(account, logoutFlags.All)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to clear IdP account %s.", name)
+		}
+
+		log.Printf("Cleared IdP account %s", name)
+	}
+
+	return nil
+}
+
+// clearAccount remove the aws credentials, saml cache and provider sessions for the account, the
+// stored password is only removed when asked for
+func clearAccount(account *cfg.IDPAccount, all bool) error {
+	sharedCreds := awsconfig.NewSharedCredentials(account.Profile, account.CredentialsFile)
+	if err := sharedCreds.Delete(); err != nil {
+		return errors.Wrap(err, "error removing aws credentials")
+	}
+
+	cacheProvider := &samlcache.SAMLCacheProvider{
+		Account:  account.CacheName(),
+		Filename: account.SAMLCacheFile,
+	}
+	if err := cacheProvider.Delete(); err != nil {
+		return errors.Wrap(err, "error removing saml cache")
+	}
+
+	if account.URL == "" {
+		return nil
+	}
+
+	keys := []string{credentials.SessionCookieURL(account.URL, account.ConfigScope())}
+	if all {
+		keys = append(keys, account.URL, path.Join(account.URL, OneLoginOAuthPath))
+	}
+	for _, key := range keys {
+		if err := credentials.DeleteCredentials(key); err != nil {
+			return errors.Wrap(err, "error removing stored credentials")
+		}
+	}
+
+	return nil
+}
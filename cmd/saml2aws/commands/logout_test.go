@@ -0,0 +1,90 @@
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/versent/saml2aws/v2/helper/credentials"
+	"github.com/versent/saml2aws/v2/pkg/awsconfig"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
+	"github.com/versent/saml2aws/v2/pkg/flags"
+)
+
+func TestLogout(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "saml2aws.ini")
+	credentialsFile := filepath.Join(dir, "credentials")
+	cacheFile := filepath.Join(dir, "cache")
+
+	config := "[default]\nurl = https://id.example.com\nprovider = Okta\naws_profile = saml\n" +
+		"credentials_file = " + credentialsFile + "\nsaml_cache_file = " + cacheFile + "\n"
+	require.Nil(t, os.WriteFile(configFile, []byte(config), 0600))
+
+	// the session is kept apart from the one of the same IdP in other config files
+	deleteSession := "Delete " + credentials.SessionCookieURL("https://id.example.com", (&cfg.IDPAccount{ConfigFile: configFile}).ConfigScope())
+	assert.NotEqual(t, "Delete https://id.example.com/sessionCookie", deleteSession)
+
+	setup := func(t *testing.T) *recordingHelper {
+		require.Nil(t, os.WriteFile(credentialsFile, []byte(""), 0600))
+		require.Nil(t, awsconfig.NewSharedCredentials("saml", credentialsFile).Save(&awsconfig.AWSCredentials{AWSAccessKey: "testid"}))
+		require.Nil(t, awsconfig.NewSharedCredentials("other", credentialsFile).Save(&awsconfig.AWSCredentials{AWSAccessKey: "otherid"}))
+		require.Nil(t, os.WriteFile(cacheFile, []byte("assertion"), 0600))
+
+		helper := &recordingHelper{}
+		currentHelper := credentials.CurrentHelper
+		credentials.CurrentHelper = helper
+		t.Cleanup(func() {
+			credentials.CurrentHelper = currentHelper
+		})
+		return helper
+	}
+
+	assertCleared := func(t *testing.T) {
+		_, err := awsconfig.NewSharedCredentials("saml", credentialsFile).Load()
+		assert.Equal(t, awsconfig.ErrCredentialsNotFound, err)
+
+		other, err := awsconfig.NewSharedCredentials("other", credentialsFile).Load()
+		assert.Nil(t, err)
+		assert.Equal(t, "otherid", other.AWSAccessKey)
+
+		_, err = os.Stat(cacheFile)
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	t.Run("keeps the password", func(t *testing.T) {
+		helper := setup(t)
+
+		err := Logout(&flags.LogoutFlags{CommonFlags: &flags.CommonFlags{ConfigFile: configFile, IdpAccount: "default"}})
+		assert.Nil(t, err)
+
+		assertCleared(t)
+		assert.Equal(t, []string{deleteSession}, helper.calls)
+	})
+
+	t.Run("all", func(t *testing.T) {
+		helper := setup(t)
+
+		err := Logout(&flags.LogoutFlags{CommonFlags: &flags.CommonFlags{ConfigFile: configFile, IdpAccount: "default"}, All: true})
+		assert.Nil(t, err)
+
+		assertCleared(t)
+		assert.Equal(t, []string{
+			deleteSession,
+			"Delete https://id.example.com",
+			"Delete https:/id.example.com/auth/oauth2/v2/token",
+		}, helper.calls)
+	})
+
+	t.Run("all accounts", func(t *testing.T) {
+		helper := setup(t)
+
+		err := Logout(&flags.LogoutFlags{CommonFlags: &flags.CommonFlags{ConfigFile: configFile}, AllAccounts: true})
+		assert.Nil(t, err)
+
+		assertCleared(t)
+		assert.Equal(t, []string{deleteSession}, helper.calls)
+	})
+}
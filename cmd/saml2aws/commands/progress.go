@@ -0,0 +1,90 @@
+package commands
+
+import (
+	"io"
+	"log"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"github.com/versent/saml2aws/v2/pkg/progress"
+	"github.com/versent/saml2aws/v2/pkg/prompter"
+)
+
+// stderrIsTerminal report whether STDERR is a terminal, replaced in tests
+var stderrIsTerminal = func() bool {
+	fi, err := os.Stderr.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// startProgress show a spinner with the step the login has reached on the writer, normally STDERR, the log output
+// clears it before each message and the prompts pause it. Nothing is shown when STDERR isn't a terminal as the
+// redrawn line would only clutter a log file or pipe. The returned func stops the spinner.
+func startProgress(out io.Writer) func() {
+	if !stderrIsTerminal() {
+		return func() {}
+	}
+
+	spinner := progress.NewSpinner(out)
+	logOut, logrusOut, activePrompter := log.Writer(), logrus.StandardLogger().Out, prompter.ActivePrompter
+	log.SetOutput(spinner.Writer(logOut))
+	logrus.SetOutput(spinner.Writer(logrusOut))
+	prompter.SetPrompter(&pausingPrompter{Prompter: activePrompter, spinner: spinner})
+	progress.SetReporter(spinner)
+	spinner.Start()
+
+	return func() {
+		progress.SetReporter(nil)
+		spinner.Stop()
+		prompter.SetPrompter(activePrompter)
+		logrus.SetOutput(logrusOut)
+		log.SetOutput(logOut)
+	}
+}
+
+// pausingPrompter hide the spinner while the user is prompted
+type pausingPrompter struct {
+	prompter.Prompter
+	spinner *progress.Spinner
+}
+
+func (p *pausingPrompter) RequestSecurityCode(pattern string) string {
+	p.spinner.Pause()
+	defer p.spinner.Resume()
+	return p.Prompter.RequestSecurityCode(pattern)
+}
+
+func (p *pausingPrompter) ChooseWithDefault(pr string, defaultValue string, options []string) (string, error) {
+	p.spinner.Pause()
+	defer p.spinner.Resume()
+	return p.Prompter.ChooseWithDefault(pr, defaultValue, options)
+}
+
+func (p *pausingPrompter) ChooseWithSearch(pr string, options []string) (string, error) {
+	p.spinner.Pause()
+	defer p.spinner.Resume()
+	return p.Prompter.ChooseWithSearch(pr, options)
+}
+
+func (p *pausingPrompter) Choose(pr string, options []string) int {
+	p.spinner.Pause()
+	defer p.spinner.Resume()
+	return p.Prompter.Choose(pr, options)
+}
+
+func (p *pausingPrompter) StringRequired(pr string) string {
+	p.spinner.Pause()
+	defer p.spinner.Resume()
+	return p.Prompter.StringRequired(pr)
+}
+
+func (p *pausingPrompter) String(pr string, defaultValue string) string {
+	p.spinner.Pause()
+	defer p.spinner.Resume()
+	return p.Prompter.String(pr, defaultValue)
+}
+
+func (p *pausingPrompter) Password(pr string) string {
+	p.spinner.Pause()
+	defer p.spinner.Resume()
+	return p.Prompter.Password(pr)
+}
@@ -0,0 +1,50 @@
+package commands
+
+import (
+	"bytes"
+	"log"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/versent/saml2aws/v2/pkg/progress"
+	"github.com/versent/saml2aws/v2/pkg/prompter"
+)
+
+func TestStartProgressNotTerminal(t *testing.T) {
+	defer func(f func() bool) { stderrIsTerminal = f }(stderrIsTerminal)
+	stderrIsTerminal = func() bool { return false }
+
+	logOut, activePrompter := log.Writer(), prompter.ActivePrompter
+
+	var buf bytes.Buffer
+	stop := startProgress(&buf)
+	progress.Step("ConvergedTFA")
+	stop()
+
+	assert.Empty(t, buf.String())
+	assert.Equal(t, logOut, log.Writer())
+	assert.Equal(t, activePrompter, prompter.ActivePrompter)
+}
+
+func TestStartProgressTerminal(t *testing.T) {
+	defer func(f func() bool) { stderrIsTerminal = f }(stderrIsTerminal)
+	stderrIsTerminal = func() bool { return true }
+
+	logOut, activePrompter := log.Writer(), prompter.ActivePrompter
+
+	var buf bytes.Buffer
+	stop := startProgress(&buf)
+	progress.Step("ConvergedTFA")
+	_, isPausing := prompter.ActivePrompter.(*pausingPrompter)
+	assert.True(t, isPausing)
+	stop()
+
+	assert.Contains(t, buf.String(), "ConvergedTFA")
+	assert.Equal(t, logOut, log.Writer())
+	assert.Equal(t, activePrompter, prompter.ActivePrompter)
+
+	// the reporter is unset once stopped
+	buf.Reset()
+	progress.Step("SAMLResponse")
+	assert.Empty(t, buf.String())
+}
@@ -2,8 +2,10 @@ package commands
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"log"
+	"strings"
 	"text/template"
 	"time"
 
@@ -51,6 +53,63 @@ AWS_SECURITY_TOKEN={{ .AWSSecurityToken }}
 SAML2AWS_PROFILE={{ .ProfileName }}
 `
 
+// dockerEnvTmpl a file for docker run --env-file, docker takes everything after the = literally so values
+// are neither quoted nor escaped
+const dockerEnvTmpl = `AWS_ACCESS_KEY_ID={{ dockerenv .AWSAccessKey }}
+AWS_SECRET_ACCESS_KEY={{ dockerenv .AWSSecretKey }}
+AWS_SESSION_TOKEN={{ dockerenv .AWSSessionToken }}
+AWS_SECURITY_TOKEN={{ dockerenv .AWSSecurityToken }}
+SAML2AWS_PROFILE={{ dockerenv .ProfileName }}
+AWS_CREDENTIAL_EXPIRATION={{ .Expires.Format "2006-01-02T15:04:05Z07:00" }}
+`
+
+// yamlTmpl a small YAML document for configuration tools, the keys match the AWS config file names and every
+// value is a double quoted scalar so tokens with signs or a leading digit stay strings
+const yamlTmpl = `aws_access_key_id: {{ yamlquote .AWSAccessKey }}
+aws_secret_access_key: {{ yamlquote .AWSSecretKey }}
+aws_session_token: {{ yamlquote .AWSSessionToken }}
+aws_security_token: {{ yamlquote .AWSSecurityToken }}
+profile: {{ yamlquote .ProfileName }}
+expiration: {{ yamlquote (.Expires.Format "2006-01-02T15:04:05Z07:00") }}
+`
+
+// ssoJSONTmpl a file in the shape of the AWS SDK SSO token cache, ~/.aws/sso/cache/*.json, for tools which only
+// check that file for a token and its expiry. The session token stands in for the access token, it isn't an SSO
+// OIDC token so the AWS SDKs can't exchange it for role credentials, these are added under roleCredentials in the
+// shape of the SSO GetRoleCredentials response instead.
+const ssoJSONTmpl = `{
+  "startUrl": {{ jsonquote .StartURL }},
+  "region": {{ jsonquote .Region }},
+  "accessToken": {{ jsonquote .AWSSessionToken }},
+  "expiresAt": "{{ .Expires.UTC.Format "2006-01-02T15:04:05Z" }}",
+  "roleCredentials": {
+    "accessKeyId": {{ jsonquote .AWSAccessKey }},
+    "secretAccessKey": {{ jsonquote .AWSSecretKey }},
+    "sessionToken": {{ jsonquote .AWSSessionToken }},
+    "expiration": {{ .Expires.UnixMilli }}
+  }
+}
+`
+
+// yamlQuote a JSON string is also a valid YAML double quoted scalar, which escapes quotes, backslashes and
+// control characters
+func yamlQuote(value string) (string, error) {
+	b, err := json.Marshal(value)
+	return string(b), err
+}
+
+// dockerEnvValue docker env-files have no way to quote a value, so a line break would end it early and
+// surrounding whitespace would silently become part of it
+func dockerEnvValue(value string) (string, error) {
+	if strings.ContainsAny(value, "\r\n") {
+		return "", errors.New("value contains a line break which can't be written to a docker env-file")
+	}
+	if strings.TrimSpace(value) != value {
+		return "", errors.New("value has surrounding whitespace which can't be written to a docker env-file")
+	}
+	return value, nil
+}
+
 // Script will emit a bash script that will export environment variables
 func Script(execFlags *flags.LoginExecFlags, shell string) error {
 	account, err := buildIdpAccount(execFlags)
@@ -84,9 +143,13 @@ func Script(execFlags *flags.LoginExecFlags, shell string) error {
 	// annoymous struct to pass to template
 	data := struct {
 		ProfileName string
+		Region      string
+		StartURL    string
 		*awsconfig.AWSCredentials
 	}{
 		account.Profile,
+		account.Region,
+		account.URL,
 		awsCreds,
 	}
 
@@ -115,6 +178,13 @@ func buildTmpl(shell string, data interface{}) (string, error) {
 		t, err = t.Parse(fishTmpl)
 	case "env":
 		t, err = t.Parse(envTmpl)
+	case "docker-env":
+		t, err = t.Funcs(template.FuncMap{"dockerenv": dockerEnvValue}).Parse(dockerEnvTmpl)
+	case "yaml":
+		t, err = t.Funcs(template.FuncMap{"yamlquote": yamlQuote}).Parse(yamlTmpl)
+	case "sso-json":
+		// a JSON string is exactly what yamlQuote produces
+		t, err = t.Funcs(template.FuncMap{"jsonquote": yamlQuote}).Parse(ssoJSONTmpl)
 	}
 
 	if err != nil {
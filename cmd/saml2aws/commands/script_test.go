@@ -1,11 +1,15 @@
 package commands
 
 import (
+	"encoding/json"
+	"strings"
 	"testing"
 	"time"
+	"unicode"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/versent/saml2aws/v2/pkg/awsconfig"
+	"gopkg.in/yaml.v3"
 )
 
 func TestBuildTmplBash(t *testing.T) {
@@ -139,3 +143,145 @@ func TestBuildTmplEnv(t *testing.T) {
 	}
 
 }
+
+// parseDockerEnvFile read an env-file following the rules of docker run --env-file, leading whitespace
+// is trimmed, blank lines and comments are skipped and the value is everything after the first =
+func parseDockerEnvFile(t *testing.T, content string) map[string]string {
+	env := map[string]string{}
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimLeftFunc(line, unicode.IsSpace)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		assert.True(t, ok, "line without a value: %q", line)
+		assert.Equal(t, -1, strings.IndexFunc(name, unicode.IsSpace), "variable with whitespace: %q", name)
+		env[name] = value
+	}
+	return env
+}
+
+func TestBuildTmplDockerEnv(t *testing.T) {
+
+	data := struct {
+		ProfileName string
+		*awsconfig.AWSCredentials
+	}{
+		"test_profile",
+		&awsconfig.AWSCredentials{
+			AWSSecretKey:     "secret/key+with=signs",
+			AWSAccessKey:     "access_key",
+			AWSSessionToken:  "session_token==",
+			AWSSecurityToken: "security_token==",
+			Expires:          time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		},
+	}
+
+	st, err := buildTmpl("docker-env", data)
+	assert.Nil(t, err)
+	assert.Equal(t, `AWS_ACCESS_KEY_ID=access_key
+AWS_SECRET_ACCESS_KEY=secret/key+with=signs
+AWS_SESSION_TOKEN=session_token==
+AWS_SECURITY_TOKEN=security_token==
+SAML2AWS_PROFILE=test_profile
+AWS_CREDENTIAL_EXPIRATION=2024-01-02T03:04:05Z
+`, st)
+
+	assert.Equal(t, map[string]string{
+		"AWS_ACCESS_KEY_ID":         "access_key",
+		"AWS_SECRET_ACCESS_KEY":     "secret/key+with=signs",
+		"AWS_SESSION_TOKEN":         "session_token==",
+		"AWS_SECURITY_TOKEN":        "security_token==",
+		"SAML2AWS_PROFILE":          "test_profile",
+		"AWS_CREDENTIAL_EXPIRATION": "2024-01-02T03:04:05Z",
+	}, parseDockerEnvFile(t, st))
+
+	data.ProfileName = "test\nprofile"
+	_, err = buildTmpl("docker-env", data)
+	assert.ErrorContains(t, err, "value contains a line break which can't be written to a docker env-file")
+
+	data.ProfileName = "test_profile "
+	_, err = buildTmpl("docker-env", data)
+	assert.ErrorContains(t, err, "value has surrounding whitespace which can't be written to a docker env-file")
+}
+
+func TestBuildTmplYAML(t *testing.T) {
+
+	data := struct {
+		ProfileName string
+		*awsconfig.AWSCredentials
+	}{
+		"test: profile",
+		&awsconfig.AWSCredentials{
+			AWSSecretKey:     "secret/key+with=signs\"and'quotes",
+			AWSAccessKey:     "0123456789",
+			AWSSessionToken:  "session_token==",
+			AWSSecurityToken: "security\ntoken",
+			Expires:          time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		},
+	}
+
+	st, err := buildTmpl("yaml", data)
+	assert.Nil(t, err)
+
+	var doc map[string]interface{}
+	assert.Nil(t, yaml.Unmarshal([]byte(st), &doc))
+	assert.Equal(t, map[string]interface{}{
+		"aws_access_key_id":     "0123456789",
+		"aws_secret_access_key": "secret/key+with=signs\"and'quotes",
+		"aws_session_token":     "session_token==",
+		"aws_security_token":    "security\ntoken",
+		"profile":               "test: profile",
+		"expiration":            "2024-01-02T03:04:05Z",
+	}, doc)
+}
+
+func TestBuildTmplSSOJSON(t *testing.T) {
+
+	data := struct {
+		ProfileName string
+		Region      string
+		StartURL    string
+		*awsconfig.AWSCredentials
+	}{
+		"test_profile",
+		"ap-southeast-2",
+		"https://id.example.com/sso?a=1&b=\"2\"",
+		&awsconfig.AWSCredentials{
+			AWSSecretKey:     "secret/key+with=signs\"and'quotes",
+			AWSAccessKey:     "access_key",
+			AWSSessionToken:  "session\\token==",
+			AWSSecurityToken: "security_token",
+			Expires:          time.Date(2024, 1, 2, 13, 4, 5, 0, time.FixedZone("AEDT", 11*60*60)),
+		},
+	}
+
+	st, err := buildTmpl("sso-json", data)
+	assert.Nil(t, err)
+
+	// the keys and types of the AWS SDK SSO token cache, with the role credentials alongside
+	var doc struct {
+		StartURL        string `json:"startUrl"`
+		Region          string `json:"region"`
+		AccessToken     string `json:"accessToken"`
+		ExpiresAt       string `json:"expiresAt"`
+		RoleCredentials struct {
+			AccessKeyID     string `json:"accessKeyId"`
+			SecretAccessKey string `json:"secretAccessKey"`
+			SessionToken    string `json:"sessionToken"`
+			Expiration      int64  `json:"expiration"`
+		} `json:"roleCredentials"`
+	}
+	dec := json.NewDecoder(strings.NewReader(st))
+	dec.DisallowUnknownFields()
+	assert.Nil(t, dec.Decode(&doc))
+
+	assert.Equal(t, "https://id.example.com/sso?a=1&b=\"2\"", doc.StartURL)
+	assert.Equal(t, "ap-southeast-2", doc.Region)
+	assert.Equal(t, "session\\token==", doc.AccessToken)
+	assert.Equal(t, "2024-01-02T02:04:05Z", doc.ExpiresAt)
+	assert.Equal(t, "access_key", doc.RoleCredentials.AccessKeyID)
+	assert.Equal(t, "secret/key+with=signs\"and'quotes", doc.RoleCredentials.SecretAccessKey)
+	assert.Equal(t, "session\\token==", doc.RoleCredentials.SessionToken)
+	assert.Equal(t, data.Expires.UnixMilli(), doc.RoleCredentials.Expiration)
+}
@@ -0,0 +1,89 @@
+package commands
+
+import (
+	"log"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/versent/saml2aws/v2/helper/credentials"
+	"github.com/versent/saml2aws/v2/pkg/flags"
+	"github.com/versent/saml2aws/v2/pkg/samlcache"
+)
+
+// Warm authenticate to the IdP, including MFA, without requesting AWS credentials. Okta and Azure AD save their
+// session in the keychain, so the logins which follow skip the password and MFA until it expires, and with the SAML
+// cache the assertion is kept too so they skip the IdP altogether until it expires
+func Warm(loginFlags *flags.LoginExecFlags) error {
+
+	logger := logrus.WithField("command", "warm")
+
+	account, err := buildIdpAccount(loginFlags)
+	if err != nil {
+		return errors.Wrap(err, "Error building login details.")
+	}
+
+	// Okta and Azure AD save their own session in the keychain, every other provider relies on the SAML cache
+	session := (account.Provider == "Okta" || account.Provider == "AzureAD") && !account.DisableSessions && !loginFlags.CommonFlags.DisableKeychain
+	if !account.SAMLCache && !session {
+		return errors.New("Nothing would be kept for the next login, enable the SAML cache with --cache-saml.")
+	}
+
+	cacheProvider := &samlcache.SAMLCacheProvider{
+		Account:  account.CacheName(),
+		Filename: account.SAMLCacheFile,
+	}
+
+	loginDetails, err := resolveLoginDetails(account, loginFlags)
+	if err != nil {
+		return err
+	}
+
+	logger.WithField("idpAccount", account).Debug("building provider")
+
+	provider, err := newSAMLClient(account)
+	if err != nil {
+		return errors.Wrap(err, "Error building IdP client.")
+	}
+
+	err = provider.Validate(loginDetails)
+	if err != nil {
+		return errors.Wrap(err, "Error validating login details.")
+	}
+
+	log.Printf("Authenticating as %s ...", loginDetails.DisplayUsername())
+
+	if err := runPreAuthCommand(account); err != nil {
+		return err
+	}
+	samlAssertion, err := provider.Authenticate(loginDetails)
+	if err != nil {
+		writeFailureReport(loginFlags.CommonFlags.FailureReport, account, loginDetails, err)
+		return errors.Wrap(err, "Error authenticating to IdP.")
+	}
+	if samlAssertion == "" {
+		return errors.New("Response did not contain a valid SAML assertion.")
+	}
+
+	if account.SAMLCache {
+		err = cacheProvider.WriteRaw(samlAssertion)
+		if err != nil {
+			return errors.Wrap(err, "Could not write SAML cache.")
+		}
+	}
+
+	if !loginFlags.CommonFlags.DisableKeychain {
+		err = credentials.SaveCredentials(loginDetails.URL, loginDetails.Username, loginDetails.Password)
+		if err != nil {
+			return errors.Wrap(err, "Error storing password in keychain.")
+		}
+	}
+
+	if session {
+		log.Println("The session is saved, logins will skip the password and MFA until it expires.")
+	}
+	if account.SAMLCache {
+		log.Println("The SAML assertion is cached, logins with the SAML cache will reuse it until it expires.")
+	}
+
+	return nil
+}
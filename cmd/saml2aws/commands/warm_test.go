@@ -0,0 +1,160 @@
+package commands
+
+import (
+	b64 "encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/versent/saml2aws/v2"
+	"github.com/versent/saml2aws/v2/helper/credentials"
+	"github.com/versent/saml2aws/v2/mocks"
+	"github.com/versent/saml2aws/v2/pkg/awsconfig"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
+	"github.com/versent/saml2aws/v2/pkg/flags"
+	"github.com/versent/saml2aws/v2/pkg/prompter"
+	"github.com/versent/saml2aws/v2/pkg/provider/aad/aadtest"
+	"github.com/versent/saml2aws/v2/pkg/samlcache"
+)
+
+func TestWarm(t *testing.T) {
+	// STS is reached through the proxy, which must not see a request
+	var requests int
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer proxy.Close()
+
+	data, err := os.ReadFile("../../../testdata/assertion_multi_account.xml")
+	assert.Nil(t, err)
+	samlAssertion := b64.StdEncoding.EncodeToString([]byte(strings.ReplaceAll(string(data), "2016-09-10T02:59:39.387Z", time.Now().Add(time.Hour).UTC().Format(time.RFC3339))))
+
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "saml2aws")
+	assert.Nil(t, os.WriteFile(configFile, []byte("[default]\nprovider = AzureAD\napp_id = app\nurl = https://login.example.com\nusername = user@example.com\nmfa = Auto\nprofile = saml\nrole_arn = arn:aws:iam::000000000001:role/Development\nprincipal_arn = arn:aws:iam::000000000001:saml-provider/ExampleADFS\naws_use_idp_transport = true\nproxy_url = "+proxy.URL+"\n"), 0600))
+	cacheFile := filepath.Join(dir, "cache")
+	credentialsFile := filepath.Join(dir, "credentials")
+
+	client := &fakeSAMLClient{samlAssertion: samlAssertion}
+	newSAMLClient = func(*cfg.IDPAccount) (saml2aws.SAMLClient, error) { return client, nil }
+	t.Cleanup(func() { newSAMLClient = saml2aws.NewSAMLClient })
+
+	commonFlags := &flags.CommonFlags{ConfigFile: configFile, CredentialsFile: credentialsFile, Password: "secret", SkipPrompt: true, DisableKeychain: true, SAMLCacheFile: cacheFile}
+
+	err = Warm(&flags.LoginExecFlags{CommonFlags: commonFlags})
+	assert.EqualError(t, err, "Nothing would be kept for the next login, enable the SAML cache with --cache-saml.")
+	assert.Equal(t, 0, client.authentications)
+
+	commonFlags.SAMLCache = true
+	assert.Nil(t, Warm(&flags.LoginExecFlags{CommonFlags: commonFlags}))
+	assert.Equal(t, 1, client.authentications)
+
+	// only the assertion is kept, no credentials are requested
+	cacheProvider := &samlcache.SAMLCacheProvider{Filename: cacheFile}
+	cached, err := cacheProvider.ReadRaw()
+	assert.Nil(t, err)
+	assert.Equal(t, samlAssertion, cached)
+
+	assert.Equal(t, 0, requests)
+	_, err = os.Stat(credentialsFile)
+	assert.True(t, os.IsNotExist(err))
+
+	// the login which follows assumes the role with the cached assertion without authenticating again
+	var stsAssertion string
+	loginToSts = func(account *cfg.IDPAccount, role *saml2aws.AWSRole, samlAssertion string) (*awsconfig.AWSCredentials, error) {
+		stsAssertion = samlAssertion
+		return &awsconfig.AWSCredentials{AWSAccessKey: "id", RoleARN: role.RoleARN, Expires: time.Now().Add(time.Hour)}, nil
+	}
+	t.Cleanup(func() { loginToSts = loginToStsUsingRole })
+
+	loginFlags := &flags.LoginExecFlags{CommonFlags: commonFlags}
+	account, err := buildIdpAccount(loginFlags)
+	assert.Nil(t, err)
+	_, err = loginToAws(account, loginFlags)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, client.authentications)
+	assert.Equal(t, samlAssertion, stsAssertion)
+}
+
+func TestWarmAzureADSession(t *testing.T) {
+	var mfaRequests int
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		render := func(name string, data aadtest.FixtureData) {
+			body, err := aadtest.Render(name, r.Host, data)
+			assert.Nil(t, err)
+			_, _ = w.Write(body)
+		}
+		switch r.URL.Path {
+		case "/applications/redirecttofederatedapplication.aspx":
+			if cookie, err := r.Cookie("ESTSAUTHPERSISTENT"); err == nil && cookie.Value == "persistent" {
+				render("SAMLResponse.html", aadtest.FixtureData{})
+				return
+			}
+			render("ConvergedSignIn.html", aadtest.FixtureData{UrlPost: "/defaultLogin", UrlGetCredentialType: "/getCredentialType"})
+		case "/getCredentialType":
+			render("GetCredentialType_default.json", aadtest.FixtureData{})
+		case "/defaultLogin":
+			render("ConvergedTFA.html", aadtest.FixtureData{UrlPost: "/processAuth", UrlBeginAuth: "/beginAuth", UrlEndAuth: "/endAuth"})
+		case "/beginAuth":
+			mfaRequests++
+			render("BeginAuth.json", aadtest.FixtureData{})
+		case "/endAuth":
+			render("EndAuth.json", aadtest.FixtureData{})
+		case "/processAuth":
+			http.SetCookie(w, &http.Cookie{Name: "ESTSAUTHPERSISTENT", Value: "persistent", Path: "/", Secure: true, HttpOnly: true})
+			render("SAMLResponse.html", aadtest.FixtureData{})
+		default:
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		}
+	}))
+	defer ts.Close()
+
+	helper := &memoryHelper{secrets: map[string]string{}}
+	currentHelper := credentials.CurrentHelper
+	credentials.CurrentHelper = helper
+	t.Cleanup(func() { credentials.CurrentHelper = currentHelper })
+
+	currentPrompter := prompter.ActivePrompter
+	pr := &mocks.Prompter{}
+	prompter.SetPrompter(pr)
+	t.Cleanup(func() { prompter.SetPrompter(currentPrompter) })
+	pr.Mock.On("StringRequired", "Enter verification code").Return("000000").Once()
+
+	var stsCalls int
+	loginToSts = func(account *cfg.IDPAccount, role *saml2aws.AWSRole, samlAssertion string) (*awsconfig.AWSCredentials, error) {
+		stsCalls++
+		return nil, errors.New("unexpected STS call")
+	}
+	t.Cleanup(func() { loginToSts = loginToStsUsingRole })
+
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "saml2aws")
+	assert.Nil(t, os.WriteFile(configFile, []byte("[default]\nprovider = AzureAD\napp_id = app\nurl = "+ts.URL+"\nusername = user@example.com\nmfa = Auto\nskip_verify = true\nprofile = saml\n"), 0600))
+	credentialsFile := filepath.Join(dir, "credentials")
+
+	commonFlags := &flags.CommonFlags{ConfigFile: configFile, CredentialsFile: credentialsFile, Password: "secret", SkipPrompt: true}
+
+	// the first run does the MFA and keeps the session, without the SAML cache
+	assert.Nil(t, Warm(&flags.LoginExecFlags{CommonFlags: commonFlags}))
+	assert.Equal(t, 1, mfaRequests)
+
+	account, err := buildIdpAccount(&flags.LoginExecFlags{CommonFlags: commonFlags})
+	assert.Nil(t, err)
+	assert.Contains(t, helper.secrets[credentials.SessionCookieURL(ts.URL, account.ConfigScope())], "ESTSAUTHPERSISTENT")
+
+	// the second reuses the session, neither asks for MFA again nor calls STS
+	assert.Nil(t, Warm(&flags.LoginExecFlags{CommonFlags: commonFlags}))
+	assert.Equal(t, 1, mfaRequests)
+	assert.Equal(t, 0, stsCalls)
+	pr.Mock.AssertExpectations(t)
+
+	_, err = os.Stat(credentialsFile)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -11,7 +11,9 @@ import (
 	"github.com/alecthomas/kingpin"
 	"github.com/sirupsen/logrus"
 	"github.com/versent/saml2aws/v2/cmd/saml2aws/commands"
+	"github.com/versent/saml2aws/v2/helper/credentials"
 	"github.com/versent/saml2aws/v2/pkg/flags"
+	samlprovider "github.com/versent/saml2aws/v2/pkg/provider"
 )
 
 var (
@@ -68,20 +70,28 @@ func main() {
 	// Common (to all commands) settings
 	commonFlags := new(flags.CommonFlags)
 	app.Flag("config", "Path/filename of saml2aws config file (env: SAML2AWS_CONFIGFILE)").Envar("SAML2AWS_CONFIGFILE").StringVar(&commonFlags.ConfigFile)
-	app.Flag("idp-account", "The name of the configured IDP account. (env: SAML2AWS_IDP_ACCOUNT)").Envar("SAML2AWS_IDP_ACCOUNT").Short('a').Default("default").StringVar(&commonFlags.IdpAccount)
+	app.Flag("idp-account", "The name of the configured IDP account, prompts when several are configured and none is named default. (env: SAML2AWS_IDP_ACCOUNT)").Envar("SAML2AWS_IDP_ACCOUNT").Short('a').StringVar(&commonFlags.IdpAccount)
 	app.Flag("idp-provider", "The configured IDP provider. (env: SAML2AWS_IDP_PROVIDER)").Envar("SAML2AWS_IDP_PROVIDER").EnumVar(&commonFlags.IdpProvider, "Akamai", "AzureAD", "ADFS", "ADFS2", "Browser", "GoogleApps", "Ping", "JumpCloud", "Okta", "OneLogin", "PSU", "KeyCloak", "F5APM", "Shibboleth", "ShibbolethECP", "NetIQ", "Auth0")
 	app.Flag("mfa", "The name of the mfa. (env: SAML2AWS_MFA)").Envar("SAML2AWS_MFA").StringVar(&commonFlags.MFA)
 	app.Flag("skip-verify", "Skip verification of server certificate. (env: SAML2AWS_SKIP_VERIFY)").Envar("SAML2AWS_SKIP_VERIFY").Short('s').BoolVar(&commonFlags.SkipVerify)
+	app.Flag("require-insecure-confirmation", "Only skip verification of the server certificate when I_UNDERSTAND_INSECURE=true is set. (env: SAML2AWS_REQUIRE_INSECURE_CONFIRMATION)").Envar("SAML2AWS_REQUIRE_INSECURE_CONFIRMATION").BoolVar(&commonFlags.RequireInsecureConfirm)
 	app.Flag("url", "The URL of the SAML IDP server used to login. (env: SAML2AWS_URL)").Envar("SAML2AWS_URL").StringVar(&commonFlags.URL)
 	app.Flag("username", "The username used to login. (env: SAML2AWS_USERNAME)").Envar("SAML2AWS_USERNAME").StringVar(&commonFlags.Username)
 	app.Flag("password", "The password used to login. (env: SAML2AWS_PASSWORD)").Envar("SAML2AWS_PASSWORD").StringVar(&commonFlags.Password)
 	app.Flag("mfa-token", "The current MFA token (supported in Keycloak, ADFS, GoogleApps). (env: SAML2AWS_MFA_TOKEN)").Envar("SAML2AWS_MFA_TOKEN").StringVar(&commonFlags.MFAToken)
-	app.Flag("role", "The ARN of the role to assume. (env: SAML2AWS_ROLE)").Envar("SAML2AWS_ROLE").StringVar(&commonFlags.RoleArn)
+	app.Flag("mfa-totp-secret", "The base32 secret used to generate authenticator app codes (supported in AzureAD). (env: SAML2AWS_MFA_TOTP_SECRET)").Envar("SAML2AWS_MFA_TOTP_SECRET").StringVar(&commonFlags.MFATOTPSecret)
+	app.Flag("mfa-retries", "The number of times to start MFA over after a transient failure such as an unanswered push (supported in AzureAD). (env: SAML2AWS_MFA_RETRIES)").Envar("SAML2AWS_MFA_RETRIES").IntVar(&commonFlags.MFARetries)
+	app.Flag("password-retries", "The number of times to ask for the password again after a wrong one (supported in AzureAD). (env: SAML2AWS_PASSWORD_RETRIES)").Envar("SAML2AWS_PASSWORD_RETRIES").IntVar(&commonFlags.PasswordRetries)
+	app.Flag("verbose-mfa", "Print the MFA methods offered by the IdP, to help pick the mfa to configure (supported in AzureAD). (env: SAML2AWS_VERBOSE_MFA)").Envar("SAML2AWS_VERBOSE_MFA").BoolVar(&commonFlags.MFAVerbose)
+	app.Flag("role", "The ARN of the role to assume, or a unique part of it such as the role name or account ID. (env: SAML2AWS_ROLE)").Envar("SAML2AWS_ROLE").StringVar(&commonFlags.RoleArn)
+	app.Flag("principal", "The ARN of the SAML provider to assume the role with, picks among the roles of several providers. (env: SAML2AWS_PRINCIPAL)").Envar("SAML2AWS_PRINCIPAL").StringVar(&commonFlags.PrincipalArn)
 	app.Flag("aws-urn", "The URN used by SAML when you login. (env: SAML2AWS_AWS_URN)").Envar("SAML2AWS_AWS_URN").StringVar(&commonFlags.AmazonWebservicesURN)
 	app.Flag("skip-prompt", "Skip prompting for parameters during login.").BoolVar(&commonFlags.SkipPrompt)
-	app.Flag("session-duration", "The duration of your AWS Session. (env: SAML2AWS_SESSION_DURATION)").Envar("SAML2AWS_SESSION_DURATION").IntVar(&commonFlags.SessionDuration)
+	app.Flag("session-duration", "The duration of your AWS Session in seconds, between 900 and 43200 and clamped to the role's maximum. (env: SAML2AWS_SESSION_DURATION)").Envar("SAML2AWS_SESSION_DURATION").IntVar(&commonFlags.SessionDuration)
+	app.Flag("no-session", "Request the longest session the role and the SAML assertion allow, instead of --session-duration. (env: SAML2AWS_NO_SESSION)").Envar("SAML2AWS_NO_SESSION").BoolVar(&commonFlags.NoSession)
 	app.Flag("disable-keychain", "Do not use keychain at all. This will also disable Okta sessions & remembering MFA device. (env: SAML2AWS_DISABLE_KEYCHAIN)").Envar("SAML2AWS_DISABLE_KEYCHAIN").BoolVar(&commonFlags.DisableKeychain)
 	app.Flag("region", "AWS region to use for API requests, e.g. us-east-1, us-gov-west-1, cn-north-1 (env: SAML2AWS_REGION)").Envar("SAML2AWS_REGION").Short('r').StringVar(&commonFlags.Region)
+	app.Flag("failure-report", "Write a JSON report of a failed authentication to the file, - for stderr. (env: SAML2AWS_FAILURE_REPORT)").Envar("SAML2AWS_FAILURE_REPORT").StringVar(&commonFlags.FailureReport)
 	app.Flag("prompter", "The prompter to use for user input (default, pinentry)").StringVar(&commonFlags.Prompter)
 
 	// `configure` command and settings
@@ -96,8 +106,9 @@ func main() {
 	cmdConfigure.Flag("credentials-file", "The file that will cache the credentials retrieved from AWS. When not specified, will use the default AWS credentials file location. (env: SAML2AWS_CREDENTIALS_FILE)").Envar("SAML2AWS_CREDENTIALS_FILE").StringVar(&commonFlags.CredentialsFile)
 	cmdConfigure.Flag("cache-saml", "Caches the SAML response (env: SAML2AWS_CACHE_SAML)").Envar("SAML2AWS_CACHE_SAML").BoolVar(&commonFlags.SAMLCache)
 	cmdConfigure.Flag("cache-file", "The location of the SAML cache file (env: SAML2AWS_SAML_CACHE_FILE)").Envar("SAML2AWS_SAML_CACHE_FILE").StringVar(&commonFlags.SAMLCacheFile)
-	cmdConfigure.Flag("disable-sessions", "Do not use Okta sessions. Uses Okta sessions by default. (env: SAML2AWS_OKTA_DISABLE_SESSIONS)").Envar("SAML2AWS_OKTA_DISABLE_SESSIONS").BoolVar(&commonFlags.DisableSessions)
+	cmdConfigure.Flag("disable-sessions", "Do not use Okta or AzureAD sessions. Uses sessions by default. (env: SAML2AWS_OKTA_DISABLE_SESSIONS)").Envar("SAML2AWS_OKTA_DISABLE_SESSIONS").BoolVar(&commonFlags.DisableSessions)
 	cmdConfigure.Flag("disable-remember-device", "Do not remember Okta MFA device. Remembers MFA device by default. (env: SAML2AWS_OKTA_DISABLE_REMEMBER_DEVICE)").Envar("SAML2AWS_OKTA_DISABLE_REMEMBER_DEVICE").BoolVar(&commonFlags.DisableRememberDevice)
+	cmdConfigure.Flag("select-mfa", "Sign in to list the MFA methods offered and choose the default one, AzureAD only. (env: SAML2AWS_SELECT_MFA)").Envar("SAML2AWS_SELECT_MFA").BoolVar(&commonFlags.SelectMFA)
 	configFlags := commonFlags
 
 	// `login` command and settings
@@ -111,13 +122,32 @@ func main() {
 	cmdLogin.Flag("mfa-ip-address", "IP address whitelisting defined in OneLogin MFA policies. (env: ONELOGIN_MFA_IP_ADDRESS)").Envar("ONELOGIN_MFA_IP_ADDRESS").StringVar(&commonFlags.MFAIPAddress)
 	cmdLogin.Flag("force", "Refresh credentials even if not expired.").BoolVar(&loginFlags.Force)
 	cmdLogin.Flag("credential-process", "Enables AWS Credential Process support by outputting credentials to STDOUT in a JSON message.").BoolVar(&loginFlags.CredentialProcess)
+	cmdLogin.Flag("print-creds-process-for-config", "Print the credential_process line to add to the profile in ~/.aws/config for the account, role and profile, instead of logging in.").BoolVar(&loginFlags.PrintCredsProcess)
+	cmdLogin.Flag("print-role-arn", "Print the ARN of the role the credentials are for, to STDERR when used with --credential-process, --eval or --creds-tmpfile.").BoolVar(&loginFlags.PrintRoleARN)
+	cmdLogin.Flag("print-expiry", "Print when the credentials expire, to STDERR when used with --credential-process, --eval or --creds-tmpfile.").BoolVar(&loginFlags.PrintExpiry)
+	cmdLogin.Flag("expiry-format", "The format used by --print-expiry. Options include: rfc3339, epoch, human").Default("rfc3339").EnumVar(&loginFlags.ExpiryFormat, "rfc3339", "epoch", "human")
+	cmdLogin.Flag("eval", "Print only the export lines for the credentials to STDOUT, for eval \"$(saml2aws login --eval)\", prompts and messages go to STDERR.").BoolVar(&loginFlags.Eval)
+	cmdLogin.Flag("creds-tmpfile", "Write the export lines for the credentials to a new file under $XDG_RUNTIME_DIR, or /dev/shm, and print its path, for source \"$(saml2aws login --creds-tmpfile)\".").BoolVar(&loginFlags.CredsTmpfile)
+	cmdLogin.Flag("creds-tmpfile-ttl", "Remove the file written by --creds-tmpfile after this long, e.g. 15m. Defaults to when the credentials expire.").DurationVar(&loginFlags.CredsTmpfileTTL)
+	cmdLogin.Flag("show-progress", "Show a spinner with the step the login has reached on STDERR, e.g. while waiting on MFA. Only shown when STDERR is a terminal and not with --quiet. (env: SAML2AWS_SHOW_PROGRESS)").Envar("SAML2AWS_SHOW_PROGRESS").BoolVar(&loginFlags.ShowProgress)
+	cmdLogin.Flag("cli-cache", "Also write the credentials to the AWS CLI cache in ~/.aws/cli/cache, keyed on the role ARN. (env: SAML2AWS_CLI_CACHE)").Envar("SAML2AWS_CLI_CACHE").BoolVar(&loginFlags.CLICache)
+	cmdLogin.Flag("credential-socket", "Serve the credentials in the credential_process JSON format on a Unix domain socket at this path until they expire. (env: SAML2AWS_CREDENTIAL_SOCKET)").Envar("SAML2AWS_CREDENTIAL_SOCKET").StringVar(&loginFlags.CredentialSocket)
+	cmdLogin.Flag("overwrite-region", "Replace the region already set in the profile with the configured region.").BoolVar(&loginFlags.OverwriteRegion)
 	cmdLogin.Flag("credentials-file", "The file that will cache the credentials retrieved from AWS. When not specified, will use the default AWS credentials file location. (env: SAML2AWS_CREDENTIALS_FILE)").Envar("SAML2AWS_CREDENTIALS_FILE").StringVar(&commonFlags.CredentialsFile)
 	cmdLogin.Flag("cache-saml", "Caches the SAML response (env: SAML2AWS_CACHE_SAML)").Envar("SAML2AWS_CACHE_SAML").BoolVar(&commonFlags.SAMLCache)
 	cmdLogin.Flag("cache-file", "The location of the SAML cache file (env: SAML2AWS_SAML_CACHE_FILE)").Envar("SAML2AWS_SAML_CACHE_FILE").StringVar(&commonFlags.SAMLCacheFile)
 	cmdLogin.Flag("download-browser-driver", "Automatically download browsers for Browser IDP. (env: SAML2AWS_AUTO_BROWSER_DOWNLOAD)").Envar("SAML2AWS_AUTO_BROWSER_DOWNLOAD").BoolVar(&loginFlags.DownloadBrowser)
-	cmdLogin.Flag("disable-sessions", "Do not use Okta sessions. Uses Okta sessions by default. (env: SAML2AWS_OKTA_DISABLE_SESSIONS)").Envar("SAML2AWS_OKTA_DISABLE_SESSIONS").BoolVar(&commonFlags.DisableSessions)
+	cmdLogin.Flag("disable-sessions", "Do not use Okta or AzureAD sessions. Uses sessions by default. (env: SAML2AWS_OKTA_DISABLE_SESSIONS)").Envar("SAML2AWS_OKTA_DISABLE_SESSIONS").BoolVar(&commonFlags.DisableSessions)
 	cmdLogin.Flag("disable-remember-device", "Do not remember Okta MFA device. Remembers MFA device by default. (env: SAML2AWS_OKTA_DISABLE_REMEMBER_DEVICE)").Envar("SAML2AWS_OKTA_DISABLE_REMEMBER_DEVICE").BoolVar(&commonFlags.DisableRememberDevice)
 
+	// `warm` command and settings
+	cmdWarm := app.Command("warm", "Login to the IDP, including MFA, and cache the SAML assertion for later logins without requesting AWS credentials.")
+	warmFlags := new(flags.LoginExecFlags)
+	warmFlags.CommonFlags = commonFlags
+	cmdWarm.Flag("cache-saml", "Caches the SAML response (env: SAML2AWS_CACHE_SAML)").Envar("SAML2AWS_CACHE_SAML").BoolVar(&commonFlags.SAMLCache)
+	cmdWarm.Flag("cache-file", "The location of the SAML cache file (env: SAML2AWS_SAML_CACHE_FILE)").Envar("SAML2AWS_SAML_CACHE_FILE").StringVar(&commonFlags.SAMLCacheFile)
+	cmdWarm.Flag("disable-sessions", "Do not use Okta or AzureAD sessions. Uses sessions by default. (env: SAML2AWS_OKTA_DISABLE_SESSIONS)").Envar("SAML2AWS_OKTA_DISABLE_SESSIONS").BoolVar(&commonFlags.DisableSessions)
+
 	// `exec` command and settings
 	cmdExec := app.Command("exec", "Exec the supplied command with env vars from STS token.")
 	execFlags := new(flags.LoginExecFlags)
@@ -153,9 +183,29 @@ func main() {
 	cmdScript.Flag("credentials-file", "The file that will cache the credentials retrieved from AWS. When not specified, will use the default AWS credentials file location. (env: SAML2AWS_CREDENTIALS_FILE)").Envar("SAML2AWS_CREDENTIALS_FILE").StringVar(&commonFlags.CredentialsFile)
 	var shell string
 	cmdScript.
-		Flag("shell", "Type of shell environment. Options include: bash, /bin/sh, powershell, fish, env").
+		Flag("shell", "Type of shell environment. Options include: bash, /bin/sh, powershell, fish, env, docker-env, yaml, sso-json").
 		Default("bash").
-		EnumVar(&shell, "bash", "/bin/sh", "powershell", "fish", "env")
+		EnumVar(&shell, "bash", "/bin/sh", "powershell", "fish", "env", "docker-env", "yaml", "sso-json")
+
+	// `inspect` command and settings
+	cmdInspect := app.Command("inspect", "Decode a base64 encoded SAML response and print a summary of the assertion.")
+	var inspectFile string
+	cmdInspect.Flag("file", "Read the SAML response from a file instead of STDIN.").StringVar(&inspectFile)
+
+	// `logout` command and settings
+	cmdLogout := app.Command("logout", "Remove the cached credentials and sessions of an IDP account.").Alias("clear")
+	logoutFlags := new(flags.LogoutFlags)
+	logoutFlags.CommonFlags = commonFlags
+	cmdLogout.Flag("profile", "The AWS profile holding the temporary credentials. (env: SAML2AWS_PROFILE)").Envar("SAML2AWS_PROFILE").Short('p').StringVar(&commonFlags.Profile)
+	cmdLogout.Flag("credentials-file", "The file that caches the credentials retrieved from AWS. When not specified, will use the default AWS credentials file location. (env: SAML2AWS_CREDENTIALS_FILE)").Envar("SAML2AWS_CREDENTIALS_FILE").StringVar(&commonFlags.CredentialsFile)
+	cmdLogout.Flag("cache-file", "The location of the SAML cache file (env: SAML2AWS_SAML_CACHE_FILE)").Envar("SAML2AWS_SAML_CACHE_FILE").StringVar(&commonFlags.SAMLCacheFile)
+	cmdLogout.Flag("all", "Also remove the stored password.").BoolVar(&logoutFlags.All)
+	cmdLogout.Flag("all-accounts", "Clear every configured IDP account.").BoolVar(&logoutFlags.AllAccounts)
+
+	// `keyring-test` command and settings
+	cmdKeyringTest := app.Command("keyring-test", "Store, read back and remove a dummy secret to check the keyring works.")
+	var keyringBackend string
+	cmdKeyringTest.Flag("backend", "The keyring backend to test instead of the configured one (Linux only). Options include: kwallet, secret-service, pass").EnumVar(&keyringBackend, "kwallet", "secret-service", "pass")
 
 	// Trigger the parsing of the command line inputs via kingpin
 	command := kingpin.MustParse(app.Parse(os.Args[1:]))
@@ -175,6 +225,17 @@ func main() {
 	if *quiet {
 		log.SetOutput(io.Discard)
 		logrus.SetOutput(io.Discard)
+		loginFlags.ShowProgress = false
+	}
+
+	// make sure nothing touches the keychain, including providers which store sessions
+	if commonFlags.DisableKeychain {
+		credentials.DisableStorage()
+	}
+
+	if err := samlprovider.CheckSkipVerify(commonFlags.SkipVerify, commonFlags.RequireInsecureConfirm); err != nil {
+		log.Printf(errtpl, err)
+		os.Exit(1)
 	}
 
 	// Set the default transport settings so all http clients will pick them up.
@@ -189,6 +250,8 @@ func main() {
 		err = commands.Script(scriptFlags, shell)
 	case cmdLogin.FullCommand():
 		err = commands.Login(loginFlags)
+	case cmdWarm.FullCommand():
+		err = commands.Warm(warmFlags)
 	case cmdExec.FullCommand():
 		err = commands.Exec(execFlags, *cmdLine)
 	case cmdConsole.FullCommand():
@@ -197,6 +260,12 @@ func main() {
 		err = commands.ListRoles(listRolesFlags)
 	case cmdConfigure.FullCommand():
 		err = commands.Configure(configFlags)
+	case cmdInspect.FullCommand():
+		err = commands.Inspect(inspectFile)
+	case cmdLogout.FullCommand():
+		err = commands.Logout(logoutFlags)
+	case cmdKeyringTest.FullCommand():
+		err = commands.KeyringTest(keyringBackend)
 	}
 
 	if err != nil {
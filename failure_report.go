@@ -0,0 +1,72 @@
+package saml2aws
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/versent/saml2aws/v2/pkg/creds"
+	"github.com/versent/saml2aws/v2/pkg/provider/aad"
+)
+
+// FailureReport a machine readable account of a failed authentication, to attach to bug reports or feed
+// automated triage, it holds neither the password nor the username
+type FailureReport struct {
+	Time           time.Time `json:"time"`
+	Provider       string    `json:"provider"`
+	Classification string    `json:"classification"`
+	Error          string    `json:"error"`
+	Pgid           string    `json:"pgid,omitempty"`
+	ErrorCode      string    `json:"error_code,omitempty"`
+	CorrelationID  string    `json:"correlation_id,omitempty"`
+	SessionID      string    `json:"session_id,omitempty"`
+	HTTPStatus     int       `json:"http_status,omitempty"`
+	URL            string    `json:"url,omitempty"`
+}
+
+// NewFailureReport build the report of the authentication error, the classification is the reason the failure
+// is counted under in the metrics
+func NewFailureReport(provider string, err error, loginDetails *creds.LoginDetails) *FailureReport {
+	report := &FailureReport{
+		Time:           time.Now().UTC(),
+		Provider:       provider,
+		Classification: failureReason(err),
+		Error:          scrubError(err, loginDetails),
+	}
+
+	var pageErr *aad.UnknownPageError
+	if errors.As(err, &pageErr) {
+		report.Pgid = pageErr.Pgid
+		report.ErrorCode = pageErr.ErrorCode
+		report.CorrelationID = pageErr.CorrelationID
+		report.SessionID = pageErr.SessionID
+		report.HTTPStatus = pageErr.StatusCode
+		report.URL = pageErr.URL
+	}
+
+	return report
+}
+
+// Write the report as indented JSON
+func (r *FailureReport) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// scrubError the error message with the credentials masked, in case a provider included them
+func scrubError(err error, loginDetails *creds.LoginDetails) string {
+	msg := err.Error()
+	if loginDetails == nil {
+		return msg
+	}
+	if loginDetails.Password != "" {
+		msg = strings.ReplaceAll(msg, loginDetails.Password, "********")
+	}
+	if loginDetails.Username != "" {
+		msg = strings.ReplaceAll(msg, loginDetails.Username, creds.MaskUsername(loginDetails.Username))
+	}
+	return msg
+}
@@ -0,0 +1,49 @@
+package saml2aws
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/versent/saml2aws/v2/pkg/creds"
+	"github.com/versent/saml2aws/v2/pkg/provider/aad"
+)
+
+func TestNewFailureReport(t *testing.T) {
+	loginDetails := &creds.LoginDetails{Username: "user@example.com", Password: "secret"}
+	pageErr := &aad.UnknownPageError{
+		Pgid:          "ConvergedUnknown",
+		ErrorCode:     "50000",
+		CorrelationID: "correlation",
+		SessionID:     "session",
+		StatusCode:    200,
+		URL:           "https://login.microsoftonline.com/common/login",
+	}
+
+	report := NewFailureReport("AzureAD", errors.Wrap(pageErr, "signing in as user@example.com"), loginDetails)
+	require.Equal(t, "AzureAD", report.Provider)
+	require.Equal(t, "unknown_page", report.Classification)
+	require.Equal(t, "signing in as u***@example.com: failed get SAMLAssertion, stopped at page ConvergedUnknown", report.Error)
+	require.Equal(t, "ConvergedUnknown", report.Pgid)
+	require.Equal(t, "50000", report.ErrorCode)
+	require.Equal(t, "correlation", report.CorrelationID)
+	require.Equal(t, "session", report.SessionID)
+	require.Equal(t, 200, report.HTTPStatus)
+	require.Equal(t, "https://login.microsoftonline.com/common/login", report.URL)
+
+	var buf bytes.Buffer
+	require.Nil(t, report.Write(&buf))
+	var fields map[string]interface{}
+	require.Nil(t, json.Unmarshal(buf.Bytes(), &fields))
+	require.Equal(t, "ConvergedUnknown", fields["pgid"])
+	require.Equal(t, "correlation", fields["correlation_id"])
+	require.Equal(t, float64(200), fields["http_status"])
+	require.NotContains(t, buf.String(), "user@example.com")
+
+	report = NewFailureReport("AzureAD", errors.New("wrong password secret"), loginDetails)
+	require.Equal(t, "error", report.Classification)
+	require.Equal(t, "wrong password ********", report.Error)
+	require.Empty(t, report.Pgid)
+}
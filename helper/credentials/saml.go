@@ -19,12 +19,20 @@ func LookupCredentials(loginDetails *creds.LoginDetails, provider string) error
 
 	// If the provider is Okta, check for existing Okta Session Cookie (sid)
 	if provider == "Okta" {
-		_, oktaSessionCookie, err := CurrentHelper.Get(loginDetails.URL + "/sessionCookie")
+		_, oktaSessionCookie, err := CurrentHelper.Get(SessionCookieURL(loginDetails.URL, loginDetails.ConfigScope))
 		if err == nil {
 			loginDetails.OktaSessionCookie = oktaSessionCookie
 		}
 	}
 
+	// Azure AD keeps its session cookies under the same key
+	if provider == "AzureAD" {
+		_, aadSessionCookies, err := CurrentHelper.Get(SessionCookieURL(loginDetails.URL, loginDetails.ConfigScope))
+		if err == nil {
+			loginDetails.AADSessionCookies = aadSessionCookies
+		}
+	}
+
 	if provider == "OneLogin" {
 		id, secret, err := CurrentHelper.Get(path.Join(loginDetails.URL, "/auth/oauth2/v2/token"))
 		if err != nil {
@@ -36,6 +44,15 @@ func LookupCredentials(loginDetails *creds.LoginDetails, provider string) error
 	return nil
 }
 
+// SessionCookieURL the key the Okta session cookie, or the Azure AD session cookies, of the IdP are stored under, scoped to the config file the account
+// was loaded from when it isn't the default one.
+func SessionCookieURL(url, configScope string) string {
+	if configScope == "" {
+		return url + "/sessionCookie"
+	}
+	return url + "/sessionCookie/" + configScope
+}
+
 // SaveCredentials save the user credentials.
 func SaveCredentials(url, username, password string) error {
 
@@ -48,6 +65,21 @@ func SaveCredentials(url, username, password string) error {
 	return CurrentHelper.Add(creds)
 }
 
+// DeleteCredentials remove the credentials stored for the url, it is not an error if there are none.
+func DeleteCredentials(url string) error {
+	err := CurrentHelper.Delete(url)
+	if err != nil && !IsErrCredentialsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// DisableStorage replace the current helper with one which never reads from or
+// writes to the native credentials store.
+func DisableStorage() {
+	CurrentHelper = &defaultHelper{}
+}
+
 // SupportsStorage will return true or false if storage is supported.
 func SupportsStorage() bool {
 	return CurrentHelper.SupportsCredentialStorage()
@@ -3,7 +3,6 @@ package saml2aws
 import (
 	"fmt"
 	"log"
-	"sort"
 
 	"github.com/pkg/errors"
 	"github.com/versent/saml2aws/v2/pkg/cfg"
@@ -40,7 +39,7 @@ func PromptForConfigurationDetails(idpAccount *cfg.IDPAccount) error {
 	idpAccount.Profile = prompter.String("AWS Profile", idpAccount.Profile)
 
 	idpAccount.URL = prompter.String("URL", idpAccount.URL)
-	idpAccount.Username = prompter.String("Username", idpAccount.Username)
+	idpAccount.Username = promptForUsername(idpAccount.Username, idpAccount.MaskUsername)
 
 	switch idpAccount.Provider {
 	case "OneLogin":
@@ -63,7 +62,7 @@ func PromptForLoginDetails(loginDetails *creds.LoginDetails, provider string) er
 
 	log.Println("To use saved password just hit enter.")
 
-	loginDetails.Username = prompter.String("Username", loginDetails.Username)
+	loginDetails.Username = promptForUsername(loginDetails.Username, loginDetails.MaskUsername)
 
 	if enteredPassword := prompter.Password("Password"); enteredPassword != "" {
 		loginDetails.Password = enteredPassword
@@ -87,7 +86,23 @@ func PromptForLoginDetails(loginDetails *creds.LoginDetails, provider string) er
 	return nil
 }
 
-// PromptForAWSRoleSelection present a list of roles to the user for selection
+// promptForUsername prompt for the username with the current one as the default, when masked the default is
+// shown masked and kept unless something else is entered
+func promptForUsername(username string, mask bool) string {
+	if !mask || username == "" {
+		return prompter.String("Username", username)
+	}
+
+	masked := creds.MaskUsername(username)
+	if entered := prompter.String("Username", masked); entered != masked {
+		return entered
+	}
+	return username
+}
+
+// PromptForAWSRoleSelection present a list of roles to the user for selection, the roles are listed in
+// sections per account in the order the accounts are given, see GroupAWSRolesByAccount. A long list can
+// be searched by account alias or role name
 func PromptForAWSRoleSelection(accounts []*AWSAccount) (*AWSRole, error) {
 
 	roles := map[string]*AWSRole{}
@@ -101,9 +116,7 @@ func PromptForAWSRoleSelection(accounts []*AWSAccount) (*AWSRole, error) {
 		}
 	}
 
-	sort.Strings(roleOptions)
-
-	selectedRole, err := prompter.ChooseWithDefault("Please choose the role", roleOptions[0], roleOptions)
+	selectedRole, err := prompter.ChooseWithSearch("Please choose the role", roleOptions)
 	if err != nil {
 		return nil, errors.Wrap(err, "Role selection failed")
 	}
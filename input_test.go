@@ -0,0 +1,23 @@
+package saml2aws
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/versent/saml2aws/v2/mocks"
+	"github.com/versent/saml2aws/v2/pkg/prompter"
+)
+
+func TestPromptForUsernameMasked(t *testing.T) {
+	pr := &mocks.Prompter{}
+	prompter.SetPrompter(pr)
+	pr.Mock.On("String", "Username", "e***@exampledomain.com").Return("e***@exampledomain.com").Once()
+	pr.Mock.On("String", "Username", "e***@exampledomain.com").Return("other@exampledomain.com").Once()
+	pr.Mock.On("String", "Username", "exampleuser@exampledomain.com").Return("exampleuser@exampledomain.com").Once()
+
+	// keeping the masked default keeps the username
+	assert.Equal(t, "exampleuser@exampledomain.com", promptForUsername("exampleuser@exampledomain.com", true))
+	assert.Equal(t, "other@exampledomain.com", promptForUsername("exampleuser@exampledomain.com", true))
+	assert.Equal(t, "exampleuser@exampledomain.com", promptForUsername("exampleuser@exampledomain.com", false))
+	pr.Mock.AssertExpectations(t)
+}
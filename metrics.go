@@ -0,0 +1,59 @@
+package saml2aws
+
+import (
+	"errors"
+
+	"github.com/versent/saml2aws/v2/pkg/creds"
+	"github.com/versent/saml2aws/v2/pkg/metrics"
+	"github.com/versent/saml2aws/v2/pkg/provider/aad"
+)
+
+// failureReasons the reasons known errors are counted under, any other error is counted as "error"
+var failureReasons = []struct {
+	err    error
+	reason string
+}{
+	{aad.ErrMfaDenied, "mfa_denied"},
+	{aad.ErrPasswordChangeRequired, "password_change_required"},
+	{aad.ErrMfaRegistrationRequired, "mfa_registration_required"},
+	{aad.ErrClaimsChallenge, "claims_challenge"},
+	{aad.ErrSignInLocked, "locked_out"},
+	{aad.ErrUnknownPage, "unknown_page"},
+}
+
+// instrumentedClient record the authentication attempts and their outcome with the metrics recorder
+type instrumentedClient struct {
+	SAMLClient
+	provider string
+}
+
+func (c *instrumentedClient) Authenticate(loginDetails *creds.LoginDetails) (string, error) {
+	metrics.AuthAttempt(c.provider)
+
+	samlAssertion, err := c.SAMLClient.Authenticate(loginDetails)
+	switch {
+	case err != nil:
+		metrics.AuthFailure(c.provider, failureReason(err))
+	case samlAssertion == "":
+		metrics.AuthFailure(c.provider, "no_assertion")
+	default:
+		metrics.AuthSuccess(c.provider)
+	}
+
+	return samlAssertion, err
+}
+
+// MFAPerformed pass through to the wrapped client, false when it can't tell
+func (c *instrumentedClient) MFAPerformed() bool {
+	reporter, ok := c.SAMLClient.(MFAReporter)
+	return ok && reporter.MFAPerformed()
+}
+
+func failureReason(err error) string {
+	for _, known := range failureReasons {
+		if errors.Is(err, known.err) {
+			return known.reason
+		}
+	}
+	return "error"
+}
@@ -0,0 +1,69 @@
+package saml2aws
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
+	"github.com/versent/saml2aws/v2/pkg/creds"
+	"github.com/versent/saml2aws/v2/pkg/metrics"
+	"github.com/versent/saml2aws/v2/pkg/provider/aad"
+)
+
+func TestInstrumentedClient(t *testing.T) {
+	defer func() {
+		delete(providers, "Custom")
+		delete(MFAsByProvider, "Custom")
+	}()
+
+	var result string
+	var resultErr error
+	RegisterProvider("Custom", nil, func(idpAccount *cfg.IDPAccount) (SAMLClient, error) {
+		return &fakeSAMLClient{account: idpAccount, authenticate: func(loginDetails *creds.LoginDetails) (string, error) {
+			return result, resultErr
+		}}, nil
+	})
+
+	// nothing is wrapped until a recorder is set
+	client, err := NewSAMLClient(&cfg.IDPAccount{Provider: "Custom"})
+	require.Nil(t, err)
+	require.IsType(t, &fakeSAMLClient{}, client)
+
+	registry := metrics.NewRegistry()
+	metrics.SetRecorder(registry)
+	defer metrics.SetRecorder(nil)
+
+	client, err = NewSAMLClient(&cfg.IDPAccount{Provider: "Custom"})
+	require.Nil(t, err)
+	require.False(t, client.(MFAReporter).MFAPerformed())
+
+	result, resultErr = "assertion", nil
+	_, err = client.Authenticate(&creds.LoginDetails{})
+	require.Nil(t, err)
+	require.Equal(t, uint64(1), registry.Value(metrics.AuthSuccessesTotal, "Custom"))
+
+	failures := []struct {
+		err    error
+		reason string
+	}{
+		{errors.Wrap(aad.ErrMfaDenied, "error processing MFA"), "mfa_denied"},
+		{aad.ErrPasswordChangeRequired, "password_change_required"},
+		{&aad.MfaRegistrationRequiredError{URL: "https://aka.ms/mfasetup"}, "mfa_registration_required"},
+		{errors.Wrap(aad.ErrClaimsChallenge, "no claims found in the challenge"), "claims_challenge"},
+		{errors.Wrap(aad.ErrSignInLocked, "error 50053"), "locked_out"},
+		{&aad.UnknownPageError{Pgid: "ConvergedUnknown"}, "unknown_page"},
+		{errors.New("connection refused"), "error"},
+		{nil, "no_assertion"},
+	}
+	result = ""
+	for _, failure := range failures {
+		resultErr = failure.err
+		_, err = client.Authenticate(&creds.LoginDetails{})
+		require.Equal(t, failure.err, err)
+		require.Equal(t, uint64(1), registry.Value(metrics.AuthFailuresTotal, "Custom", failure.reason), failure.reason)
+	}
+
+	require.Equal(t, uint64(1+len(failures)), registry.Value(metrics.AuthAttemptsTotal, "Custom"))
+	require.Equal(t, uint64(1), registry.Value(metrics.AuthSuccessesTotal, "Custom"))
+}
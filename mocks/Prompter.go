@@ -44,6 +44,27 @@ func (_m *Prompter) ChooseWithDefault(_a0 string, _a1 string, _a2 []string) (str
 	return r0, r1
 }
 
+// ChooseWithSearch provides a mock function with given fields: _a0, _a1
+func (_m *Prompter) ChooseWithSearch(_a0 string, _a1 []string) (string, error) {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func(string, []string) string); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, []string) error); ok {
+		r1 = rf(_a0, _a1)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // Password provides a mock function with given fields: _a0
 func (_m *Prompter) Password(_a0 string) string {
 	ret := _m.Called(_a0)
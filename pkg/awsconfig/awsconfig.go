@@ -30,14 +30,22 @@ type AWSCredentials struct {
 	AWSSessionToken  string    `ini:"aws_session_token"`
 	AWSSecurityToken string    `ini:"aws_security_token"`
 	PrincipalARN     string    `ini:"x_principal_arn"`
+	RoleARN          string    `ini:"x_role_arn,omitempty"`
 	Expires          time.Time `ini:"x_security_token_expires"`
 	Region           string    `ini:"region,omitempty"`
+	MFAPerformed     bool      `ini:"-"` // MFA was completed at the IdP for the assertion, only part of the login result
 }
 
 // CredentialsProvider loads aws credentials file
 type CredentialsProvider struct {
 	Filename string
 	Profile  string
+
+	// OverwriteRegion replace a region already set in the profile, otherwise it is kept
+	OverwriteRegion bool
+
+	// SkipRegion never write the configured region to the profile
+	SkipRegion bool
 }
 
 // NewSharedCredentials helper to create the credentials provider
@@ -66,22 +74,31 @@ func (p *CredentialsProvider) CredsExists() (bool, error) {
 	return true, nil
 }
 
-// Save persist the credentials
+// Save persist the credentials, the file is locked while it is updated and replaced in one step
 func (p *CredentialsProvider) Save(awsCreds *AWSCredentials) error {
 	filename, err := p.resolveFilename()
 	if err != nil {
 		return err
 	}
 
-	err = p.ensureConfigExists()
-	if err != nil {
-		if os.IsNotExist(err) {
-			return createAndSaveProfile(filename, p.Profile, awsCreds)
+	return updateFile(filename, func(config *ini.File) error {
+		iniProfile, err := config.NewSection(p.Profile)
+		if err != nil {
+			return err
 		}
-		return errors.Wrap(err, "unable to load file")
-	}
 
-	return saveProfile(filename, p.Profile, awsCreds)
+		// the region may have been set by hand so it is only replaced when asked to
+		if p.SkipRegion || (iniProfile.HasKey("region") && !p.OverwriteRegion) {
+			saved := *awsCreds
+			saved.Region = ""
+			if iniProfile.HasKey("region") {
+				saved.Region = iniProfile.Key("region").String()
+			}
+			return iniProfile.ReflectFrom(&saved)
+		}
+
+		return iniProfile.ReflectFrom(awsCreds)
+	})
 }
 
 // Load load the aws credentials file
@@ -111,6 +128,23 @@ func (p *CredentialsProvider) Load() (*AWSCredentials, error) {
 	return awsCreds, nil
 }
 
+// Delete remove the profile from the credentials file, it is not an error if there is nothing to remove
+func (p *CredentialsProvider) Delete() error {
+	filename, err := p.resolveFilename()
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		return nil
+	}
+
+	return updateFile(filename, func(config *ini.File) error {
+		config.DeleteSection(p.Profile)
+		return nil
+	})
+}
+
 // Expired checks if the current credentials are expired
 func (p *CredentialsProvider) Expired() bool {
 	creds, err := p.Load()
@@ -213,38 +247,3 @@ func resolveSymlink(filename string) (string, error) {
 
 	return sympath, nil
 }
-
-func createAndSaveProfile(filename, profile string, awsCreds *AWSCredentials) error {
-
-	dirPath := filepath.Dir(filename)
-
-	err := os.Mkdir(dirPath, 0700)
-	if err != nil {
-		return errors.Wrapf(err, "unable to create %s directory", dirPath)
-	}
-
-	_, err = os.Create(filename)
-	if err != nil {
-		return errors.Wrapf(err, "unable to create configuration")
-	}
-
-	return saveProfile(filename, profile, awsCreds)
-}
-
-func saveProfile(filename, profile string, awsCreds *AWSCredentials) error {
-	config, err := ini.Load(filename)
-	if err != nil {
-		return err
-	}
-	iniProfile, err := config.NewSection(profile)
-	if err != nil {
-		return err
-	}
-
-	err = iniProfile.ReflectFrom(awsCreds)
-	if err != nil {
-		return err
-	}
-
-	return config.SaveTo(filename)
-}
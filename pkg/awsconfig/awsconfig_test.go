@@ -1,12 +1,18 @@
 package awsconfig
 
 import (
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/sirupsen/logrus"
 
 	"github.com/stretchr/testify/assert"
+	ini "gopkg.in/ini.v1"
 )
 
 func TestUpdateSamlConfig(t *testing.T) {
@@ -14,7 +20,7 @@ func TestUpdateSamlConfig(t *testing.T) {
 
 	logrus.SetLevel(logrus.DebugLevel)
 
-	sharedCreds := &CredentialsProvider{".credentials", "saml"}
+	sharedCreds := &CredentialsProvider{Filename: ".credentials", Profile: "saml"}
 
 	exist, err := sharedCreds.CredsExists()
 	assert.Nil(t, err)
@@ -38,3 +44,159 @@ func TestUpdateSamlConfig(t *testing.T) {
 
 	os.Remove(".credentials")
 }
+
+func TestDeleteSamlConfig(t *testing.T) {
+	os.Remove(".credentials")
+
+	sharedCreds := &CredentialsProvider{Filename: ".credentials", Profile: "saml"}
+	otherCreds := &CredentialsProvider{Filename: ".credentials", Profile: "other"}
+
+	// nothing to delete yet
+	err := sharedCreds.Delete()
+	assert.Nil(t, err)
+
+	_, err = sharedCreds.CredsExists()
+	assert.Nil(t, err)
+	err = sharedCreds.Save(&AWSCredentials{AWSAccessKey: "testid"})
+	assert.Nil(t, err)
+	err = otherCreds.Save(&AWSCredentials{AWSAccessKey: "otherid"})
+	assert.Nil(t, err)
+
+	err = sharedCreds.Delete()
+	assert.Nil(t, err)
+
+	_, err = sharedCreds.Load()
+	assert.Equal(t, ErrCredentialsNotFound, err)
+
+	awsCreds, err := otherCreds.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, "otherid", awsCreds.AWSAccessKey)
+
+	os.Remove(".credentials")
+}
+
+func TestSaveConcurrentWriters(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "credentials")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sharedCreds := NewSharedCredentials(fmt.Sprintf("profile%d", i), filename)
+			errs <- sharedCreds.Save(&AWSCredentials{AWSAccessKey: fmt.Sprintf("id%d", i)})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		assert.Nil(t, err)
+	}
+
+	// every writer's profile survives, none were lost to a concurrent update
+	for i := 0; i < 10; i++ {
+		awsCreds, err := NewSharedCredentials(fmt.Sprintf("profile%d", i), filename).Load()
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("id%d", i), awsCreds.AWSAccessKey)
+	}
+
+	_, err := os.Stat(filename + ".lock")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSaveInterruptedWrite(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "credentials")
+
+	sharedCreds := NewSharedCredentials("saml", filename)
+	err := sharedCreds.Save(&AWSCredentials{AWSAccessKey: "testid"})
+	assert.Nil(t, err)
+
+	before, err := os.ReadFile(filename)
+	assert.Nil(t, err)
+
+	defer func() { rename = os.Rename }()
+	rename = func(oldpath, newpath string) error {
+		return errors.New("interrupted")
+	}
+
+	err = NewSharedCredentials("other", filename).Save(&AWSCredentials{AWSAccessKey: "otherid"})
+	assert.EqualError(t, err, "unable to replace "+filename+": interrupted")
+
+	// the original file is untouched and neither the temporary file nor the lock is left behind
+	after, err := os.ReadFile(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, before, after)
+
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestSaveStaleLock(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "credentials")
+
+	err := os.WriteFile(filename+".lock", nil, 0600)
+	assert.Nil(t, err)
+	stale := time.Now().Add(-time.Minute)
+	assert.Nil(t, os.Chtimes(filename+".lock", stale, stale))
+
+	err = NewSharedCredentials("saml", filename).Save(&AWSCredentials{AWSAccessKey: "testid"})
+	assert.Nil(t, err)
+}
+
+func TestSaveRegion(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "credentials")
+
+	// a new profile gets the configured region
+	sharedCreds := NewSharedCredentials("saml", filename)
+	err := sharedCreds.Save(&AWSCredentials{AWSAccessKey: "testid", Region: "ap-southeast-2"})
+	assert.Nil(t, err)
+
+	awsCreds, err := sharedCreds.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, "ap-southeast-2", awsCreds.Region)
+
+	// an existing region is preserved
+	err = sharedCreds.Save(&AWSCredentials{AWSAccessKey: "newid", Region: "us-east-1"})
+	assert.Nil(t, err)
+
+	awsCreds, err = sharedCreds.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, "newid", awsCreds.AWSAccessKey)
+	assert.Equal(t, "ap-southeast-2", awsCreds.Region)
+
+	// unless asked to overwrite it
+	sharedCreds.OverwriteRegion = true
+	saved := &AWSCredentials{AWSAccessKey: "newid", Region: "us-east-1"}
+	err = sharedCreds.Save(saved)
+	assert.Nil(t, err)
+	assert.Equal(t, "us-east-1", saved.Region)
+
+	awsCreds, err = sharedCreds.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, "us-east-1", awsCreds.Region)
+
+	// the region is kept out of the profile when skipped
+	sharedCreds = NewSharedCredentials("other", filename)
+	sharedCreds.SkipRegion = true
+	err = sharedCreds.Save(&AWSCredentials{AWSAccessKey: "otherid", Region: "us-east-1"})
+	assert.Nil(t, err)
+
+	cfg, err := ini.Load(filename)
+	assert.Nil(t, err)
+	assert.False(t, cfg.Section("other").HasKey("region"))
+
+	// and one set by hand is left as it is
+	sharedCreds = NewSharedCredentials("saml", filename)
+	sharedCreds.SkipRegion = true
+	sharedCreds.OverwriteRegion = true
+	err = sharedCreds.Save(&AWSCredentials{AWSAccessKey: "newid", Region: "eu-west-1"})
+	assert.Nil(t, err)
+
+	awsCreds, err = sharedCreds.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, "us-east-1", awsCreds.Region)
+}
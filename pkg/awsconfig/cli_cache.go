@@ -0,0 +1,104 @@
+package awsconfig
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/pkg/errors"
+)
+
+// cliCacheCredentials the credentials of an AWS CLI cache entry, the CLI reads them as returned by STS
+type cliCacheCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	SessionToken    string `json:"SessionToken"`
+	Expiration      string `json:"Expiration"`
+}
+
+// cliCacheEntry an AWS CLI cache entry, this is the AssumeRole response the CLI stores in ~/.aws/cli/cache
+type cliCacheEntry struct {
+	Credentials     cliCacheCredentials `json:"Credentials"`
+	AssumedRoleUser struct {
+		Arn string `json:"Arn"`
+	} `json:"AssumedRoleUser"`
+}
+
+// LocateCLICacheDir return the directory the AWS CLI caches assumed role credentials in
+func LocateCLICacheDir() (string, error) {
+	if runtime.GOOS == "windows" {
+		return path.Join(os.Getenv("USERPROFILE"), ".aws", "cli", "cache"), nil
+	}
+
+	name, err := homedir.Expand("~/.aws/cli/cache")
+	if err != nil {
+		return "", ErrCredentialsHomeNotFound
+	}
+
+	return name, nil
+}
+
+// CLICacheKey compute the cache key the AWS CLI uses for a profile which assumes the role, this is the sha1 of
+// the assume role arguments serialised as python's json.dumps(args, sort_keys=True) does
+func CLICacheKey(roleARN string) string {
+	arg, _ := json.Marshal(roleARN)
+	sum := sha1.Sum([]byte(`{"RoleArn": ` + string(arg) + `}`))
+	return hex.EncodeToString(sum[:])
+}
+
+// SaveCLICache write the credentials to the AWS CLI cache directory so a profile with the same role_arn picks
+// them up without calling STS, the path of the cache file is returned
+func SaveCLICache(dir string, awsCreds *AWSCredentials) (string, error) {
+	roleARN := awsCreds.RoleARN
+	if roleARN == "" {
+		roleARN = assumedRoleARN(awsCreds.PrincipalARN)
+	}
+	if roleARN == "" {
+		return "", errors.New("unable to determine the role arn of the credentials")
+	}
+
+	entry := cliCacheEntry{
+		Credentials: cliCacheCredentials{
+			AccessKeyID:     awsCreds.AWSAccessKey,
+			SecretAccessKey: awsCreds.AWSSecretKey,
+			SessionToken:    awsCreds.AWSSessionToken,
+			Expiration:      awsCreds.Expires.UTC().Format(time.RFC3339),
+		},
+	}
+	entry.AssumedRoleUser.Arn = awsCreds.PrincipalARN
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to encode cli cache entry")
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", errors.Wrap(err, "unable to create cli cache directory")
+	}
+
+	filename := filepath.Join(dir, CLICacheKey(roleARN)+".json")
+	if err := writeFileAtomic(filename, data); err != nil {
+		return "", err
+	}
+
+	return filename, nil
+}
+
+// assumedRoleARN derive the role ARN from an assumed role ARN such as
+// arn:aws:sts::000000000001:assumed-role/Development/user, any path of the role is lost
+func assumedRoleARN(principalARN string) string {
+	parts := strings.SplitN(principalARN, ":", 6)
+	if len(parts) < 6 || !strings.HasPrefix(parts[5], "assumed-role/") {
+		return ""
+	}
+
+	resource := strings.Split(strings.TrimPrefix(parts[5], "assumed-role/"), "/")
+	return strings.Join([]string{parts[0], parts[1], "iam", "", parts[4], "role/" + resource[0]}, ":")
+}
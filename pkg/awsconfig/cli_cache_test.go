@@ -0,0 +1,67 @@
+package awsconfig
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCLICacheKey(t *testing.T) {
+	// python -c 'import json,hashlib; print(hashlib.sha1(json.dumps({"RoleArn": "arn:aws:iam::000000000001:role/Development"}, sort_keys=True).encode()).hexdigest())'
+	assert.Equal(t, "07b8c9e241dffa66be9f1fdc13be6186fd8a3943", CLICacheKey("arn:aws:iam::000000000001:role/Development"))
+}
+
+func TestSaveCLICache(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "cli", "cache")
+	expires := time.Date(2026, 10, 16, 12, 0, 0, 0, time.FixedZone("AEDT", 11*60*60))
+
+	filename, err := SaveCLICache(dir, &AWSCredentials{
+		AWSAccessKey:    "testID",
+		AWSSecretKey:    "testSecret",
+		AWSSessionToken: "testToken",
+		PrincipalARN:    "arn:aws:sts::000000000001:assumed-role/Development/user@example.com",
+		RoleARN:         "arn:aws:iam::000000000001:role/Development",
+		Expires:         expires,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(dir, "07b8c9e241dffa66be9f1fdc13be6186fd8a3943.json"), filename)
+
+	info, err := os.Stat(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	data, err := os.ReadFile(filename)
+	assert.Nil(t, err)
+
+	var entry map[string]map[string]string
+	assert.Nil(t, json.Unmarshal(data, &entry))
+	assert.Equal(t, map[string]map[string]string{
+		"Credentials": {
+			"AccessKeyId":     "testID",
+			"SecretAccessKey": "testSecret",
+			"SessionToken":    "testToken",
+			"Expiration":      "2026-10-16T01:00:00Z",
+		},
+		"AssumedRoleUser": {
+			"Arn": "arn:aws:sts::000000000001:assumed-role/Development/user@example.com",
+		},
+	}, entry)
+}
+
+func TestSaveCLICacheWithoutRoleARN(t *testing.T) {
+	dir := t.TempDir()
+
+	// credentials saved before the role ARN was recorded fall back to the assumed role
+	filename, err := SaveCLICache(dir, &AWSCredentials{
+		PrincipalARN: "arn:aws:sts::000000000001:assumed-role/Development/user@example.com",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(dir, "07b8c9e241dffa66be9f1fdc13be6186fd8a3943.json"), filename)
+
+	_, err = SaveCLICache(dir, &AWSCredentials{PrincipalARN: "arn:aws:iam::000000000001:user/someone"})
+	assert.EqualError(t, err, "unable to determine the role arn of the credentials")
+}
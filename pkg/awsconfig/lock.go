@@ -0,0 +1,119 @@
+package awsconfig
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	ini "gopkg.in/ini.v1"
+)
+
+const (
+	lockRetryInterval = 50 * time.Millisecond
+	lockTimeout       = 10 * time.Second
+
+	// a lock older than this was left behind by a run which didn't get to remove it
+	lockStaleAge = 30 * time.Second
+)
+
+// rename is replaced in tests to simulate a write which is interrupted before it completes
+var rename = os.Rename
+
+// updateFile load the ini file, apply the change and write it back while holding a lock so concurrent runs
+// don't lose each other's updates. The file is replaced in one step so it is never left partly written.
+func updateFile(filename string, update func(config *ini.File) error) error {
+	filename, err := resolveSymlink(filename)
+	if err != nil {
+		return errors.Wrap(err, "unable to resolve symlink")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return errors.Wrapf(err, "unable to create %s directory", filepath.Dir(filename))
+	}
+
+	unlock, err := lockFile(filename)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	config := ini.Empty()
+	data, err := os.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "unable to load file")
+	}
+	if err == nil {
+		if config, err = ini.Load(data); err != nil {
+			return errors.Wrap(err, "unable to parse file")
+		}
+	}
+
+	if err := update(config); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if _, err := config.WriteTo(&buf); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filename, buf.Bytes())
+}
+
+// lockFile take an exclusive lock on the file by creating a lock file next to it, returning a function which
+// releases the lock
+func lockFile(filename string) (func(), error) {
+	lockname := filename + ".lock"
+	deadline := time.Now().Add(lockTimeout)
+
+	for {
+		f, err := os.OpenFile(lockname, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(lockname) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, errors.Wrapf(err, "unable to lock %s", filename)
+		}
+
+		if fi, err := os.Stat(lockname); err == nil && time.Since(fi.ModTime()) > lockStaleAge {
+			logger.WithField("lockname", lockname).Debug("Removing stale lock")
+			os.Remove(lockname)
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return nil, errors.Errorf("timed out waiting for the lock on %s, remove %s if no other saml2aws is running", filename, lockname)
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
+
+// writeFileAtomic write the data to a temporary file in the same directory then rename it over the file
+func writeFileAtomic(filename string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return errors.Wrap(err, "unable to create temporary file")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "unable to write temporary file")
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "unable to write temporary file")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "unable to write temporary file")
+	}
+
+	if err := rename(tmp.Name(), filename); err != nil {
+		return errors.Wrapf(err, "unable to replace %s", filename)
+	}
+
+	return nil
+}
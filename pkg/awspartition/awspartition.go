@@ -0,0 +1,77 @@
+package awspartition
+
+import (
+	"net/url"
+	"strings"
+)
+
+// Partition where to sign in with SAML for one of the AWS partitions
+type Partition struct {
+	ID            string
+	SignInURL     string
+	DefaultRegion string
+	regionPrefix  string
+}
+
+// Partitions the AWS partitions saml2aws can sign in to
+var Partitions = []*Partition{
+	{ID: "aws", SignInURL: "https://signin.aws.amazon.com/saml"},
+	{ID: "aws-cn", SignInURL: "https://signin.amazonaws.cn/saml", DefaultRegion: "cn-north-1", regionPrefix: "cn-"},
+	{ID: "aws-us-gov", SignInURL: "https://signin.amazonaws-us-gov.com/saml", DefaultRegion: "us-gov-west-1", regionPrefix: "us-gov-"},
+}
+
+// Lookup the partition with the ID, nil when there isn't one
+func Lookup(id string) *Partition {
+	for _, partition := range Partitions {
+		if partition.ID == id {
+			return partition
+		}
+	}
+	return nil
+}
+
+// ForHost the partition the sign in host belongs to, nil when the host isn't an AWS sign in host
+func ForHost(host string) *Partition {
+	for _, partition := range Partitions {
+		if MatchHost(host, []string{partition.SignInHost()}) {
+			return partition
+		}
+	}
+	return nil
+}
+
+// SignInHosts the sign in hosts of all the partitions
+func SignInHosts() []string {
+	hosts := make([]string, 0, len(Partitions))
+	for _, partition := range Partitions {
+		hosts = append(hosts, partition.SignInHost())
+	}
+	return hosts
+}
+
+// MatchHost whether the host is one of the hosts or a subdomain of one, so regional endpoints such as
+// us-east-1.signin.aws.amazon.com match signin.aws.amazon.com
+func MatchHost(host string, hosts []string) bool {
+	host = strings.ToLower(host)
+	for _, h := range hosts {
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return false
+}
+
+// SignInHost the host of the partition's SAML sign in endpoint
+func (p *Partition) SignInHost() string {
+	u, _ := url.Parse(p.SignInURL)
+	return u.Host
+}
+
+// Region the region to use for STS, the configured one unless the partition has its own regions and the
+// configured one isn't among them, in which case it is the partition's default
+func (p *Partition) Region(region string) string {
+	if p.regionPrefix == "" || strings.HasPrefix(region, p.regionPrefix) {
+		return region
+	}
+	return p.DefaultRegion
+}
@@ -0,0 +1,25 @@
+package awspartition
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignInHosts(t *testing.T) {
+	require.Equal(t, []string{"signin.aws.amazon.com", "signin.amazonaws.cn", "signin.amazonaws-us-gov.com"}, SignInHosts())
+}
+
+func TestMatchHost(t *testing.T) {
+	hosts := SignInHosts()
+	require.True(t, MatchHost("signin.aws.amazon.com", hosts))
+	require.True(t, MatchHost("us-east-1.signin.aws.amazon.com", hosts))
+	require.True(t, MatchHost("Signin.AmazonAWS.cn", hosts))
+	require.False(t, MatchHost("signin.aws.amazon.com.example.com", hosts))
+	require.False(t, MatchHost("evilsignin.aws.amazon.com", hosts))
+}
+
+func TestForHost(t *testing.T) {
+	require.Equal(t, "aws-us-gov", ForHost("signin.amazonaws-us-gov.com").ID)
+	require.Nil(t, ForHost("sp.example.com"))
+}
@@ -1,18 +1,29 @@
 package cfg
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
 
 	"github.com/mitchellh/go-homedir"
 	"github.com/pkg/errors"
+	"github.com/versent/saml2aws/v2/pkg/awspartition"
+	"github.com/versent/saml2aws/v2/pkg/creds"
 	"github.com/versent/saml2aws/v2/pkg/prompter"
+	"golang.org/x/net/http/httpguts"
 	ini "gopkg.in/ini.v1"
 )
 
 // ErrIdpAccountNotFound returned if the idp account is not found in the configuration file
 var ErrIdpAccountNotFound = errors.New("IDP account not found, run configure to set it up")
 
+// awsAccountIDRegexp an AWS account ID is always 12 digits
+var awsAccountIDRegexp = regexp.MustCompile(`^\d{12}$`)
+
 const (
 	// DefaultConfigPath the default saml2aws configuration path
 	DefaultConfigPath = "~/.saml2aws"
@@ -25,6 +36,12 @@ const (
 	// see https://aws.amazon.com/blogs/security/enable-federated-api-access-to-your-aws-resources-for-up-to-12-hours-using-iam-roles/
 	DefaultSessionDuration = 3600
 
+	// MinSessionDuration the shortest session STS will issue credentials for
+	MinSessionDuration = 900
+
+	// MaxSessionDuration the longest session STS will issue credentials for, provided the role allows it
+	MaxSessionDuration = 43200
+
 	// DefaultProfile this is the default profile name used to save the credentials in the aws cli
 	DefaultProfile = "saml"
 
@@ -34,34 +51,80 @@ const (
 
 // IDPAccount saml IDP account
 type IDPAccount struct {
-	Name                  string `ini:"name"`
-	AppID                 string `ini:"app_id"` // used by OneLogin and AzureAD
-	URL                   string `ini:"url"`
-	Username              string `ini:"username"`
-	Provider              string `ini:"provider"`
-	MFA                   string `ini:"mfa"`
-	MFAIPAddress          string `ini:"mfa_ip_address"` // used by OneLogin
-	SkipVerify            bool   `ini:"skip_verify"`
-	Timeout               int    `ini:"timeout"`
-	AmazonWebservicesURN  string `ini:"aws_urn"`
-	SessionDuration       int    `ini:"aws_session_duration"`
-	Profile               string `ini:"aws_profile"`
-	ResourceID            string `ini:"resource_id"` // used by F5APM
-	Subdomain             string `ini:"subdomain"`   // used by OneLogin
-	RoleARN               string `ini:"role_arn"`
-	Region                string `ini:"region"`
-	HttpAttemptsCount     string `ini:"http_attempts_count"`
-	HttpRetryDelay        string `ini:"http_retry_delay"`
-	CredentialsFile       string `ini:"credentials_file"`
-	SAMLCache             bool   `ini:"saml_cache"`
-	SAMLCacheFile         string `ini:"saml_cache_file"`
-	TargetURL             string `ini:"target_url"`
-	DisableRememberDevice bool   `ini:"disable_remember_device"`      // used by Okta
-	DisableSessions       bool   `ini:"disable_sessions"`             // used by Okta
-	DownloadBrowser       bool   `ini:"download_browser_driver"`      // used by browser
-	BrowserDriverDir      string `ini:"browser_driver_dir,omitempty"` // used by browser; hide from user if not set
-	Headless              bool   `ini:"headless"`                     // used by browser
-	Prompter              string `ini:"prompter"`
+	Name                   string `ini:"name"`
+	ConfigFile             string `ini:"-"`                  // the config file the account was loaded from
+	AppID                  string `ini:"app_id"`             // used by OneLogin and AzureAD
+	AppName                string `ini:"app_name,omitempty"` // used by AzureAD to discover the app ID
+	URL                    string `ini:"url"`
+	Username               string `ini:"username"`
+	Provider               string `ini:"provider"`
+	MFA                    string `ini:"mfa"`
+	MFAIPAddress           string `ini:"mfa_ip_address"` // used by OneLogin
+	SkipVerify             bool   `ini:"skip_verify"`
+	RequireInsecureConfirm bool   `ini:"require_insecure_confirmation,omitempty"` // skip_verify only applies with I_UNDERSTAND_INSECURE=true
+	Timeout                int    `ini:"timeout"`
+	AmazonWebservicesURN   string `ini:"aws_urn"`
+	SessionDuration        int    `ini:"aws_session_duration"`
+	Profile                string `ini:"aws_profile"`
+	ResourceID             string `ini:"resource_id"` // used by F5APM
+	Subdomain              string `ini:"subdomain"`   // used by OneLogin
+	RoleARN                string `ini:"role_arn"`
+	PrincipalARN           string `ini:"principal_arn,omitempty"`       // with role_arn the role is assumed without prompting or parsing every role
+	MaxAuthAge             int    `ini:"max_auth_age,omitempty"`        // seconds, refuse assertions from an older authentication at the IdP
+	OnAssertionExpiry      string `ini:"on_assertion_expiry,omitempty"` // reauthenticate (default) or fail when the assertion expires before the role is assumed
+	RoleAttribute          string `ini:"role_attribute,omitempty"`      // hide from user if not set
+	Region                 string `ini:"region"`
+	SkipProfileRegion      bool   `ini:"skip_profile_region,omitempty"`  // don't write the region to the aws profile
+	AWSPartition           string `ini:"aws_partition,omitempty"`        // aws, aws-cn or aws-us-gov; derived from the role ARN if not set
+	VerifyDestination      bool   `ini:"verify_destination,omitempty"`   // reject assertions not addressed to expected_destination
+	ExpectedDestination    string `ini:"expected_destination,omitempty"` // defaults to the sign in URL of the partition
+	MaskUsername           bool   `ini:"mask_username,omitempty"`        // show the username masked in prompts and output
+	PreAuthCommand         string `ini:"pre_auth_command,omitempty"`     // run before authenticating, e.g. to connect a VPN
+	PreAuthTimeout         int    `ini:"pre_auth_timeout,omitempty"`     // seconds the pre_auth_command may take, defaults to 60
+	AccountAliases         string `ini:"account_aliases,omitempty"`      // comma separated account ID=name pairs used to label roles
+	HttpAttemptsCount      string `ini:"http_attempts_count"`
+	HttpRetryDelay         string `ini:"http_retry_delay"`
+	CredentialsFile        string `ini:"credentials_file"`
+	SAMLCache              bool   `ini:"saml_cache"`
+	SAMLCacheFile          string `ini:"saml_cache_file"`
+	TargetURL              string `ini:"target_url"`
+	DisableRememberDevice  bool   `ini:"disable_remember_device"`      // used by Okta
+	DisableSessions        bool   `ini:"disable_sessions"`             // used by Okta
+	DownloadBrowser        bool   `ini:"download_browser_driver"`      // used by browser
+	BrowserDriverDir       string `ini:"browser_driver_dir,omitempty"` // used by browser; hide from user if not set
+	Headless               bool   `ini:"headless"`                     // used by browser
+	Prompter               string `ini:"prompter"`
+	RestrictAccessTenants  string `ini:"restrict_access_to_tenants,omitempty"` // used by AzureAD
+	RestrictAccessContext  string `ini:"restrict_access_context,omitempty"`    // used by AzureAD
+	MFAIdleWarning         int    `ini:"mfa_idle_warning,omitempty"`           // used by AzureAD; seconds, negative disables
+	MFAPhone               string `ini:"mfa_phone,omitempty"`                  // used by AzureAD; matched against the masked number
+	TLSPinnedSHA256        string `ini:"tls_pinned_sha256,omitempty"`          // used by AzureAD; comma separated certificate fingerprints
+	CustomHeaders          string `ini:"custom_headers,omitempty"`             // used by AzureAD; comma separated Name: value pairs
+	MFARetries             int    `ini:"mfa_retries,omitempty"`                // used by AzureAD; attempts after a transient MFA failure
+	MFAInitialDelay        int    `ini:"mfa_initial_delay,omitempty"`          // used by AzureAD; seconds before the first poll of a push or call, negative disables
+	MFAPushEarly           bool   `ini:"mfa_push_early,omitempty"`             // used by AzureAD; sends a push as soon as the MFA page is read
+	MFAAliases             string `ini:"mfa_aliases,omitempty"`                // used by AzureAD; comma separated name=AuthMethodId pairs the mfa may be set to
+	PasswordRetries        int    `ini:"password_retries,omitempty"`           // used by AzureAD; prompts for the password again after a wrong one
+	MFAVerbose             bool   `ini:"mfa_verbose,omitempty"`                // used by AzureAD; prints the MFA methods offered
+	LoginHint              bool   `ini:"login_hint,omitempty"`                 // used by AzureAD; sends the username with the start request
+	RemoteConnect          bool   `ini:"remote_connect,omitempty"`             // used by AzureAD; approves the sign in on another device with a code
+	RelayState             string `ini:"relay_state,omitempty"`                // used by AzureAD; replaces the RelayState of the hidden forms submitted
+	TrustedACSHosts        string `ini:"trusted_acs_hosts,omitempty"`          // used by AzureAD; comma separated hosts a SAMLResponse may be submitted to
+	ExpectedAudience       string `ini:"expected_audience,omitempty"`          // the audience the assertion must be for, AWS by default; AzureAD also picks the SAMLResponse for it when a page carries several
+	DialTimeout            int    `ini:"dial_timeout,omitempty"`               // used by AzureAD; seconds to establish a connection
+	ResponseHeaderTimeout  int    `ini:"response_header_timeout,omitempty"`    // used by AzureAD; seconds to wait on the response headers of each request
+	StartOperation         string `ini:"start_operation,omitempty"`            // used by AzureAD; Operation of the start URL, LinkedSignIn by default
+	StartURLRetries        int    `ini:"start_url_retries,omitempty"`          // used by AzureAD; retries of the first request after a network error, negative disables
+	ProxyURL               string `ini:"proxy_url,omitempty"`                  // used by AzureAD; replaces the proxy from the environment
+	CABundle               string `ini:"ca_bundle,omitempty"`                  // used by AzureAD; PEM file of the only CAs trusted, see ca_bundle_append
+	CABundleAppend         bool   `ini:"ca_bundle_append,omitempty"`           // used by AzureAD; trusts the ca_bundle CAs along with the system roots
+	AWSUseIDPTransport     bool   `ini:"aws_use_idp_transport,omitempty"`      // STS and IAM calls use the proxy, CA and TLS settings of the IdP
+	StrictJSON             bool   `ini:"strict_json,omitempty"`                // used by AzureAD; logs the fields of JSON responses the provider doesn't capture
+	RequestLog             string `ini:"request_log,omitempty"`                // used by AzureAD; appends a line for each request made to the IdP to this file
+	RequestLogMaxSize      int    `ini:"request_log_max_size,omitempty"`       // used by AzureAD; bytes, the request log is rotated once this size is reached
+	DisableHTTP2           bool   `ini:"disable_http2,omitempty"`              // used by AzureAD; forces HTTP/1.1 for proxies which mishandle HTTP/2
+	TLSRenegotiation       string `ini:"tls_renegotiation,omitempty"`          // used by AzureAD; never, once or freely (default)
+	Origin                 string `ini:"origin,omitempty"`                     // used by AzureAD; Origin header of the JSON calls, the scheme and host they're sent to by default
 }
 
 func (ia IDPAccount) String() string {
@@ -84,6 +147,11 @@ func (ia IDPAccount) String() string {
   DisableRememberDevice: %v`, ia.DisableSessions, ia.DisableSessions)
 	}
 
+	username := ia.Username
+	if ia.MaskUsername {
+		username = creds.MaskUsername(username)
+	}
+
 	return fmt.Sprintf(`account {%s%s%s
   URL: %s
   Username: %s
@@ -95,7 +163,7 @@ func (ia IDPAccount) String() string {
   Profile: %s
   RoleARN: %s
   Region: %s
-}`, appID, policyID, oktaCfg, ia.URL, ia.Username, ia.Provider, ia.MFA, ia.SkipVerify, ia.AmazonWebservicesURN, ia.SessionDuration, ia.Profile, ia.RoleARN, ia.Region)
+}`, appID, policyID, oktaCfg, ia.URL, username, ia.Provider, ia.MFA, ia.SkipVerify, ia.AmazonWebservicesURN, ia.SessionDuration, ia.Profile, ia.RoleARN, ia.Region)
 }
 
 // Validate validate the required / expected fields are set
@@ -113,8 +181,8 @@ func (ia *IDPAccount) Validate() error {
 			return errors.New("Resource ID empty in idp account")
 		}
 	case "AzureAD":
-		if ia.AppID == "" {
-			return errors.New("app ID empty in idp account")
+		if ia.AppID == "" && ia.AppName == "" {
+			return errors.New("app ID and app name empty in idp account")
 		}
 	}
 
@@ -141,13 +209,137 @@ func (ia *IDPAccount) Validate() error {
 		return errors.New("Profile empty in idp account")
 	}
 
+	if ia.SessionDuration != 0 && ia.SessionDuration < MinSessionDuration {
+		return fmt.Errorf("session duration %d is below the minimum of %d seconds", ia.SessionDuration, MinSessionDuration)
+	}
+
+	if ia.SessionDuration > MaxSessionDuration {
+		return fmt.Errorf("session duration %d is above the maximum of %d seconds", ia.SessionDuration, MaxSessionDuration)
+	}
+
+	if ia.AWSPartition != "" && awspartition.Lookup(ia.AWSPartition) == nil {
+		return fmt.Errorf("unknown aws partition %s in idp account", ia.AWSPartition)
+	}
+
+	switch ia.TLSRenegotiation {
+	case "", "never", "once", "freely":
+	default:
+		return fmt.Errorf("unknown tls renegotiation %s in idp account", ia.TLSRenegotiation)
+	}
+
 	if err := prompter.ValidateAndSetPrompter(ia.Prompter); err != nil {
 		return err
 	}
 
+	if _, err := ia.CustomHeaderMap(); err != nil {
+		return err
+	}
+
+	if _, err := ia.AccountAliasMap(); err != nil {
+		return err
+	}
+
+	if _, err := ia.MFAAliasMap(); err != nil {
+		return err
+	}
+
 	return nil
 }
 
+// ConfigScope tell apart the caches and sessions of accounts loaded from a config file other than the default one,
+// this is empty for the default config file and a short hash of the path otherwise so separate config sets, e.g. for
+// work and personal use, with accounts of the same name don't share a cached assertion or session
+func (ia *IDPAccount) ConfigScope() string {
+	if ia.ConfigFile == "" {
+		return ""
+	}
+
+	configPath, err := filepath.Abs(ia.ConfigFile)
+	if err != nil {
+		configPath = filepath.Clean(ia.ConfigFile)
+	}
+	if defaultPath, err := homedir.Expand(DefaultConfigPath); err == nil && configPath == filepath.Clean(defaultPath) {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(configPath))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// CacheName the name the SAML cache of the account is kept under, the account name scoped to its config file
+func (ia *IDPAccount) CacheName() string {
+	if scope := ia.ConfigScope(); scope != "" {
+		return ia.Name + "_" + scope
+	}
+	return ia.Name
+}
+
+// CustomHeaderMap parse the custom headers which are added to every request sent to the idp, these are
+// configured as comma separated Name: value pairs
+func (ia *IDPAccount) CustomHeaderMap() (map[string]string, error) {
+	headers := map[string]string{}
+	if strings.TrimSpace(ia.CustomHeaders) == "" {
+		return headers, nil
+	}
+
+	for _, pair := range strings.Split(ia.CustomHeaders, ",") {
+		name, value, ok := strings.Cut(pair, ":")
+		name = strings.TrimSpace(name)
+		value = strings.TrimSpace(value)
+		if !ok || !httpguts.ValidHeaderFieldName(name) {
+			return nil, fmt.Errorf("invalid custom header %q in idp account", strings.TrimSpace(pair))
+		}
+		if !httpguts.ValidHeaderFieldValue(value) {
+			return nil, fmt.Errorf("invalid value for custom header %s in idp account", name)
+		}
+		headers[name] = value
+	}
+
+	return headers, nil
+}
+
+// AccountAliasMap parse the friendly names of AWS accounts which are shown instead of the account ID, these are
+// configured as comma separated ID=name pairs
+func (ia *IDPAccount) AccountAliasMap() (map[string]string, error) {
+	aliases := map[string]string{}
+	if strings.TrimSpace(ia.AccountAliases) == "" {
+		return aliases, nil
+	}
+
+	for _, pair := range strings.Split(ia.AccountAliases, ",") {
+		id, name, ok := strings.Cut(pair, "=")
+		id = strings.TrimSpace(id)
+		name = strings.TrimSpace(name)
+		if !ok || !awsAccountIDRegexp.MatchString(id) || name == "" {
+			return nil, fmt.Errorf("invalid account alias %q in idp account", strings.TrimSpace(pair))
+		}
+		aliases[id] = name
+	}
+
+	return aliases, nil
+}
+
+// MFAAliasMap parse the names the mfa may be set to instead of the ID of a method, these are configured as comma
+// separated name=ID pairs and keyed in lower case as names are compared regardless of case
+func (ia *IDPAccount) MFAAliasMap() (map[string]string, error) {
+	aliases := map[string]string{}
+	if strings.TrimSpace(ia.MFAAliases) == "" {
+		return aliases, nil
+	}
+
+	for _, pair := range strings.Split(ia.MFAAliases, ",") {
+		name, method, ok := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		method = strings.TrimSpace(method)
+		if !ok || name == "" || method == "" {
+			return nil, fmt.Errorf("invalid mfa alias %q in idp account", strings.TrimSpace(pair))
+		}
+		aliases[strings.ToLower(name)] = method
+	}
+
+	return aliases, nil
+}
+
 // NewIDPAccount Create an idp account and fill in any default fields with sane values
 func NewIDPAccount() *IDPAccount {
 	return &IDPAccount{
@@ -223,10 +415,30 @@ func (cm *ConfigManager) LoadIDPAccount(idpAccountName string) (*IDPAccount, err
 
 	// adding Name at Load time for the IdpAccount to have awareness of "self"
 	account.Name = idpAccountName
+	account.ConfigFile = cm.configPath
 
 	return account, nil
 }
 
+// IDPAccountNames list the names of all idp accounts in the configuration file
+func (cm *ConfigManager) IDPAccountNames() ([]string, error) {
+
+	cfg, err := ini.LoadSources(ini.LoadOptions{Loose: true, SpaceBeforeInlineComment: true}, cm.configPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to load configuration file")
+	}
+
+	names := []string{}
+	for _, sec := range cfg.Sections() {
+		if sec.Name() == ini.DefaultSection {
+			continue
+		}
+		names = append(names, sec.Name())
+	}
+
+	return names, nil
+}
+
 func readAccount(idpAccountName string, cfg *ini.File) (*IDPAccount, error) {
 
 	account := NewIDPAccount()
@@ -2,8 +2,10 @@ package cfg
 
 import (
 	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/mitchellh/go-homedir"
 	"github.com/stretchr/testify/require"
 )
 
@@ -48,6 +50,7 @@ func TestNewConfigManagerLoad(t *testing.T) {
 	require.Nil(t, err)
 	require.Equal(t, &IDPAccount{
 		Name:                 "test123",
+		ConfigFile:           "example/saml2aws.ini",
 		URL:                  "https://id.whatever.com/#/hash",
 		Username:             "abc@whatever.com",
 		Provider:             "keycloak",
@@ -60,12 +63,23 @@ func TestNewConfigManagerLoad(t *testing.T) {
 	idpAccount, err = cfgm.LoadIDPAccount("")
 	require.Nil(t, err)
 	require.Equal(t, &IDPAccount{
+		ConfigFile:           "example/saml2aws.ini",
 		AmazonWebservicesURN: DefaultAmazonWebservicesURN,
 		SessionDuration:      3600,
 		Profile:              "saml",
 	}, idpAccount)
 }
 
+func TestIDPAccountNames(t *testing.T) {
+
+	cfgm, err := NewConfigManager("example/saml2aws.ini")
+	require.Nil(t, err)
+
+	names, err := cfgm.IDPAccountNames()
+	require.Nil(t, err)
+	require.Equal(t, []string{"wolfeidau", "test123"}, names)
+}
+
 func TestNewConfigManagerSave(t *testing.T) {
 
 	cfgm, err := NewConfigManager(throwAwayConfig)
@@ -83,6 +97,7 @@ func TestNewConfigManagerSave(t *testing.T) {
 	require.Nil(t, err)
 	require.Equal(t, &IDPAccount{
 		Name:                 "testing2",
+		ConfigFile:           throwAwayConfig,
 		URL:                  "https://id.whatever.com",
 		Username:             "abc@whatever.com",
 		Provider:             "keycloak",
@@ -94,3 +109,79 @@ func TestNewConfigManagerSave(t *testing.T) {
 	os.Remove(throwAwayConfig)
 
 }
+
+func TestIDPAccountConfigScope(t *testing.T) {
+	defaultPath, err := homedir.Expand(DefaultConfigPath)
+	require.Nil(t, err)
+
+	require.Equal(t, "", (&IDPAccount{Name: "work"}).ConfigScope())
+	require.Equal(t, "", (&IDPAccount{Name: "work", ConfigFile: defaultPath}).ConfigScope())
+	require.Equal(t, "work", (&IDPAccount{Name: "work", ConfigFile: defaultPath}).CacheName())
+
+	cfgm, err := NewConfigManager("example/saml2aws.ini")
+	require.Nil(t, err)
+	idpAccount, err := cfgm.LoadIDPAccount("test123")
+	require.Nil(t, err)
+
+	scope := idpAccount.ConfigScope()
+	require.Len(t, scope, 12)
+	require.Equal(t, "test123_"+scope, idpAccount.CacheName())
+
+	// the same file named another way is the same scope, another file isn't
+	abs, err := filepath.Abs("example/saml2aws.ini")
+	require.Nil(t, err)
+	require.Equal(t, scope, (&IDPAccount{ConfigFile: abs}).ConfigScope())
+	require.Equal(t, scope, (&IDPAccount{ConfigFile: "./example/../example/saml2aws.ini"}).ConfigScope())
+	require.NotEqual(t, scope, (&IDPAccount{ConfigFile: throwAwayConfig}).ConfigScope())
+}
+
+func TestIDPAccountCustomHeaderMap(t *testing.T) {
+	account := &IDPAccount{CustomHeaders: "X-Waf-Token: abc123 , X-Client-Name:saml2aws"}
+	headers, err := account.CustomHeaderMap()
+	require.Nil(t, err)
+	require.Equal(t, map[string]string{"X-Waf-Token": "abc123", "X-Client-Name": "saml2aws"}, headers)
+
+	headers, err = (&IDPAccount{}).CustomHeaderMap()
+	require.Nil(t, err)
+	require.Empty(t, headers)
+
+	_, err = (&IDPAccount{CustomHeaders: "X-Waf-Token"}).CustomHeaderMap()
+	require.EqualError(t, err, `invalid custom header "X-Waf-Token" in idp account`)
+
+	_, err = (&IDPAccount{CustomHeaders: "X-Waf(Token): abc"}).CustomHeaderMap()
+	require.EqualError(t, err, `invalid custom header "X-Waf(Token): abc" in idp account`)
+}
+
+func TestIDPAccountAccountAliasMap(t *testing.T) {
+	account := &IDPAccount{AccountAliases: "000000000001=production , 000000000002= staging"}
+	aliases, err := account.AccountAliasMap()
+	require.Nil(t, err)
+	require.Equal(t, map[string]string{"000000000001": "production", "000000000002": "staging"}, aliases)
+
+	aliases, err = (&IDPAccount{}).AccountAliasMap()
+	require.Nil(t, err)
+	require.Empty(t, aliases)
+
+	_, err = (&IDPAccount{AccountAliases: "000000000001"}).AccountAliasMap()
+	require.EqualError(t, err, `invalid account alias "000000000001" in idp account`)
+
+	_, err = (&IDPAccount{AccountAliases: "production=000000000001"}).AccountAliasMap()
+	require.EqualError(t, err, `invalid account alias "production=000000000001" in idp account`)
+}
+
+func TestIDPAccountMFAAliasMap(t *testing.T) {
+	account := &IDPAccount{MFAAliases: "Office=TwoWayVoiceOffice , app = PhoneAppNotification"}
+	aliases, err := account.MFAAliasMap()
+	require.Nil(t, err)
+	require.Equal(t, map[string]string{"office": "TwoWayVoiceOffice", "app": "PhoneAppNotification"}, aliases)
+
+	aliases, err = (&IDPAccount{}).MFAAliasMap()
+	require.Nil(t, err)
+	require.Empty(t, aliases)
+
+	_, err = (&IDPAccount{MFAAliases: "office"}).MFAAliasMap()
+	require.EqualError(t, err, `invalid mfa alias "office" in idp account`)
+
+	_, err = (&IDPAccount{MFAAliases: "office="}).MFAAliasMap()
+	require.EqualError(t, err, `invalid mfa alias "office=" in idp account`)
+}
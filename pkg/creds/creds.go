@@ -1,5 +1,7 @@
 package creds
 
+import "strings"
+
 // LoginDetails used to authenticate
 type LoginDetails struct {
 	ClientID          string // used by OneLogin
@@ -9,8 +11,44 @@ type LoginDetails struct {
 	Username          string
 	Password          string
 	MFAToken          string
+	MFATOTPSecret     string // used by AzureAD
 	DuoMFAOption      string
 	URL               string
 	StateToken        string // used by Okta
 	OktaSessionCookie string // used by Okta
+	AADSessionCookies string // used by AzureAD
+	ConfigScope       string // used by Okta and AzureAD; keeps the session of accounts from separate config files apart
+	MaskUsername      bool   // show the username masked in prompts and output
+	SkipPrompt        bool   // never prompt, e.g. for the password again once it has been rejected
+}
+
+// DisplayUsername the username as it may be shown, masked when MaskUsername is set
+func (ld *LoginDetails) DisplayUsername() string {
+	if ld.MaskUsername {
+		return MaskUsername(ld.Username)
+	}
+	return ld.Username
+}
+
+// MaskUsername hide all but the first character of the username and its domain, e.g. u***@example.com for
+// user@example.com or EXAMPLE\u*** for EXAMPLE\user, so it can be shown on a shared screen
+func MaskUsername(username string) string {
+	if username == "" {
+		return ""
+	}
+
+	prefix, name, suffix := "", username, ""
+	if i := strings.LastIndex(name, "\\"); i >= 0 {
+		prefix, name = name[:i+1], name[i+1:]
+	}
+	if i := strings.LastIndex(name, "@"); i >= 0 {
+		name, suffix = name[:i], name[i:]
+	}
+
+	first := []rune(name)
+	if len(first) > 0 {
+		first = first[:1]
+	}
+
+	return prefix + string(first) + "***" + suffix
 }
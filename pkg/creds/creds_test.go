@@ -0,0 +1,35 @@
+package creds
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaskUsername(t *testing.T) {
+	tests := []struct {
+		username string
+		want     string
+	}{
+		{"exampleuser@exampledomain.com", "e***@exampledomain.com"},
+		{"a@example.com", "a***@example.com"},
+		{"EXAMPLE\\wolfeidau", "EXAMPLE\\w***"},
+		{"wolfeidau", "w***"},
+		{"élodie@example.fr", "é***@example.fr"},
+		{"@example.com", "***@example.com"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.username, func(t *testing.T) {
+			require.Equal(t, tt.want, MaskUsername(tt.username))
+		})
+	}
+}
+
+func TestLoginDetailsDisplayUsername(t *testing.T) {
+	loginDetails := &LoginDetails{Username: "exampleuser@exampledomain.com"}
+	require.Equal(t, "exampleuser@exampledomain.com", loginDetails.DisplayUsername())
+
+	loginDetails.MaskUsername = true
+	require.Equal(t, "e***@exampledomain.com", loginDetails.DisplayUsername())
+}
@@ -4,6 +4,9 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
 )
 
 // RequestString helper method to dump the http request
@@ -14,7 +17,7 @@ func RequestString(req *http.Request) string {
 		return ""
 	}
 
-	return string(data)
+	return truncateBody(string(data), ContentLimit())
 }
 
 // ResponseString helper method to dump the http response
@@ -25,10 +28,48 @@ func ResponseString(res *http.Response) string {
 		return ""
 	}
 
-	return string(data)
+	return truncateBody(string(data), ContentLimit())
 }
 
 // ContentEnable enable dumping of request / response content
 func ContentEnable() bool {
 	return os.Getenv("DUMP_CONTENT") == "true"
 }
+
+// ContentLimit the number of bytes of each dumped body to keep, set with DUMP_CONTENT_LIMIT, zero keeps them whole
+func ContentLimit() int {
+	limit, err := strconv.Atoi(os.Getenv("DUMP_CONTENT_LIMIT"))
+	if err != nil || limit < 0 {
+		return 0
+	}
+	return limit
+}
+
+// truncateBody cut the body following the headers of a dumped request or response down to the limit, the headers
+// are always kept in full
+func truncateBody(dump string, limit int) string {
+	if limit == 0 {
+		return dump
+	}
+
+	headerEnd := strings.Index(dump, "\r\n\r\n")
+	if headerEnd < 0 {
+		return dump
+	}
+	bodyStart := headerEnd + len("\r\n\r\n")
+	if len(dump)-bodyStart <= limit {
+		return dump
+	}
+
+	end := bodyStart + limit
+	for end > bodyStart && !utf8.RuneStart(dump[end]) {
+		end--
+	}
+
+	return dump[:end] + "..."
+}
+
+// TraceEnable enable logging of the connection timings of each request
+func TraceEnable() bool {
+	return os.Getenv("TRACE_HTTP") == "true"
+}
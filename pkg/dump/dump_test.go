@@ -0,0 +1,41 @@
+package dump
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseStringContentLimit(t *testing.T) {
+	t.Setenv("DUMP_CONTENT", "true")
+	t.Setenv("DUMP_CONTENT_LIMIT", "20")
+
+	body := `<html><script>$Config={"pgid":"ConvergedSignIn","sFT":"flowtoken"}</script></html>`
+	res := &http.Response{
+		StatusCode:    200,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/html"}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+
+	got := ResponseString(res)
+	require.True(t, strings.HasPrefix(got, "HTTP/1.1 200 OK\r\n"))
+	require.Contains(t, got, "Content-Type: text/html\r\n")
+	require.True(t, strings.HasSuffix(got, "\r\n\r\n"+body[:20]+"..."))
+}
+
+func TestTruncateBody(t *testing.T) {
+	dump := "HTTP/1.1 200 OK\r\n\r\n" + "héllo"
+
+	require.Equal(t, dump, truncateBody(dump, 0))
+	require.Equal(t, dump, truncateBody(dump, 6))
+	// never split a multi byte character
+	require.Equal(t, "HTTP/1.1 200 OK\r\n\r\nh...", truncateBody(dump, 2))
+	require.Equal(t, "HTTP/1.1 200 OK\r\n\r\nhé...", truncateBody(dump, 3))
+	require.Equal(t, "no headers", truncateBody("no headers", 2))
+}
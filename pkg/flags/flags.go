@@ -1,39 +1,50 @@
 package flags
 
 import (
+	"time"
+
 	"github.com/versent/saml2aws/v2/pkg/cfg"
 )
 
 // CommonFlags flags common to all of the `saml2aws` commands (except `help`)
 type CommonFlags struct {
-	AppID                 string
-	ClientID              string
-	ClientSecret          string
-	ConfigFile            string
-	IdpAccount            string
-	IdpProvider           string
-	MFA                   string
-	MFAIPAddress          string
-	MFAToken              string
-	URL                   string
-	Username              string
-	Password              string
-	RoleArn               string
-	AmazonWebservicesURN  string
-	SessionDuration       int
-	SkipPrompt            bool
-	SkipVerify            bool
-	Profile               string
-	Subdomain             string
-	ResourceID            string
-	DisableKeychain       bool
-	Region                string
-	CredentialsFile       string
-	SAMLCache             bool
-	SAMLCacheFile         string
-	DisableRememberDevice bool
-	DisableSessions       bool
-	Prompter              string
+	AppID                  string
+	ClientID               string
+	ClientSecret           string
+	ConfigFile             string
+	IdpAccount             string
+	IdpProvider            string
+	MFA                    string
+	MFAIPAddress           string
+	MFAToken               string
+	MFATOTPSecret          string
+	MFARetries             int
+	PasswordRetries        int
+	MFAVerbose             bool
+	SelectMFA              bool
+	URL                    string
+	Username               string
+	Password               string
+	RoleArn                string
+	PrincipalArn           string
+	AmazonWebservicesURN   string
+	SessionDuration        int
+	NoSession              bool
+	SkipPrompt             bool
+	SkipVerify             bool
+	RequireInsecureConfirm bool
+	Profile                string
+	Subdomain              string
+	ResourceID             string
+	DisableKeychain        bool
+	Region                 string
+	CredentialsFile        string
+	SAMLCache              bool
+	SAMLCacheFile          string
+	DisableRememberDevice  bool
+	DisableSessions        bool
+	Prompter               string
+	FailureReport          string
 }
 
 // LoginExecFlags flags for the Login / Exec commands
@@ -44,6 +55,24 @@ type LoginExecFlags struct {
 	DuoMFAOption      string
 	ExecProfile       string
 	CredentialProcess bool
+	PrintExpiry       bool
+	ExpiryFormat      string
+	CLICache          bool
+	OverwriteRegion   bool
+	PrintCredsProcess bool
+	PrintRoleARN      bool
+	CredentialSocket  string
+	Eval              bool
+	CredsTmpfile      bool
+	CredsTmpfileTTL   time.Duration
+	ShowProgress      bool
+}
+
+// LogoutFlags flags for the Logout command
+type LogoutFlags struct {
+	CommonFlags *CommonFlags
+	All         bool
+	AllAccounts bool
 }
 
 type ConsoleFlags struct {
@@ -69,6 +98,10 @@ func ApplyFlagOverrides(commonFlags *CommonFlags, account *cfg.IDPAccount) {
 		account.SkipVerify = commonFlags.SkipVerify
 	}
 
+	if commonFlags.RequireInsecureConfirm {
+		account.RequireInsecureConfirm = commonFlags.RequireInsecureConfirm
+	}
+
 	if commonFlags.IdpProvider != "" {
 		account.Provider = commonFlags.IdpProvider
 	}
@@ -81,6 +114,18 @@ func ApplyFlagOverrides(commonFlags *CommonFlags, account *cfg.IDPAccount) {
 		account.MFAIPAddress = commonFlags.MFAIPAddress
 	}
 
+	if commonFlags.MFARetries != 0 {
+		account.MFARetries = commonFlags.MFARetries
+	}
+
+	if commonFlags.PasswordRetries != 0 {
+		account.PasswordRetries = commonFlags.PasswordRetries
+	}
+
+	if commonFlags.MFAVerbose {
+		account.MFAVerbose = commonFlags.MFAVerbose
+	}
+
 	if commonFlags.AmazonWebservicesURN != "" {
 		account.AmazonWebservicesURN = commonFlags.AmazonWebservicesURN
 	}
@@ -88,6 +133,9 @@ func ApplyFlagOverrides(commonFlags *CommonFlags, account *cfg.IDPAccount) {
 	if commonFlags.SessionDuration != 0 {
 		account.SessionDuration = commonFlags.SessionDuration
 	}
+	if commonFlags.NoSession {
+		account.SessionDuration = cfg.MaxSessionDuration
+	}
 
 	if commonFlags.Profile != "" {
 		account.Profile = commonFlags.Profile
@@ -100,6 +148,9 @@ func ApplyFlagOverrides(commonFlags *CommonFlags, account *cfg.IDPAccount) {
 	if commonFlags.RoleArn != "" {
 		account.RoleARN = commonFlags.RoleArn
 	}
+	if commonFlags.PrincipalArn != "" {
+		account.PrincipalARN = commonFlags.PrincipalArn
+	}
 	if commonFlags.ResourceID != "" {
 		account.ResourceID = commonFlags.ResourceID
 	}
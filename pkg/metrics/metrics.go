@@ -0,0 +1,190 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// AuthAttemptsTotal counts the authentications started, labelled by provider
+	AuthAttemptsTotal = "saml2aws_auth_attempts_total"
+	// AuthSuccessesTotal counts the authentications which returned a SAML assertion, labelled by provider
+	AuthSuccessesTotal = "saml2aws_auth_successes_total"
+	// AuthFailuresTotal counts the authentications which failed, labelled by provider and reason
+	AuthFailuresTotal = "saml2aws_auth_failures_total"
+	// MFATotal counts the MFA challenges completed, labelled by provider and method
+	MFATotal = "saml2aws_mfa_total"
+)
+
+// Recorder receives the authentication events, implement it to forward these to Prometheus or any other
+// metrics system without saml2aws depending on it
+type Recorder interface {
+	AuthAttempt(provider string)
+	AuthSuccess(provider string)
+	AuthFailure(provider string, reason string)
+	MFAUsed(provider string, method string)
+}
+
+type nopRecorder struct{}
+
+func (nopRecorder) AuthAttempt(string)         {}
+func (nopRecorder) AuthSuccess(string)         {}
+func (nopRecorder) AuthFailure(string, string) {}
+func (nopRecorder) MFAUsed(string, string)     {}
+
+var (
+	recorderMu sync.RWMutex
+	recorder   Recorder = nopRecorder{}
+)
+
+// SetRecorder set the recorder the events are sent to, nil turns recording off again
+func SetRecorder(r Recorder) {
+	recorderMu.Lock()
+	defer recorderMu.Unlock()
+
+	if r == nil {
+		r = nopRecorder{}
+	}
+	recorder = r
+}
+
+// Enabled report whether a recorder has been set
+func Enabled() bool {
+	_, nop := current().(nopRecorder)
+	return !nop
+}
+
+func current() Recorder {
+	recorderMu.RLock()
+	defer recorderMu.RUnlock()
+	return recorder
+}
+
+// AuthAttempt record that an authentication has started
+func AuthAttempt(provider string) {
+	current().AuthAttempt(provider)
+}
+
+// AuthSuccess record that an authentication returned a SAML assertion
+func AuthSuccess(provider string) {
+	current().AuthSuccess(provider)
+}
+
+// AuthFailure record that an authentication failed for the reason
+func AuthFailure(provider string, reason string) {
+	current().AuthFailure(provider, reason)
+}
+
+// MFAUsed record that an MFA challenge was completed with the method
+func MFAUsed(provider string, method string) {
+	current().MFAUsed(provider, method)
+}
+
+var metricHelp = map[string]string{
+	AuthAttemptsTotal:  "Authentications started.",
+	AuthSuccessesTotal: "Authentications which returned a SAML assertion.",
+	AuthFailuresTotal:  "Authentications which failed.",
+	MFATotal:           "MFA challenges completed.",
+}
+
+var metricLabels = map[string][]string{
+	AuthAttemptsTotal:  {"provider"},
+	AuthSuccessesTotal: {"provider"},
+	AuthFailuresTotal:  {"provider", "reason"},
+	MFATotal:           {"provider", "method"},
+}
+
+// Registry a Recorder which keeps the counters in memory, these can be read back or written in the
+// Prometheus text format to serve them for scraping
+type Registry struct {
+	mu       sync.Mutex
+	counters map[string]map[string]uint64
+}
+
+// NewRegistry create an empty registry
+func NewRegistry() *Registry {
+	return &Registry{counters: map[string]map[string]uint64{}}
+}
+
+// AuthAttempt increment the attempts counter
+func (r *Registry) AuthAttempt(provider string) {
+	r.inc(AuthAttemptsTotal, provider)
+}
+
+// AuthSuccess increment the successes counter
+func (r *Registry) AuthSuccess(provider string) {
+	r.inc(AuthSuccessesTotal, provider)
+}
+
+// AuthFailure increment the failures counter
+func (r *Registry) AuthFailure(provider string, reason string) {
+	r.inc(AuthFailuresTotal, provider, reason)
+}
+
+// MFAUsed increment the MFA counter
+func (r *Registry) MFAUsed(provider string, method string) {
+	r.inc(MFATotal, provider, method)
+}
+
+// Value return the counter of the metric with the label values, in the order the metric declares its labels
+func (r *Registry) Value(name string, labelValues ...string) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.counters[name][labelSet(name, labelValues)]
+}
+
+// WriteTo write the counters in the Prometheus text exposition format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names := make([]string, 0, len(metricHelp))
+	for name := range metricHelp {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s counter\n", name, metricHelp[name], name)
+
+		series := make([]string, 0, len(r.counters[name]))
+		for labels := range r.counters[name] {
+			series = append(series, labels)
+		}
+		sort.Strings(series)
+		for _, labels := range series {
+			fmt.Fprintf(&b, "%s{%s} %d\n", name, labels, r.counters[name][labels])
+		}
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func (r *Registry) inc(name string, labelValues ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.counters[name] == nil {
+		r.counters[name] = map[string]uint64{}
+	}
+	r.counters[name][labelSet(name, labelValues)]++
+}
+
+// labelSet render the label values of the metric as they appear in the text format, e.g. provider="AzureAD"
+func labelSet(name string, labelValues []string) string {
+	pairs := make([]string, 0, len(labelValues))
+	for i, label := range metricLabels[name] {
+		value := ""
+		if i < len(labelValues) {
+			value = labelValues[i]
+		}
+		pairs = append(pairs, fmt.Sprintf("%s=%q", label, value))
+	}
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	registry := NewRegistry()
+	registry.AuthAttempt("AzureAD")
+	registry.AuthAttempt("AzureAD")
+	registry.AuthSuccess("AzureAD")
+	registry.AuthFailure("AzureAD", "mfa_denied")
+	registry.MFAUsed("AzureAD", "PhoneAppNotification")
+
+	require.Equal(t, uint64(2), registry.Value(AuthAttemptsTotal, "AzureAD"))
+	require.Equal(t, uint64(1), registry.Value(AuthSuccessesTotal, "AzureAD"))
+	require.Equal(t, uint64(1), registry.Value(AuthFailuresTotal, "AzureAD", "mfa_denied"))
+	require.Equal(t, uint64(0), registry.Value(AuthFailuresTotal, "AzureAD", "other"))
+	require.Equal(t, uint64(1), registry.Value(MFATotal, "AzureAD", "PhoneAppNotification"))
+
+	var buf bytes.Buffer
+	_, err := registry.WriteTo(&buf)
+	require.Nil(t, err)
+	require.Equal(t, `# HELP saml2aws_auth_attempts_total Authentications started.
+# TYPE saml2aws_auth_attempts_total counter
+saml2aws_auth_attempts_total{provider="AzureAD"} 2
+# HELP saml2aws_auth_failures_total Authentications which failed.
+# TYPE saml2aws_auth_failures_total counter
+saml2aws_auth_failures_total{provider="AzureAD",reason="mfa_denied"} 1
+# HELP saml2aws_auth_successes_total Authentications which returned a SAML assertion.
+# TYPE saml2aws_auth_successes_total counter
+saml2aws_auth_successes_total{provider="AzureAD"} 1
+# HELP saml2aws_mfa_total MFA challenges completed.
+# TYPE saml2aws_mfa_total counter
+saml2aws_mfa_total{provider="AzureAD",method="PhoneAppNotification"} 1
+`, buf.String())
+}
+
+func TestSetRecorder(t *testing.T) {
+	require.False(t, Enabled())
+	AuthAttempt("AzureAD")
+
+	registry := NewRegistry()
+	SetRecorder(registry)
+	defer SetRecorder(nil)
+	require.True(t, Enabled())
+
+	AuthAttempt("AzureAD")
+	MFAUsed("AzureAD", "OneWaySMS")
+	require.Equal(t, uint64(1), registry.Value(AuthAttemptsTotal, "AzureAD"))
+	require.Equal(t, uint64(1), registry.Value(MFATotal, "AzureAD", "OneWaySMS"))
+
+	SetRecorder(nil)
+	require.False(t, Enabled())
+	AuthAttempt("AzureAD")
+	require.Equal(t, uint64(1), registry.Value(AuthAttemptsTotal, "AzureAD"))
+}
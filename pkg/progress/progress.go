@@ -0,0 +1,40 @@
+package progress
+
+import (
+	"sync"
+)
+
+// Reporter receives the steps of a login as it goes through them, implement it to show the user what saml2aws is
+// waiting on
+type Reporter interface {
+	Step(step string)
+}
+
+type nopReporter struct{}
+
+func (nopReporter) Step(string) {}
+
+var (
+	reporterMu sync.RWMutex
+	reporter   Reporter = nopReporter{}
+)
+
+// SetReporter set the reporter the steps are sent to, nil turns reporting off again
+func SetReporter(r Reporter) {
+	reporterMu.Lock()
+	defer reporterMu.Unlock()
+
+	if r == nil {
+		r = nopReporter{}
+	}
+	reporter = r
+}
+
+// Step report the step the login has reached, e.g. the page of the IdP being handled or the MFA being waited on
+func Step(step string) {
+	reporterMu.RLock()
+	r := reporter
+	reporterMu.RUnlock()
+
+	r.Step(step)
+}
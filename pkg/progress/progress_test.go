@@ -0,0 +1,65 @@
+package progress
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type recordingReporter struct {
+	steps []string
+}
+
+func (r *recordingReporter) Step(step string) {
+	r.steps = append(r.steps, step)
+}
+
+func TestStep(t *testing.T) {
+	Step("ignored without a reporter")
+
+	r := &recordingReporter{}
+	SetReporter(r)
+	Step("ConvergedPassword")
+	Step("ConvergedTFA")
+	SetReporter(nil)
+	Step("ignored once the reporter is unset")
+
+	require.Equal(t, []string{"ConvergedPassword", "ConvergedTFA"}, r.steps)
+}
+
+func TestSpinner(t *testing.T) {
+	var buf bytes.Buffer
+	s := NewSpinner(&buf)
+	// only the calls below draw the spinner, not the ticker
+	s.interval = time.Hour
+	s.Start()
+
+	// nothing is drawn before the first step
+	_, err := s.Writer(&buf).Write([]byte("Authenticating as user ...\n"))
+	require.Nil(t, err)
+	require.Equal(t, "Authenticating as user ...\n", buf.String())
+
+	buf.Reset()
+	s.Step("ConvergedTFA")
+	require.Equal(t, "\r\033[K| ConvergedTFA (0s)", buf.String())
+
+	// the spinner is cleared before anything else is written
+	buf.Reset()
+	_, err = s.Writer(&buf).Write([]byte("Phone approval required.\n"))
+	require.Nil(t, err)
+	require.Equal(t, "\r\033[KPhone approval required.\n", buf.String())
+
+	// and isn't drawn while paused
+	buf.Reset()
+	s.Pause()
+	s.Step("MFA PhoneAppOTP")
+	require.Equal(t, "", buf.String())
+	s.Resume()
+	require.Equal(t, "\r\033[K| MFA PhoneAppOTP (0s)", buf.String())
+
+	buf.Reset()
+	s.Stop()
+	require.Equal(t, "\r\033[K", buf.String())
+}
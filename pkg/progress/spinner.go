@@ -0,0 +1,137 @@
+package progress
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// spinnerFrames plain ASCII so the spinner draws the same in every terminal, windows consoles included
+const spinnerFrames = `|/-\`
+
+// clearLine return to the start of the line and erase it
+const clearLine = "\r\033[K"
+
+// Spinner a Reporter which keeps a spinner, the current step and the time elapsed on the last line of a terminal.
+// Anything else written to the terminal should go through Writer, which clears the line first so the output isn't
+// mixed up with it, and the spinner should be paused while the user is prompted.
+type Spinner struct {
+	mu       sync.Mutex
+	out      io.Writer
+	interval time.Duration
+	started  time.Time
+	step     string
+	frame    int
+	drawn    bool
+	paused   int
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewSpinner create a spinner drawn on the writer, normally STDERR
+func NewSpinner(out io.Writer) *Spinner {
+	return &Spinner{out: out, interval: 100 * time.Millisecond}
+}
+
+// Start draw the spinner until Stop is called, nothing is drawn before the first step
+func (s *Spinner) Start() {
+	s.mu.Lock()
+	s.started = time.Now()
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	s.mu.Unlock()
+
+	go func() {
+		defer close(s.done)
+
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				s.mu.Lock()
+				s.frame++
+				s.draw()
+				s.mu.Unlock()
+			}
+		}
+	}()
+}
+
+// Stop stop drawing and clear the spinner
+func (s *Spinner) Stop() {
+	close(s.stop)
+	<-s.done
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clear()
+}
+
+// Step show the step the login has reached
+func (s *Spinner) Step(step string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.step = step
+	s.draw()
+}
+
+// Pause clear the spinner and stop drawing it until Resume is called, e.g. while the user is prompted
+func (s *Spinner) Pause() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.paused++
+	s.clear()
+}
+
+// Resume draw the spinner again after Pause
+func (s *Spinner) Resume() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.paused--
+	s.draw()
+}
+
+// Writer wrap a writer sharing the terminal with the spinner so the spinner is cleared before each write, it's
+// drawn again on the next tick
+func (s *Spinner) Writer(w io.Writer) io.Writer {
+	return &spinnerWriter{spinner: s, out: w}
+}
+
+type spinnerWriter struct {
+	spinner *Spinner
+	out     io.Writer
+}
+
+func (w *spinnerWriter) Write(p []byte) (int, error) {
+	w.spinner.mu.Lock()
+	defer w.spinner.mu.Unlock()
+
+	w.spinner.clear()
+	return w.out.Write(p)
+}
+
+func (s *Spinner) draw() {
+	if s.step == "" || s.paused > 0 {
+		return
+	}
+
+	frame := spinnerFrames[s.frame%len(spinnerFrames)]
+	fmt.Fprintf(s.out, "%s%c %s (%ds)", clearLine, frame, s.step, int(time.Since(s.started).Seconds()))
+	s.drawn = true
+}
+
+func (s *Spinner) clear() {
+	if !s.drawn {
+		return
+	}
+
+	fmt.Fprint(s.out, clearLine)
+	s.drawn = false
+}
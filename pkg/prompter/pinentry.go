@@ -62,6 +62,11 @@ func (p *PinentryPrompter) ChooseWithDefault(prompt string, def string, choices
 	return p.DefaultPrompter.ChooseWithDefault(prompt, def, choices)
 }
 
+// ChooseWithSearch is running the default CLI ChooseWithSearch
+func (p *PinentryPrompter) ChooseWithSearch(prompt string, choices []string) (string, error) {
+	return p.DefaultPrompter.ChooseWithSearch(prompt, choices)
+}
+
 // Choose is running the default CLI Choose
 func (p *PinentryPrompter) Choose(pr string, options []string) int {
 	return p.DefaultPrompter.Choose(pr, options)
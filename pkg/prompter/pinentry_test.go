@@ -33,6 +33,7 @@ type FakeDefaultPrompter struct {
 	CalledRequestSecurityCode bool
 	CalledChoose              bool
 	CalledChooseWithDefault   bool
+	CalledChooseWithSearch    bool
 	CalledString              bool
 	CalledStringRequired      bool
 	CalledPassword            bool
@@ -51,6 +52,10 @@ func (f *FakeDefaultPrompter) ChooseWithDefault(p string, d string, c []string)
 	f.CalledChooseWithDefault = true
 	return "", nil
 }
+func (f *FakeDefaultPrompter) ChooseWithSearch(p string, c []string) (string, error) {
+	f.CalledChooseWithSearch = true
+	return "", nil
+}
 func (f *FakeDefaultPrompter) String(p string, defaultValue string) string {
 	f.CalledString = true
 	return ""
@@ -2,7 +2,9 @@ package prompter
 
 import (
 	"fmt"
+	"os"
 	"regexp"
+	"strings"
 )
 
 // ActivePrompter is by default the survey cli prompter
@@ -12,6 +14,7 @@ var ActivePrompter Prompter = NewCli()
 type Prompter interface {
 	RequestSecurityCode(string) string
 	ChooseWithDefault(string, string, []string) (string, error)
+	ChooseWithSearch(string, []string) (string, error)
 	Choose(string, []string) int
 	StringRequired(string) string
 	String(string, string) string
@@ -60,6 +63,52 @@ func ChooseWithDefault(pr string, defaultValue string, options []string) (string
 	return ActivePrompter.ChooseWithDefault(pr, defaultValue, options)
 }
 
+// searchThreshold lists with fewer options than this are offered as a plain menu
+const searchThreshold = 10
+
+// interactive report whether the user can type at the prompt, a search is of no use otherwise
+var interactive = func() bool {
+	fi, err := os.Stdin.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// ChooseWithSearch given the choice return the option selected, long lists can be filtered by typing part of each
+// word of the option. The first option is the default, short lists and input which isn't a terminal get a plain menu.
+func ChooseWithSearch(pr string, options []string) (string, error) {
+	if len(options) < searchThreshold || !interactive() {
+		return ChooseWithDefault(pr, "", options)
+	}
+
+	return ActivePrompter.ChooseWithSearch(pr, options)
+}
+
+// FuzzyMatch report whether the option matches the filter, every word of the filter must appear in the option with
+// its letters in order, though not necessarily next to each other, ignoring case. e.g. "prd adm" matches
+// "production / AdminRole".
+func FuzzyMatch(filter string, option string) bool {
+	option = strings.ToLower(option)
+	for _, word := range strings.Fields(strings.ToLower(filter)) {
+		if !containsSubsequence(option, word) {
+			return false
+		}
+	}
+	return true
+}
+
+// containsSubsequence report whether the letters of word appear in s in order
+func containsSubsequence(s string, word string) bool {
+	letters := []rune(word)
+	for _, r := range s {
+		if len(letters) == 0 {
+			break
+		}
+		if r == letters[0] {
+			letters = letters[1:]
+		}
+	}
+	return len(letters) == 0
+}
+
 // Choose given the choice return the option selected
 func Choose(pr string, options []string) int {
 	return ActivePrompter.Choose(pr, options)
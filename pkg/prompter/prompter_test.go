@@ -0,0 +1,65 @@
+package prompter
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/versent/saml2aws/v2/mocks"
+)
+
+func TestFuzzyMatch(t *testing.T) {
+	tests := []struct {
+		filter string
+		option string
+		want   bool
+	}{
+		{"", "production / AdminRole", true},
+		{"prod", "production / AdminRole", true},
+		{"PRD", "production / AdminRole", true},
+		{"prd adm", "production / AdminRole", true},
+		{"adm prd", "production / AdminRole", true},
+		{"123456", "123456789012 / Developer", true},
+		{"dpr", "production / AdminRole", false},
+		{"prod dev", "production / AdminRole", false},
+		{"staging", "production / AdminRole", false},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s in %s", tt.filter, tt.option), func(t *testing.T) {
+			assert.Equal(t, tt.want, FuzzyMatch(tt.filter, tt.option))
+		})
+	}
+}
+
+func TestChooseWithSearch(t *testing.T) {
+	oldPrompter, oldInteractive := ActivePrompter, interactive
+	defer func() { ActivePrompter, interactive = oldPrompter, oldInteractive }()
+
+	var many []string
+	for i := 0; i < searchThreshold; i++ {
+		many = append(many, fmt.Sprintf("account%d / Developer", i))
+	}
+	few := many[:3]
+
+	pr := &mocks.Prompter{}
+	ActivePrompter = pr
+	pr.Mock.On("ChooseWithDefault", "Please choose the role", "account0 / Developer", few).Return("account1 / Developer", nil)
+	pr.Mock.On("ChooseWithDefault", "Please choose the role", "account0 / Developer", many).Return("account2 / Developer", nil)
+	pr.Mock.On("ChooseWithSearch", "Please choose the role", many).Return("account3 / Developer", nil)
+
+	interactive = func() bool { return true }
+	selected, err := ChooseWithSearch("Please choose the role", few)
+	assert.Nil(t, err)
+	assert.Equal(t, "account1 / Developer", selected)
+
+	selected, err = ChooseWithSearch("Please choose the role", many)
+	assert.Nil(t, err)
+	assert.Equal(t, "account3 / Developer", selected)
+
+	interactive = func() bool { return false }
+	selected, err = ChooseWithSearch("Please choose the role", many)
+	assert.Nil(t, err)
+	assert.Equal(t, "account2 / Developer", selected)
+
+	pr.Mock.AssertExpectations(t)
+}
@@ -45,6 +45,27 @@ func (cli *CliPrompter) ChooseWithDefault(pr string, defaultValue string, option
 	return "", errors.New("bad input")
 }
 
+// ChooseWithSearch given the choice return the option selected, typing filters the options with FuzzyMatch
+func (cli *CliPrompter) ChooseWithSearch(pr string, options []string) (string, error) {
+	selected := ""
+	prompt := &survey.Select{
+		Message:  pr,
+		Options:  options,
+		PageSize: 15,
+		Filter: func(filter string, value string, index int) bool {
+			return FuzzyMatch(filter, value)
+		},
+	}
+	_ = survey.AskOne(prompt, &selected, survey.WithValidator(survey.Required))
+
+	for _, option := range options {
+		if selected == option {
+			return option, nil
+		}
+	}
+	return "", errors.New("bad input")
+}
+
 // Choose given the choice return the option selected
 func (cli *CliPrompter) Choose(pr string, options []string) int {
 	selected := ""
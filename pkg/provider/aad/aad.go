@@ -2,59 +2,439 @@ package aad
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/PuerkitoBio/goquery"
+	"github.com/beevik/etree"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 
+	"github.com/versent/saml2aws/v2/helper/credentials"
+	"github.com/versent/saml2aws/v2/pkg/awspartition"
 	"github.com/versent/saml2aws/v2/pkg/cfg"
 	"github.com/versent/saml2aws/v2/pkg/creds"
+	"github.com/versent/saml2aws/v2/pkg/metrics"
+	"github.com/versent/saml2aws/v2/pkg/progress"
 	"github.com/versent/saml2aws/v2/pkg/prompter"
 	"github.com/versent/saml2aws/v2/pkg/provider"
 )
 
 var logger = logrus.WithField("provider", "AzureAD")
 
+// mfaBehavior how the user completes a given MFA method
+type mfaBehavior int
+
+const (
+	// mfaPoll wait on EndAuth without involving the user, used for unknown methods
+	mfaPoll mfaBehavior = iota
+	// mfaEnterCode prompt for the code sent to or generated by the user
+	mfaEnterCode
+	// mfaApprovePush wait on the user approving a notification
+	mfaApprovePush
+	// mfaAnswerCall wait on the user answering a phone call
+	mfaAnswerCall
+)
+
+// mfaMethodBehaviors maps the AuthMethodId of each known MFA proof to how it is completed
+var mfaMethodBehaviors = map[string]mfaBehavior{
+	"PhoneAppOTP":                mfaEnterCode,
+	"OneWaySMS":                  mfaEnterCode,
+	"ConsolidatedTelephony":      mfaEnterCode,
+	"PhoneAppNotification":       mfaApprovePush,
+	"CompanionAppsNotification":  mfaApprovePush,
+	"TwoWayVoiceMobile":          mfaAnswerCall,
+	"TwoWayVoiceAlternateMobile": mfaAnswerCall,
+	"TwoWayVoiceOffice":          mfaAnswerCall,
+}
+
+// mfaAliases the names the mfa may be set to instead of the AuthMethodId of a method, keyed in lower case, the
+// mfa_aliases of the account add to and override these
+var mfaAliases = map[string]string{
+	"push":         "PhoneAppNotification",
+	"notification": "PhoneAppNotification",
+	"totp":         "PhoneAppOTP",
+	"otp":          "PhoneAppOTP",
+	"sms":          "OneWaySMS",
+	"call":         "TwoWayVoiceMobile",
+	"voice":        "TwoWayVoiceMobile",
+}
+
+// MFAMethods the values the mfa of an account may be set to, Auto uses the default method of the user and the
+// rest are the AuthMethodId of a method
+func MFAMethods() []string {
+	methods := make([]string, 0, len(mfaMethodBehaviors))
+	for method := range mfaMethodBehaviors {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+
+	return append([]string{"Auto"}, methods...)
+}
+
+// ResolveMFA the method the mfa of an account stands for, Auto and the AuthMethodId of a method are returned as
+// they are while an alias such as push or sms, compared regardless of case, is translated to the method it names.
+// The aliases configured with mfa_aliases are looked up before the built in ones.
+func ResolveMFA(mfa string, aliases map[string]string) string {
+	if mfa == "Auto" {
+		return mfa
+	}
+	if _, ok := mfaMethodBehaviors[mfa]; ok {
+		return mfa
+	}
+	if method, ok := aliases[strings.ToLower(mfa)]; ok {
+		return method
+	}
+	if method, ok := mfaAliases[strings.ToLower(mfa)]; ok {
+		return method
+	}
+	return mfa
+}
+
+// ValidateMFA check the mfa, once its aliases are resolved, is one of MFAMethods, it's compared exactly to the
+// AuthMethodId of the methods offered so anything else silently falls back to the first of these. The error names
+// the method which was likely meant, e.g. PhoneAppOTP for phoneappotp, and lists the valid options.
+func ValidateMFA(mfa string, aliases map[string]string) error {
+	mfa = ResolveMFA(mfa, aliases)
+
+	methods := MFAMethods()
+	for _, method := range methods {
+		if mfa == method {
+			return nil
+		}
+	}
+
+	suggestion := ""
+	for _, method := range methods {
+		if strings.EqualFold(mfa, method) {
+			suggestion = method
+		}
+	}
+
+	if suggestion != "" {
+		return fmt.Errorf("unknown AzureAD MFA method %q, did you mean %s? Valid options are: %s", mfa, suggestion, strings.Join(methods, ", "))
+	}
+	return fmt.Errorf("unknown AzureAD MFA method %q, valid options are: %s", mfa, strings.Join(methods, ", "))
+}
+
+// ErrClaimsChallenge returned when a continuous access evaluation (CAE) claims challenge can't be satisfied
+var ErrClaimsChallenge = errors.New("unable to satisfy the continuous access evaluation (CAE) claims challenge")
+
+// claimsRegexp locate the claims of a challenge in either a WWW-Authenticate header or the embedded page config
+var claimsRegexp = regexp.MustCompile(`"?claims"?\s*[:=]\s*"([^"]+)"`)
+
+// maxMetaRefreshes the number of meta refresh redirects followed during a login before giving up on a redirect loop
+const maxMetaRefreshes = 5
+
+// maxSecurityInfoNags the number of optional security info pages skipped during a login before giving up on a loop
+const maxSecurityInfoNags = 3
+
+// serviceUnavailableErrorCodes the error codes of the "Sorry, but we're having trouble signing you in" page
+// Azure AD serves during an incident, the step which led to the page is retried
+var serviceUnavailableErrorCodes = map[string]bool{
+	"90033": true, // a transient error has occurred
+}
+
+// maxServiceUnavailableRetries the number of times a step is retried while Azure AD is unavailable
+const maxServiceUnavailableRetries = 3
+
+// serviceUnavailableDelay the delay before the first retry, this doubles on each retry
+var serviceUnavailableDelay = 2 * time.Second
+
+// defaultStartOperation the operation of the start URL unless start_operation is set, apps which don't support a
+// linked sign in need SignIn
+const defaultStartOperation = "LinkedSignIn"
+
+// defaultStartURLRetries the number of times the start URL is fetched again after a network error, unless
+// start_url_retries says otherwise
+const defaultStartURLRetries = 2
+
+// startURLRetryDelay the delay before fetching the start URL again, this doubles on each retry
+var startURLRetryDelay = time.Second
+
+// remoteConnectPollInterval how often to ask whether the sign in has been approved on the other device, unless
+// Azure AD says otherwise
+var remoteConnectPollInterval = 5 * time.Second
+
+// remoteConnectExpiry how long to wait for the sign in to be approved on the other device, unless Azure AD says
+// otherwise
+var remoteConnectExpiry = 15 * time.Minute
+
+// errRemoteConnectExpired returned when the remote connect code wasn't used in time
+var errRemoteConnectExpired = errors.New("the code expired before the sign in was approved")
+
+// lockoutErrorCodes the error codes of Azure AD smart lockout, returned once too many sign ins have failed
+var lockoutErrorCodes = map[string]bool{
+	"50053": true,
+}
+
+// lockoutCooldown how long Azure AD locks the sign in after the first lockout, it doubles with every lockout
+// which follows up to maxLockoutCooldown
+var lockoutCooldown = time.Minute
+
+const maxLockoutCooldown = 30 * time.Minute
+
+// invalidPasswordErrorCodes the error codes of a wrong username or password, the password is asked for again
+// when password_retries allows it
+var invalidPasswordErrorCodes = map[string]bool{
+	"50126": true,
+}
+
+// ErrUnknownPage the authentication reached a page it doesn't know how to handle, the details are in the
+// UnknownPageError wrapping it
+var ErrUnknownPage = errors.New("reached an unknown page within the authentication process")
+
+// UnknownPageError describes the page the authentication stopped at, the correlation and session IDs are
+// what Microsoft support asks for
+type UnknownPageError struct {
+	Pgid          string
+	ErrorCode     string
+	Message       string // the service exception message of an error page, e.g. AADSTS50105: ...
+	CorrelationID string
+	SessionID     string
+	StatusCode    int
+	URL           string
+}
+
+func (e *UnknownPageError) Error() string {
+	if e.Pgid == "" {
+		return "failed get SAMLAssertion"
+	}
+	if e.Message != "" {
+		return fmt.Sprintf("failed get SAMLAssertion, stopped at page %s: %s", e.Pgid, e.Message)
+	}
+	return fmt.Sprintf("failed get SAMLAssertion, stopped at page %s", e.Pgid)
+}
+
+func (e *UnknownPageError) Unwrap() error {
+	return ErrUnknownPage
+}
+
+// newUnknownPageError describe the page of the response, the query is left out of the URL as it carries tokens
+func newUnknownPageError(res *http.Response, convergedResponse *ConvergedResponse) *UnknownPageError {
+	pageErr := &UnknownPageError{StatusCode: res.StatusCode}
+	if res.Request != nil {
+		pageURL := *res.Request.URL
+		pageURL.RawQuery = ""
+		pageURL.Fragment = ""
+		pageErr.URL = pageURL.String()
+	}
+	if convergedResponse != nil {
+		pageErr.Pgid = convergedResponse.Pgid
+		pageErr.ErrorCode = convergedResponse.SErrorCode
+		// Azure AD renders some errors as a page served with a 200, the message is all that explains them
+		pageErr.Message = strings.TrimSpace(convergedResponse.StrServiceExceptionMessage)
+		pageErr.CorrelationID = convergedResponse.CorrelationID
+		pageErr.SessionID = convergedResponse.SessionID
+	}
+	return pageErr
+}
+
+// ErrSignInLocked Azure AD has locked the sign in, every attempt made before the lockout passes extends it
+var ErrSignInLocked = errors.New("Azure AD has locked the sign in after too many failed attempts")
+
+// ErrPasswordChangeRequired returned when Azure AD insists on a password change which can't be skipped
+var ErrPasswordChangeRequired = errors.New("Azure AD requires the password to be changed, sign in with a browser to change it")
+
+// ErrMfaRegistrationRequired Azure AD insists an MFA method is registered before signing in, the details are in
+// the MfaRegistrationRequiredError wrapping it
+var ErrMfaRegistrationRequired = errors.New("Azure AD requires an MFA method to be registered, sign in with a browser to register one")
+
+// MfaRegistrationRequiredError returned when the tenant mandates MFA registration, which saml2aws can't do
+type MfaRegistrationRequiredError struct {
+	URL string // where to register, empty when the page doesn't say
+}
+
+func (e *MfaRegistrationRequiredError) Error() string {
+	if e.URL == "" {
+		return ErrMfaRegistrationRequired.Error()
+	}
+	return fmt.Sprintf("%s at %s", ErrMfaRegistrationRequired, e.URL)
+}
+
+func (e *MfaRegistrationRequiredError) Unwrap() error {
+	return ErrMfaRegistrationRequired
+}
+
+// ErrMfaDenied returned when the user rejects the MFA request
+var ErrMfaDenied = errors.New("MFA request denied by user")
+
+// mfaDenialResults EndAuth result values reported once the user rejects the request, as opposed to
+// AuthenticationPending which is reported while waiting on them
+var mfaDenialResults = map[string]bool{
+	"PhoneAppDenied":        true,
+	"PhoneAppFraudReported": true,
+	"UserDenied":            true,
+}
+
+// errMfaTransient wrapped by errors from an MFA attempt which failed without the user answering it, such
+// as a push which timed out or a call which went to voicemail, these can be started over with BeginAuth
+var errMfaTransient = errors.New("MFA request was not answered")
+
+// mfaTransientResults EndAuth result values where the request never reached the user or went unanswered,
+// unlike a wrong code or a denial another attempt may succeed
+var mfaTransientResults = map[string]bool{
+	"PhoneAppNoResponse":                         true,
+	"SMSAuthFailedNoResponse":                    true,
+	"SMSAuthFailedProviderCouldntSendSMS":        true,
+	"UserVoiceAuthFailedCallWentToVoicemail":     true,
+	"UserVoiceAuthFailedPhoneHungUp":             true,
+	"UserVoiceAuthFailedPhoneUnreachable":        true,
+	"UserVoiceAuthFailedProviderCouldntSendCall": true,
+}
+
+// defaultMFAIdleWarning how often to remind the user we are still waiting on an MFA approval
+const defaultMFAIdleWarning = 15 * time.Second
+
+// mfaCodeRejectedResults EndAuth result values reported when a verification code is wrong, the user can
+// try another code against the same request
+var mfaCodeRejectedResults = map[string]bool{
+	"OathCodeIncorrect":             true,
+	"OathCodeDuplicate":             true,
+	"SMSAuthFailedWrongCodeEntered": true,
+}
+
+// totpPeriod the time step of the codes generated by authenticator apps
+const totpPeriod = 30 * time.Second
+
+// totpSkewSteps the time steps tried when generating codes, the current one first then its neighbours
+// as the clocks of this machine and Azure AD often disagree by a few seconds
+var totpSkewSteps = []int{0, -1, 1}
+
+// maxOtpPrompts how many times the user is asked for a code before giving up
+const maxOtpPrompts = 3
+
+// timeNow replaced in tests to generate codes for a known time
+var timeNow = time.Now
+
+// sleep replaced in tests to record the waits between the MFA requests
+var sleep = time.Sleep
+
 // Client wrapper around AzureAD enabling authentication and retrieval of assertions
 type Client struct {
 	provider.ValidateBase
 
-	client     *provider.HTTPClient
-	idpAccount *cfg.IDPAccount
+	client         *provider.HTTPClient
+	idpAccount     *cfg.IDPAccount
+	mfaIdleWarning time.Duration
+	mfaPerformed   bool
+	totpSecret     string
+	loginHint      string
+	listingMfa     bool
+	mfaMethods     []userProof
+	lockouts       *lockoutTracker
+	credTypes      map[string]credentialTypeEntry
+	passwordRetry  int
+	requestLog     *provider.RequestLog
+	earlyPush      *earlyPush
+	origins        map[string]bool
+}
+
+// sessionCookieNames the cookies of the Azure AD session, these are kept between logins so the next one isn't asked
+// for the password or MFA until the session expires
+var sessionCookieNames = []string{"ESTSAUTH", "ESTSAUTHPERSISTENT"}
+
+// session the session cookies and the sign in host they are for, stored as JSON in the keychain
+type session struct {
+	URL     string            `json:"url"`
+	Cookies map[string]string `json:"cookies"`
 }
 
+// earlyPush a BeginAuth sent for a push as soon as the MFA page was read, with mfa_push_early, it's answered
+// while the page is still being dealt with and collected by the first MFA attempt
+type earlyPush struct {
+	proof userProof
+	sent  time.Time
+	done  chan struct{}
+	resp  mfaResponse
+	err   error
+}
+
+// credentialTypeTTL how long a GetCredentialType result is reused for the same username, kept well within the
+// lifetime of the flow token the lookup was made with
+const credentialTypeTTL = 5 * time.Minute
+
+// credentialTypeEntry a GetCredentialType result reused when signing in as the same user again, e.g. for each
+// of the additional apps
+type credentialTypeEntry struct {
+	response  GetCredentialTypeResponse
+	fetchedAt time.Time
+}
+
+// MFAMethod a proof Azure AD offers for MFA, Method is the value to configure as the mfa and Display
+// the masked phone number or device which tells proofs sharing a method apart
+type MFAMethod struct {
+	Method  string
+	Display string
+	Default bool
+}
+
+// String the method as it is listed to the user, e.g. "OneWaySMS: +XX XXXXXXXX55 (default)"
+func (m MFAMethod) String() string {
+	line := fmt.Sprintf("%s: %s", m.Method, m.Display)
+	if m.Default {
+		line += " (default)"
+	}
+	return line
+}
+
+// errMfaMethodsListed stops the sign in once the MFA methods have been collected by ListMFAMethods
+var errMfaMethodsListed = errors.New("MFA methods listed")
+
 // Autogenrated Converged Response struct
 // for some cases, some fields may not exist
 type ConvergedResponse struct {
-	URLGetCredentialType    string             `json:"urlGetCredentialType"`
-	ArrUserProofs           []userProof        `json:"arrUserProofs"`
-	URLSkipMfaRegistration  string             `json:"urlSkipMfaRegistration"`
-	OPerAuthPollingInterval map[string]float64 `json:"oPerAuthPollingInterval"`
-	URLBeginAuth            string             `json:"urlBeginAuth"`
-	URLEndAuth              string             `json:"urlEndAuth"`
-	URLPost                 string             `json:"urlPost"`
-	SErrorCode              string             `json:"sErrorCode"`
-	SErrTxt                 string             `json:"sErrTxt"`
-	SPOSTUsername           string             `json:"sPOST_Username"`
-	SFT                     string             `json:"sFT"`
-	SFTName                 string             `json:"sFTName"`
-	SCtx                    string             `json:"sCtx"`
-	Hpgact                  int                `json:"hpgact"`
-	Hpgid                   int                `json:"hpgid"`
-	Pgid                    string             `json:"pgid"`
-	APICanary               string             `json:"apiCanary"`
-	Canary                  string             `json:"canary"`
-	CorrelationID           string             `json:"correlationId"`
-	SessionID               string             `json:"sessionId"`
+	URLGetCredentialType       string             `json:"urlGetCredentialType"`
+	ArrUserProofs              []userProof        `json:"arrUserProofs"`
+	URLSkipMfaRegistration     string             `json:"urlSkipMfaRegistration"`
+	URLSetUpMfa                string             `json:"urlSetUpMfa"`
+	URLSkipPasswordChange      string             `json:"urlSkipPasswordChange"`
+	OPerAuthPollingInterval    map[string]float64 `json:"oPerAuthPollingInterval"`
+	URLBeginAuth               string             `json:"urlBeginAuth"`
+	URLEndAuth                 string             `json:"urlEndAuth"`
+	URLPost                    string             `json:"urlPost"`
+	SErrorCode                 string             `json:"sErrorCode"`
+	SErrTxt                    string             `json:"sErrTxt"`
+	StrServiceExceptionMessage string             `json:"strServiceExceptionMessage"`
+	SPOSTUsername              string             `json:"sPOST_Username"`
+	SFT                        string             `json:"sFT"`
+	SFTName                    string             `json:"sFTName"`
+	SCtx                       string             `json:"sCtx"`
+	Hpgact                     int                `json:"hpgact"`
+	Hpgid                      int                `json:"hpgid"`
+	Pgid                       string             `json:"pgid"`
+	APICanary                  string             `json:"apiCanary"`
+	Canary                     string             `json:"canary"`
+	CorrelationID              string             `json:"correlationId"`
+	SessionID                  string             `json:"sessionId"`
+	ArrSessions                []accountSession   `json:"arrSessions"`
+	URLSessionState            string             `json:"urlSessionState"`
+	URLHomeTenantRedirect      string             `json:"urlHomeTenantRedirect"`
+	SHomeTenantDomain          string             `json:"sHomeTenantDomain"`
+}
+
+// accountSession an account already signed in on this machine, as offered by the account picker
+type accountSession struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
 }
 
 // Autogenerated GetCredentialType Request struct
@@ -75,6 +455,7 @@ type GetCredentialTypeRequest struct {
 	IsSignup                       bool   `json:"isSignup"`
 	FlowToken                      string `json:"flowToken"`
 	IsAccessPassSupported          bool   `json:"isAccessPassSupported"`
+	LoginHint                      string `json:"loginHint,omitempty"`
 }
 
 // Autogenerated GetCredentialType Response struct
@@ -86,21 +467,44 @@ type GetCredentialTypeResponse struct {
 	IsUnmanaged    bool   `json:"IsUnmanaged"`
 	ThrottleStatus int    `json:"ThrottleStatus"`
 	Credentials    struct {
-		PrefCredential        int         `json:"PrefCredential"`
-		HasPassword           bool        `json:"HasPassword"`
-		RemoteNgcParams       interface{} `json:"RemoteNgcParams"`
-		FidoParams            interface{} `json:"FidoParams"`
-		SasParams             interface{} `json:"SasParams"`
-		CertAuthParams        interface{} `json:"CertAuthParams"`
-		GoogleParams          interface{} `json:"GoogleParams"`
-		FacebookParams        interface{} `json:"FacebookParams"`
-		FederationRedirectURL string      `json:"FederationRedirectUrl"`
+		PrefCredential        int                  `json:"PrefCredential"`
+		HasPassword           bool                 `json:"HasPassword"`
+		RemoteNgcParams       interface{}          `json:"RemoteNgcParams"`
+		FidoParams            interface{}          `json:"FidoParams"`
+		SasParams             interface{}          `json:"SasParams"`
+		CertAuthParams        interface{}          `json:"CertAuthParams"`
+		GoogleParams          interface{}          `json:"GoogleParams"`
+		FacebookParams        interface{}          `json:"FacebookParams"`
+		FederationRedirectURL string               `json:"FederationRedirectUrl"`
+		RemoteConnectParams   *remoteConnectParams `json:"RemoteConnectParams"`
 	} `json:"Credentials"`
 	FlowToken          string `json:"FlowToken"`
 	IsSignupDisallowed bool   `json:"IsSignupDisallowed"`
 	APICanary          string `json:"apiCanary"`
 }
 
+// remoteConnectParams the code to approve the sign in with on another device, returned by GetCredentialType
+// when remote connect is supported
+type remoteConnectParams struct {
+	UserCode        string `json:"userCode"`
+	VerificationURI string `json:"verificationUri"`
+	DeviceCode      string `json:"deviceCode"`
+	Interval        int    `json:"interval"`
+	ExpiresIn       int    `json:"expiresIn"`
+}
+
+// remoteConnectStatusRequest asks whether the sign in has been approved on the other device
+type remoteConnectStatusRequest struct {
+	DeviceCode string `json:"DeviceCode"`
+	FlowToken  string `json:"FlowToken"`
+}
+
+// remoteConnectStatusResponse the state of the sign in, the flow token is returned once it's approved
+type remoteConnectStatusResponse struct {
+	Status    string `json:"Status"`
+	FlowToken string `json:"FlowToken"`
+}
+
 // MFA Request struct
 type mfaRequest struct {
 	AuthMethodID       string `json:"AuthMethodId"`
@@ -138,88 +542,743 @@ type userProof struct {
 // New create a new AzureAD client
 func New(idpAccount *cfg.IDPAccount) (*Client, error) {
 
+	aliases, err := idpAccount.MFAAliasMap()
+	if err != nil {
+		return nil, err
+	}
+	if idpAccount.MFA != "" {
+		if err := ValidateMFA(idpAccount.MFA, aliases); err != nil {
+			logger.Warnf("%v, the first MFA method offered will be used", err)
+		}
+	}
+
+	if idpAccount.Origin != "" {
+		if u, err := url.Parse(idpAccount.Origin); err != nil || u.Scheme == "" || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+			return nil, fmt.Errorf("origin %s isn't a scheme and host, e.g. https://login.microsoftonline.com", idpAccount.Origin)
+		}
+	}
+
+	verifyPin, err := pinnedCertificateVerifier(idpAccount.TLSPinnedSHA256)
+	if err != nil {
+		return nil, errors.Wrap(err, "error parsing pinned certificates")
+	}
+
 	tr := &http.Transport{
 		Proxy:           http.ProxyFromEnvironment,
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: idpAccount.SkipVerify, Renegotiation: tls.RenegotiateFreelyAsClient},
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: idpAccount.SkipVerify, VerifyConnection: verifyPin},
+	}
+
+	if err := provider.ApplyProxyAndCA(tr, idpAccount); err != nil {
+		return nil, err
+	}
+	if err := provider.ApplyTLSRenegotiation(tr, idpAccount); err != nil {
+		return nil, err
+	}
+	provider.ApplyTimeouts(tr, idpAccount)
+	if idpAccount.DisableHTTP2 {
+		provider.DisableHTTP2(tr)
+	}
+
+	headers := tenantRestrictionHeaders(idpAccount)
+	customHeaders, err := idpAccount.CustomHeaderMap()
+	if err != nil {
+		return nil, errors.Wrap(err, "error parsing custom headers")
+	}
+	for name, value := range customHeaders {
+		headers.Set(name, value)
 	}
 
-	client, err := provider.NewHTTPClient(tr, provider.BuildHttpClientOpts(idpAccount))
+	requestLog := provider.NewRequestLog(idpAccount)
+	rt := provider.NewTraceRoundTripper(provider.NewHeaderRoundTripper(requestLog.RoundTripper(tr), headers))
+	client, err := provider.NewHTTPClient(rt, provider.BuildHttpClientOpts(idpAccount))
 	if err != nil {
 		return nil, errors.Wrap(err, "error building http client")
 	}
 
 	return &Client{
-		client:     client,
-		idpAccount: idpAccount,
+		client:         client,
+		idpAccount:     idpAccount,
+		mfaIdleWarning: mfaIdleWarningInterval(idpAccount),
+		lockouts:       newLockoutTracker(),
+		requestLog:     requestLog,
+	}, nil
+}
+
+// mfaIdleWarningInterval returns zero when no reminders should be printed while waiting on MFA, this
+// is the case when disabled in the configuration or when nobody is watching stderr
+func mfaIdleWarningInterval(idpAccount *cfg.IDPAccount) time.Duration {
+	if idpAccount.MFAIdleWarning < 0 {
+		return 0
+	}
+	if fi, err := os.Stderr.Stat(); err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return 0
+	}
+	if idpAccount.MFAIdleWarning == 0 {
+		return defaultMFAIdleWarning
+	}
+	return time.Duration(idpAccount.MFAIdleWarning) * time.Second
+}
+
+// pinnedCertificateVerifier build a check which rejects connections unless one of the presented certificates, either the
+// leaf or an intermediate, matches one of the SHA-256 fingerprints. This is done even when the chain is otherwise valid.
+func pinnedCertificateVerifier(fingerprints string) (func(tls.ConnectionState) error, error) {
+	if fingerprints == "" {
+		return nil, nil
+	}
+
+	pins := map[string]bool{}
+	for _, fingerprint := range strings.Split(fingerprints, ",") {
+		fingerprint = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(fingerprint), ":", ""))
+		pin, err := hex.DecodeString(fingerprint)
+		if err != nil || len(pin) != sha256.Size {
+			return nil, fmt.Errorf("invalid SHA-256 fingerprint %q", fingerprint)
+		}
+		pins[fingerprint] = true
+	}
+
+	return func(cs tls.ConnectionState) error {
+		for _, cert := range cs.PeerCertificates {
+			sum := sha256.Sum256(cert.Raw)
+			if pins[hex.EncodeToString(sum[:])] {
+				return nil
+			}
+		}
+		return fmt.Errorf("no certificate presented by %s matches the pinned certificates", cs.ServerName)
 	}, nil
 }
 
+// tenantRestrictionHeaders build the headers required by networks which enforce Azure AD tenant restrictions
+// see https://learn.microsoft.com/en-us/azure/active-directory/manage-apps/tenant-restrictions
+func tenantRestrictionHeaders(idpAccount *cfg.IDPAccount) http.Header {
+	headers := http.Header{}
+	if idpAccount.RestrictAccessTenants != "" {
+		headers.Set("Restrict-Access-To-Tenants", idpAccount.RestrictAccessTenants)
+	}
+	if idpAccount.RestrictAccessContext != "" {
+		headers.Set("Restrict-Access-Context", idpAccount.RestrictAccessContext)
+	}
+	return headers
+}
+
+// MFAPerformed whether the user completed MFA during the last call to Authenticate
+func (ac *Client) MFAPerformed() bool {
+	return ac.mfaPerformed
+}
+
 // Authenticate to AzureAD and return the data from the body of the SAML assertion.
 func (ac *Client) Authenticate(loginDetails *creds.LoginDetails) (string, error) {
-	var samlAssertion string
-	var res *http.Response
-	var err error
-	var resBody []byte
-	var resBodyStr string
-	var convergedResponse *ConvergedResponse
+	ac.mfaPerformed = false
+	ac.totpSecret = loginDetails.MFATOTPSecret
+	ac.loginHint = ""
+	ac.passwordRetry = 0
+	if ac.idpAccount.LoginHint {
+		ac.loginHint = loginDetails.Username
+	}
+
+	// don't add to a lockout by signing in again before it has passed
+	if err := ac.lockouts.check(loginDetails); err != nil {
+		return "", err
+	}
+
+	ac.origins = map[string]bool{}
+	ac.restoreSession(loginDetails)
 
 	// idpAccount.URL = https://account.activedirectory.windowsazure.com
 
-	// startSAML
-	startURL := fmt.Sprintf("%s/applications/redirecttofederatedapplication.aspx?Operation=LinkedSignIn&applicationId=%s", ac.idpAccount.URL, ac.idpAccount.AppID)
+	// startSAML, or sign in to the app tiles first when the app ID has to be discovered
+	startURL := ac.startURL(ac.idpAccount.AppID)
+	if ac.discoveringAppID() {
+		startURL = ac.idpAccount.URL + "/"
+	}
+
+	res, err := ac.getStartURL(startURL)
+	if err != nil {
+		return "", errors.Wrap(err, "error retrieving entry URL")
+	}
+
+	samlAssertion, err := ac.processAuthFlow(res, loginDetails)
+	if err != nil {
+		return samlAssertion, err
+	}
+	ac.lockouts.clear(loginDetails.Username)
+
+	if err := ac.saveSession(loginDetails); err != nil {
+		return samlAssertion, err
+	}
+
+	return samlAssertion, nil
+}
+
+// restoreSession put the session cookies saved by an earlier login back in the cookie jar
+func (ac *Client) restoreSession(loginDetails *creds.LoginDetails) {
+	if ac.idpAccount.DisableSessions || loginDetails.AADSessionCookies == "" || ac.client.Jar == nil {
+		return
+	}
+
+	var saved session
+	if err := json.Unmarshal([]byte(loginDetails.AADSessionCookies), &saved); err != nil {
+		logger.WithError(err).Debug("ignoring the saved session")
+		return
+	}
+	u, err := url.Parse(saved.URL)
+	if err != nil {
+		logger.WithError(err).Debug("ignoring the saved session")
+		return
+	}
+
+	cookies := make([]*http.Cookie, 0, len(saved.Cookies))
+	for name, value := range saved.Cookies {
+		cookies = append(cookies, &http.Cookie{Name: name, Value: value, Path: "/", Secure: true, HttpOnly: true})
+	}
+	ac.client.Jar.SetCookies(u, cookies)
+	logger.WithField("url", saved.URL).Debug("restored the saved session")
+}
+
+// saveSession keep the session cookies of the sign in host in the keychain, scoped like the Okta session
+func (ac *Client) saveSession(loginDetails *creds.LoginDetails) error {
+	if ac.idpAccount.DisableSessions || ac.client.Jar == nil {
+		return nil
+	}
+
+	origins := make([]string, 0, len(ac.origins))
+	for origin := range ac.origins {
+		origins = append(origins, origin)
+	}
+	sort.Strings(origins)
+
+	for _, origin := range origins {
+		u, err := url.Parse(origin)
+		if err != nil {
+			continue
+		}
+		cookies := map[string]string{}
+		for _, cookie := range ac.client.Jar.Cookies(u) {
+			for _, name := range sessionCookieNames {
+				if cookie.Name == name {
+					cookies[name] = cookie.Value
+				}
+			}
+		}
+		if len(cookies) == 0 {
+			continue
+		}
+
+		data, err := json.Marshal(session{URL: origin, Cookies: cookies})
+		if err != nil {
+			return errors.Wrap(err, "error encoding the session")
+		}
+		if err := credentials.SaveCredentials(credentials.SessionCookieURL(loginDetails.URL, loginDetails.ConfigScope), loginDetails.Username, string(data)); err != nil {
+			return errors.Wrap(err, "error storing the session")
+		}
+		return nil
+	}
+
+	return nil
+}
+
+// getStartURL fetch the URL the login starts at, this is the request which fails when the network isn't quite up
+// yet, e.g. just after connecting the VPN, so a network error is retried a few times before giving up
+func (ac *Client) getStartURL(startURL string) (*http.Response, error) {
+	ac.requestLog.SetStep("start")
+
+	retries := ac.idpAccount.StartURLRetries
+	if retries == 0 {
+		retries = defaultStartURLRetries
+	}
+
+	delay := startURLRetryDelay
+	for attempt := 0; ; attempt++ {
+		res, err := ac.client.Get(startURL)
+		if err == nil || attempt >= retries {
+			return res, err
+		}
+		logger.WithError(err).Debug("fetching the start URL failed")
+		log.Printf("Unable to reach Azure AD, retrying in %v (%d of %d)", delay, attempt+1, retries)
+		sleep(delay)
+		delay *= 2
+	}
+}
+
+// ListMFAMethods sign in up to the MFA step and return the methods Azure AD offers the user without
+// starting MFA, no methods are returned when Azure AD doesn't ask for MFA
+func (ac *Client) ListMFAMethods(loginDetails *creds.LoginDetails) ([]MFAMethod, error) {
+	ac.listingMfa = true
+	ac.mfaMethods = nil
+	defer func() { ac.listingMfa = false }()
+
+	if _, err := ac.Authenticate(loginDetails); err != nil && errors.Cause(err) != errMfaMethodsListed {
+		return nil, err
+	}
 
-	res, err = ac.client.Get(startURL)
+	methods := make([]MFAMethod, len(ac.mfaMethods))
+	for i, v := range ac.mfaMethods {
+		methods[i] = v.mfaMethod()
+	}
+	return methods, nil
+}
+
+// AuthenticateApps authenticate to the configured app and then reuse the established session to retrieve
+// the assertions of the additional apps, these normally don't ask for the password or MFA again. The
+// assertions are returned by app ID.
+func (ac *Client) AuthenticateApps(loginDetails *creds.LoginDetails, appIDs []string) (map[string]string, error) {
+	samlAssertion, err := ac.Authenticate(loginDetails)
 	if err != nil {
-		return samlAssertion, errors.Wrap(err, "error retrieving entry URL")
+		return nil, err
+	}
+
+	assertions := map[string]string{ac.idpAccount.AppID: samlAssertion}
+	for _, appID := range appIDs {
+		appID = strings.TrimSpace(appID)
+		if _, ok := assertions[appID]; ok || appID == "" {
+			continue
+		}
+
+		logger.WithField("appID", appID).Debug("retrieving assertion for additional app")
+		res, err := ac.client.Get(ac.startURL(appID))
+		if err != nil {
+			return nil, errors.Wrapf(err, "error retrieving entry URL for app %s", appID)
+		}
+
+		samlAssertion, err := ac.processAuthFlow(res, loginDetails)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error retrieving SAML assertion for app %s", appID)
+		}
+		assertions[appID] = samlAssertion
 	}
 
-AuthProcessor:
+	return assertions, nil
+}
+
+// processAuthFlow follow the pages of the sign in flow from the response until the SAML assertion is found
+func (ac *Client) processAuthFlow(res *http.Response, loginDetails *creds.LoginDetails) (string, error) {
+	var samlAssertion string
+	var err error
+	var resBody []byte
+	var resBodyStr string
+	var convergedResponse *ConvergedResponse
+	var claimsChallenged bool
+	var metaRefreshes int
+	var serviceRetries int
+	var passwordSubmitted bool
+	var homeTenantRedirected bool
+	var securityInfoNags int
+
 	for {
+		if res.Request != nil && ac.origins != nil {
+			// the session cookies are looked for on the hosts the flow went through
+			ac.origins[res.Request.URL.Scheme+"://"+res.Request.URL.Host] = true
+		}
 		resBody, _ = io.ReadAll(res.Body)
 		resBodyStr = string(resBody)
 		// reset res.Body so it can be read again later if required
 		res.Body = io.NopCloser(bytes.NewBuffer(resBody))
+		lockoutCode := lockoutErrorCode(resBodyStr)
 
 		switch {
+		case lockoutCode != "":
+			// retrying would only extend the lockout
+			return samlAssertion, ac.signInLocked(lockoutCode, loginDetails)
+		case ac.isClaimsChallenge(res, resBodyStr):
+			ac.processing("claims challenge")
+			if claimsChallenged {
+				return samlAssertion, ErrClaimsChallenge
+			}
+			claimsChallenged = true
+			res, err = ac.processClaimsChallenge(res, resBodyStr)
+		case strings.Contains(resBodyStr, `"pgid":"ConvergedChooseAccount"`):
+			ac.processing("ConvergedChooseAccount")
+			res, err = ac.processAccountPicker(res, resBodyStr, loginDetails)
+		case strings.Contains(resBodyStr, `"urlHomeTenantRedirect"`):
+			ac.processing("home tenant redirect")
+			if homeTenantRedirected {
+				return samlAssertion, errors.New("redirected to the home tenant more than once")
+			}
+			homeTenantRedirected = true
+			res, err = ac.processHomeTenantRedirect(res, resBodyStr)
+		case strings.Contains(resBodyStr, "ConvergedChangePassword"):
+			ac.processing("ConvergedChangePassword")
+			res, err = ac.processChangePassword(res, resBodyStr)
+		case strings.Contains(resBodyStr, `"pgid":"ConvergedPassword"`):
+			ac.processing("ConvergedPassword")
+			if passwordSubmitted && !invalidPasswordErrorCodes[ac.signInErrorCode(resBodyStr)] {
+				return samlAssertion, errors.New("the password page was shown again after submitting the password")
+			}
+			passwordSubmitted = true
+			res, err = ac.processPasswordPage(res, resBodyStr, loginDetails)
 		case strings.Contains(resBodyStr, "ConvergedSignIn"):
-			logger.Debug("processing ConvergedSignIn")
+			ac.processing("ConvergedSignIn")
 			res, err = ac.processConvergedSignIn(res, resBodyStr, loginDetails)
 		case strings.Contains(resBodyStr, "ConvergedProofUpRedirect"):
-			logger.Debug("processing ConvergedProofUpRedirect")
+			ac.processing("ConvergedProofUpRedirect")
 			res, err = ac.processConvergedProofUpRedirect(res, resBodyStr)
 		case strings.Contains(resBodyStr, "KmsiInterrupt"):
-			logger.Debug("processing KmsiInterrupt")
-			res, err = ac.processKmsiInterrupt(res, resBodyStr)
+			ac.processing("KmsiInterrupt")
+			res, samlAssertion, err = ac.processKmsiInterrupt(res, resBodyStr)
+			if err == nil && samlAssertion != "" {
+				ac.processing("SAMLResponse")
+				return samlAssertion, nil
+			}
 		case strings.Contains(resBodyStr, "ConvergedTFA"):
-			logger.Debug("processing ConvergedTFA")
+			ac.processing("ConvergedTFA")
 			res, err = ac.processConvergedTFA(res, resBodyStr)
 		case strings.Contains(resBodyStr, "SAMLRequest"):
-			logger.Debug("processing SAMLRequest")
+			ac.processing("SAMLRequest")
 			res, err = ac.processSAMLRequest(res, resBodyStr)
 		case ac.isHiddenForm(resBodyStr):
-			if samlAssertion, _ = ac.getSamlAssertion(resBodyStr); samlAssertion != "" {
-				logger.Debug("processing a SAMLResponse")
+			if samlAssertion, err = ac.getSamlAssertion(resBodyStr); err != nil {
+				return "", err
+			}
+			if samlAssertion != "" {
+				ac.processing("SAMLResponse")
+				if err := ac.checkSAMLResponseAction(res, resBodyStr); err != nil {
+					return "", err
+				}
 				return samlAssertion, nil
 			}
-			logger.Debug("processing a 'hiddenform'")
-			res, err = ac.reProcessForm(resBodyStr)
+			ac.processing("hiddenform")
+			res, err = ac.reProcessForm(res, resBodyStr)
+		case ac.discoveringAppID() && strings.Contains(resBodyStr, "applicationId="):
+			ac.processing("app tiles")
+			res, err = ac.processAppTiles(resBodyStr)
+		case metaRefreshTarget(resBodyStr) != "":
+			ac.processing("meta refresh")
+			if metaRefreshes++; metaRefreshes > maxMetaRefreshes {
+				return samlAssertion, errors.New("too many meta refresh redirects")
+			}
+			res, err = ac.processMetaRefresh(res, resBodyStr)
 		default:
 			if strings.Contains(resBodyStr, "$Config") {
+				convergedResponse = nil
 				if err := ac.unmarshalEmbeddedJson(resBodyStr, &convergedResponse); err != nil {
 					return samlAssertion, errors.Wrap(err, "unmarshal error")
 				}
+				if convergedResponse.Pgid == "ConvergedError" && serviceUnavailableErrorCodes[convergedResponse.SErrorCode] {
+					if serviceRetries >= maxServiceUnavailableRetries {
+						return samlAssertion, fmt.Errorf("Azure AD is unavailable, error %s persisted after %d retries", convergedResponse.SErrorCode, serviceRetries)
+					}
+					delay := serviceUnavailableDelay << serviceRetries
+					serviceRetries++
+					log.Printf("Azure AD is having trouble signing you in (error %s), retrying in %v", convergedResponse.SErrorCode, delay)
+					sleep(delay)
+					res, err = ac.retryRequest(res)
+					break
+				}
+				if skipURL := ac.securityInfoNagSkipURL(res, resBodyStr); skipURL != "" && convergedResponse.Pgid != "ConvergedError" {
+					ac.processing("security info")
+					if securityInfoNags++; securityInfoNags > maxSecurityInfoNags {
+						return samlAssertion, errors.New("too many security info pages")
+					}
+					logger.WithField("pgid", convergedResponse.Pgid).Debug("asking later to add security info")
+					res, err = ac.client.Get(skipURL)
+					if err != nil {
+						err = errors.Wrap(err, "error skipping the security info page")
+					}
+					break
+				}
 				logger.Debug("unknown process step found:", convergedResponse.Pgid)
 			} else {
 				logger.Debug("reached an unknown page within the authentication process")
 			}
-			break AuthProcessor
+			return samlAssertion, newUnknownPageError(res, convergedResponse)
 		}
 		if err != nil {
 			return samlAssertion, err
 		}
 	}
+}
+
+// processing log the step of the flow the response is handled by, the requests made from it are logged under it
+func (ac *Client) processing(step string) {
+	logger.Debug("processing ", step)
+	ac.requestLog.SetStep(step)
+	progress.Step(step)
+}
+
+// lockoutErrorCode the smart lockout error code of the page, empty when the sign in isn't locked
+func lockoutErrorCode(srcBodyStr string) string {
+	for code := range lockoutErrorCodes {
+		if strings.Contains(srcBodyStr, `"sErrorCode":"`+code+`"`) {
+			return code
+		}
+	}
+	return ""
+}
+
+// signInLocked record the lockout of the user and explain how long to wait before signing in again
+func (ac *Client) signInLocked(code string, loginDetails *creds.LoginDetails) error {
+	cooldown := ac.lockouts.record(loginDetails.Username)
+	return errors.Wrapf(ErrSignInLocked, "error %s, wait at least %v before signing in again as every attempt made while locked extends the lockout", code, cooldown)
+}
+
+// lockoutRecord the recent lockouts of a user and when the last one passes
+type lockoutRecord struct {
+	Lockouts int       `json:"lockouts"`
+	Until    time.Time `json:"until"`
+}
+
+// lockoutTracker remember the lockouts by user in a file so later runs, e.g. from a script, don't keep
+// signing in while the user is locked
+type lockoutTracker struct {
+	filename string
+}
+
+func newLockoutTracker() *lockoutTracker {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		logger.WithError(err).Debug("unable to locate the home directory, lockouts aren't remembered")
+		return nil
+	}
+	return &lockoutTracker{filename: filepath.Join(home, ".aws", "saml2aws", "aad_lockouts.json")}
+}
+
+// check return an error while a recorded lockout of the user hasn't passed
+func (lt *lockoutTracker) check(loginDetails *creds.LoginDetails) error {
+	record, ok := lt.load()[strings.ToLower(loginDetails.Username)]
+	if !ok || !timeNow().Before(record.Until) {
+		return nil
+	}
+	return errors.Wrapf(ErrSignInLocked, "the sign in of %s is locked until %s, wait before signing in again", loginDetails.DisplayUsername(), record.Until.Local().Format(time.Kitchen))
+}
+
+// record remember a lockout of the user, the time to wait before signing in again is returned
+func (lt *lockoutTracker) record(username string) time.Duration {
+	records := lt.load()
+	record := records[strings.ToLower(username)]
+	record.Lockouts++
+
+	cooldown := lockoutCooldown
+	for i := 1; i < record.Lockouts && cooldown < maxLockoutCooldown; i++ {
+		cooldown *= 2
+	}
+	if cooldown > maxLockoutCooldown {
+		cooldown = maxLockoutCooldown
+	}
+	record.Until = timeNow().Add(cooldown)
+
+	records[strings.ToLower(username)] = record
+	lt.save(records)
+
+	return cooldown
+}
+
+// clear forget the lockouts of the user once signing in succeeds
+func (lt *lockoutTracker) clear(username string) {
+	records := lt.load()
+	if _, ok := records[strings.ToLower(username)]; !ok {
+		return
+	}
+	delete(records, strings.ToLower(username))
+	lt.save(records)
+}
+
+func (lt *lockoutTracker) load() map[string]lockoutRecord {
+	records := map[string]lockoutRecord{}
+	if lt == nil {
+		return records
+	}
+
+	data, err := os.ReadFile(lt.filename)
+	if err != nil {
+		return records
+	}
+	if err := json.Unmarshal(data, &records); err != nil {
+		logger.WithError(err).Debug("ignoring unreadable lockout file")
+		return map[string]lockoutRecord{}
+	}
+	return records
+}
+
+func (lt *lockoutTracker) save(records map[string]lockoutRecord) {
+	if lt == nil {
+		return
+	}
+
+	data, err := json.Marshal(records)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(lt.filename), 0700)
+	}
+	if err == nil {
+		err = os.WriteFile(lt.filename, data, 0600)
+	}
+	if err != nil {
+		logger.WithError(err).Debug("unable to save lockout file")
+	}
+}
+
+// retryRequest send the request which led to the response again, the body of a POST is replayed
+func (ac *Client) retryRequest(res *http.Response) (*http.Response, error) {
+	req := res.Request.Clone(res.Request.Context())
+	if res.Request.GetBody != nil {
+		body, err := res.Request.GetBody()
+		if err != nil {
+			return res, errors.Wrap(err, "error replaying request body")
+		}
+		req.Body = body
+	}
+
+	res, err := ac.client.Do(req)
+	if err != nil {
+		return res, errors.Wrap(err, "error retrying request")
+	}
+
+	return res, nil
+}
+
+// isClaimsChallenge a CAE enabled tenant can demand fresh claims part way through the flow, either as a bearer
+// challenge in the response headers or as an interstitial error page
+func (ac *Client) isClaimsChallenge(res *http.Response, resBodyStr string) bool {
+	return strings.Contains(res.Header.Get("WWW-Authenticate"), "insufficient_claims") ||
+		(strings.Contains(resBodyStr, "$Config") && strings.Contains(resBodyStr, `"error":"insufficient_claims"`))
+}
+
+// processClaimsChallenge resubmit the challenged request with the claims the challenge asks for
+func (ac *Client) processClaimsChallenge(res *http.Response, srcBodyStr string) (*http.Response, error) {
+	claims := challengeClaims(res.Header.Get("WWW-Authenticate"))
+	if claims == "" {
+		claims = challengeClaims(srcBodyStr)
+	}
+	if claims == "" {
+		return res, errors.Wrap(ErrClaimsChallenge, "no claims found in the challenge")
+	}
+
+	challengeURL := *res.Request.URL
+	query := challengeURL.Query()
+	query.Set("claims", claims)
+	challengeURL.RawQuery = query.Encode()
+
+	res, err := ac.client.Get(challengeURL.String())
+	if err != nil {
+		return res, errors.Wrap(err, "error retrieving claims challenge results")
+	}
+
+	return res, nil
+}
+
+// challengeClaims extract the claims, which are usually base64 encoded JSON, from a challenge
+func challengeClaims(challenge string) string {
+	match := claimsRegexp.FindStringSubmatch(challenge)
+	if match == nil {
+		return ""
+	}
+	claims := match[1]
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.RawURLEncoding} {
+		if decoded, err := encoding.DecodeString(claims); err == nil && json.Valid(decoded) {
+			return string(decoded)
+		}
+	}
+	return ""
+}
+
+func (ac *Client) startURL(appID string) string {
+	operation := ac.idpAccount.StartOperation
+	if operation == "" {
+		operation = defaultStartOperation
+	}
+	startURL := fmt.Sprintf("%s/applications/redirecttofederatedapplication.aspx?Operation=%s&applicationId=%s", ac.idpAccount.URL, url.QueryEscape(operation), appID)
+	if ac.loginHint != "" {
+		startURL += "&login_hint=" + url.QueryEscape(ac.loginHint)
+	}
+	return startURL
+}
+
+// discoveringAppID the configured app ID always wins over discovery by name
+func (ac *Client) discoveringAppID() bool {
+	return ac.idpAccount.AppID == "" && ac.idpAccount.AppName != ""
+}
+
+// processAppTiles look up the app ID by name in the app tiles the user is presented with after signing in, the
+// discovered app ID is kept on the account so the caller is able to save it
+func (ac *Client) processAppTiles(srcBodyStr string) (*http.Response, error) {
+	appID, err := findAppID(srcBodyStr, ac.idpAccount.AppName)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.WithField("appID", appID).Debug("discovered app ID")
+	ac.idpAccount.AppID = appID
+
+	res, err := ac.client.Get(ac.startURL(appID))
+	if err != nil {
+		return res, errors.Wrap(err, "error retrieving entry URL")
+	}
+
+	return res, nil
+}
 
-	return samlAssertion, errors.New("failed get SAMLAssertion")
+// processMetaRefresh follow the redirect of a page which uses a meta refresh rather than a script or an HTTP redirect
+func (ac *Client) processMetaRefresh(res *http.Response, srcBodyStr string) (*http.Response, error) {
+	target := ac.fullUrl(res, metaRefreshTarget(srcBodyStr))
+	logger.WithField("url", target).Debug("following meta refresh")
+
+	res, err := ac.client.Get(target)
+	if err != nil {
+		return res, errors.Wrap(err, "error following meta refresh")
+	}
+
+	return res, nil
+}
+
+// metaRefreshTarget the URL a <meta http-equiv="refresh" content="0;url=..."> tag redirects to, empty when the page
+// has none. Refresh tags within noscript, such as the one Azure AD adds to every page, aren't parsed as elements so
+// they are ignored.
+func metaRefreshTarget(srcBodyStr string) string {
+	if !strings.Contains(strings.ToLower(srcBodyStr), "http-equiv") {
+		return ""
+	}
+
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(srcBodyStr))
+	if err != nil {
+		return ""
+	}
+
+	var target string
+	doc.Find("meta[http-equiv]").EachWithBreak(func(i int, s *goquery.Selection) bool {
+		if !strings.EqualFold(s.AttrOr("http-equiv", ""), "refresh") {
+			return true
+		}
+		for _, part := range strings.Split(s.AttrOr("content", ""), ";") {
+			part = strings.TrimSpace(part)
+			if len(part) > 4 && strings.EqualFold(part[:4], "url=") {
+				target = strings.Trim(strings.TrimSpace(part[4:]), `'"`)
+				break
+			}
+		}
+		return target == ""
+	})
+
+	return target
+}
+
+// findAppID search the app tiles for a link to the application with the given name
+func findAppID(srcBodyStr string, appName string) (string, error) {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(srcBodyStr))
+	if err != nil {
+		return "", errors.Wrap(err, "failed to build document from app tiles")
+	}
+
+	var appID string
+	doc.Find("a[href*='applicationId=']").EachWithBreak(func(i int, s *goquery.Selection) bool {
+		name := strings.TrimSpace(s.AttrOr("title", ""))
+		if name == "" {
+			name = strings.TrimSpace(s.Text())
+		}
+		if !strings.EqualFold(name, appName) {
+			return true
+		}
+		href, _ := s.Attr("href")
+		u, err := url.Parse(href)
+		if err != nil {
+			return true
+		}
+		appID = u.Query().Get("applicationId")
+		return appID == ""
+	})
+
+	if appID == "" {
+		return "", fmt.Errorf("unable to locate app %q in the app tiles", appName)
+	}
+
+	return appID, nil
 }
 
 func (ac *Client) processConvergedSignIn(res *http.Response, srcBodyStr string, loginDetails *creds.LoginDetails) (*http.Response, error) {
@@ -234,28 +1293,226 @@ func (ac *Client) processConvergedSignIn(res *http.Response, srcBodyStr string,
 
 	refererUrl := res.Request.URL.String()
 
-	getCredentialTypeResponse, _, err := ac.requestGetCredentialType(refererUrl, loginDetails, convergedResponse)
+	getCredentialTypeResponse, err := ac.credentialType(refererUrl, loginDetails, convergedResponse)
 	if err != nil {
 		return res, errors.Wrap(err, "error processing GetCredentialType request")
 	}
 
-	federationRedirectURL := getCredentialTypeResponse.Credentials.FederationRedirectURL
+	credentials := getCredentialTypeResponse.Credentials
+
+	// federated users sign in at their own idp, the password is only ever sent there and never posted to
+	// Azure AD, for pure federated tenants Azure AD doesn't hold a password at all
+	if credentials.FederationRedirectURL != "" {
+		logger.WithField("hasPassword", credentials.HasPassword).Debug("following federation redirect")
+		return ac.processADFSAuthentication(credentials.FederationRedirectURL, loginDetails)
+	}
+
+	if credentials.RemoteConnectParams != nil {
+		return ac.processRemoteConnect(loginRequestUrl, credentials.RemoteConnectParams, loginDetails, convergedResponse)
+	}
+
+	// posting the password would only fail, and send it to Azure AD for nothing
+	if !credentials.HasPassword {
+		return res, fmt.Errorf("Azure AD holds no password for %s and didn't redirect to a federated idp, sign in with remote_connect or the browser provider instead", loginDetails.DisplayUsername())
+	}
+
+	return ac.processAuthentication(loginRequestUrl, refererUrl, loginDetails, convergedResponse)
+}
+
+// processRemoteConnect show the code to approve the sign in with on another device and poll until it has been,
+// for when neither the password nor the MFA can be entered here
+func (ac *Client) processRemoteConnect(loginUrl string, params *remoteConnectParams, loginDetails *creds.LoginDetails, convergedResponse *ConvergedResponse) (*http.Response, error) {
+	log.Printf("To sign in, open %s on another device and enter the code %s", params.VerificationURI, params.UserCode)
+
+	interval := remoteConnectPollInterval
+	if params.Interval > 0 {
+		interval = time.Duration(params.Interval) * time.Second
+	}
+	expiry := remoteConnectExpiry
+	if params.ExpiresIn > 0 {
+		expiry = time.Duration(params.ExpiresIn) * time.Second
+	}
+	deadline := timeNow().Add(expiry)
 
-	if federationRedirectURL != "" {
-		res, err = ac.processADFSAuthentication(federationRedirectURL, loginDetails)
+	for {
+		status, err := ac.requestRemoteConnectStatus(params, convergedResponse)
 		if err != nil {
-			return res, err
+			return nil, errors.Wrap(err, "error processing remote connect status")
 		}
-	} else {
-		res, err = ac.processAuthentication(loginRequestUrl, refererUrl, loginDetails, convergedResponse)
-		if err != nil {
-			return res, err
+
+		switch status.Status {
+		case "Approved":
+			formValues := url.Values{}
+			formValues.Set(convergedResponse.SFTName, status.FlowToken)
+			formValues.Set("ctx", convergedResponse.SCtx)
+			formValues.Set("login", loginDetails.Username)
+			formValues.Set("loginfmt", loginDetails.Username)
+
+			req, err := http.NewRequest("POST", loginUrl, strings.NewReader(formValues.Encode()))
+			if err != nil {
+				return nil, errors.Wrap(err, "error building remote connect login request")
+			}
+			req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+			res, err := ac.client.Do(req)
+			if err != nil {
+				return res, errors.Wrap(err, "error retrieving remote connect login results")
+			}
+			return res, nil
+		case "Declined":
+			return nil, ErrMfaDenied
+		case "Expired":
+			return nil, errRemoteConnectExpired
+		case "Pending":
+		default:
+			return nil, fmt.Errorf("remote connect failed with status %s", status.Status)
 		}
+
+		if timeNow().After(deadline) {
+			return nil, errRemoteConnectExpired
+		}
+		sleep(interval)
+	}
+}
+
+func (ac *Client) requestRemoteConnectStatus(params *remoteConnectParams, convergedResponse *ConvergedResponse) (remoteConnectStatusResponse, error) {
+	var status remoteConnectStatusResponse
+
+	reqBodyJson, err := json.Marshal(remoteConnectStatusRequest{DeviceCode: params.DeviceCode, FlowToken: convergedResponse.SFT})
+	if err != nil {
+		return status, errors.Wrap(err, "failed to build remote connect status request JSON")
+	}
+
+	req, err := http.NewRequest("POST", convergedResponse.URLSessionState, strings.NewReader(string(reqBodyJson)))
+	if err != nil {
+		return status, errors.Wrap(err, "error building remote connect status request")
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("canary", convergedResponse.APICanary)
+	ac.setOrigin(req)
+
+	res, err := ac.client.Do(req)
+	if err != nil {
+		return status, errors.Wrap(err, "error retrieving remote connect status")
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return status, fmt.Errorf("remote connect status request failed with %s", res.Status)
+	}
+
+	if err := ac.decodeJSON(res.Body, &status); err != nil {
+		return status, errors.Wrap(err, "error decoding remote connect status")
+	}
+
+	return status, nil
+}
+
+// processHomeTenantRedirect follow the redirect of a guest (B2B) user to the tenant their account belongs to, the
+// sign in carries on there and returns to the tenant of the app afterwards
+func (ac *Client) processHomeTenantRedirect(res *http.Response, srcBodyStr string) (*http.Response, error) {
+	var convergedResponse *ConvergedResponse
+
+	if err := ac.unmarshalEmbeddedJson(srcBodyStr, &convergedResponse); err != nil {
+		return res, errors.Wrap(err, "home tenant redirect response unmarshal error")
+	}
+
+	redirectUrl, err := url.Parse(ac.fullUrl(res, convergedResponse.URLHomeTenantRedirect))
+	if err != nil {
+		return res, errors.Wrap(err, "error parsing home tenant redirect URL")
+	}
+	// the home tenant signs in at the same Azure AD endpoint, anything else isn't followed with the session
+	if !strings.EqualFold(redirectUrl.Host, res.Request.URL.Host) {
+		return res, fmt.Errorf("refusing the home tenant redirect to %s", redirectUrl.Host)
+	}
+
+	home := convergedResponse.SHomeTenantDomain
+	if home == "" {
+		home = "unknown"
+	}
+	logger.WithField("homeTenant", home).Debug("following home tenant redirect")
+	log.Printf("Signing in as a guest, continuing at the home tenant %s", home)
+
+	req, err := http.NewRequest("GET", redirectUrl.String(), nil)
+	if err != nil {
+		return res, errors.Wrap(err, "error building home tenant request")
+	}
+	req.Header.Add("Referer", res.Request.URL.String())
+
+	res, err = ac.client.Do(req)
+	if err != nil {
+		return res, errors.Wrap(err, "error retrieving home tenant sign in")
 	}
 
 	return res, nil
 }
 
+// processAccountPicker answer the "Pick an account" page shown when several accounts are signed in on the
+// machine, the configured user is picked when listed otherwise we "Use another account" and sign in as usual
+func (ac *Client) processAccountPicker(res *http.Response, srcBodyStr string, loginDetails *creds.LoginDetails) (*http.Response, error) {
+	var convergedResponse *ConvergedResponse
+
+	if err := ac.unmarshalEmbeddedJson(srcBodyStr, &convergedResponse); err != nil {
+		return res, errors.Wrap(err, "ConvergedChooseAccount response unmarshal error")
+	}
+
+	for _, session := range convergedResponse.ArrSessions {
+		if !strings.EqualFold(session.Name, loginDetails.Username) {
+			continue
+		}
+
+		// the hint has already been tried, picking the same account again would loop
+		pickURL := *res.Request.URL
+		query := pickURL.Query()
+		if strings.EqualFold(query.Get("login_hint"), session.Name) {
+			break
+		}
+		query.Set("login_hint", session.Name)
+		pickURL.RawQuery = query.Encode()
+
+		logger.WithField("sessionID", session.ID).Debug("picking the signed in account")
+		res, err := ac.client.Get(pickURL.String())
+		if err != nil {
+			return res, errors.Wrap(err, "error retrieving account picker results")
+		}
+		return res, nil
+	}
+
+	logger.Debug("using another account")
+	return ac.processConvergedSignIn(res, srcBodyStr, loginDetails)
+}
+
+// credentialType the GetCredentialType result for the user, served from the cache while it is fresh, the flow
+// token and canary of a cached result belong to an earlier flow so they are dropped
+func (ac *Client) credentialType(refererUrl string, loginDetails *creds.LoginDetails, convergedResponse *ConvergedResponse) (GetCredentialTypeResponse, error) {
+	// each sign in needs a device code of its own with remote connect
+	if ac.idpAccount.RemoteConnect {
+		response, _, err := ac.requestGetCredentialType(refererUrl, loginDetails, convergedResponse)
+		return response, err
+	}
+
+	key := strings.ToLower(loginDetails.Username)
+	if entry, ok := ac.credTypes[key]; ok && timeNow().Sub(entry.fetchedAt) < credentialTypeTTL {
+		logger.Debug("using cached GetCredentialType result")
+		response := entry.response
+		response.FlowToken = ""
+		response.APICanary = ""
+		return response, nil
+	}
+
+	response, _, err := ac.requestGetCredentialType(refererUrl, loginDetails, convergedResponse)
+	if err != nil {
+		return response, err
+	}
+
+	if ac.credTypes == nil {
+		ac.credTypes = map[string]credentialTypeEntry{}
+	}
+	ac.credTypes[key] = credentialTypeEntry{response: response, fetchedAt: timeNow()}
+
+	return response, nil
+}
+
 func (ac *Client) requestGetCredentialType(refererUrl string, loginDetails *creds.LoginDetails, convergedResponse *ConvergedResponse) (GetCredentialTypeResponse, *http.Response, error) {
 	var res *http.Response
 	var getCredentialTypeResponse GetCredentialTypeResponse
@@ -269,6 +1526,10 @@ func (ac *Client) requestGetCredentialType(refererUrl string, loginDetails *cred
 		IsFidoSupported:      false,
 		OriginalRequest:      convergedResponse.SCtx,
 		FlowToken:            convergedResponse.SFT,
+		// the device code it returns can only be used once, see credentialType
+		IsRemoteConnectSupported: ac.idpAccount.RemoteConnect,
+		// sent along with the login_hint of the start URL when login_hint is set
+		LoginHint: ac.loginHint,
 	}
 	reqBodyJson, err := json.Marshal(reqBodyObj)
 	if err != nil {
@@ -286,13 +1547,14 @@ func (ac *Client) requestGetCredentialType(refererUrl string, loginDetails *cred
 	req.Header.Add("hpgid", fmt.Sprint(convergedResponse.Hpgid))
 	req.Header.Add("hpgrequestid", convergedResponse.SessionID)
 	req.Header.Add("Referer", refererUrl)
+	ac.setOrigin(req)
 
 	res, err = ac.client.Do(req)
 	if err != nil {
 		return getCredentialTypeResponse, res, errors.Wrap(err, "error retrieving GetCredentialType results")
 	}
 
-	err = json.NewDecoder(res.Body).Decode(&getCredentialTypeResponse)
+	err = ac.decodeJSON(res.Body, &getCredentialTypeResponse)
 	if err != nil {
 		return getCredentialTypeResponse, res, errors.Wrap(err, "error decoding GetCredentialType results")
 	}
@@ -303,38 +1565,27 @@ func (ac *Client) requestGetCredentialType(refererUrl string, loginDetails *cred
 func (ac *Client) processADFSAuthentication(federationUrl string, loginDetails *creds.LoginDetails) (*http.Response, error) {
 	var res *http.Response
 	var err error
-	var resBodyStr string
-	var formValues url.Values
-	var formSubmitUrl string
 	var req *http.Request
 
 	res, err = ac.client.Get(federationUrl)
 	if err != nil {
-		return res, errors.Wrap(err, "error retrieving ADFS url")
-	}
-
-	resBodyStr, _ = ac.responseBodyAsString(res.Body)
-
-	formValues, formSubmitUrl, err = ac.reSubmitFormData(resBodyStr)
-	if err != nil {
-		return res, errors.Wrap(err, "failed to parse ADFS login form")
+		return res, errors.Wrap(err, "error retrieving ADFS url")
 	}
 
-	if formSubmitUrl == "" {
-		return res, fmt.Errorf("unable to locate ADFS form submit URL")
+	doc, err := goquery.NewDocumentFromReader(res.Body)
+	if err != nil {
+		return res, errors.Wrap(err, "failed to build document from ADFS login form")
 	}
 
-	formValues.Set("UserName", loginDetails.Username)
-	formValues.Set("Password", loginDetails.Password)
-	formValues.Set("AuthMethod", "FormsAuthentication")
-
-	req, err = http.NewRequest("POST", ac.fullUrl(res, formSubmitUrl), strings.NewReader(formValues.Encode()))
+	req, err = provider.SubmitForm(doc, res.Request.URL, url.Values{
+		"UserName":   {loginDetails.Username},
+		"Password":   {loginDetails.Password},
+		"AuthMethod": {"FormsAuthentication"},
+	})
 	if err != nil {
 		return res, errors.Wrap(err, "error building ADFS login request")
 	}
 
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-
 	res, err = ac.client.Do(req)
 	if err != nil {
 		return res, errors.Wrap(err, "error retrieving ADFS login results")
@@ -349,7 +1600,7 @@ func (ac *Client) processAuthentication(loginUrl string, refererUrl string, logi
 	var req *http.Request
 
 	// 50058: user is not signed in (yet)
-	if convergedResponse.SErrorCode != "" && convergedResponse.SErrorCode != "50058" {
+	if convergedResponse.SErrorCode != "" && convergedResponse.SErrorCode != "50058" && !ac.promptPasswordAgain(convergedResponse.SErrorCode, loginDetails) {
 		return res, fmt.Errorf("login error %s", convergedResponse.SErrorCode)
 	}
 
@@ -378,34 +1629,137 @@ func (ac *Client) processAuthentication(loginUrl string, refererUrl string, logi
 	return res, nil
 }
 
-func (ac *Client) processKmsiInterrupt(res *http.Response, srcBodyStr string) (*http.Response, error) {
+// promptPasswordAgain ask for the password again after Azure AD rejected it, the page telling so carries a fresh
+// flow token so the password is posted with it rather than starting the sign in over. MFA isn't affected as it
+// only follows a correct password. False is returned when the retries are used up or prompting isn't allowed
+func (ac *Client) promptPasswordAgain(code string, loginDetails *creds.LoginDetails) bool {
+	if !invalidPasswordErrorCodes[code] || loginDetails.SkipPrompt || ac.passwordRetry >= ac.idpAccount.PasswordRetries {
+		return false
+	}
+
+	ac.passwordRetry++
+	log.Printf("The password was rejected (error %s), try again (%d of %d)", code, ac.passwordRetry, ac.idpAccount.PasswordRetries)
+	loginDetails.Password = prompter.Password("Password")
+	return true
+}
+
+// signInErrorCode the error code of the sign in page, empty when there is none
+func (ac *Client) signInErrorCode(srcBodyStr string) string {
+	var convergedResponse *ConvergedResponse
+
+	if err := ac.unmarshalEmbeddedJson(srcBodyStr, &convergedResponse); err != nil || convergedResponse == nil {
+		return ""
+	}
+	return convergedResponse.SErrorCode
+}
+
+// processPasswordPage submit the password on the page of its own some tenants ask for it on once the username
+// has been accepted, the username is bound to the flow token by then so only the password is posted
+func (ac *Client) processPasswordPage(res *http.Response, srcBodyStr string, loginDetails *creds.LoginDetails) (*http.Response, error) {
+	var convergedResponse *ConvergedResponse
+
+	if err := ac.unmarshalEmbeddedJson(srcBodyStr, &convergedResponse); err != nil {
+		return res, errors.Wrap(err, "ConvergedPassword response unmarshal error")
+	}
+
+	// 50058: user is not signed in (yet)
+	if convergedResponse.SErrorCode != "" && convergedResponse.SErrorCode != "50058" && !ac.promptPasswordAgain(convergedResponse.SErrorCode, loginDetails) {
+		return res, fmt.Errorf("login error %s", convergedResponse.SErrorCode)
+	}
+
+	formValues := url.Values{}
+	formValues.Set("canary", convergedResponse.Canary)
+	formValues.Set("hpgrequestid", convergedResponse.SessionID)
+	formValues.Set(convergedResponse.SFTName, convergedResponse.SFT)
+	formValues.Set("ctx", convergedResponse.SCtx)
+	formValues.Set("passwd", loginDetails.Password)
+
+	req, err := http.NewRequest("POST", ac.fullUrl(res, convergedResponse.URLPost), strings.NewReader(formValues.Encode()))
+	if err != nil {
+		return res, errors.Wrap(err, "error building password request")
+	}
+
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Referer", res.Request.URL.String())
+
+	res, err = ac.client.Do(req)
+	if err != nil {
+		return res, errors.Wrap(err, "error retrieving password results")
+	}
+
+	return res, nil
+}
+
+// processKmsiInterrupt answer the "stay signed in?" page, the SAML assertion is returned when the response to it
+// already carries the SAMLResponse
+func (ac *Client) processKmsiInterrupt(res *http.Response, srcBodyStr string) (*http.Response, string, error) {
 	var convergedResponse *ConvergedResponse
-	var err error
 
 	if err := ac.unmarshalEmbeddedJson(srcBodyStr, &convergedResponse); err != nil {
-		return res, errors.Wrap(err, "KMSI request unmarshal error")
+		return res, "", errors.Wrap(err, "KMSI request unmarshal error")
+	}
+
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(srcBodyStr))
+	if err != nil {
+		return res, "", errors.Wrap(err, "failed to build document from KMSI page")
 	}
 
+	// some variants of the page carry further hidden fields, e.g. i19 or DontShowAgain, which are posted
+	// back as they are with the known fields set on top
 	formValues := url.Values{}
+	doc.Find(`input[type="hidden"][name]`).Each(func(i int, s *goquery.Selection) {
+		formValues.Set(s.AttrOr("name", ""), s.AttrOr("value", ""))
+	})
 	formValues.Set(convergedResponse.SFTName, convergedResponse.SFT)
 	formValues.Set("ctx", convergedResponse.SCtx)
 	formValues.Set("LoginOptions", "1")
 
 	req, err := http.NewRequest("POST", ac.fullUrl(res, convergedResponse.URLPost), strings.NewReader(formValues.Encode()))
 	if err != nil {
-		return res, errors.Wrap(err, "error building KMSI request")
+		return res, "", errors.Wrap(err, "error building KMSI request")
 	}
 
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
 	ac.client.DisableFollowRedirect()
 	res, err = ac.client.Do(req)
+	ac.client.EnableFollowRedirect()
 	if err != nil {
-		return res, errors.Wrap(err, "error retrieving KMSI results")
+		return res, "", errors.Wrap(err, "error retrieving KMSI results")
 	}
-	ac.client.EnableFollowRedirect()
 
-	return res, nil
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return res, "", errors.Wrap(err, "error reading KMSI results")
+	}
+	res.Body = io.NopCloser(bytes.NewBuffer(resBody))
+	resBodyStr := string(resBody)
+
+	// some tenants answer with the form carrying the SAMLResponse, which isn't always laid out like the hidden
+	// forms of the flow, rather than redirecting to it
+	if strings.Contains(resBodyStr, `name="SAMLResponse"`) {
+		samlAssertion, err := ac.getSamlAssertion(resBodyStr)
+		if err != nil {
+			return res, "", err
+		}
+		if samlAssertion != "" {
+			logger.Debug("SAMLResponse returned by the KMSI request")
+			if err := ac.checkSAMLResponseAction(res, resBodyStr); err != nil {
+				return res, "", err
+			}
+			return res, samlAssertion, nil
+		}
+	}
+
+	// the redirect, and any which follow it, lead on to the next page of the flow
+	if location := res.Header.Get("Location"); location != "" && res.StatusCode >= 300 && res.StatusCode < 400 {
+		res, err = ac.client.Get(ac.fullUrl(res, location))
+		if err != nil {
+			return res, "", errors.Wrap(err, "error following the KMSI redirect")
+		}
+	}
+
+	return res, "", nil
 }
 
 func (ac *Client) processConvergedTFA(res *http.Response, srcBodyStr string) (*http.Response, error) {
@@ -417,6 +1771,21 @@ func (ac *Client) processConvergedTFA(res *http.Response, srcBodyStr string) (*h
 	}
 
 	mfas := convergedResponse.ArrUserProofs
+	ac.earlyPush = nil
+	if ac.idpAccount.MFAPushEarly && !ac.listingMfa && convergedResponse.URLSkipMfaRegistration == "" && len(mfas) != 0 {
+		if mfa := ac.selectMfa(mfas); mfaMethodBehaviors[mfa.AuthMethodID] == mfaApprovePush {
+			ac.startEarlyPush(mfa, convergedResponse)
+		}
+	}
+
+	if ac.idpAccount.MFAVerbose {
+		printMfaMethods(mfas)
+	}
+
+	if ac.listingMfa && len(mfas) != 0 {
+		ac.mfaMethods = mfas
+		return res, errMfaMethodsListed
+	}
 
 	// if there's an explicit option to skip MFA, do so
 	if convergedResponse.URLSkipMfaRegistration != "" {
@@ -444,11 +1813,58 @@ func (ac *Client) processMfa(mfas []userProof, convergedResponse *ConvergedRespo
 		return res, fmt.Errorf("MFA not found")
 	}
 
-	mfaResp, err = ac.processMfaBeginAuth(mfas, convergedResponse)
+	// pick the proof once so the user isn't asked for a phone number again on every retry
+	var mfa userProof
+	if ac.earlyPush != nil {
+		mfa = ac.earlyPush.proof
+	} else {
+		mfa = ac.selectMfa(mfas)
+	}
+	for attempt := 0; ; attempt++ {
+		mfaResp, err = ac.processMfaAttempt(mfa, convergedResponse)
+		if err == nil {
+			break
+		}
+		if errors.Cause(err) != errMfaTransient || attempt >= ac.idpAccount.MFARetries {
+			return res, err
+		}
+		log.Printf("MFA failed, retrying (%d of %d): %v", attempt+1, ac.idpAccount.MFARetries, err)
+	}
+	ac.mfaPerformed = true
+	metrics.MFAUsed("AzureAD", mfa.AuthMethodID)
+
+	res, err = ac.processMfaAuth(mfaResp, convergedResponse)
+	if err != nil {
+		return res, errors.Wrap(err, "error processing MFA ProcessAuth")
+	}
+
+	return res, nil
+}
+
+// processMfaAttempt start MFA with the proof then poll until the user has answered, errors which wrap
+// errMfaTransient mean the attempt can be started over
+func (ac *Client) processMfaAttempt(mfa userProof, convergedResponse *ConvergedResponse) (mfaResponse, error) {
+	var mfaResp mfaResponse
+	var err error
+
+	progress.Step("MFA " + mfa.AuthMethodID)
+
+	// a push sent early is only used for the first attempt, a retry starts over
+	push := ac.earlyPush
+	ac.earlyPush = nil
+	if push != nil {
+		<-push.done
+		mfaResp, err = push.resp, push.err
+	} else {
+		mfaResp, err = ac.processMfaBeginAuth(mfa, convergedResponse)
+	}
 	if err != nil {
-		return res, errors.Wrap(err, "error processing MFA BeginAuth")
+		return mfaResp, errors.Wrap(err, "error processing MFA BeginAuth")
 	}
 
+	started := time.Now()
+	lastWarning := started
+	codeAttempt := 0
 	for i := 0; ; i++ {
 		mfaReq := mfaRequest{
 			AuthMethodID: mfaResp.AuthMethodID,
@@ -457,25 +1873,62 @@ func (ac *Client) processMfa(mfas []userProof, convergedResponse *ConvergedRespo
 			FlowToken:    mfaResp.FlowToken,
 			SessionID:    mfaResp.SessionID,
 		}
-		if mfaReq.AuthMethodID == "PhoneAppOTP" || mfaReq.AuthMethodID == "OneWaySMS" {
-			verifyCode := prompter.StringRequired("Enter verification code")
+		switch mfaMethodBehaviors[mfaReq.AuthMethodID] {
+		case mfaEnterCode:
+			verifyCode, err := ac.verificationCode(mfaReq.AuthMethodID, codeAttempt)
+			if err != nil {
+				return mfaResp, err
+			}
 			mfaReq.AdditionalAuthData = verifyCode
-		}
-		if mfaReq.AuthMethodID == "PhoneAppNotification" && i == 0 {
-			if mfaResp.Entropy == 0 {
-				log.Println("Phone approval required.")
-			} else {
-				log.Printf("Phone approval required. Entropy is: %d", mfaResp.Entropy)
+			codeAttempt++
+		case mfaApprovePush:
+			if i == 0 && push != nil {
+				// the prompt was shown when the push was sent, the wait counts from then too
+				if mfaResp.Entropy != 0 {
+					log.Printf("Entropy is: %d", mfaResp.Entropy)
+				}
+				delay := ac.mfaInitialDelay(mfaReq.AuthMethodID, convergedResponse) - timeNow().Sub(push.sent)
+				if delay < 0 {
+					delay = 0
+				}
+				sleep(delay)
+			} else if i == 0 {
+				if mfaResp.Entropy == 0 {
+					log.Println("Phone approval required.")
+				} else {
+					log.Printf("Phone approval required. Entropy is: %d", mfaResp.Entropy)
+				}
+				sleep(ac.mfaInitialDelay(mfaReq.AuthMethodID, convergedResponse))
+			}
+		case mfaAnswerCall:
+			if i == 0 {
+				log.Println("Answer the phone call to approve.")
+				sleep(ac.mfaInitialDelay(mfaReq.AuthMethodID, convergedResponse))
 			}
 		}
 
 		mfaResp, err = ac.processMfaEndAuth(mfaReq, convergedResponse)
 		if err != nil {
-			return res, errors.Wrap(err, "error processing MFA EndAuth")
+			return mfaResp, errors.Wrap(err, "error processing MFA EndAuth")
+		}
+
+		// a denied request is final, don't keep polling until it times out
+		if mfaDenialResults[mfaResp.ResultValue] {
+			return mfaResp, ErrMfaDenied
+		}
+
+		// a wrong code can be followed by another one without starting over
+		if mfaCodeRejectedResults[mfaResp.ResultValue] && mfaMethodBehaviors[mfaReq.AuthMethodID] == mfaEnterCode {
+			logger.WithField("result", mfaResp.ResultValue).Debug("verification code rejected")
+			continue
+		}
+
+		if mfaTransientResults[mfaResp.ResultValue] {
+			return mfaResp, errors.Wrapf(errMfaTransient, "MFA result %s", mfaResp.ResultValue)
 		}
 
 		if mfaResp.ErrCode != 0 {
-			return res, fmt.Errorf("error processing MFA, errcode: %d, message: %v", mfaResp.ErrCode, mfaResp.Message)
+			return mfaResp, fmt.Errorf("error processing MFA, errcode: %d, message: %v", mfaResp.ErrCode, mfaResp.Message)
 		}
 
 		if mfaResp.Success {
@@ -485,46 +1938,170 @@ func (ac *Client) processMfa(mfas []userProof, convergedResponse *ConvergedRespo
 			break
 		}
 
+		// let the user know we haven't hung while waiting for them to approve the request
+		// log output is discarded in quiet mode so this stays silent there
+		if ac.mfaIdleWarning > 0 && time.Since(lastWarning) >= ac.mfaIdleWarning {
+			lastWarning = time.Now()
+			log.Printf("Still waiting for approval (%ds elapsed)", int(time.Since(started).Seconds()))
+		}
+
 		// if mfaResp.Retry == true then
 		// must exist convergedResponse.OPerAuthPollingInterval[mfaResp.AuthMethodID]
-		time.Sleep(time.Duration(convergedResponse.OPerAuthPollingInterval[mfaResp.AuthMethodID]) * time.Second)
+		sleep(time.Duration(convergedResponse.OPerAuthPollingInterval[mfaResp.AuthMethodID]) * time.Second)
 	}
 
 	if !mfaResp.Success {
-		return res, fmt.Errorf("error processing MFA")
+		return mfaResp, fmt.Errorf("error processing MFA")
 	}
 
-	res, err = ac.processMfaAuth(mfaResp, convergedResponse)
+	return mfaResp, nil
+}
+
+// startEarlyPush send BeginAuth for the push without waiting on the answer, so the phone shows the request and
+// the user is told to approve it straight away. The login still only goes ahead once EndAuth reports it approved.
+func (ac *Client) startEarlyPush(mfa userProof, convergedResponse *ConvergedResponse) {
+	push := &earlyPush{proof: mfa, sent: timeNow(), done: make(chan struct{})}
+	go func() {
+		defer close(push.done)
+		push.resp, push.err = ac.processMfaBeginAuth(mfa, convergedResponse)
+	}()
+	ac.earlyPush = push
+	log.Println("Phone approval required.")
+}
+
+// mfaInitialDelay how long to wait between BeginAuth and the first EndAuth of a push or call, polling straight away
+// races ahead of the notification being delivered and wastes a poll. This is mfa_initial_delay when set and the
+// polling interval Azure AD gives for the method otherwise.
+func (ac *Client) mfaInitialDelay(authMethodID string, convergedResponse *ConvergedResponse) time.Duration {
+	if ac.idpAccount.MFAInitialDelay < 0 {
+		return 0
+	}
+	if ac.idpAccount.MFAInitialDelay > 0 {
+		return time.Duration(ac.idpAccount.MFAInitialDelay) * time.Second
+	}
+	return time.Duration(convergedResponse.OPerAuthPollingInterval[authMethodID] * float64(time.Second))
+}
+
+// verificationCode the code to submit for the given attempt, when a TOTP secret is available codes for
+// the authenticator app are generated for the current and adjacent time steps before the user is asked
+func (ac *Client) verificationCode(authMethodID string, attempt int) (string, error) {
+	if ac.totpSecret != "" && authMethodID == "PhoneAppOTP" {
+		if attempt < len(totpSkewSteps) {
+			return totpCode(ac.totpSecret, timeNow().Add(time.Duration(totpSkewSteps[attempt])*totpPeriod))
+		}
+		attempt -= len(totpSkewSteps)
+	}
+
+	if attempt >= maxOtpPrompts {
+		return "", fmt.Errorf("verification code rejected %d times", attempt)
+	}
+	if attempt > 0 {
+		log.Println("The verification code was rejected, please try again.")
+	}
+
+	return prompter.StringRequired("Enter verification code"), nil
+}
+
+// totpCode generate the RFC 6238 code for the base32 encoded secret at the given time, using the six
+// digit, 30 second, SHA-1 variant supported by Microsoft Authenticator
+func totpCode(secret string, at time.Time) (string, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
 	if err != nil {
-		return res, errors.Wrap(err, "error processing MFA ProcessAuth")
+		return "", errors.Wrap(err, "invalid TOTP secret")
 	}
 
-	return res, nil
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(at.Unix()/int64(totpPeriod/time.Second)))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%06d", code%1000000), nil
 }
 
-func (ac *Client) processMfaBeginAuth(mfas []userProof, convergedResponse *ConvergedResponse) (mfaResponse, error) {
-	var res *http.Response
-	var err error
-	var mfaResp mfaResponse
-	var req *http.Request
+// printMfaMethods list the proofs Azure AD offers, the method ID is the value to configure as the mfa
+func printMfaMethods(mfas []userProof) {
+	log.Println("MFA methods offered by Azure AD:")
+	for _, v := range mfas {
+		log.Println("  " + v.mfaMethod().String())
+	}
+}
 
-	mfa := mfas[0]
-	switch ac.idpAccount.MFA {
-	case "Auto":
-		for _, v := range mfas {
-			if v.IsDefault {
-				mfa = v
-				break
+func (v userProof) mfaMethod() MFAMethod {
+	return MFAMethod{Method: v.AuthMethodID, Display: v.Display, Default: v.IsDefault}
+}
+
+// mfaMethod the method the mfa of the account stands for once its aliases are resolved
+func (ac *Client) mfaMethod() string {
+	// an invalid mfa_aliases is rejected when the client is created
+	aliases, _ := ac.idpAccount.MFAAliasMap()
+	return ResolveMFA(ac.idpAccount.MFA, aliases)
+}
+
+// selectMfa pick the proof to use for MFA, several phone based proofs can share the same method so
+// these are told apart by their masked number, either configured with mfa_phone or chosen by the user
+func (ac *Client) selectMfa(mfas []userProof) userProof {
+	method := ac.mfaMethod()
+	candidates := []userProof{}
+	for _, v := range mfas {
+		if method == "Auto" || v.AuthMethodID == method {
+			candidates = append(candidates, v)
+		}
+	}
+	if len(candidates) == 0 {
+		return mfas[0]
+	}
+
+	if ac.idpAccount.MFAPhone != "" {
+		for _, v := range candidates {
+			if strings.Contains(v.Display, ac.idpAccount.MFAPhone) {
+				return v
 			}
 		}
-	default:
-		for _, v := range mfas {
-			if v.AuthMethodID == ac.idpAccount.MFA {
-				mfa = v
-				break
+		logger.WithField("mfa_phone", ac.idpAccount.MFAPhone).Warn("no MFA option matches the configured phone number")
+	}
+
+	if method == "Auto" {
+		for _, v := range candidates {
+			if v.IsDefault {
+				return v
 			}
 		}
+		return mfas[0]
 	}
+
+	if len(candidates) > 1 && ac.idpAccount.MFAPhone == "" {
+		displays := make([]string, len(candidates))
+		for i, v := range candidates {
+			displays[i] = v.Display
+		}
+		return candidates[prompter.Choose("Select a phone number", displays)]
+	}
+
+	return candidates[0]
+}
+
+// setOrigin set the Origin header of a JSON call, which some tenants behind a WAF require. It's the configured
+// origin, or else the scheme and host the call is sent to, as a browser on the sign in page would send
+func (ac *Client) setOrigin(req *http.Request) {
+	origin := strings.TrimSuffix(ac.idpAccount.Origin, "/")
+	if origin == "" {
+		origin = req.URL.Scheme + "://" + req.URL.Host
+	}
+	req.Header.Set("Origin", origin)
+}
+
+func (ac *Client) processMfaBeginAuth(mfa userProof, convergedResponse *ConvergedResponse) (mfaResponse, error) {
+	var res *http.Response
+	var err error
+	var mfaResp mfaResponse
+	var req *http.Request
+
 	mfaReqObj := mfaRequest{
 		AuthMethodID: mfa.AuthMethodID,
 		Method:       "BeginAuth",
@@ -542,13 +2119,14 @@ func (ac *Client) processMfaBeginAuth(mfas []userProof, convergedResponse *Conve
 	}
 
 	req.Header.Add("Content-Type", "application/json")
+	ac.setOrigin(req)
 
 	res, err = ac.client.Do(req)
 	if err != nil {
 		return mfaResp, errors.Wrap(err, "error retrieving MFA BeginAuth results")
 	}
 
-	err = json.NewDecoder(res.Body).Decode(&mfaResp)
+	err = ac.decodeJSON(res.Body, &mfaResp)
 	if err != nil {
 		return mfaResp, errors.Wrap(err, "error decoding MFA BeginAuth results")
 	}
@@ -577,13 +2155,15 @@ func (ac *Client) processMfaEndAuth(mfaReqObj mfaRequest, convergedResponse *Con
 	}
 
 	req.Header.Add("Content-Type", "application/json")
+	ac.setOrigin(req)
 
 	res, err = ac.client.Do(req)
 	if err != nil {
-		return mfaResp, errors.Wrap(err, "error retrieving MFA EndAuth results")
+		// the request never got an answer, starting MFA over may well succeed
+		return mfaResp, errors.Wrapf(errMfaTransient, "error retrieving MFA EndAuth results: %v", err)
 	}
 
-	err = json.NewDecoder(res.Body).Decode(&mfaResp)
+	err = ac.decodeJSON(res.Body, &mfaResp)
 	if err != nil {
 		return mfaResp, errors.Wrap(err, "error decoding MFA EndAuth results")
 	}
@@ -645,6 +2225,42 @@ func (ac *Client) processSAMLRequest(res *http.Response, srcBodyStr string) (*ht
 	return res, nil
 }
 
+// securityInfoNagSkipURL the skip, or "ask later", action of an optional page asking the user to add security info,
+// e.g. "Help us protect your account", which isn't the ProofUp redirect and comes under other page IDs. The action is
+// the first URL in the page config named urlSkip... or urlAskLater..., empty when there isn't one.
+func (ac *Client) securityInfoNagSkipURL(res *http.Response, resBodyStr string) string {
+	var config map[string]interface{}
+	if err := ac.unmarshalEmbeddedJson(resBodyStr, &config); err != nil {
+		return ""
+	}
+
+	keys := make([]string, 0, len(config))
+	for key := range config {
+		if strings.HasPrefix(key, "urlSkip") || strings.HasPrefix(key, "urlAskLater") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	base := &url.URL{}
+	if res.Request != nil {
+		base = res.Request.URL
+	}
+	for _, key := range keys {
+		value, ok := config[key].(string)
+		if !ok || value == "" {
+			continue
+		}
+		skipURL, err := base.Parse(value)
+		if err != nil || (skipURL.Scheme != "https" && skipURL.Scheme != "http") {
+			continue
+		}
+		return skipURL.String()
+	}
+
+	return ""
+}
+
 func (ac *Client) processConvergedProofUpRedirect(res *http.Response, srcBodyStr string) (*http.Response, error) {
 	var convergedResponse *ConvergedResponse
 	var err error
@@ -659,7 +2275,12 @@ func (ac *Client) processConvergedProofUpRedirect(res *http.Response, srcBodyStr
 	}
 
 	if convergedResponse.URLSkipMfaRegistration == "" {
-		return res, errors.Wrap(err, "skip MFA not possible")
+		// the page asks the browser to open the registration, e.g. browser://aka.ms/mfasetup
+		registrationURL := convergedResponse.URLSetUpMfa
+		if strings.HasPrefix(registrationURL, "browser://") {
+			registrationURL = "https://" + strings.TrimPrefix(registrationURL, "browser://")
+		}
+		return res, &MfaRegistrationRequiredError{URL: registrationURL}
 	}
 
 	res, err = ac.client.Get(convergedResponse.URLSkipMfaRegistration)
@@ -670,6 +2291,49 @@ func (ac *Client) processConvergedProofUpRedirect(res *http.Response, srcBodyStr
 	return res, nil
 }
 
+// processChangePassword follow the skip link of an optional request to update the password, when the change is
+// mandatory there is no link and the password has to be changed in a browser
+func (ac *Client) processChangePassword(res *http.Response, srcBodyStr string) (*http.Response, error) {
+	var convergedResponse *ConvergedResponse
+
+	if err := ac.unmarshalEmbeddedJson(srcBodyStr, &convergedResponse); err != nil {
+		return res, errors.Wrap(err, "change password response unmarshal error")
+	}
+
+	if convergedResponse.URLSkipPasswordChange == "" {
+		return res, ErrPasswordChangeRequired
+	}
+
+	res, err := ac.client.Get(ac.fullUrl(res, convergedResponse.URLSkipPasswordChange))
+	if err != nil {
+		return res, errors.Wrap(err, "error processing skip password change request")
+	}
+
+	return res, nil
+}
+
+// decodeJSON decode a response of the Azure AD JSON API. With strict_json the fields v doesn't capture are logged, so
+// maintainers notice when Azure AD adds to a response, and the response is then decoded leniently as usual. The
+// $Config of the pages isn't checked as the ConvergedResponse only captures the few fields the flow needs
+func (ac *Client) decodeJSON(r io.Reader, v any) error {
+	if !ac.idpAccount.StrictJSON {
+		return json.NewDecoder(r).Decode(v)
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	strict := json.NewDecoder(bytes.NewReader(data))
+	strict.DisallowUnknownFields()
+	if err := strict.Decode(v); err != nil && strings.HasPrefix(err.Error(), "json: unknown field") {
+		logger.Warnf("strict_json: %T doesn't capture the response, %v", v, err)
+	}
+
+	return json.Unmarshal(data, v)
+}
+
 func (ac *Client) unmarshalEmbeddedJson(resBodyStr string, v any) error {
 	/*
 	 * data is embedded in a javascript object
@@ -679,45 +2343,43 @@ func (ac *Client) unmarshalEmbeddedJson(resBodyStr string, v any) error {
 	return json.NewDecoder(strings.NewReader(resBodyStr[startIndex:])).Decode(&v)
 }
 
-func (ac *Client) responseBodyAsString(body io.ReadCloser) (string, error) {
-	resBody, err := io.ReadAll(body)
-	return string(resBody), err
-}
-
+// fullUrl resolve an absolute, root relative, relative or protocol relative URL against the URL of the
+// request which produced the response
 func (ac *Client) fullUrl(res *http.Response, urlFragment string) string {
-	if strings.HasPrefix(urlFragment, "/") {
-		return res.Request.URL.Scheme + "://" + res.Request.URL.Host + urlFragment
-	} else {
+	ref, err := url.Parse(urlFragment)
+	if err != nil {
 		return urlFragment
 	}
+	return res.Request.URL.ResolveReference(ref).String()
 }
 
 func (ac *Client) isHiddenForm(resBodyStr string) bool {
 	return strings.HasPrefix(resBodyStr, "<html><head><title>Working...</title>") && strings.Contains(resBodyStr, "name=\"hiddenform\"")
 }
 
-func (ac *Client) reProcessForm(srcBodyStr string) (*http.Response, error) {
-	var res *http.Response
-	var err error
-	var formValues url.Values
-	var formSubmitUrl string
-
-	formValues, formSubmitUrl, err = ac.reSubmitFormData(srcBodyStr)
+func (ac *Client) reProcessForm(res *http.Response, srcBodyStr string) (*http.Response, error) {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(srcBodyStr))
 	if err != nil {
-		return res, errors.Wrap(err, "failed to parse hiddenform form")
+		return res, errors.Wrap(err, "failed to build document from hiddenform")
 	}
 
-	if formSubmitUrl == "" {
-		return res, fmt.Errorf("unable to locate hiddenform submit URL")
+	if err := ac.checkSAMLResponseAction(res, srcBodyStr); err != nil {
+		return res, err
 	}
 
-	req, err := http.NewRequest("POST", formSubmitUrl, strings.NewReader(formValues.Encode()))
+	var overrides url.Values
+	if relayState, ok := doc.Find(`input[name="RelayState"]`).Attr("value"); ok {
+		logger.WithField("relayState", relayState).Debug("hiddenform RelayState")
+		if ac.idpAccount.RelayState != "" {
+			overrides = url.Values{"RelayState": {ac.idpAccount.RelayState}}
+		}
+	}
+
+	req, err := provider.SubmitForm(doc, res.Request.URL, overrides)
 	if err != nil {
 		return res, errors.Wrap(err, "error building hiddenform request")
 	}
 
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-
 	res, err = ac.client.Do(req)
 	if err != nil {
 		return res, errors.Wrap(err, "error retrieving hiddenform results")
@@ -726,58 +2388,111 @@ func (ac *Client) reProcessForm(srcBodyStr string) (*http.Response, error) {
 	return res, nil
 }
 
-func (ac *Client) reSubmitFormData(resBodyStr string) (url.Values, string, error) {
-	formValues := url.Values{}
-	var formSubmitUrl string
+// checkSAMLResponseAction refuse a form carrying a SAMLResponse to a host other than the trusted ACS hosts, so
+// a compromised IdP can't have the assertion submitted anywhere it likes
+func (ac *Client) checkSAMLResponseAction(res *http.Response, srcBodyStr string) error {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(srcBodyStr))
+	if err != nil {
+		return errors.Wrap(err, "failed to build document from hiddenform")
+	}
 
-	doc, err := goquery.NewDocumentFromReader(strings.NewReader(resBodyStr))
+	input, err := ac.samlResponseInput(doc)
 	if err != nil {
-		return formValues, formSubmitUrl, errors.Wrap(err, "failed to build document from response")
+		return err
+	}
+	form := input.Closest("form")
+	if form.Length() == 0 {
+		return nil
 	}
 
-	// prefil form data from page as provided
-	doc.Find("input").Each(func(i int, s *goquery.Selection) {
-		name, ok := s.Attr("name")
-		if !ok {
-			return
-		}
-		value, ok := s.Attr("value")
-		if !ok {
-			return
-		}
-		formValues.Set(name, value)
-	})
+	action, err := url.Parse(form.AttrOr("action", ""))
+	if err != nil {
+		return errors.Wrap(err, "failed to parse SAMLResponse form action")
+	}
+	if res.Request != nil {
+		action = res.Request.URL.ResolveReference(action)
+	}
 
-	// identify form submit url/path
-	doc.Find("form").Each(func(i int, s *goquery.Selection) {
-		action, ok := s.Attr("action")
-		if !ok {
-			return
-		}
-		formSubmitUrl = action
-	})
+	host := strings.ToLower(action.Hostname())
+	if awspartition.MatchHost(host, ac.trustedACSHosts()) {
+		return nil
+	}
 
-	return formValues, formSubmitUrl, nil
+	return fmt.Errorf("refusing to submit the SAMLResponse to %s which isn't a trusted ACS host", host)
 }
 
-func (ac *Client) getSamlAssertion(resBodyStr string) (string, error) {
-	var samlAssertion string
+// trustedACSHosts the configured hosts a SAMLResponse may be submitted to, by default the AWS sign in hosts
+func (ac *Client) trustedACSHosts() []string {
+	var hosts []string
+	for _, host := range strings.Split(ac.idpAccount.TrustedACSHosts, ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	if len(hosts) == 0 {
+		return awspartition.SignInHosts()
+	}
+	return hosts
+}
 
+func (ac *Client) getSamlAssertion(resBodyStr string) (string, error) {
 	doc, err := goquery.NewDocumentFromReader(strings.NewReader(resBodyStr))
 	if err != nil {
-		return samlAssertion, errors.Wrap(err, "failed to build document from response")
+		return "", errors.Wrap(err, "failed to build document from response")
 	}
 
-	doc.Find("input").Each(func(i int, s *goquery.Selection) {
-		attrName, ok := s.Attr("name")
-		if !ok {
-			return
-		}
-		if attrName != "SAMLResponse" {
-			return
+	input, err := ac.samlResponseInput(doc)
+	if err != nil {
+		return "", err
+	}
+
+	return samlResponseValue(input), nil
+}
+
+// samlResponseInput the SAMLResponse input of the page, when the page carries several for different service
+// providers the one for the expected audience is picked, without an expected audience the last one is used
+func (ac *Client) samlResponseInput(doc *goquery.Document) (*goquery.Selection, error) {
+	inputs := doc.Find(`input[name="SAMLResponse"]`)
+	if ac.idpAccount.ExpectedAudience == "" || inputs.Length() == 0 {
+		return inputs.Last(), nil
+	}
+
+	var audiences []string
+	for i := range inputs.Nodes {
+		input := inputs.Eq(i)
+		found := assertionAudiences(samlResponseValue(input))
+		for _, audience := range found {
+			if audience == ac.idpAccount.ExpectedAudience {
+				return input, nil
+			}
 		}
-		samlAssertion, _ = s.Attr("value")
-	})
+		audiences = append(audiences, found...)
+	}
 
-	return samlAssertion, nil
+	return nil, fmt.Errorf("none of the SAMLResponses is for audience %s, found %s", ac.idpAccount.ExpectedAudience, strings.Join(audiences, ", "))
+}
+
+// samlResponseValue the value of the input, some IdPs wrap the base64 value across lines which strict decoding
+// rejects so the whitespace is removed
+func samlResponseValue(input *goquery.Selection) string {
+	return strings.Join(strings.Fields(input.AttrOr("value", "")), "")
+}
+
+// assertionAudiences the audiences the encoded SAMLResponse is restricted to, none when it doesn't decode
+func assertionAudiences(samlResponse string) []string {
+	data, err := base64.StdEncoding.DecodeString(samlResponse)
+	if err != nil {
+		return nil
+	}
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		return nil
+	}
+
+	var audiences []string
+	for _, audience := range doc.FindElements("//Audience") {
+		audiences = append(audiences, strings.TrimSpace(audience.Text()))
+	}
+	return audiences
 }
@@ -2,96 +2,49 @@ package aad
 
 import (
 	"bytes"
-	crand "crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
 	"fmt"
-	"math"
-	mrand "math/rand"
+	"io"
+	"io/fs"
+	"log"
 	"net/http"
+	"net/http/cookiejar"
 	"net/http/httptest"
+	"net/url"
 	"os"
-	"strconv"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"sync"
 	"testing"
 	"text/template"
+	"time"
 
-	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/require"
 
+	"github.com/versent/saml2aws/v2/helper/credentials"
 	"github.com/versent/saml2aws/v2/mocks"
 	"github.com/versent/saml2aws/v2/pkg/cfg"
 	"github.com/versent/saml2aws/v2/pkg/creds"
+	"github.com/versent/saml2aws/v2/pkg/metrics"
 	"github.com/versent/saml2aws/v2/pkg/prompter"
 	"github.com/versent/saml2aws/v2/pkg/provider"
+	"github.com/versent/saml2aws/v2/pkg/provider/aad/aadtest"
 )
 
-var once sync.Once
-
-// example values are mainly url safe base64 secure random bytes to illustrate payload values
-type FixtureData struct {
-	ApplicationId                         string // 31eaeb21-4b55-4390-a8fe-21a780dfedc7
-	State                                 string // Su7ku6ROOSiNe3BN16zhOYZGfQ8dC-wihtcvx4aGi9PNmAyePGemK_yT9H0CapK8HtwS83mbmlltNOknoftpDQ6gP4reH9cyEI5LufKgJ6wozu4msl0npXJZLAO14yUxUjLtxgHuAlvY91umliqPCEGHSwrKYm2piA6HZXqR5wIIK5LiSC_N7k7BOULpDE9qassFTfqTFF5kRNsrSmukREVdOZeNKr-RIPrNOASnH-nggHo-h7HiExFSJEZE8CQBG8JZ5PNcZbaQ2SZeHScKtUr8KCVyoaMdZ5xwXQ2G57VKF5DZsfQfMEPIspnbNkdqwRBHYIJZnX9JakvcKPXckEHriCTL1yN1_cLgBrPA62YBSim80GR8AMOx4Ij7lIQRTy-aLyDGpp6E3PdvTY72W51b1J5vzYl9XslyfRIWj1h_Q5cLlC03k5VJ8rIpeWgUIiEFgOZeDWQctR370JauwvJTfrOFE2yQXvXgU1zFhIvuEy3HhfoYPtlwGfLpeu1Czm-8PkMF24CdgIBRFIn2Rg4Pqt1KDDve7eKygqF79Qgiq-Hm5qGDdURKUF-Ei-Abft7pRs-A0hai27KtOCoJ9YUSoBrdLRyqLXvWkIWz5eeafRqIPlcSV32_jqbkZVJxj_jRdHrJCOSgtETyk1h_zAU_pLmhXfPuMcrIWZMbFTwGrC-xwPVRnaSGzztCVsXiiwWgtUAzzJIuNQSQ9DPpUIzdlOznwi8sVNMw51MXaPx6Qdgv-1pTJX-Hr78lJJRzaKPMBALsgoco9L-yJju7PCnBEJMOucw_J632ofAuzEOox7vfQ0dWVDg5VOOkFsqb0mWSnllFJWkk27wzBZ4-csABoSD8AkrnhnLC5ggCFNh16rPxPDejOfDvdyEV7-zXPJFgJP5rSP8n3kKb27Co10MISI0eWzHdghzbWpJSu78XBElT-5h6w_d4bdZfxgn-UxXCFz7yDQGQ5hKF-q2xx4R3uYn8Xg-5q2Es0OLJsHg5QOVYJ0DYJtcZqtlctP__BBrR3boFT-k0rytvqleuZy3ErSMBSGfCvh9C32bYgIM
-	UaId                                  string // b96e46687a7350c07d4709e1c54b87d4
-	Ctx                                   string // tkdXR5EHHAyb8jhx9XgSfRWpRASqfOc-2WnbZ6N8zxXgudxf70uzJ_izSIAcJylZcalEj4X60sW8naje072dEviyjpvUQu29mjCI80201-x4jijCexX-0_xphUkrcyDnMNFdpdjlhVeJG7ZNKKP2KxrrIDOX5fEFzUi8Sn1I4iwzJWkyOqznTQj7Na7mLhduZwcPX-slpOaNCx11x5CeyXgNmmDY5YNQxCHPsbGB6UeTMkfgBsQXpgLI-ppUuRf-wc7fYfc7pw-VifZggoEKEubdSVsjNS2tAFJKeoX6CzaJ8q2_KZh5T3HMcjhmlxNQ_tsqSb4uc69eZEdb227vk7D57n8FYjmrozMtVFX-XvrYTtbCUQZQWfRaSF14ZgkBUcqS0cQqEXJElvP2yFl8yBLsNVtB7y5pl6yjaIWAh7PzksFPRHUr6WpAmtfH1zSJguIjMpKrId4AjCXClU4y38k1QaVpXIr_H2TK0I3Se36Pc5jJ2urAeCMNSz7Dkb4ETnFoG77jbX5hmc-KsOw3y-SH1b3xgmSXryI8fC5WQnUMTRYKSP7A2GSP507O7jQKBun5lU69L4EwC78e5YuSwK9wlO53THzM_HW0Mn35uD2dGolL8X5AgK72PZkMuLNkNpmc-f2gjZmcBgBlK6A7tJW18WzUsJ0q2mXZFOJB9TVM8LIf58vt-CoggKxgTOeyL9qOVlRlUWt5Cz9HPDR_VazS0ZPeL6e3Xp8O5XzVMPKNp89U3H5BJ7EXrpGmqGasPvxugfHY5mBwA4YyoZeGr2fF9aDcnKK2PiRmUAGvo1GUfy4913uMnDff9riTjNCu9Yy-C7FyWcAl2VFhadI3PwTq3Z05038lGnFEOPsOFKJJrQ3Whtj9G1k-l7idQd3WVMwqjQ3yyGbj_Rl1ilzd0PcxNZqTZxrHA1N3Xi7BdusfvJ2BnPk-LONKfTteFrcZaylSmYtE6h7poo6I8cjTx_aHMkkXN-zg5AvcLWPwOKK_qUdjrGbiSB52G7b4yRHJnTxvNe1NgXFZC2xdDEbY8Pj9cdZzRHH-bpZebaO1MtI
-	OpenIdConnectAuthenticationProperties string // nNB2aD/pc12XrIZ8Ga9i9dI8g0/Kb4WPCLK1jIXEoYH/AFVTojIEvz5LMmVit8YETkHevIXJ+Ye/qTuhlYW4MCMs0g3GBNrtx/cS/NX0yAg08lbQYEWnq0ddhT6NhhysDq7s7PPdcCok8x/wf2LDTE5n4r53C9b+q6ArCLqD8xDb9snlTH3LSsrsgfOoa+GOOTG+5HsnC2kP+yZT2YK9Ifk+5bZVF0yVT5T2WaTVxsWva3+LNcGPYPDR56as8KJ5UvUuvR+bBInw7yX2fzFkfgC8bc8cvlGI1QRtzcTc0KLqayyplFa7XV2yhKv9wY1uEh6RigJX4FJdKzaX84juPKi/RA9rU37KUwnKdZlZ4762YzIqGrRTBwJZUHHisu1O7ooGgA+x2gQ1VY9cAkCQiq5/VgSyZ4wCJniBinwlBwxh9/thBawgHTTThpMfQSXEMWUyAGt8SoWz9FHgF9hEhte1kifXkEr7srrtUwuaxhdYvsLlZKcVZhttgbQR/js1/ZMFHEIRTPnfWZLq9atRiA==
-	Nonce                                 string // 1577836800._ekiEOvOQz4YQL8FvAZsdQ
-	SFT                                   string // vZXtKGAHg7jYK1oppkd43__si0KvHN0i02_TENgVBl_j1mYs0APdQ4bYjh3PcH-1Coouq384kZnIp2MXyS87NmOpwS_Nyb-ntXeQCPvDn0Ubiss7XvvYgq1ReeeyBCuzaE9kUoUlDnMU5D1dx_-KnFHh5evlsRrDBPLRWhG7Kt3fauAg5nvNyKXSF0DA90k8I4oMFaiaNe9ObjmkilRnPUBu3G2p1__BrsgJCGMXv9eZc2d3ANGz6ftwnTrK2OMODyjd5vXuDkQSTu1vZgbSWTkb_prS80o_B3vpvEt1Zord1xPZxTK262-oeUIpFnVjV4sSGnL_smwbA7_qHxSTwmY_1ZCbjuvJTXg1OOKS36GcqwX4h6kMHPAAGwMvvUlMXicqE4xFwF-1yOzFW7L8vPDMHxJtapY_Q94g2pVlKv3uwa0jF3Rk_RddhRZ4mzp7n319_Uq1WcgX-9lvsBoLOtadWstlvKPZ6Y4rUzESAYwOlM8OQ3HGWvvArBqd33o2MFKwqKcpXX73F07QR8qS6A
-	ClientRequestId                       string // 5ec023a2-663b-4168-9cb0-fe7c400b79fa
-	SessionId                             string // dda35067-5d88-4660-9f5f-f68f4c751cca
-	ApiCanary                             string // ype6puaxP6rNV_JtHkyBUEop77KMbSWCBsi4sJmIxLTN0z8NsvLH6ihw1MMT49eTKsCX-RIQl5_vfEllanIyaKijtOGfCHVfgUW0UZ_chdfnuokV9Q9_bUMl-43TLKlDYN0iEwVxQRyIcEYwFISHaYgY14wHe9LkRLmrQt2BlOaMtDQOT8qD-tH7urTxZ8Uj20UKT7wujO20V3_6teiL86s_V4_DDtPta2N355Pz2pFWaVfS7_2a6zf3YnY4wyEHbN_xcT2RBjo
-	Canary                                string // Llh9ry4LOBrmLXLlwgbPhxdrOcd4l5HeTPBVR9tG8vg
-	InstrumentationKey                    string // 1cc3422557e1ba83979ee678092399df-8d876a22-d379-46d2-b066-17a83683d9be-2529
-	Code                                  string // HIdSBXkPCB2Q2oLUjtCiET6Ogb7yPfRumZkWGgmWKrtfCnbKAreOR_o0GCYDBo5ebqe9OrrXLZz1OfPJDlMSR2uM_t_a5Pyw0Kf86KB2P6StMyWr-nHlY2NM7iK9c1TUCevEWhbFIdAwPgxtpt91IiG7rpoapTobUHLqpcVHNahAHE7rPkVXnFGBq6khbsCzgHk1vc2LgC79AQk1m7Mxf3KVDgglpIIVkk6NQpdc_J1pUzjX2WLHh_k_UHK4O9ygf07ELTZJz5Z16ZZJMSs5aOZhurzbOh8mGZeruaHr8FnmK_23Iqx6o_YdehMi5_GcxQjdGD1EM66X27kwghufJBRAa66nmOv3oYI1ILkY29mSnuKnEZDO715zITwdaahrOW0dqXwMR2QtutwxoEZJvJbwXWRrGW8yiNKav03a_j4duY1kVvNmOmT6gE6oaEKboWHxjGDUCCeNJ4-8mtTYnG0rVFrF8Y2-Prq4n23LrbQKfgteD_MG12eihJaQHPCjQgyIZoCcf9unWC5ty0duSNNsb0_GMWc3tGI2bfqNFSFvSvv8BYtyPTjYBhecgBodMr5haKM3pKXh0ZRAqms7hV8myViWlZtIs-pTRAXghPEUBG0Yzg1lPME-KuZOmP-RYggjzyO9IL5suoLIgacXqUI6nJA
-	IdToken                               string // Wz0fWBNb4WkJN_z-97b6LQ5nu6tNmQJC1UGQ7ewy9j7nEO7kMYwA7lA8sQdzO7piZawRLfB1Rgcu0B66RSpWND7yiQYyx99ra-4uTJLPUM7Ngw1ELjExod0nttyMc4f-4RZdWe3KkuORiHdarA27PdP1xhxChyrGdNfZtPNJSLwEvmoSMIYErVbrlhu8i0ZsS5C-zGFiWxRxl6jDDZRXeRFi-DQRDm5qeMfbUDcg6V2TV9BDilkyH_P0o5rHQ7zSjK7YZj20LyLsXXpPadEwUtkE38br2ezG9scSXrqE0UXGgu8T5DvNVBJjwGtFfOBuQrGEMQ5y6LZROMTY-m_ZqE0kevU9vekeV3dw6i9b4O7_l1fwih0Um46-gxlELv32Vb4Wgcl9mqeM1yXoIawyPMGrsqQ1CnHcTNccDj9G5UCAF2zw54sqg2e3L5Zvl-7KVsPGM-A3h241GfiWYvQ_VHpsoR1PZE1DcfkaHusvu_OB8lUAuFbLnerqLo-73rVkhNGH2YxNXWWB7hanx1zDuXEZ1G9gJNnMWQZN-pPRgYylKIL-5Fr1K3yN1Y1l4P8clESRzwA1gvZON7UuFGcn289BfeiAS-Hc6XiGOwHLd0aBLN-wtmzA_w4CnKmBieEAuz8MJGT3mjv4PXcaxEXkaqH_avo4iBnRJAp7hd5J6xQJ0t_vfWHqHEbSLomHTcM9Dk24_PuHIDJS93eJ0Jx-JYtWO0xTpB6rUc-arHyM4x38_l_3NHZRSI2_ut_FqeV1qetD7__-k7sjGxmM6BkqncjRVqQS14B-OeO15ali-VBHvUfi36GAsdQwboGnEzfa7yXmWe31P2qazPZfYa-IOkJfaj4v7wJ_kAKwqB5xfFRJvgs8gl3KHEOQHnC3V3oNXf6vY2RpgBO0b5cmmkJblEtRVChyABU0U1djjT_REw1S97mKsnJJIBA2iPyUHMTsk6jGddx6DHj86sD497yhN4TinSloJTlsrMlH1LlYaZrFmLG2qmBylL4_cE9m8-sxlIuJYPbGcDXRHuTiEwR8XHM9LGMwf9rhMOVIjt8XyXUbmED0Pt7uy4t75mzP2YAUfwdohnFNXzV-ZbaUTMVQurSNh_RAL6gLFbjsXc8cmJ1-5PdR9ohrhszN9oYZTTW-9OZ2TGk0anh9APqoKIecORBHYxdVmnJAxIZIB2cKLfqD74kMFlfkAYmJSb1yLV3Hfgv2EJYDxY-neRhopjm7-R52ESx38d7JaZL7ubAuUi7NqNN-CX8UXzZ6_GBvVLYtQf80ARnQew07fygQZ8mR8k7NAZqAvnN4ebItVabQ0vtzcEii_dRr242J38XRM_dClEipbLEluoUVM1-E9hMnhDKqHu0IHT0m5y7asYYsdF-QCGU2FxDTQ0QSKPcyDoZASP74-UIk6S26an4FIM7Ojc9__1Pu3DQgPYvKNxw7mv5FYXPStJm-MhAiTXo1LZGN2Po3wYLfWbhVm9q6bEFdy0-e8UqUT-tXyk3AwwC-LpfpkmmJiotH3mmtIWoZZ3dN2UaZz2tyJJaSD7yPcH-elgIn5mwv90DF1XvOgpB51GvHElc0lUykqoRPLQeEWMYKCX0fPnQ-si21nUx1ko6nZcnvFlkR06Ik41vWBSDpb0NbFXx-Jz94TPREUkUqfZspK3vLsG0UPj1bawWa6dFXEgmdys4mzZurEZGLbiiFnHO8N47qtjZul6l53_92ZFsj0MOBNgPp4qWIXi1PhJ3PJSSbnrR8rW-l3uBArTW56TlxsP7exr6TMn3C7ZfzO7G2tD1ifEiZ_0qGj80nn7ltrkfZZlc6HsrQri4LiQ4NgU85ikofugB7F42W07-9HDEJsyCuG6qdDY33EiufsdmNPb-mogeN2ELL9NSiQ1zjRjkjG8bcls-hMJbjP_GDXvjce6k_QdPK3fvyxgXvqRBGIwwXxDXmnSCn8vLiY8c20F_SyBXFfRmNtGCu-cGeoPFDX766DXPod5JYb2RABKCbJN7wE8wans4cH_nZHS_1QQyWtjkxStrFC141DUR6PIzKxO4J2KNeMqX4fk5fhHZPriZtkJHuRaRU_Lx6TlMU6n23KdrwJJWhmTN7UUxXzQvCgVO2GE6YdxDlFtVC6X7vO0rZAStqXCGK3Hq1jE1aFfpIFakl9JuBaPege6sYGdM5dwQHaGY7rlqOxVatsVG0pmE89o8QLiFJSz_0v9BVHM2_G1cl2797Kfm1QRSD8Hqt1Iq7ruD9VdQLlFN0mwc3Dt0RdRWlcxHdyFVjZj08vhiUoAhRsjMljdwRldcW8Y8SbZ7HpgifL2PZKKBFcJ8575ytN7Ft2w8QqBi6kRMqxPGa07HsL7AngavD_CXhrxKneES8xDuPzIFCleYWy9yKXVFrAHJUic4J174D57v6DtgNfHbvUaqJWX7qwlNIjeCqaPcj82GH0RYAqVeJShFhGqNw0VwyMMYhotBQdFJQkRBtllPnshj4Pw6TuwSxtVyDvSkfZmOA65vkduk1D4uEBEVt4CdiZgTMzEESD4Pt_LvfBHe4YFHaTU9J7Y3Wj7m44xlj9WL10XM2V8jGPypXuskv46-T-rdZdfgRzRMjM7r-5vlYCli-48YrbB47Z1scJ18lMTeE1G-0E6473JZjg4TGtAhYwFm_AcbsMlX1XLc
-	SessionState                          string // d2371e2d-9bcd-4647-abf3-aa2eace51a9f
-	UrlFederationRedirect                 string // https://sts.exampledomain.com/adfs/ls/?example-parameter=example-value
-	UrlSkipMfaRegistration                string // https://login.microsoftonline.com/common/resume?ctx={{.Ctx}}\u0026flowtoken={{.SFT}}\u0026skipmfaregistration=1
-	UrlGetCredentialType                  string // https://login.microsoftonline.com/common/GetCredentialType?mkt=en-US
-	UrlPost                               string // https://login.microsoftonline.com/common/login
-	UrlBeginAuth                          string // https://login.microsoftonline.com/common/SAS/BeginAuth
-	UrlEndAuth                            string // https://login.microsoftonline.com/common/SAS/EndAuth
-	UrlProcessAuth                        string // https://login.microsoftonline.com/common/SAS/ProcessAuth
-	UrlHiddenForm                         string // https://account.activedirectory.windowsazure.com/
-	UrlSamlRequest                        string // https://login.microsoftonline.com/{{.ApplicationId}}/saml2?SAMLRequest={{.SAMLRequestPayload}}
-	TenantId                              string // 0cfbdd7a-1d78-47ea-b458-8aa3c2558727
-	SosId                                 string // 7f55cb4c-c904-4255-8d26-faa8da77c492
-	ProofUpToken                          string // UVrFbiiZj6kdD6oWm4k87CkipgjEbKhlq_dKoMTo8p0TRCf4utimEAnOizRQ7qAoHaotT08os5kctHfJhXw7dkactSsYjtYo9Lt_1vlPPmZ8i0FtfrwjMeztp0sMY6PHkfRO_sWIHR2bsvIpjaKqqNTJ8PZCuwNmfR8Tx2Jdud3F1FcUgkF3-MG5omxJR7oaueRn1SvnjR-sWEleKptBqLTFnVwNeY8kVfpiKV4liNACZkWc9N5CJRC7HO4aLHVUkKcWaCERUZWeaHh0Bdk_aHSZFll1C6yBv0v4IIJfTQuCOdRMXmqvSpxpRUcwgZ7vdY6krAYUAV8SG926Fptr3if69AM5GHxKN4AlyNNJZ5ghv0yqwI4aGTg1vsanq0q8ZE80TOCBZdMz39Tr_J5MKMW2HO7lEMPtZYBCYwz3Z4nzbgWo9aB65GcxNcnzXgBMeiwjgxQphpFahbj89Rc8H0PWbN4Yhh-aDlv_UMwd2lp1I98hxdEn-8uA56xCE4l1647RuwSiCIfzE_6dYxXm8Q
-	UserName                              string // exampleuser@exampledomain.com
-	UserNameUrlEncoded                    string // exampleuser%40exampledomain.com
-	SErrorCode                            string // 50058
-}
-
-var fixtureData *FixtureData
+// FixtureData the values filled in the page templates
+type FixtureData = aadtest.FixtureData
 
 func genFixtureData() *FixtureData {
-	once.Do(func() {
-		fixtureData = &FixtureData{
-			ApplicationId:                         genUUID(),
-			State:                                 genBase64Fixture(800),
-			UaId:                                  genHexFixture(16),
-			Ctx:                                   genBase64Fixture(800),
-			OpenIdConnectAuthenticationProperties: genBase64Fixture(400),
-			Nonce:                                 "1577836800" + "." + genBase64Fixture(16),
-			SFT:                                   genBase64Fixture(400),
-			ClientRequestId:                       genUUID(),
-			SessionId:                             genUUID(),
-			ApiCanary:                             genBase64Fixture(200),
-			Canary:                                genBase64Fixture(32),
-			InstrumentationKey:                    genHexFixture(16) + "-" + genUUID() + "-" + genIntFixture(4),
-			Code:                                  genBase64Fixture(500),
-			IdToken:                               genBase64Fixture(2000),
-			SessionState:                          genUUID(),
-			TenantId:                              genUUID(),
-			SosId:                                 genUUID(),
-			ProofUpToken:                          genBase64Fixture(400),
-			UserName:                              "exampleuser@exampledomain.com",
-			UserNameUrlEncoded:                    "exampleuser%40exampledomain.com",
-		}
-	})
-	return fixtureData
+	return aadtest.NewFixtureData()
 }
 
 func Test_fullUrl(t *testing.T) {
@@ -102,7 +55,7 @@ func Test_fullUrl(t *testing.T) {
 
 	ac, _ := setupTestClient(t, ts)
 
-	res, err := ac.client.Get(ts.URL + "/Dummy")
+	res, err := ac.client.Get(ts.URL + "/common/oauth2/authorize?client_id=123")
 	require.Nil(t, err)
 
 	require.Equal(t, ac.fullUrl(res, "/Only-Path"), ts.URL+"/Only-Path")
@@ -110,11 +63,17 @@ func Test_fullUrl(t *testing.T) {
 	require.Equal(t, ac.fullUrl(res, "https://domain.com/"), "https://domain.com/")
 	require.Equal(t, ac.fullUrl(res, "https://domain.com"), "https://domain.com")
 	require.Equal(t, ac.fullUrl(res, "https://domain.com/With-Path"), "https://domain.com/With-Path")
+	require.Equal(t, ac.fullUrl(res, "/Only-Path?with=query"), ts.URL+"/Only-Path?with=query")
+	require.Equal(t, ac.fullUrl(res, "login"), ts.URL+"/common/oauth2/login")
+	require.Equal(t, ac.fullUrl(res, "./login"), ts.URL+"/common/oauth2/login")
+	require.Equal(t, ac.fullUrl(res, "../auth"), ts.URL+"/common/auth")
+	require.Equal(t, ac.fullUrl(res, "//domain.com/With-Path"), "https://domain.com/With-Path")
+	require.Equal(t, ac.fullUrl(res, "?other=query"), ts.URL+"/common/oauth2/authorize?other=query")
 }
 
 func Test_isHiddenForm(t *testing.T) {
 	fixtureData := genFixtureData()
-	template, err := template.ParseFiles("testdata/HiddenForm.html")
+	template, err := template.ParseFS(aadtest.Pages, "HiddenForm.html")
 	require.Nil(t, err)
 	var tpl bytes.Buffer
 	err = template.Execute(&tpl, fixtureData)
@@ -126,6 +85,191 @@ func Test_isHiddenForm(t *testing.T) {
 	require.True(t, ac.isHiddenForm(tpl.String()))
 }
 
+func Test_tenantRestrictionHeaders(t *testing.T) {
+	t.Run("configured", func(t *testing.T) {
+		var got http.Header
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/redirect" {
+				http.Redirect(w, r, "/final", http.StatusFound)
+				return
+			}
+			got = r.Header
+			_, _ = w.Write([]byte("OK"))
+		}))
+		defer ts.Close()
+
+		ac, err := New(&cfg.IDPAccount{
+			URL:                   ts.URL,
+			SkipVerify:            true,
+			RestrictAccessTenants: "contoso.com,fabrikam.onmicrosoft.com",
+			RestrictAccessContext: "456ff232-35l2-5h23-b3b3-3236w0826f3d",
+		})
+		require.Nil(t, err)
+
+		_, err = ac.client.Get(ts.URL + "/redirect")
+		require.Nil(t, err)
+		require.Equal(t, "contoso.com,fabrikam.onmicrosoft.com", got.Get("Restrict-Access-To-Tenants"))
+		require.Equal(t, "456ff232-35l2-5h23-b3b3-3236w0826f3d", got.Get("Restrict-Access-Context"))
+	})
+	t.Run("unset", func(t *testing.T) {
+		var got http.Header
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = r.Header
+			_, _ = w.Write([]byte("OK"))
+		}))
+		defer ts.Close()
+
+		ac, err := New(&cfg.IDPAccount{URL: ts.URL, SkipVerify: true})
+		require.Nil(t, err)
+
+		_, err = ac.client.Get(ts.URL)
+		require.Nil(t, err)
+		require.NotContains(t, got, "Restrict-Access-To-Tenants")
+		require.NotContains(t, got, "Restrict-Access-Context")
+	})
+}
+
+func Test_customHeaders(t *testing.T) {
+	var got http.Header
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+		_, _ = w.Write([]byte("OK"))
+	}))
+	defer ts.Close()
+
+	ac, err := New(&cfg.IDPAccount{
+		URL:                   ts.URL,
+		SkipVerify:            true,
+		RestrictAccessTenants: "contoso.com",
+		CustomHeaders:         "X-Waf-Token: abc123, X-Client-Name:saml2aws",
+	})
+	require.Nil(t, err)
+
+	_, err = ac.client.Get(ts.URL)
+	require.Nil(t, err)
+	require.Equal(t, "abc123", got.Get("X-Waf-Token"))
+	require.Equal(t, "saml2aws", got.Get("X-Client-Name"))
+	require.Equal(t, "contoso.com", got.Get("Restrict-Access-To-Tenants"))
+
+	_, err = New(&cfg.IDPAccount{URL: ts.URL, CustomHeaders: "X Waf Token: abc123"})
+	require.EqualError(t, err, `error parsing custom headers: invalid custom header "X Waf Token: abc123" in idp account`)
+}
+
+func Test_pinnedCertificate(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("OK"))
+	}))
+	defer ts.Close()
+
+	sum := sha256.Sum256(ts.Certificate().Raw)
+	pin := hex.EncodeToString(sum[:])
+
+	t.Run("matching pin", func(t *testing.T) {
+		ac, err := New(&cfg.IDPAccount{URL: ts.URL, SkipVerify: true, TLSPinnedSHA256: "00" + pin[2:] + "," + strings.ToUpper(pin)})
+		require.Nil(t, err)
+
+		res, err := ac.client.Get(ts.URL)
+		require.Nil(t, err)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+	})
+	t.Run("mismatching pin", func(t *testing.T) {
+		other := sha256.Sum256([]byte("another certificate"))
+		ac, err := New(&cfg.IDPAccount{URL: ts.URL, SkipVerify: true, TLSPinnedSHA256: hex.EncodeToString(other[:])})
+		require.Nil(t, err)
+
+		_, err = ac.client.Get(ts.URL)
+		require.ErrorContains(t, err, "matches the pinned certificates")
+	})
+	t.Run("invalid pin", func(t *testing.T) {
+		_, err := New(&cfg.IDPAccount{URL: ts.URL, TLSPinnedSHA256: "not-a-fingerprint"})
+		require.ErrorContains(t, err, "invalid SHA-256 fingerprint")
+	})
+}
+
+func Test_disableHTTP2(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Proto))
+	}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	ac, err := New(&cfg.IDPAccount{URL: ts.URL, SkipVerify: true, DisableHTTP2: true})
+	require.Nil(t, err)
+
+	res, err := ac.client.Get(ts.URL)
+	require.Nil(t, err)
+	require.Equal(t, "HTTP/1.1", res.Proto)
+	require.NotEqual(t, "h2", res.TLS.NegotiatedProtocol)
+	body, err := io.ReadAll(res.Body)
+	require.Nil(t, err)
+	require.Equal(t, "HTTP/1.1", string(body))
+}
+
+func Test_tlsRenegotiation(t *testing.T) {
+	tests := []struct {
+		renegotiation string
+		want          tls.RenegotiationSupport
+	}{
+		{renegotiation: "", want: tls.RenegotiateFreelyAsClient},
+		{renegotiation: "never", want: tls.RenegotiateNever},
+		{renegotiation: "once", want: tls.RenegotiateOnceAsClient},
+		{renegotiation: "freely", want: tls.RenegotiateFreelyAsClient},
+	}
+	for _, tt := range tests {
+		t.Run(tt.renegotiation, func(t *testing.T) {
+			ac, err := New(&cfg.IDPAccount{URL: "https://account.example.test", TLSRenegotiation: tt.renegotiation})
+			require.Nil(t, err)
+
+			// without headers, a request log or tracing the transport isn't wrapped
+			tr, ok := ac.client.Transport.(*http.Transport)
+			require.True(t, ok)
+			require.Equal(t, tt.want, tr.TLSClientConfig.Renegotiation)
+		})
+	}
+
+	_, err := New(&cfg.IDPAccount{URL: "https://account.example.test", TLSRenegotiation: "sometimes"})
+	require.EqualError(t, err, "unknown tls_renegotiation sometimes, valid options are: never, once, freely")
+}
+
+func TestClient_credentialType(t *testing.T) {
+	fixtureData := genFixtureData()
+	lookups := 0
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookups++
+		writeFixtureBytes(t, w, r, "GetCredentialType_default.json", FixtureData{})
+	}))
+	defer ts.Close()
+
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	ac, loginDetails := setupTestClient(t, ts)
+	convergedResponse := ConvergedResponse{
+		URLGetCredentialType: ts.URL + fixtureData.UrlGetCredentialType,
+		SCtx:                 fixtureData.Ctx,
+		SFT:                  fixtureData.SFT,
+	}
+
+	first, err := ac.credentialType("https://referer.com", loginDetails, &convergedResponse)
+	require.Nil(t, err)
+	require.Equal(t, 1, lookups)
+
+	now = now.Add(time.Minute)
+	second, err := ac.credentialType("https://referer.com", loginDetails, &convergedResponse)
+	require.Nil(t, err)
+	require.Equal(t, 1, lookups)
+	require.Equal(t, first.Username, second.Username)
+	require.Equal(t, first.Credentials, second.Credentials)
+	require.Empty(t, second.FlowToken)
+
+	now = now.Add(credentialTypeTTL)
+	_, err = ac.credentialType("https://referer.com", loginDetails, &convergedResponse)
+	require.Nil(t, err)
+	require.Equal(t, 2, lookups)
+}
+
 func Test_requestGetCredentialType(t *testing.T) {
 	t.Run("ADFS login", func(t *testing.T) {
 		fixtureData := genFixtureData()
@@ -154,7 +298,7 @@ func Test_requestGetCredentialType(t *testing.T) {
 
 		require.Equal(t, getCredentialTypeResponse.Username, fixtureData.UserName)
 		require.NotEmpty(t, getCredentialTypeResponse.Credentials.FederationRedirectURL)
-		require.Equal(t, getCredentialTypeResponse.Credentials.FederationRedirectURL, fixtureData.UrlFederationRedirect)
+		require.Equal(t, ts.URL+"/adfsLogin", getCredentialTypeResponse.Credentials.FederationRedirectURL)
 	})
 	t.Run("Default login", func(t *testing.T) {
 		fixtureData := genFixtureData()
@@ -181,7 +325,6 @@ func Test_requestGetCredentialType(t *testing.T) {
 
 		require.Equal(t, getCredentialTypeResponse.Username, fixtureData.UserName)
 		require.Empty(t, getCredentialTypeResponse.Credentials.FederationRedirectURL)
-		require.Equal(t, getCredentialTypeResponse.Credentials.FederationRedirectURL, fixtureData.UrlFederationRedirect)
 	})
 }
 
@@ -220,11 +363,14 @@ func Test_Authenticate(t *testing.T) {
 		got, err := ac.Authenticate(loginDetails)
 		require.Nil(t, err)
 		require.NotEmpty(t, got)
+		require.False(t, ac.MFAPerformed())
 	})
-	t.Run("Default login with KMSI but skip MFA", func(t *testing.T) {
+	t.Run("Default login with the SAMLResponse returned by KMSI", func(t *testing.T) {
+		var paths []string
 		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			paths = append(paths, r.URL.Path)
 			switch r.URL.Path {
-			case "/index", "/applications/redirecttofederatedapplication.aspx":
+			case "/applications/redirecttofederatedapplication.aspx":
 				writeFixtureBytes(t, w, r, "ConvergedSignIn.html", FixtureData{
 					UrlPost:              "/defaultLogin",
 					UrlGetCredentialType: "/getCredentialType",
@@ -232,10 +378,71 @@ func Test_Authenticate(t *testing.T) {
 			case "/getCredentialType":
 				writeFixtureBytes(t, w, r, "GetCredentialType_default.json", FixtureData{})
 			case "/defaultLogin":
-				writeFixtureBytes(t, w, r, "ConvergedProofUpRedirect.html", FixtureData{
-					UrlSkipMfaRegistration: "/skipMfaRegistration",
+				writeFixtureBytes(t, w, r, "KmsiInterrupt.html", FixtureData{
+					UrlPost: "/kmsi",
 				})
-			case "/skipMfaRegistration":
+			case "/kmsi":
+				// laid out differently to the hidden forms of the flow
+				_, _ = w.Write([]byte("<!DOCTYPE html>\n"))
+				writeFixtureBytes(t, w, r, "SAMLResponse.html", FixtureData{})
+			default:
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			}
+		}))
+		defer ts.Close()
+
+		ac, loginDetails := setupTestClient(t, ts)
+		got, err := ac.Authenticate(loginDetails)
+		require.Nil(t, err)
+		require.NotEmpty(t, got)
+		require.Equal(t, "/kmsi", paths[len(paths)-1])
+	})
+	t.Run("Default login with KMSI redirecting more than once", func(t *testing.T) {
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/applications/redirecttofederatedapplication.aspx":
+				writeFixtureBytes(t, w, r, "ConvergedSignIn.html", FixtureData{
+					UrlPost:              "/defaultLogin",
+					UrlGetCredentialType: "/getCredentialType",
+				})
+			case "/getCredentialType":
+				writeFixtureBytes(t, w, r, "GetCredentialType_default.json", FixtureData{})
+			case "/defaultLogin":
+				writeFixtureBytes(t, w, r, "KmsiInterrupt.html", FixtureData{
+					UrlPost: "/kmsi",
+				})
+			case "/kmsi":
+				http.Redirect(w, r, "/redirect", http.StatusFound)
+			case "/redirect":
+				http.Redirect(w, r, "/sResponse", http.StatusFound)
+			case "/sResponse":
+				writeFixtureBytes(t, w, r, "SAMLResponse.html", FixtureData{})
+			default:
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			}
+		}))
+		defer ts.Close()
+
+		ac, loginDetails := setupTestClient(t, ts)
+		got, err := ac.Authenticate(loginDetails)
+		require.Nil(t, err)
+		require.NotEmpty(t, got)
+	})
+	t.Run("Default login with login hint", func(t *testing.T) {
+		var startQuery url.Values
+		var credentialTypeRequest GetCredentialTypeRequest
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/applications/redirecttofederatedapplication.aspx":
+				startQuery = r.URL.Query()
+				writeFixtureBytes(t, w, r, "ConvergedSignIn.html", FixtureData{
+					UrlPost:              "/defaultLogin",
+					UrlGetCredentialType: "/getCredentialType",
+				})
+			case "/getCredentialType":
+				require.Nil(t, json.NewDecoder(r.Body).Decode(&credentialTypeRequest))
+				writeFixtureBytes(t, w, r, "GetCredentialType_default.json", FixtureData{})
+			case "/defaultLogin":
 				writeFixtureBytes(t, w, r, "KmsiInterrupt.html", FixtureData{
 					UrlPost: "/hForm",
 				})
@@ -256,11 +463,85 @@ func Test_Authenticate(t *testing.T) {
 		defer ts.Close()
 
 		ac, loginDetails := setupTestClient(t, ts)
+		ac.idpAccount.LoginHint = true
 		got, err := ac.Authenticate(loginDetails)
 		require.Nil(t, err)
 		require.NotEmpty(t, got)
+		require.Equal(t, loginDetails.Username, startQuery.Get("login_hint"))
+		require.Equal(t, ac.idpAccount.AppID, startQuery.Get("applicationId"))
+		require.Equal(t, loginDetails.Username, credentialTypeRequest.LoginHint)
+
+		ac.idpAccount.LoginHint = false
+		_, err = ac.Authenticate(loginDetails)
+		require.Nil(t, err)
+		require.NotContains(t, startQuery, "login_hint")
 	})
-	t.Run("Default login with KMSI and MFA", func(t *testing.T) {
+	t.Run("Default login with account picker", func(t *testing.T) {
+		tests := []struct {
+			name         string
+			username     string
+			wantHint     string
+			wantUsername string
+		}{
+			{name: "listed account", username: strings.ToUpper(genFixtureData().UserName), wantHint: genFixtureData().UserName, wantUsername: strings.ToUpper(genFixtureData().UserName)},
+			{name: "another account", username: "another.user@exampledomain.com", wantUsername: "another.user@exampledomain.com"},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				var gotHint, gotUsername string
+				ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					switch r.URL.Path {
+					case "/applications/redirecttofederatedapplication.aspx":
+						if gotHint = r.URL.Query().Get("login_hint"); gotHint == "" {
+							writeFixtureBytes(t, w, r, "ConvergedChooseAccount.html", FixtureData{
+								UrlPost:              "/defaultLogin",
+								UrlGetCredentialType: "/getCredentialType",
+							})
+							return
+						}
+						writeFixtureBytes(t, w, r, "KmsiInterrupt.html", FixtureData{
+							UrlPost: "/hForm",
+						})
+					case "/getCredentialType":
+						var credentialTypeReq GetCredentialTypeRequest
+						require.Nil(t, json.NewDecoder(r.Body).Decode(&credentialTypeReq))
+						gotUsername = credentialTypeReq.Username
+						writeFixtureBytes(t, w, r, "GetCredentialType_default.json", FixtureData{})
+					case "/defaultLogin":
+						writeFixtureBytes(t, w, r, "KmsiInterrupt.html", FixtureData{
+							UrlPost: "/hForm",
+						})
+					case "/hForm":
+						writeFixtureBytes(t, w, r, "HiddenForm.html", FixtureData{
+							UrlHiddenForm: "/sRequest",
+						})
+					case "/sRequest":
+						writeFixtureBytes(t, w, r, "SAMLRequest.html", FixtureData{
+							UrlSamlRequest: "/sResponse?SAMLRequest=ExampleValue",
+						})
+					case "/sResponse":
+						writeFixtureBytes(t, w, r, "SAMLResponse.html", FixtureData{})
+					default:
+						http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+					}
+				}))
+				defer ts.Close()
+
+				ac, loginDetails := setupTestClient(t, ts)
+				loginDetails.Username = tt.username
+				got, err := ac.Authenticate(loginDetails)
+				require.Nil(t, err)
+				require.NotEmpty(t, got)
+				require.Equal(t, tt.wantHint, gotHint)
+				if tt.wantHint == "" {
+					require.Equal(t, tt.wantUsername, gotUsername)
+				} else {
+					require.Empty(t, gotUsername)
+				}
+			})
+		}
+	})
+	t.Run("Default login with KMSI but skip MFA", func(t *testing.T) {
 		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			switch r.URL.Path {
 			case "/index", "/applications/redirecttofederatedapplication.aspx":
@@ -271,6 +552,10 @@ func Test_Authenticate(t *testing.T) {
 			case "/getCredentialType":
 				writeFixtureBytes(t, w, r, "GetCredentialType_default.json", FixtureData{})
 			case "/defaultLogin":
+				writeFixtureBytes(t, w, r, "ConvergedProofUpRedirect.html", FixtureData{
+					UrlSkipMfaRegistration: "/skipMfaRegistration",
+				})
+			case "/skipMfaRegistration":
 				writeFixtureBytes(t, w, r, "KmsiInterrupt.html", FixtureData{
 					UrlPost: "/hForm",
 				})
@@ -283,16 +568,6 @@ func Test_Authenticate(t *testing.T) {
 					UrlSamlRequest: "/sResponse?SAMLRequest=ExampleValue",
 				})
 			case "/sResponse":
-				writeFixtureBytes(t, w, r, "ConvergedTFA.html", FixtureData{
-					UrlPost:      "/processAuth",
-					UrlBeginAuth: "/beginAuth",
-					UrlEndAuth:   "/endAuth",
-				})
-			case "/beginAuth":
-				writeFixtureBytes(t, w, r, "BeginAuth.json", FixtureData{})
-			case "/endAuth":
-				writeFixtureBytes(t, w, r, "EndAuth.json", FixtureData{})
-			case "/processAuth":
 				writeFixtureBytes(t, w, r, "SAMLResponse.html", FixtureData{})
 			default:
 				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
@@ -300,16 +575,14 @@ func Test_Authenticate(t *testing.T) {
 		}))
 		defer ts.Close()
 
-		pr := &mocks.Prompter{}
-		prompter.SetPrompter(pr)
-		pr.Mock.On("StringRequired", "Enter verification code").Return("000000")
-
 		ac, loginDetails := setupTestClient(t, ts)
 		got, err := ac.Authenticate(loginDetails)
 		require.Nil(t, err)
 		require.NotEmpty(t, got)
+		require.False(t, ac.MFAPerformed())
 	})
-	t.Run("Default login with KMSI and MFA but Authenticator required", func(t *testing.T) {
+	t.Run("Default login with security info nag", func(t *testing.T) {
+		asked := 0
 		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			switch r.URL.Path {
 			case "/index", "/applications/redirecttofederatedapplication.aspx":
@@ -320,6 +593,11 @@ func Test_Authenticate(t *testing.T) {
 			case "/getCredentialType":
 				writeFixtureBytes(t, w, r, "GetCredentialType_default.json", FixtureData{})
 			case "/defaultLogin":
+				writeFixtureBytes(t, w, r, "ConvergedSecurityInfoNag.html", FixtureData{
+					UrlSkipMfaRegistration: "/askLater",
+				})
+			case "/askLater":
+				asked++
 				writeFixtureBytes(t, w, r, "KmsiInterrupt.html", FixtureData{
 					UrlPost: "/hForm",
 				})
@@ -332,18 +610,32 @@ func Test_Authenticate(t *testing.T) {
 					UrlSamlRequest: "/sResponse?SAMLRequest=ExampleValue",
 				})
 			case "/sResponse":
-				writeFixtureBytes(t, w, r, "ConvergedTFA.html", FixtureData{
-					UrlPost:      "/processAuth",
-					UrlBeginAuth: "/beginAuth",
-					UrlEndAuth:   "/endAuth",
+				writeFixtureBytes(t, w, r, "SAMLResponse.html", FixtureData{})
+			default:
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			}
+		}))
+		defer ts.Close()
+
+		ac, loginDetails := setupTestClient(t, ts)
+		got, err := ac.Authenticate(loginDetails)
+		require.Nil(t, err)
+		require.NotEmpty(t, got)
+		require.Equal(t, 1, asked)
+	})
+	t.Run("Default login with security info nag loop", func(t *testing.T) {
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/index", "/applications/redirecttofederatedapplication.aspx":
+				writeFixtureBytes(t, w, r, "ConvergedSignIn.html", FixtureData{
+					UrlPost:              "/defaultLogin",
+					UrlGetCredentialType: "/getCredentialType",
 				})
-			case "/beginAuth":
-				writeFixtureBytes(t, w, r, "BeginAuth.json", FixtureData{})
-			case "/endAuth":
-				writeFixtureBytes(t, w, r, "EndAuth.json", FixtureData{})
-			case "/processAuth":
-				writeFixtureBytes(t, w, r, "ConvergedProofUpRedirect.html", FixtureData{
-					SErrorCode: "502031",
+			case "/getCredentialType":
+				writeFixtureBytes(t, w, r, "GetCredentialType_default.json", FixtureData{})
+			case "/defaultLogin", "/askLater":
+				writeFixtureBytes(t, w, r, "ConvergedSecurityInfoNag.html", FixtureData{
+					UrlSkipMfaRegistration: "/askLater",
 				})
 			default:
 				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
@@ -351,16 +643,11 @@ func Test_Authenticate(t *testing.T) {
 		}))
 		defer ts.Close()
 
-		pr := &mocks.Prompter{}
-		prompter.SetPrompter(pr)
-		pr.Mock.On("StringRequired", "Enter verification code").Return("000000")
-
 		ac, loginDetails := setupTestClient(t, ts)
 		_, err := ac.Authenticate(loginDetails)
-		require.Error(t, err)
-		require.Contains(t, err.Error(), "502031")
+		require.EqualError(t, err, "too many security info pages")
 	})
-	t.Run("ADFS login with KMSI and MFA", func(t *testing.T) {
+	t.Run("Default login with mandatory MFA registration", func(t *testing.T) {
 		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			switch r.URL.Path {
 			case "/index", "/applications/redirecttofederatedapplication.aspx":
@@ -369,18 +656,237 @@ func Test_Authenticate(t *testing.T) {
 					UrlGetCredentialType: "/getCredentialType",
 				})
 			case "/getCredentialType":
-				writeFixtureBytes(t, w, r, "GetCredentialType_adfs.json", FixtureData{
-					UrlFederationRedirect: "/adfsLogin",
-				})
-			case "/adfsLogin":
-				writeFixtureBytes(t, w, r, "ADFS.html", FixtureData{
-					UrlPost: "/adfsTrust",
+				writeFixtureBytes(t, w, r, "GetCredentialType_default.json", FixtureData{})
+			case "/defaultLogin":
+				writeFixtureBytes(t, w, r, "ConvergedProofUpRedirect.html", FixtureData{})
+			default:
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			}
+		}))
+		defer ts.Close()
+
+		ac, loginDetails := setupTestClient(t, ts)
+		_, err := ac.Authenticate(loginDetails)
+		require.ErrorIs(t, err, ErrMfaRegistrationRequired)
+		var registrationErr *MfaRegistrationRequiredError
+		require.True(t, errors.As(err, &registrationErr))
+		require.Equal(t, "https://aka.ms/mfasetup", registrationErr.URL)
+		require.Contains(t, err.Error(), "sign in with a browser to register one at https://aka.ms/mfasetup")
+	})
+	t.Run("Default login with password change", func(t *testing.T) {
+		tests := []struct {
+			name    string
+			skipURL string
+			wantErr error
+		}{
+			{name: "skippable", skipURL: "/skipPasswordChange"},
+			{name: "mandatory", wantErr: ErrPasswordChangeRequired},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					switch r.URL.Path {
+					case "/applications/redirecttofederatedapplication.aspx":
+						writeFixtureBytes(t, w, r, "ConvergedSignIn.html", FixtureData{
+							UrlPost:              "/defaultLogin",
+							UrlGetCredentialType: "/getCredentialType",
+						})
+					case "/getCredentialType":
+						writeFixtureBytes(t, w, r, "GetCredentialType_default.json", FixtureData{})
+					case "/defaultLogin":
+						writeFixtureBytes(t, w, r, "ConvergedChangePassword.html", FixtureData{
+							UrlPost:               "/changePassword",
+							UrlSkipPasswordChange: tt.skipURL,
+						})
+					case "/skipPasswordChange":
+						writeFixtureBytes(t, w, r, "KmsiInterrupt.html", FixtureData{
+							UrlPost: "/hForm",
+						})
+					case "/hForm":
+						writeFixtureBytes(t, w, r, "HiddenForm.html", FixtureData{
+							UrlHiddenForm: "/sRequest",
+						})
+					case "/sRequest":
+						writeFixtureBytes(t, w, r, "SAMLRequest.html", FixtureData{
+							UrlSamlRequest: "/sResponse?SAMLRequest=ExampleValue",
+						})
+					case "/sResponse":
+						writeFixtureBytes(t, w, r, "SAMLResponse.html", FixtureData{})
+					default:
+						http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+					}
+				}))
+				defer ts.Close()
+
+				ac, loginDetails := setupTestClient(t, ts)
+				got, err := ac.Authenticate(loginDetails)
+				if tt.wantErr != nil {
+					require.Equal(t, tt.wantErr, err)
+					return
+				}
+				require.Nil(t, err)
+				require.NotEmpty(t, got)
+			})
+		}
+	})
+	t.Run("Default login with separate password page", func(t *testing.T) {
+		tests := []struct {
+			name         string
+			passwordPage bool
+			wantErr      string
+		}{
+			{name: "password accepted"},
+			{name: "password page shown again", passwordPage: true, wantErr: "the password page was shown again after submitting the password"},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					switch r.URL.Path {
+					case "/applications/redirecttofederatedapplication.aspx":
+						writeFixtureBytes(t, w, r, "ConvergedSignIn.html", FixtureData{
+							UrlPost:              "/defaultLogin",
+							UrlGetCredentialType: "/getCredentialType",
+						})
+					case "/getCredentialType":
+						writeFixtureBytes(t, w, r, "GetCredentialType_default.json", FixtureData{})
+					case "/defaultLogin":
+						writeFixtureBytes(t, w, r, "ConvergedPassword.html", FixtureData{
+							UrlPost: "/password",
+						})
+					case "/password":
+						require.Nil(t, r.ParseForm())
+						require.Equal(t, "test123", r.PostForm.Get("passwd"))
+						require.Empty(t, r.PostForm.Get("login"))
+						require.Empty(t, r.PostForm.Get("loginfmt"))
+						require.NotEmpty(t, r.PostForm.Get("flowToken"))
+						if tt.passwordPage {
+							writeFixtureBytes(t, w, r, "ConvergedPassword.html", FixtureData{
+								UrlPost: "/password",
+							})
+							return
+						}
+						writeFixtureBytes(t, w, r, "KmsiInterrupt.html", FixtureData{
+							UrlPost: "/hForm",
+						})
+					case "/hForm":
+						writeFixtureBytes(t, w, r, "HiddenForm.html", FixtureData{
+							UrlHiddenForm: "/sRequest",
+						})
+					case "/sRequest":
+						writeFixtureBytes(t, w, r, "SAMLRequest.html", FixtureData{
+							UrlSamlRequest: "/sResponse?SAMLRequest=ExampleValue",
+						})
+					case "/sResponse":
+						writeFixtureBytes(t, w, r, "SAMLResponse.html", FixtureData{})
+					default:
+						http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+					}
+				}))
+				defer ts.Close()
+
+				ac, loginDetails := setupTestClient(t, ts)
+				got, err := ac.Authenticate(loginDetails)
+				if tt.wantErr != "" {
+					require.EqualError(t, err, tt.wantErr)
+					return
+				}
+				require.Nil(t, err)
+				require.NotEmpty(t, got)
+			})
+		}
+	})
+	t.Run("Default login with a wrong password", func(t *testing.T) {
+		tests := []struct {
+			name            string
+			passwordRetries int
+			skipPrompt      bool
+			wantErr         string
+		}{
+			{name: "password asked for again", passwordRetries: 1},
+			{name: "retries not configured", wantErr: "login error 50126"},
+			{name: "prompt skipped", passwordRetries: 1, skipPrompt: true, wantErr: "login error 50126"},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				var passwords []string
+				ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					switch r.URL.Path {
+					case "/applications/redirecttofederatedapplication.aspx":
+						writeFixtureBytes(t, w, r, "ConvergedSignIn.html", FixtureData{
+							UrlPost:              "/defaultLogin",
+							UrlGetCredentialType: "/getCredentialType",
+						})
+					case "/getCredentialType":
+						writeFixtureBytes(t, w, r, "GetCredentialType_default.json", FixtureData{})
+					case "/defaultLogin":
+						require.Nil(t, r.ParseForm())
+						require.NotEmpty(t, r.PostForm.Get("flowToken"))
+						passwords = append(passwords, r.PostForm.Get("passwd"))
+						if r.PostForm.Get("passwd") != "correct" {
+							writeFixtureBytes(t, w, r, "ConvergedSignIn.html", FixtureData{
+								UrlPost:              "/defaultLogin",
+								UrlGetCredentialType: "/getCredentialType",
+								SErrorCode:           "50126",
+							})
+							return
+						}
+						writeFixtureBytes(t, w, r, "KmsiInterrupt.html", FixtureData{
+							UrlPost: "/hForm",
+						})
+					case "/hForm":
+						writeFixtureBytes(t, w, r, "HiddenForm.html", FixtureData{
+							UrlHiddenForm: "/sRequest",
+						})
+					case "/sRequest":
+						writeFixtureBytes(t, w, r, "SAMLRequest.html", FixtureData{
+							UrlSamlRequest: "/sResponse?SAMLRequest=ExampleValue",
+						})
+					case "/sResponse":
+						writeFixtureBytes(t, w, r, "SAMLResponse.html", FixtureData{})
+					default:
+						http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+					}
+				}))
+				defer ts.Close()
+
+				pr := &mocks.Prompter{}
+				prompter.SetPrompter(pr)
+				pr.Mock.On("Password", "Password").Return("correct")
+
+				ac, loginDetails := setupTestClient(t, ts)
+				ac.idpAccount.PasswordRetries = tt.passwordRetries
+				loginDetails.SkipPrompt = tt.skipPrompt
+				got, err := ac.Authenticate(loginDetails)
+				if tt.wantErr != "" {
+					require.EqualError(t, err, tt.wantErr)
+					require.Equal(t, []string{"test123"}, passwords)
+					pr.Mock.AssertNotCalled(t, "Password", "Password")
+					return
+				}
+				require.Nil(t, err)
+				require.NotEmpty(t, got)
+				require.Equal(t, []string{"test123", "correct"}, passwords)
+				require.Equal(t, "correct", loginDetails.Password)
+			})
+		}
+	})
+	t.Run("Guest login redirected to the home tenant", func(t *testing.T) {
+		var homeTenantSignIn bool
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/applications/redirecttofederatedapplication.aspx":
+				writeFixtureBytes(t, w, r, "ConvergedHomeTenantRedirect.html", FixtureData{
+					UrlPost: "/home/saml2",
 				})
-			case "/adfsTrust":
-				writeFixtureBytes(t, w, r, "ADFStrust.html", FixtureData{
-					UrlPost: "/adfsSAML",
+			case "/home/saml2":
+				homeTenantSignIn = true
+				writeFixtureBytes(t, w, r, "ConvergedSignIn.html", FixtureData{
+					UrlPost:              "/defaultLogin",
+					UrlGetCredentialType: "/getCredentialType",
 				})
-			case "/adfsSAML":
+			case "/getCredentialType":
+				writeFixtureBytes(t, w, r, "GetCredentialType_default.json", FixtureData{})
+			case "/defaultLogin":
 				writeFixtureBytes(t, w, r, "KmsiInterrupt.html", FixtureData{
 					UrlPost: "/hForm",
 				})
@@ -393,16 +899,6 @@ func Test_Authenticate(t *testing.T) {
 					UrlSamlRequest: "/sResponse?SAMLRequest=ExampleValue",
 				})
 			case "/sResponse":
-				writeFixtureBytes(t, w, r, "ConvergedTFA.html", FixtureData{
-					UrlPost:      "/processAuth",
-					UrlBeginAuth: "/beginAuth",
-					UrlEndAuth:   "/endAuth",
-				})
-			case "/beginAuth":
-				writeFixtureBytes(t, w, r, "BeginAuth.json", FixtureData{})
-			case "/endAuth":
-				writeFixtureBytes(t, w, r, "EndAuth.json", FixtureData{})
-			case "/processAuth":
 				writeFixtureBytes(t, w, r, "SAMLResponse.html", FixtureData{})
 			default:
 				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
@@ -410,111 +906,1954 @@ func Test_Authenticate(t *testing.T) {
 		}))
 		defer ts.Close()
 
-		pr := &mocks.Prompter{}
+		ac, loginDetails := setupTestClient(t, ts)
+		got, err := ac.Authenticate(loginDetails)
+		require.Nil(t, err)
+		require.NotEmpty(t, got)
+		require.True(t, homeTenantSignIn)
+	})
+	t.Run("Guest login redirected to another host", func(t *testing.T) {
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(`$Config={"urlHomeTenantRedirect":"https://login.example.com/home/saml2","pgid":"ConvergedHomeTenantRedirect"};`))
+		}))
+		defer ts.Close()
+
+		ac, loginDetails := setupTestClient(t, ts)
+		_, err := ac.Authenticate(loginDetails)
+		require.EqualError(t, err, "refusing the home tenant redirect to login.example.com")
+	})
+	t.Run("Default login with meta refresh", func(t *testing.T) {
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/applications/redirecttofederatedapplication.aspx":
+				writeFixtureBytes(t, w, r, "MetaRefresh.html", FixtureData{
+					UrlPost: "/signIn",
+				})
+			case "/signIn":
+				writeFixtureBytes(t, w, r, "ConvergedSignIn.html", FixtureData{
+					UrlPost:              "/defaultLogin",
+					UrlGetCredentialType: "/getCredentialType",
+				})
+			case "/getCredentialType":
+				writeFixtureBytes(t, w, r, "GetCredentialType_default.json", FixtureData{})
+			case "/defaultLogin":
+				writeFixtureBytes(t, w, r, "KmsiInterrupt.html", FixtureData{
+					UrlPost: "/hForm",
+				})
+			case "/hForm":
+				writeFixtureBytes(t, w, r, "HiddenForm.html", FixtureData{
+					UrlHiddenForm: "/sRequest",
+				})
+			case "/sRequest":
+				writeFixtureBytes(t, w, r, "SAMLRequest.html", FixtureData{
+					UrlSamlRequest: "/sResponse?SAMLRequest=ExampleValue",
+				})
+			case "/sResponse":
+				writeFixtureBytes(t, w, r, "SAMLResponse.html", FixtureData{})
+			default:
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			}
+		}))
+		defer ts.Close()
+
+		ac, loginDetails := setupTestClient(t, ts)
+		got, err := ac.Authenticate(loginDetails)
+		require.Nil(t, err)
+		require.NotEmpty(t, got)
+	})
+	t.Run("Default login with meta refresh loop", func(t *testing.T) {
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			writeFixtureBytes(t, w, r, "MetaRefresh.html", FixtureData{
+				UrlPost: "/applications/redirecttofederatedapplication.aspx",
+			})
+		}))
+		defer ts.Close()
+
+		ac, loginDetails := setupTestClient(t, ts)
+		_, err := ac.Authenticate(loginDetails)
+		require.EqualError(t, err, "too many meta refresh redirects")
+	})
+	t.Run("Default login with app ID discovery", func(t *testing.T) {
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/":
+				writeFixtureBytes(t, w, r, "ConvergedSignIn.html", FixtureData{
+					UrlPost:              "/defaultLogin",
+					UrlGetCredentialType: "/getCredentialType",
+				})
+			case "/getCredentialType":
+				writeFixtureBytes(t, w, r, "GetCredentialType_default.json", FixtureData{})
+			case "/defaultLogin":
+				writeFixtureBytes(t, w, r, "KmsiInterrupt.html", FixtureData{
+					UrlPost: "/myApps",
+				})
+			case "/myApps":
+				writeFixtureBytes(t, w, r, "MyApps.html", FixtureData{})
+			case "/applications/redirecttofederatedapplication.aspx":
+				if r.URL.Query().Get("applicationId") != genFixtureData().ApplicationId {
+					http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+					return
+				}
+				writeFixtureBytes(t, w, r, "HiddenForm.html", FixtureData{
+					UrlHiddenForm: "/sRequest",
+				})
+			case "/sRequest":
+				writeFixtureBytes(t, w, r, "SAMLRequest.html", FixtureData{
+					UrlSamlRequest: "/sResponse?SAMLRequest=ExampleValue",
+				})
+			case "/sResponse":
+				writeFixtureBytes(t, w, r, "SAMLResponse.html", FixtureData{})
+			default:
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			}
+		}))
+		defer ts.Close()
+
+		ac, loginDetails := setupTestClient(t, ts)
+		ac.idpAccount.AppID = ""
+		ac.idpAccount.AppName = "AWS Production"
+		got, err := ac.Authenticate(loginDetails)
+		require.Nil(t, err)
+		require.NotEmpty(t, got)
+		require.Equal(t, genFixtureData().ApplicationId, ac.idpAccount.AppID)
+	})
+	t.Run("Default login with additional apps", func(t *testing.T) {
+		var logins int
+		var appIDs []string
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/applications/redirecttofederatedapplication.aspx":
+				appIDs = append(appIDs, r.URL.Query().Get("applicationId"))
+				if _, err := r.Cookie("ESTSAUTH"); err != nil {
+					writeFixtureBytes(t, w, r, "ConvergedSignIn.html", FixtureData{
+						UrlPost:              "/defaultLogin",
+						UrlGetCredentialType: "/getCredentialType",
+					})
+					return
+				}
+				writeFixtureBytes(t, w, r, "HiddenForm.html", FixtureData{
+					UrlHiddenForm: "/sRequest",
+				})
+			case "/getCredentialType":
+				writeFixtureBytes(t, w, r, "GetCredentialType_default.json", FixtureData{})
+			case "/defaultLogin":
+				logins++
+				http.SetCookie(w, &http.Cookie{Name: "ESTSAUTH", Value: "session", Path: "/"})
+				writeFixtureBytes(t, w, r, "KmsiInterrupt.html", FixtureData{
+					UrlPost: "/hForm",
+				})
+			case "/hForm":
+				writeFixtureBytes(t, w, r, "HiddenForm.html", FixtureData{
+					UrlHiddenForm: "/sRequest",
+				})
+			case "/sRequest":
+				writeFixtureBytes(t, w, r, "SAMLRequest.html", FixtureData{
+					UrlSamlRequest: "/sResponse?SAMLRequest=ExampleValue",
+				})
+			case "/sResponse":
+				writeFixtureBytes(t, w, r, "SAMLResponse.html", FixtureData{})
+			default:
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			}
+		}))
+		defer ts.Close()
+
+		ac, loginDetails := setupTestClient(t, ts)
+		jar, err := cookiejar.New(nil)
+		require.Nil(t, err)
+		ac.client.Jar = jar
+		got, err := ac.AuthenticateApps(loginDetails, []string{"second-app-id", " " + ac.idpAccount.AppID})
+		require.Nil(t, err)
+		require.Len(t, got, 2)
+		require.NotEmpty(t, got[ac.idpAccount.AppID])
+		require.NotEmpty(t, got["second-app-id"])
+		require.Equal(t, 1, logins)
+		require.Equal(t, []string{ac.idpAccount.AppID, "second-app-id"}, appIDs)
+	})
+	t.Run("Default login with CAE claims challenge", func(t *testing.T) {
+		const claims = `{"access_token":{"nbf":{"essential":true,"value":"1604106651"}}}`
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/applications/redirecttofederatedapplication.aspx":
+				if r.URL.Query().Get("claims") != claims {
+					writeFixtureBytes(t, w, r, "CAEChallenge.html", FixtureData{
+						Claims: base64.StdEncoding.EncodeToString([]byte(claims)),
+					})
+					return
+				}
+				writeFixtureBytes(t, w, r, "ConvergedSignIn.html", FixtureData{
+					UrlPost:              "/defaultLogin",
+					UrlGetCredentialType: "/getCredentialType",
+				})
+			case "/getCredentialType":
+				writeFixtureBytes(t, w, r, "GetCredentialType_default.json", FixtureData{})
+			case "/defaultLogin":
+				writeFixtureBytes(t, w, r, "KmsiInterrupt.html", FixtureData{
+					UrlPost: "/hForm",
+				})
+			case "/hForm":
+				writeFixtureBytes(t, w, r, "HiddenForm.html", FixtureData{
+					UrlHiddenForm: "/sRequest",
+				})
+			case "/sRequest":
+				writeFixtureBytes(t, w, r, "SAMLRequest.html", FixtureData{
+					UrlSamlRequest: "/sResponse?SAMLRequest=ExampleValue",
+				})
+			case "/sResponse":
+				writeFixtureBytes(t, w, r, "SAMLResponse.html", FixtureData{})
+			default:
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			}
+		}))
+		defer ts.Close()
+
+		ac, loginDetails := setupTestClient(t, ts)
+		got, err := ac.Authenticate(loginDetails)
+		require.Nil(t, err)
+		require.NotEmpty(t, got)
+	})
+	t.Run("Default login with unsatisfiable CAE claims challenge", func(t *testing.T) {
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			writeFixtureBytes(t, w, r, "CAEChallenge.html", FixtureData{
+				Claims: base64.StdEncoding.EncodeToString([]byte(`{"access_token":{"acrs":{"essential":true,"value":"c1"}}}`)),
+			})
+		}))
+		defer ts.Close()
+
+		ac, loginDetails := setupTestClient(t, ts)
+		_, err := ac.Authenticate(loginDetails)
+		require.Equal(t, ErrClaimsChallenge, err)
+	})
+	t.Run("Default login with CAE challenge missing claims", func(t *testing.T) {
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			writeFixtureBytes(t, w, r, "CAEChallenge.html", FixtureData{})
+		}))
+		defer ts.Close()
+
+		ac, loginDetails := setupTestClient(t, ts)
+		_, err := ac.Authenticate(loginDetails)
+		require.ErrorIs(t, err, ErrClaimsChallenge)
+	})
+	t.Run("Default login with KMSI and MFA", func(t *testing.T) {
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/index", "/applications/redirecttofederatedapplication.aspx":
+				writeFixtureBytes(t, w, r, "ConvergedSignIn.html", FixtureData{
+					UrlPost:              "/defaultLogin",
+					UrlGetCredentialType: "/getCredentialType",
+				})
+			case "/getCredentialType":
+				writeFixtureBytes(t, w, r, "GetCredentialType_default.json", FixtureData{})
+			case "/defaultLogin":
+				writeFixtureBytes(t, w, r, "KmsiInterrupt.html", FixtureData{
+					UrlPost: "/hForm",
+				})
+			case "/hForm":
+				writeFixtureBytes(t, w, r, "HiddenForm.html", FixtureData{
+					UrlHiddenForm: "/sRequest",
+				})
+			case "/sRequest":
+				writeFixtureBytes(t, w, r, "SAMLRequest.html", FixtureData{
+					UrlSamlRequest: "/sResponse?SAMLRequest=ExampleValue",
+				})
+			case "/sResponse":
+				writeFixtureBytes(t, w, r, "ConvergedTFA.html", FixtureData{
+					UrlPost:      "/processAuth",
+					UrlBeginAuth: "/beginAuth",
+					UrlEndAuth:   "/endAuth",
+				})
+			case "/beginAuth":
+				writeFixtureBytes(t, w, r, "BeginAuth.json", FixtureData{})
+			case "/endAuth":
+				writeFixtureBytes(t, w, r, "EndAuth.json", FixtureData{})
+			case "/processAuth":
+				writeFixtureBytes(t, w, r, "SAMLResponse.html", FixtureData{})
+			default:
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			}
+		}))
+		defer ts.Close()
+
+		pr := &mocks.Prompter{}
+		prompter.SetPrompter(pr)
+		pr.Mock.On("StringRequired", "Enter verification code").Return("000000")
+
+		registry := metrics.NewRegistry()
+		metrics.SetRecorder(registry)
+		defer metrics.SetRecorder(nil)
+
+		ac, loginDetails := setupTestClient(t, ts)
+		got, err := ac.Authenticate(loginDetails)
+		require.Nil(t, err)
+		require.NotEmpty(t, got)
+		require.True(t, ac.MFAPerformed())
+		require.Equal(t, uint64(1), registry.Value(metrics.MFATotal, "AzureAD", "OneWaySMS"))
+	})
+	t.Run("Default login with verbose MFA", func(t *testing.T) {
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/index", "/applications/redirecttofederatedapplication.aspx":
+				writeFixtureBytes(t, w, r, "ConvergedTFA.html", FixtureData{
+					UrlPost:      "/processAuth",
+					UrlBeginAuth: "/beginAuth",
+					UrlEndAuth:   "/endAuth",
+				})
+			case "/beginAuth":
+				writeFixtureBytes(t, w, r, "BeginAuth.json", FixtureData{})
+			case "/endAuth":
+				writeFixtureBytes(t, w, r, "EndAuth.json", FixtureData{})
+			case "/processAuth":
+				writeFixtureBytes(t, w, r, "SAMLResponse.html", FixtureData{})
+			default:
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			}
+		}))
+		defer ts.Close()
+
+		pr := &mocks.Prompter{}
+		prompter.SetPrompter(pr)
+		pr.Mock.On("StringRequired", "Enter verification code").Return("000000")
+
+		var buf bytes.Buffer
+		log.SetOutput(&buf)
+		defer log.SetOutput(os.Stderr)
+
+		ac, loginDetails := setupTestClient(t, ts)
+		ac.idpAccount.MFAVerbose = true
+		got, err := ac.Authenticate(loginDetails)
+		require.Nil(t, err)
+		require.NotEmpty(t, got)
+		require.Contains(t, buf.String(), "MFA methods offered by Azure AD:\n")
+		require.Contains(t, buf.String(), "  OneWaySMS: +XX XXX XXXX X89\n")
+		require.Contains(t, buf.String(), "  TwoWayVoiceMobile: +XX XXX XXXX X89\n")
+
+		buf.Reset()
+		ac.idpAccount.MFAVerbose = false
+		_, err = ac.Authenticate(loginDetails)
+		require.Nil(t, err)
+		require.NotContains(t, buf.String(), "MFA methods offered")
+	})
+	t.Run("Default login with KMSI and MFA but Authenticator required", func(t *testing.T) {
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/index", "/applications/redirecttofederatedapplication.aspx":
+				writeFixtureBytes(t, w, r, "ConvergedSignIn.html", FixtureData{
+					UrlPost:              "/defaultLogin",
+					UrlGetCredentialType: "/getCredentialType",
+				})
+			case "/getCredentialType":
+				writeFixtureBytes(t, w, r, "GetCredentialType_default.json", FixtureData{})
+			case "/defaultLogin":
+				writeFixtureBytes(t, w, r, "KmsiInterrupt.html", FixtureData{
+					UrlPost: "/hForm",
+				})
+			case "/hForm":
+				writeFixtureBytes(t, w, r, "HiddenForm.html", FixtureData{
+					UrlHiddenForm: "/sRequest",
+				})
+			case "/sRequest":
+				writeFixtureBytes(t, w, r, "SAMLRequest.html", FixtureData{
+					UrlSamlRequest: "/sResponse?SAMLRequest=ExampleValue",
+				})
+			case "/sResponse":
+				writeFixtureBytes(t, w, r, "ConvergedTFA.html", FixtureData{
+					UrlPost:      "/processAuth",
+					UrlBeginAuth: "/beginAuth",
+					UrlEndAuth:   "/endAuth",
+				})
+			case "/beginAuth":
+				writeFixtureBytes(t, w, r, "BeginAuth.json", FixtureData{})
+			case "/endAuth":
+				writeFixtureBytes(t, w, r, "EndAuth.json", FixtureData{})
+			case "/processAuth":
+				writeFixtureBytes(t, w, r, "ConvergedProofUpRedirect.html", FixtureData{
+					SErrorCode: "502031",
+				})
+			default:
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			}
+		}))
+		defer ts.Close()
+
+		pr := &mocks.Prompter{}
+		prompter.SetPrompter(pr)
+		pr.Mock.On("StringRequired", "Enter verification code").Return("000000")
+
+		ac, loginDetails := setupTestClient(t, ts)
+		_, err := ac.Authenticate(loginDetails)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "502031")
+	})
+	t.Run("ADFS login with KMSI and MFA", func(t *testing.T) {
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/index", "/applications/redirecttofederatedapplication.aspx":
+				writeFixtureBytes(t, w, r, "ConvergedSignIn.html", FixtureData{
+					UrlPost:              "/defaultLogin",
+					UrlGetCredentialType: "/getCredentialType",
+				})
+			case "/getCredentialType":
+				writeFixtureBytes(t, w, r, "GetCredentialType_adfs.json", FixtureData{
+					UrlFederationRedirect: "/adfsLogin",
+				})
+			case "/adfsLogin":
+				writeFixtureBytes(t, w, r, "ADFS.html", FixtureData{
+					UrlPost: "/adfsTrust",
+				})
+			case "/adfsTrust":
+				writeFixtureBytes(t, w, r, "ADFStrust.html", FixtureData{
+					UrlPost: "/adfsSAML",
+				})
+			case "/adfsSAML":
+				writeFixtureBytes(t, w, r, "KmsiInterrupt.html", FixtureData{
+					UrlPost: "/hForm",
+				})
+			case "/hForm":
+				writeFixtureBytes(t, w, r, "HiddenForm.html", FixtureData{
+					UrlHiddenForm: "/sRequest",
+				})
+			case "/sRequest":
+				writeFixtureBytes(t, w, r, "SAMLRequest.html", FixtureData{
+					UrlSamlRequest: "/sResponse?SAMLRequest=ExampleValue",
+				})
+			case "/sResponse":
+				writeFixtureBytes(t, w, r, "ConvergedTFA.html", FixtureData{
+					UrlPost:      "/processAuth",
+					UrlBeginAuth: "/beginAuth",
+					UrlEndAuth:   "/endAuth",
+				})
+			case "/beginAuth":
+				writeFixtureBytes(t, w, r, "BeginAuth.json", FixtureData{})
+			case "/endAuth":
+				writeFixtureBytes(t, w, r, "EndAuth.json", FixtureData{})
+			case "/processAuth":
+				writeFixtureBytes(t, w, r, "SAMLResponse.html", FixtureData{})
+			default:
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			}
+		}))
+		defer ts.Close()
+
+		pr := &mocks.Prompter{}
 		prompter.SetPrompter(pr)
 		pr.Mock.On("StringRequired", "Enter verification code").Return("000000")
 
 		ac, loginDetails := setupTestClient(t, ts)
-		got, err := ac.Authenticate(loginDetails)
+		got, err := ac.Authenticate(loginDetails)
+		require.Nil(t, err)
+		require.NotEmpty(t, got)
+	})
+	t.Run("Default login with service unavailable", func(t *testing.T) {
+		var slept []time.Duration
+		sleep = func(d time.Duration) { slept = append(slept, d) }
+		defer func() { sleep = time.Sleep }()
+
+		var logins int
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/index", "/applications/redirecttofederatedapplication.aspx":
+				writeFixtureBytes(t, w, r, "ConvergedSignIn.html", FixtureData{
+					UrlPost:              "/defaultLogin",
+					UrlGetCredentialType: "/getCredentialType",
+				})
+			case "/getCredentialType":
+				writeFixtureBytes(t, w, r, "GetCredentialType_default.json", FixtureData{})
+			case "/defaultLogin":
+				logins++
+				require.Nil(t, r.ParseForm())
+				require.Equal(t, "test123", r.PostForm.Get("passwd"))
+				if logins == 1 {
+					writeFixtureBytes(t, w, r, "ConvergedServiceUnavailable.html", FixtureData{})
+					return
+				}
+				writeFixtureBytes(t, w, r, "KmsiInterrupt.html", FixtureData{
+					UrlPost: "/hForm",
+				})
+			case "/hForm":
+				writeFixtureBytes(t, w, r, "HiddenForm.html", FixtureData{
+					UrlHiddenForm: "/sRequest",
+				})
+			case "/sRequest":
+				writeFixtureBytes(t, w, r, "SAMLRequest.html", FixtureData{
+					UrlSamlRequest: "/sResponse?SAMLRequest=ExampleValue",
+				})
+			case "/sResponse":
+				writeFixtureBytes(t, w, r, "SAMLResponse.html", FixtureData{})
+			default:
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			}
+		}))
+		defer ts.Close()
+
+		ac, loginDetails := setupTestClient(t, ts)
+		got, err := ac.Authenticate(loginDetails)
+		require.Nil(t, err)
+		require.NotEmpty(t, got)
+		require.Equal(t, 2, logins)
+		require.Equal(t, []time.Duration{serviceUnavailableDelay}, slept)
+	})
+	t.Run("Default login with service unavailable persisting", func(t *testing.T) {
+		var slept []time.Duration
+		sleep = func(d time.Duration) { slept = append(slept, d) }
+		defer func() { sleep = time.Sleep }()
+
+		var attempts int
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts++
+			writeFixtureBytes(t, w, r, "ConvergedServiceUnavailable.html", FixtureData{})
+		}))
+		defer ts.Close()
+
+		ac, loginDetails := setupTestClient(t, ts)
+		_, err := ac.Authenticate(loginDetails)
+		require.EqualError(t, err, "Azure AD is unavailable, error 90033 persisted after 3 retries")
+		require.Equal(t, 1+maxServiceUnavailableRetries, attempts)
+		require.Equal(t, []time.Duration{serviceUnavailableDelay, 2 * serviceUnavailableDelay, 4 * serviceUnavailableDelay}, slept)
+	})
+	t.Run("Default login reaching an unknown page", func(t *testing.T) {
+		fixtureData := genFixtureData()
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			writeFixtureBytes(t, w, r, "ConvergedUnknown.html", FixtureData{SErrorCode: "50000"})
+		}))
+		defer ts.Close()
+
+		ac, loginDetails := setupTestClient(t, ts)
+		_, err := ac.Authenticate(loginDetails)
+		require.EqualError(t, err, "failed get SAMLAssertion, stopped at page ConvergedUnknown")
+		require.ErrorIs(t, err, ErrUnknownPage)
+
+		var pageErr *UnknownPageError
+		require.ErrorAs(t, err, &pageErr)
+		require.Equal(t, &UnknownPageError{
+			Pgid:          "ConvergedUnknown",
+			ErrorCode:     "50000",
+			CorrelationID: fixtureData.ClientRequestId,
+			SessionID:     fixtureData.SessionId,
+			StatusCode:    http.StatusOK,
+			URL:           ts.URL + "/applications/redirecttofederatedapplication.aspx",
+		}, pageErr)
+	})
+	t.Run("Default login reaching an error page", func(t *testing.T) {
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			writeFixtureBytes(t, w, r, "ConvergedError.html", FixtureData{})
+		}))
+		defer ts.Close()
+
+		ac, loginDetails := setupTestClient(t, ts)
+		_, err := ac.Authenticate(loginDetails)
+		require.ErrorIs(t, err, ErrUnknownPage)
+		require.ErrorContains(t, err, "failed get SAMLAssertion, stopped at page ConvergedError: AADSTS50105: Your administrator has configured the application AWS")
+
+		var pageErr *UnknownPageError
+		require.ErrorAs(t, err, &pageErr)
+		require.Equal(t, "50105", pageErr.ErrorCode)
+		require.Equal(t, http.StatusOK, pageErr.StatusCode)
+		require.True(t, strings.HasSuffix(pageErr.Message, "Please contact your administrator to assign access to this application."))
+	})
+	t.Run("Federation only login", func(t *testing.T) {
+		var passwordPosted, azureLogin bool
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/defaultLogin" {
+				azureLogin = true
+			}
+			if r.Method == "POST" {
+				require.Nil(t, r.ParseForm())
+				if r.PostForm.Get("passwd") != "" {
+					passwordPosted = true
+				}
+			}
+			switch r.URL.Path {
+			case "/index", "/applications/redirecttofederatedapplication.aspx":
+				writeFixtureBytes(t, w, r, "ConvergedSignIn.html", FixtureData{
+					UrlPost:              "/defaultLogin",
+					UrlGetCredentialType: "/getCredentialType",
+				})
+			case "/getCredentialType":
+				writeFixtureBytes(t, w, r, "GetCredentialType_federated.json", FixtureData{
+					UrlFederationRedirect: "/adfsLogin",
+				})
+			case "/adfsLogin":
+				writeFixtureBytes(t, w, r, "ADFS.html", FixtureData{
+					UrlPost: "/adfsTrust",
+				})
+			case "/adfsTrust":
+				writeFixtureBytes(t, w, r, "ADFStrust.html", FixtureData{
+					UrlPost: "/adfsSAML",
+				})
+			case "/adfsSAML":
+				writeFixtureBytes(t, w, r, "SAMLResponse.html", FixtureData{})
+			default:
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			}
+		}))
+		defer ts.Close()
+
+		ac, loginDetails := setupTestClient(t, ts)
+		got, err := ac.Authenticate(loginDetails)
+		require.Nil(t, err)
+		require.NotEmpty(t, got)
+		require.False(t, passwordPosted, "password must not be posted to Azure AD")
+		require.False(t, azureLogin, "the Azure AD sign in must be bypassed")
+	})
+	t.Run("No password and no federation", func(t *testing.T) {
+		var azureLogin bool
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/applications/redirecttofederatedapplication.aspx":
+				writeFixtureBytes(t, w, r, "ConvergedSignIn.html", FixtureData{
+					UrlPost:              "/defaultLogin",
+					UrlGetCredentialType: "/getCredentialType",
+				})
+			case "/getCredentialType":
+				writeFixtureBytes(t, w, r, "GetCredentialType_federated.json", FixtureData{})
+			case "/defaultLogin":
+				azureLogin = true
+				writeFixtureBytes(t, w, r, "KmsiInterrupt.html", FixtureData{})
+			default:
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			}
+		}))
+		defer ts.Close()
+
+		ac, loginDetails := setupTestClient(t, ts)
+		_, err := ac.Authenticate(loginDetails)
+		require.ErrorContains(t, err, "Azure AD holds no password for "+loginDetails.Username+" and didn't redirect to a federated idp")
+		require.False(t, azureLogin, "the password must not be posted to Azure AD")
+	})
+}
+
+func Test_AuthenticateSavedSession(t *testing.T) {
+	var mfaRequests int
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/applications/redirecttofederatedapplication.aspx":
+			// signed in already, Azure AD goes straight to the app
+			if cookie, err := r.Cookie("ESTSAUTHPERSISTENT"); err == nil && cookie.Value == "persistent" {
+				writeFixtureBytes(t, w, r, "SAMLResponse.html", FixtureData{})
+				return
+			}
+			writeFixtureBytes(t, w, r, "ConvergedSignIn.html", FixtureData{
+				UrlPost:              "/defaultLogin",
+				UrlGetCredentialType: "/getCredentialType",
+			})
+		case "/getCredentialType":
+			writeFixtureBytes(t, w, r, "GetCredentialType_default.json", FixtureData{})
+		case "/defaultLogin":
+			writeFixtureBytes(t, w, r, "ConvergedTFA.html", FixtureData{
+				UrlPost:      "/processAuth",
+				UrlBeginAuth: "/beginAuth",
+				UrlEndAuth:   "/endAuth",
+			})
+		case "/beginAuth":
+			mfaRequests++
+			writeFixtureBytes(t, w, r, "BeginAuth.json", FixtureData{})
+		case "/endAuth":
+			writeFixtureBytes(t, w, r, "EndAuth.json", FixtureData{})
+		case "/processAuth":
+			http.SetCookie(w, &http.Cookie{Name: "ESTSAUTH", Value: "session", Path: "/", Secure: true, HttpOnly: true})
+			http.SetCookie(w, &http.Cookie{Name: "ESTSAUTHPERSISTENT", Value: "persistent", Path: "/", Secure: true, HttpOnly: true})
+			http.SetCookie(w, &http.Cookie{Name: "fpc", Value: "tracking", Path: "/", Secure: true})
+			writeFixtureBytes(t, w, r, "SAMLResponse.html", FixtureData{})
+		default:
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		}
+	}))
+	defer ts.Close()
+
+	helper := &sessionHelper{secrets: map[string]string{}}
+	currentHelper := credentials.CurrentHelper
+	credentials.CurrentHelper = helper
+	defer func() { credentials.CurrentHelper = currentHelper }()
+
+	pr := &mocks.Prompter{}
+	prompter.SetPrompter(pr)
+	pr.Mock.On("StringRequired", "Enter verification code").Return("000000").Once()
+
+	login := func(savedSession string) *Client {
+		ac, loginDetails := setupTestClient(t, ts)
+		jar, err := cookiejar.New(nil)
+		require.Nil(t, err)
+		ac.client.Jar = jar
+		loginDetails.ConfigScope = "work"
+		loginDetails.AADSessionCookies = savedSession
+
+		got, err := ac.Authenticate(loginDetails)
+		require.Nil(t, err)
+		require.NotEmpty(t, got)
+		return &ac
+	}
+
+	ac := login("")
+	require.True(t, ac.MFAPerformed())
+	require.Equal(t, 1, mfaRequests)
+
+	saved := helper.secrets[credentials.SessionCookieURL(ts.URL, "work")]
+	var savedSession session
+	require.Nil(t, json.Unmarshal([]byte(saved), &savedSession))
+	require.Equal(t, ts.URL, savedSession.URL)
+	require.Equal(t, map[string]string{"ESTSAUTH": "session", "ESTSAUTHPERSISTENT": "persistent"}, savedSession.Cookies)
+
+	// the next login with the saved session isn't asked for MFA
+	ac = login(saved)
+	require.False(t, ac.MFAPerformed())
+	require.Equal(t, 1, mfaRequests)
+	pr.Mock.AssertExpectations(t)
+}
+
+// sessionHelper a keychain kept in memory
+type sessionHelper struct {
+	secrets map[string]string
+}
+
+func (h *sessionHelper) Add(c *credentials.Credentials) error {
+	h.secrets[c.ServerURL] = c.Secret
+	return nil
+}
+
+func (h *sessionHelper) Delete(serverURL string) error {
+	delete(h.secrets, serverURL)
+	return nil
+}
+
+func (h *sessionHelper) Get(serverURL string) (string, string, error) {
+	secret, ok := h.secrets[serverURL]
+	if !ok {
+		return "", "", credentials.ErrCredentialsNotFound
+	}
+	return "", secret, nil
+}
+
+func (h *sessionHelper) SupportsCredentialStorage() bool {
+	return true
+}
+
+func Test_AuthenticateScripted(t *testing.T) {
+	fixtureData := genFixtureData()
+	tr := aadtest.NewTransport(
+		aadtest.Step{Method: "GET", Path: "/applications/redirecttofederatedapplication.aspx", Page: "ConvergedSignIn.html", Data: FixtureData{
+			UrlPost:              "/login",
+			UrlGetCredentialType: "/getCredentialType",
+		}},
+		aadtest.Step{Method: "POST", Path: "/getCredentialType", Page: "GetCredentialType_default.json"},
+		aadtest.Step{Method: "POST", Path: "/login", Page: "ConvergedTFA.html", Data: FixtureData{
+			UrlPost:      "/processAuth",
+			UrlBeginAuth: "/beginAuth",
+			UrlEndAuth:   "/endAuth",
+		}, Check: func(r *http.Request) error {
+			if err := r.ParseForm(); err != nil {
+				return err
+			}
+			if r.PostForm.Get("login") != fixtureData.UserName || r.PostForm.Get("passwd") != "test123" {
+				return fmt.Errorf("posted %v", r.PostForm)
+			}
+			return nil
+		}},
+		aadtest.Step{Method: "POST", Path: "/beginAuth", Page: "BeginAuth.json"},
+		aadtest.Step{Method: "POST", Path: "/endAuth", Page: "EndAuth.json", Check: func(r *http.Request) error {
+			var mfaReq mfaRequest
+			if err := json.NewDecoder(r.Body).Decode(&mfaReq); err != nil {
+				return err
+			}
+			if mfaReq.AdditionalAuthData != "000000" {
+				return fmt.Errorf("posted the code %q", mfaReq.AdditionalAuthData)
+			}
+			return nil
+		}},
+		aadtest.Step{Method: "POST", Path: "/processAuth", Page: "SAMLResponse.html"},
+	)
+
+	pr := &mocks.Prompter{}
+	prompter.SetPrompter(pr)
+	pr.Mock.On("StringRequired", "Enter verification code").Return("000000")
+
+	idpAccount := &cfg.IDPAccount{Name: "default", URL: "https://account.example.test", AppID: fixtureData.ApplicationId, RequestLog: filepath.Join(t.TempDir(), "requests.log")}
+	requestLog := provider.NewRequestLog(idpAccount)
+	ac := Client{
+		client:     &provider.HTTPClient{Client: http.Client{Transport: requestLog.RoundTripper(tr)}, Options: &provider.HTTPClientOptions{}},
+		idpAccount: idpAccount,
+		lockouts:   &lockoutTracker{filename: filepath.Join(t.TempDir(), "aad_lockouts.json")},
+		requestLog: requestLog,
+	}
+	loginDetails := &creds.LoginDetails{URL: "https://account.example.test", Username: fixtureData.UserName, Password: "test123"}
+
+	got, err := ac.Authenticate(loginDetails)
+	require.Nil(t, err)
+	require.NotEmpty(t, got)
+	require.True(t, ac.MFAPerformed())
+	require.Nil(t, tr.Done())
+	require.Equal(t, "account.example.test", tr.Requests[0].URL.Host)
+
+	// each request is logged under the step of the flow it was made from
+	data, err := os.ReadFile(idpAccount.RequestLog)
+	require.Nil(t, err)
+	var steps []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		steps = append(steps, regexp.MustCompile(`step="([^"]*)" method=\S+ url="([^"]*)"`).FindStringSubmatch(line)[1:]...)
+	}
+	require.Equal(t, []string{
+		"start", "https://account.example.test/applications/redirecttofederatedapplication.aspx",
+		"ConvergedSignIn", "https://account.example.test/getCredentialType",
+		"ConvergedSignIn", "https://account.example.test/login",
+		"ConvergedTFA", "https://account.example.test/beginAuth",
+		"ConvergedTFA", "https://account.example.test/endAuth",
+		"ConvergedTFA", "https://account.example.test/processAuth",
+	}, steps)
+}
+
+// failingTransport fail the first requests with a network error before handing them to the transport
+type failingTransport struct {
+	failures int
+	requests int
+	next     http.RoundTripper
+}
+
+func (ft *failingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ft.requests++
+	if ft.requests <= ft.failures {
+		return nil, errors.New("dial tcp: lookup login.microsoftonline.com: no such host")
+	}
+	return ft.next.RoundTrip(req)
+}
+
+func Test_startURL(t *testing.T) {
+	tests := []struct {
+		name      string
+		operation string
+		loginHint string
+		want      string
+	}{
+		{name: "default", want: "https://account.activedirectory.windowsazure.com/applications/redirecttofederatedapplication.aspx?Operation=LinkedSignIn&applicationId=app"},
+		{name: "sign in", operation: "SignIn", want: "https://account.activedirectory.windowsazure.com/applications/redirecttofederatedapplication.aspx?Operation=SignIn&applicationId=app"},
+		{name: "login hint", operation: "SignIn", loginHint: "user@example.com", want: "https://account.activedirectory.windowsazure.com/applications/redirecttofederatedapplication.aspx?Operation=SignIn&applicationId=app&login_hint=user%40example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := Client{
+				idpAccount: &cfg.IDPAccount{URL: "https://account.activedirectory.windowsazure.com", StartOperation: tt.operation},
+				loginHint:  tt.loginHint,
+			}
+			require.Equal(t, tt.want, ac.startURL("app"))
+		})
+	}
+}
+
+func Test_getStartURL(t *testing.T) {
+	tests := []struct {
+		name         string
+		retries      int
+		failures     int
+		wantRequests int
+		wantSlept    []time.Duration
+		wantErr      bool
+	}{
+		{name: "first request fails", failures: 1, wantRequests: 2, wantSlept: []time.Duration{startURLRetryDelay}},
+		{name: "retries used up", failures: 3, wantRequests: 3, wantSlept: []time.Duration{startURLRetryDelay, 2 * startURLRetryDelay}, wantErr: true},
+		{name: "retries disabled", retries: -1, failures: 1, wantRequests: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var slept []time.Duration
+			sleep = func(d time.Duration) { slept = append(slept, d) }
+			defer func() { sleep = time.Sleep }()
+
+			ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte("start"))
+			}))
+			defer ts.Close()
+
+			ac, _ := setupTestClient(t, ts)
+			transport := &failingTransport{failures: tt.failures, next: ac.client.Transport}
+			ac.client.Transport = transport
+			ac.idpAccount.StartURLRetries = tt.retries
+
+			res, err := ac.getStartURL(ts.URL)
+			require.Equal(t, tt.wantRequests, transport.requests)
+			require.Equal(t, tt.wantSlept, slept)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.Nil(t, err)
+			body, err := io.ReadAll(res.Body)
+			require.Nil(t, err)
+			require.Equal(t, "start", string(body))
+		})
+	}
+}
+
+func Test_decodeJSON(t *testing.T) {
+	const body = `{"Success":true,"ResultValue":"Success","AuthMethodId":"OneWaySMS","NewField":"value"}`
+	hook := test.NewGlobal()
+	defer hook.Reset()
+
+	ac := Client{idpAccount: &cfg.IDPAccount{}}
+	var lenient mfaResponse
+	require.Nil(t, ac.decodeJSON(strings.NewReader(body), &lenient))
+	require.Empty(t, hook.AllEntries())
+
+	ac.idpAccount.StrictJSON = true
+	var strict mfaResponse
+	require.Nil(t, ac.decodeJSON(strings.NewReader(body), &strict))
+	require.Equal(t, lenient, strict)
+	require.True(t, strict.Success)
+	require.Equal(t, "OneWaySMS", strict.AuthMethodID)
+	require.Len(t, hook.AllEntries(), 1)
+	require.Equal(t, logrus.WarnLevel, hook.LastEntry().Level)
+	require.Equal(t, `strict_json: *aad.mfaResponse doesn't capture the response, json: unknown field "NewField"`, hook.LastEntry().Message)
+
+	// a response the struct captures entirely isn't logged
+	hook.Reset()
+	require.Nil(t, ac.decodeJSON(strings.NewReader(`{"Success":true}`), &strict))
+	require.Empty(t, hook.AllEntries())
+
+	require.NotNil(t, ac.decodeJSON(strings.NewReader(`{"Success":`), &strict))
+	require.Empty(t, hook.AllEntries())
+}
+
+func Test_processRemoteConnect(t *testing.T) {
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	sleep = func(d time.Duration) { now = now.Add(d) }
+	defer func() { timeNow, sleep = time.Now, time.Sleep }()
+
+	tests := []struct {
+		name       string
+		statuses   []string
+		expiresIn  int
+		wantPolls  int
+		wantErr    error
+		wantErrMsg string
+	}{
+		{name: "approved", statuses: []string{"Pending", "Pending", "Approved"}, expiresIn: 900, wantPolls: 3},
+		{name: "declined", statuses: []string{"Pending", "Declined"}, expiresIn: 900, wantPolls: 2, wantErr: ErrMfaDenied},
+		{name: "expired", statuses: []string{"Pending", "Expired"}, expiresIn: 900, wantPolls: 2, wantErr: errRemoteConnectExpired},
+		{name: "expires in", statuses: []string{"Pending"}, expiresIn: 60, wantPolls: 14, wantErr: errRemoteConnectExpired},
+		{name: "default expiry", statuses: []string{"Pending"}, wantPolls: int(remoteConnectExpiry/remoteConnectPollInterval) + 2, wantErr: errRemoteConnectExpired},
+		{name: "status error", statuses: []string{"Pending", "error"}, expiresIn: 900, wantPolls: 2, wantErrMsg: "error processing remote connect status: remote connect status request failed with 500 Internal Server Error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			polls := 0
+			ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/deviceCodeStatus":
+					var statusReq remoteConnectStatusRequest
+					require.Nil(t, json.NewDecoder(r.Body).Decode(&statusReq))
+					require.Equal(t, "device-code", statusReq.DeviceCode)
+					require.Equal(t, "flow-token", statusReq.FlowToken)
+					// the last status is repeated once they run out
+					status := tt.statuses[len(tt.statuses)-1]
+					if polls < len(tt.statuses) {
+						status = tt.statuses[polls]
+					}
+					polls++
+					if status == "error" {
+						http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+						return
+					}
+					require.Nil(t, json.NewEncoder(w).Encode(remoteConnectStatusResponse{Status: status, FlowToken: "approved-flow-token"}))
+				case "/login":
+					require.Nil(t, r.ParseForm())
+					require.Equal(t, "approved-flow-token", r.PostForm.Get("flowToken"))
+					require.Equal(t, "user@example.com", r.PostForm.Get("login"))
+					require.Empty(t, r.PostForm.Get("passwd"))
+					_, _ = w.Write([]byte("signed in"))
+				default:
+					http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				}
+			}))
+			defer ts.Close()
+
+			ac, _ := setupTestClient(t, ts)
+			params := &remoteConnectParams{UserCode: "ABCD-EFGH", VerificationURI: "https://microsoft.com/devicelogin", DeviceCode: "device-code", ExpiresIn: tt.expiresIn}
+			convergedResponse := &ConvergedResponse{URLSessionState: ts.URL + "/deviceCodeStatus", SFT: "flow-token", SFTName: "flowToken"}
+
+			res, err := ac.processRemoteConnect(ts.URL+"/login", params, &creds.LoginDetails{Username: "user@example.com"}, convergedResponse)
+			require.Equal(t, tt.wantPolls, polls)
+			if tt.wantErr != nil {
+				require.Equal(t, tt.wantErr, err)
+				return
+			}
+			if tt.wantErrMsg != "" {
+				require.EqualError(t, err, tt.wantErrMsg)
+				return
+			}
+			require.Nil(t, err)
+			body, err := io.ReadAll(res.Body)
+			require.Nil(t, err)
+			require.Equal(t, "signed in", string(body))
+		})
+	}
+}
+
+func Test_reProcessFormRelayState(t *testing.T) {
+	var gotRelayState string
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Nil(t, r.ParseForm())
+		gotRelayState = r.PostForm.Get("RelayState")
+		require.Equal(t, "SAMLBase64Encoded", r.PostForm.Get("SAMLResponse"))
+		_, _ = w.Write([]byte("OK"))
+	}))
+	defer ts.Close()
+
+	page := `<html><head><title>Working...</title></head><body><form method="POST" name="hiddenform" action="` + ts.URL + `/acs">` +
+		`<input type="hidden" name="SAMLResponse" value="SAMLBase64Encoded" /><input type="hidden" name="RelayState" value="https://idp.example.com/default" />` +
+		`</form></body></html>`
+	res := &http.Response{Request: httptest.NewRequest("GET", ts.URL+"/sResponse", nil)}
+
+	t.Run("provided by the IdP", func(t *testing.T) {
+		ac, _ := setupTestClient(t, ts)
+		ac.idpAccount.TrustedACSHosts = "127.0.0.1"
+		_, err := ac.reProcessForm(res, page)
+		require.Nil(t, err)
+		require.Equal(t, "https://idp.example.com/default", gotRelayState)
+	})
+	t.Run("overridden", func(t *testing.T) {
+		ac, _ := setupTestClient(t, ts)
+		ac.idpAccount.TrustedACSHosts = "127.0.0.1"
+		ac.idpAccount.RelayState = "https://console.aws.amazon.com/ec2/"
+		_, err := ac.reProcessForm(res, page)
+		require.Nil(t, err)
+		require.Equal(t, "https://console.aws.amazon.com/ec2/", gotRelayState)
+	})
+}
+
+func Test_checkSAMLResponseAction(t *testing.T) {
+	form := func(action string) string {
+		return `<html><head><title>Working...</title></head><body><form method="POST" name="hiddenform" action="` + action + `">` +
+			`<input type="hidden" name="SAMLResponse" value="SAMLBase64Encoded" /></form></body></html>`
+	}
+	res := &http.Response{Request: httptest.NewRequest("GET", "https://login.microsoftonline.com/login.srf", nil)}
+
+	tests := []struct {
+		name    string
+		trusted string
+		page    string
+		wantErr string
+	}{
+		{name: "aws sign in", page: form("https://signin.aws.amazon.com/saml")},
+		{name: "regional aws sign in", page: form("https://us-east-1.signin.aws.amazon.com/saml")},
+		{name: "gov cloud sign in", page: form("https://signin.amazonaws-us-gov.com/saml")},
+		{name: "no SAMLResponse", page: `<html><head><title>Working...</title></head><body><form method="POST" name="hiddenform" action="https://login.example.com/wsfed"><input type="hidden" name="wresult" value="token" /></form></body></html>`},
+		{name: "configured host", trusted: "acs.example.com, signin.aws.amazon.com", page: form("https://acs.example.com/saml")},
+		{name: "untrusted host", page: form("https://evil.example.com/saml"), wantErr: "refusing to submit the SAMLResponse to evil.example.com which isn't a trusted ACS host"},
+		{name: "lookalike host", page: form("https://signin.aws.amazon.com.evil.example.com/saml"), wantErr: "refusing to submit the SAMLResponse to signin.aws.amazon.com.evil.example.com which isn't a trusted ACS host"},
+		{name: "relative action", page: form("/saml"), wantErr: "refusing to submit the SAMLResponse to login.microsoftonline.com which isn't a trusted ACS host"},
+		{name: "aws sign in not configured", trusted: "acs.example.com", page: form("https://signin.aws.amazon.com/saml"), wantErr: "refusing to submit the SAMLResponse to signin.aws.amazon.com which isn't a trusted ACS host"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := &Client{idpAccount: &cfg.IDPAccount{TrustedACSHosts: tt.trusted}}
+			err := ac.checkSAMLResponseAction(res, tt.page)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.Nil(t, err)
+		})
+	}
+}
+
+func Test_getSamlAssertionWhitespace(t *testing.T) {
+	data, err := fs.ReadFile(aadtest.Pages, "SAMLResponse.xml")
+	require.Nil(t, err)
+	encoded := base64.StdEncoding.EncodeToString(data)
+
+	// wrapped at 76 characters as MIME encoders do, with indentation thrown in
+	var wrapped strings.Builder
+	for len(encoded) > 76 {
+		wrapped.WriteString(encoded[:76] + "\r\n    ")
+		encoded = encoded[76:]
+	}
+	wrapped.WriteString(encoded + "\n")
+	page := `<html><body><form method="POST" name="hiddenform" action="https://signin.aws.amazon.com/saml"><input type="hidden" name="SAMLResponse" value="` + wrapped.String() + `" /></form></body></html>`
+
+	ac := &Client{idpAccount: &cfg.IDPAccount{}}
+	samlAssertion, err := ac.getSamlAssertion(page)
+	require.Nil(t, err)
+
+	decoded, err := base64.StdEncoding.DecodeString(samlAssertion)
+	require.Nil(t, err)
+	require.Equal(t, data, decoded)
+	require.Nil(t, xml.Unmarshal(decoded, new(struct{})))
+}
+
+func Test_getSamlAssertionAudience(t *testing.T) {
+	data, err := fs.ReadFile(aadtest.Pages, "SAMLResponse.xml")
+	require.Nil(t, err)
+	awsResponse := base64.StdEncoding.EncodeToString(data)
+	otherResponse := base64.StdEncoding.EncodeToString([]byte(strings.ReplaceAll(string(data), "<Audience>https://signin.aws.amazon.com/saml</Audience>", "<Audience>urn:example:other</Audience>")))
+	require.NotEqual(t, awsResponse, otherResponse)
+
+	page := `<html><head><title>Working...</title></head><body>` +
+		`<form method="POST" name="hiddenform" action="https://signin.aws.amazon.com/saml"><input type="hidden" name="SAMLResponse" value="` + awsResponse + `" /></form>` +
+		`<form method="POST" name="hiddenform" action="https://other.example.com/acs"><input type="hidden" name="SAMLResponse" value="` + otherResponse + `" /></form>` +
+		`</body></html>`
+
+	tests := []struct {
+		name     string
+		audience string
+		want     string
+		wantErr  string
+	}{
+		{name: "aws", audience: "https://signin.aws.amazon.com/saml", want: awsResponse},
+		{name: "other", audience: "urn:example:other", want: otherResponse},
+		{name: "no audience configured", want: otherResponse},
+		{name: "no match", audience: "urn:amazon:webservices", wantErr: "none of the SAMLResponses is for audience urn:amazon:webservices, found https://signin.aws.amazon.com/saml, urn:example:other"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := &Client{idpAccount: &cfg.IDPAccount{ExpectedAudience: tt.audience}}
+			got, err := ac.getSamlAssertion(page)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.Nil(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+
+	t.Run("form of the picked response is checked", func(t *testing.T) {
+		res := &http.Response{Request: httptest.NewRequest("GET", "https://login.microsoftonline.com/login.srf", nil)}
+		ac := &Client{idpAccount: &cfg.IDPAccount{ExpectedAudience: "https://signin.aws.amazon.com/saml"}}
+		require.Nil(t, ac.checkSAMLResponseAction(res, page))
+
+		ac.idpAccount.ExpectedAudience = "urn:example:other"
+		require.EqualError(t, ac.checkSAMLResponseAction(res, page), "refusing to submit the SAMLResponse to other.example.com which isn't a trusted ACS host")
+	})
+}
+
+func Test_printMfaMethods(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	log.SetFlags(0)
+	defer log.SetFlags(log.LstdFlags)
+
+	printMfaMethods([]userProof{
+		{AuthMethodID: "PhoneAppNotification", Display: "+XX XXXXXXXX55", IsDefault: true},
+		{AuthMethodID: "PhoneAppOTP", Display: "+XX XXXXXXXX55"},
+	})
+	require.Equal(t, "MFA methods offered by Azure AD:\n  PhoneAppNotification: +XX XXXXXXXX55 (default)\n  PhoneAppOTP: +XX XXXXXXXX55\n", buf.String())
+}
+
+func Test_processKmsiInterruptFields(t *testing.T) {
+	var posted url.Values
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/kmsi":
+			require.Nil(t, r.ParseForm())
+			posted = r.PostForm
+			writeFixtureBytes(t, w, r, "SAMLResponse.html", FixtureData{})
+		default:
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		}
+	}))
+	defer ts.Close()
+
+	for _, fixture := range []string{"KmsiInterrupt.html", "KmsiInterrupt_fields.html"} {
+		t.Run(fixture, func(t *testing.T) {
+			ac, _ := setupTestClient(t, ts)
+			res := &http.Response{Request: httptest.NewRequest("GET", ts.URL, nil)}
+
+			page, err := aadtest.Render(fixture, ts.Listener.Addr().String(), FixtureData{UrlPost: "/kmsi"})
+			require.Nil(t, err)
+
+			posted = nil
+			_, samlAssertion, err := ac.processKmsiInterrupt(res, string(page))
+			require.Nil(t, err)
+			require.NotEmpty(t, samlAssertion)
+
+			fixtureData := genFixtureData()
+			require.Equal(t, fixtureData.SFT, posted.Get("flowToken"))
+			require.Equal(t, fixtureData.Ctx, posted.Get("ctx"))
+			require.Equal(t, "1", posted.Get("LoginOptions"))
+			if fixture == "KmsiInterrupt_fields.html" {
+				require.Equal(t, "true", posted.Get("DontShowAgain"))
+				require.Equal(t, "4231", posted.Get("i19"))
+				require.Equal(t, "28", posted.Get("type"))
+				require.Empty(t, posted.Get("KmsiCheckbox"))
+			} else {
+				require.Len(t, posted, 3)
+			}
+		})
+	}
+}
+
+func Test_lockoutGuard(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	t.Cleanup(func() { timeNow = time.Now })
+
+	var locked bool
+	var requests int
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if locked {
+			writeFixtureBytes(t, w, r, "ConvergedLockout.html", FixtureData{})
+			return
+		}
+		writeFixtureBytes(t, w, r, "SAMLResponse.html", FixtureData{})
+	}))
+	defer ts.Close()
+
+	ac, loginDetails := setupTestClient(t, ts)
+	ac.lockouts = &lockoutTracker{filename: filepath.Join(t.TempDir(), "aad_lockouts.json")}
+
+	locked = true
+	_, err := ac.Authenticate(loginDetails)
+	require.Equal(t, ErrSignInLocked, errors.Cause(err))
+	require.Contains(t, err.Error(), "error 50053, wait at least 1m0s before signing in again")
+	require.Equal(t, 1, requests)
+
+	// a repeated attempt within the cooldown doesn't reach Azure AD, also from another client reading the file
+	other, _ := setupTestClient(t, ts)
+	other.lockouts = &lockoutTracker{filename: ac.lockouts.filename}
+	_, err = other.Authenticate(loginDetails)
+	require.Equal(t, ErrSignInLocked, errors.Cause(err))
+	require.Contains(t, err.Error(), "the sign in of "+loginDetails.Username+" is locked until")
+	require.Equal(t, 1, requests)
+
+	masked := *loginDetails
+	masked.MaskUsername = true
+	_, err = other.Authenticate(&masked)
+	require.Contains(t, err.Error(), "the sign in of "+creds.MaskUsername(loginDetails.Username)+" is locked until")
+	require.NotContains(t, err.Error(), loginDetails.Username)
+	require.Equal(t, 1, requests)
+
+	// once the cooldown passes a further lockout doubles it
+	now = now.Add(time.Minute)
+	_, err = ac.Authenticate(loginDetails)
+	require.Equal(t, ErrSignInLocked, errors.Cause(err))
+	require.Contains(t, err.Error(), "wait at least 2m0s")
+	require.Equal(t, 2, requests)
+
+	now = now.Add(2 * time.Minute)
+	locked = false
+	got, err := ac.Authenticate(loginDetails)
+	require.Nil(t, err)
+	require.NotEmpty(t, got)
+	require.Empty(t, ac.lockouts.load())
+}
+
+func TestClient_ListMFAMethods(t *testing.T) {
+	t.Run("MFA requested", func(t *testing.T) {
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/index", "/applications/redirecttofederatedapplication.aspx":
+				writeFixtureBytes(t, w, r, "ConvergedTFA.html", FixtureData{
+					UrlPost:      "/processAuth",
+					UrlBeginAuth: "/beginAuth",
+					UrlEndAuth:   "/endAuth",
+				})
+			default:
+				t.Errorf("unexpected request to %s, MFA must not be started", r.URL.Path)
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			}
+		}))
+		defer ts.Close()
+
+		ac, loginDetails := setupTestClient(t, ts)
+		methods, err := ac.ListMFAMethods(loginDetails)
 		require.Nil(t, err)
-		require.NotEmpty(t, got)
+		require.Equal(t, []MFAMethod{
+			{Method: "OneWaySMS", Display: "+XX XXX XXXX X89"},
+			{Method: "TwoWayVoiceMobile", Display: "+XX XXX XXXX X89"},
+		}, methods)
+		require.False(t, ac.MFAPerformed())
+		require.False(t, ac.listingMfa)
+	})
+	t.Run("MFA not requested", func(t *testing.T) {
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/index", "/applications/redirecttofederatedapplication.aspx":
+				writeFixtureBytes(t, w, r, "SAMLResponse.html", FixtureData{})
+			default:
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			}
+		}))
+		defer ts.Close()
+
+		ac, loginDetails := setupTestClient(t, ts)
+		methods, err := ac.ListMFAMethods(loginDetails)
+		require.Nil(t, err)
+		require.Empty(t, methods)
 	})
 }
 
-func setupTestClient(t *testing.T, ts *httptest.Server) (Client, *creds.LoginDetails) {
-	fixtureData := genFixtureData()
-	testTransport := http.DefaultTransport.(*http.Transport).Clone()
-	testTransport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-	opts := &provider.HTTPClientOptions{IsWithRetries: false}
-	ac := Client{
-		client:     &provider.HTTPClient{Client: http.Client{Transport: testTransport}, Options: opts},
-		idpAccount: &cfg.IDPAccount{URL: ts.URL, AppID: fixtureData.ApplicationId},
+func Test_findAppID(t *testing.T) {
+	data, err := fs.ReadFile(aadtest.Pages, "MyApps.html")
+	require.Nil(t, err)
+	page := strings.ReplaceAll(string(data), "{{.ApplicationId}}", "31eaeb21-4b55-4390-a8fe-21a780dfedc7")
+
+	appID, err := findAppID(page, "AWS Production")
+	require.Nil(t, err)
+	require.Equal(t, "31eaeb21-4b55-4390-a8fe-21a780dfedc7", appID)
+
+	appID, err = findAppID(page, "aws sandbox")
+	require.Nil(t, err)
+	require.Equal(t, "2d6c4b0e-9f1e-4c3a-b1a7-5e2f9c0d8b22", appID)
+
+	_, err = findAppID(page, "AWS Staging")
+	require.EqualError(t, err, `unable to locate app "AWS Staging" in the app tiles`)
+}
+
+func Test_metaRefreshTarget(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{name: "unquoted", body: `<meta http-equiv="refresh" content="0;url=https://login.example.com/next">`, want: "https://login.example.com/next"},
+		{name: "quoted", body: `<meta http-equiv="Refresh" content="5; URL='/next?a=1'">`, want: "/next?a=1"},
+		{name: "no url", body: `<meta http-equiv="refresh" content="30">`},
+		{name: "other http-equiv", body: `<meta http-equiv="Content-Type" content="text/html; charset=UTF-8">`},
+		{name: "within noscript", body: `<html><head><noscript><meta http-equiv="Refresh" content="0; URL=https://login.microsoftonline.com/jsdisabled" /></noscript></head></html>`},
 	}
-	loginDetails := &creds.LoginDetails{URL: ts.URL, Username: fixtureData.UserName, Password: "test123"}
-	return ac, loginDetails
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, metaRefreshTarget(tt.body))
+		})
+	}
+
+	// the sign in pages all carry a noscript refresh which mustn't be followed
+	data, err := fs.ReadFile(aadtest.Pages, "ConvergedSignIn.html")
+	require.Nil(t, err)
+	require.Empty(t, metaRefreshTarget(string(data)))
 }
 
-func writeFixtureBytes(t *testing.T, w http.ResponseWriter, r *http.Request, templateFile string, variableFixture FixtureData) {
-	template, err := template.ParseFiles("testdata/" + templateFile)
+func Test_challengeClaims(t *testing.T) {
+	const claims = `{"access_token":{"nbf":{"essential":true,"value":"1604106651"}}}`
+	encoded := base64.StdEncoding.EncodeToString([]byte(claims))
+
+	require.Equal(t, claims, challengeClaims(`Bearer realm="", authorization_uri="https://login.microsoftonline.com/common/oauth2/authorize", error="insufficient_claims", claims="`+encoded+`"`))
+	require.Equal(t, claims, challengeClaims(`$Config={"error":"insufficient_claims","claims":"`+encoded+`"};`))
+	require.Equal(t, claims, challengeClaims(`claims="`+base64.RawURLEncoding.EncodeToString([]byte(claims))+`"`))
+	require.Empty(t, challengeClaims(`Bearer error="insufficient_claims"`))
+	require.Empty(t, challengeClaims(`claims="not base64 json"`))
+}
+
+func Test_processMfaIdleWarning(t *testing.T) {
+	polls := 0
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/beginAuth":
+			_, _ = w.Write([]byte(`{"Success":true,"AuthMethodId":"PhoneAppNotification","Retry":false}`))
+		case "/endAuth":
+			polls++
+			if polls < 4 {
+				time.Sleep(20 * time.Millisecond)
+				_, _ = w.Write([]byte(`{"Success":false,"AuthMethodId":"PhoneAppNotification","Retry":true}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"Success":true,"AuthMethodId":"PhoneAppNotification","Retry":false}`))
+		case "/processAuth":
+			_, _ = w.Write([]byte("OK"))
+		default:
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		}
+	}))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	ac, _ := setupTestClient(t, ts)
+	ac.idpAccount.MFA = "Auto"
+	ac.mfaIdleWarning = 10 * time.Millisecond
+	convergedResponse := &ConvergedResponse{
+		URLBeginAuth:            ts.URL + "/beginAuth",
+		URLEndAuth:              ts.URL + "/endAuth",
+		URLPost:                 ts.URL + "/processAuth",
+		OPerAuthPollingInterval: map[string]float64{"PhoneAppNotification": 0},
+	}
+	mfas := []userProof{{AuthMethodID: "PhoneAppNotification", IsDefault: true}}
+
+	_, err := ac.processMfa(mfas, convergedResponse)
 	require.Nil(t, err)
-	var tpl bytes.Buffer
-	err = template.Execute(&tpl, responseFixtures(r.Host, variableFixture))
+	require.Equal(t, 4, polls)
+	require.Contains(t, buf.String(), "Still waiting for approval")
+
+	buf.Reset()
+	polls = 0
+	ac.mfaIdleWarning = 0
+	_, err = ac.processMfa(mfas, convergedResponse)
 	require.Nil(t, err)
-	_, _ = w.Write(tpl.Bytes())
+	require.NotContains(t, buf.String(), "Still waiting for approval")
 }
 
-func responseFixtures(host string, variableFixture FixtureData) *FixtureData {
-	const scheme = "https://"
-	fixtureData := genFixtureData()
-	fixtureData.SErrorCode = variableFixture.SErrorCode
-	if variableFixture.UrlFederationRedirect != "" {
-		fixtureData.UrlFederationRedirect = scheme + host + variableFixture.UrlFederationRedirect
-	} else {
-		fixtureData.UrlFederationRedirect = ""
+func Test_ValidateMFA(t *testing.T) {
+	for _, mfa := range []string{"Auto", "PhoneAppNotification", "PhoneAppOTP", "OneWaySMS", "TwoWayVoiceMobile", "Push", "sms"} {
+		require.NoError(t, ValidateMFA(mfa, nil), mfa)
+	}
+	require.NoError(t, ValidateMFA("office", map[string]string{"office": "TwoWayVoiceOffice"}))
+
+	valid := "Valid options are: Auto, CompanionAppsNotification, ConsolidatedTelephony, OneWaySMS, PhoneAppNotification, PhoneAppOTP, TwoWayVoiceAlternateMobile, TwoWayVoiceMobile, TwoWayVoiceOffice"
+	require.EqualError(t, ValidateMFA("phoneappotp", nil), `unknown AzureAD MFA method "phoneappotp", did you mean PhoneAppOTP? `+valid)
+	require.EqualError(t, ValidateMFA("Authenticator", nil), `unknown AzureAD MFA method "Authenticator", valid options are: `+strings.Join(MFAMethods(), ", "))
+	require.EqualError(t, ValidateMFA("office", map[string]string{"office": "Office"}), `unknown AzureAD MFA method "Office", valid options are: `+strings.Join(MFAMethods(), ", "))
+}
+
+func Test_selectMfaAliases(t *testing.T) {
+	mfas := []userProof{
+		{AuthMethodID: "PhoneAppNotification", Display: "+XX XXXXXXX12"},
+		{AuthMethodID: "PhoneAppOTP", Display: "+XX XXXXXXX12"},
+		{AuthMethodID: "OneWaySMS", Display: "+XX XXXXXXX34", IsDefault: true},
+		{AuthMethodID: "TwoWayVoiceMobile", Display: "+XX XXXXXXX34"},
+		{AuthMethodID: "TwoWayVoiceOffice", Display: "+XX XXXXXXX56"},
 	}
-	if variableFixture.UrlSkipMfaRegistration != "" {
-		fixtureData.UrlSkipMfaRegistration = scheme + host + variableFixture.UrlSkipMfaRegistration
-	} else {
-		fixtureData.UrlSkipMfaRegistration = ""
+
+	tests := []struct {
+		mfa  string
+		want userProof
+	}{
+		{mfa: "push", want: mfas[0]},
+		{mfa: "Push", want: mfas[0]},
+		{mfa: "notification", want: mfas[0]},
+		{mfa: "otp", want: mfas[1]},
+		{mfa: "totp", want: mfas[1]},
+		{mfa: "sms", want: mfas[2]},
+		{mfa: "SMS", want: mfas[2]},
+		{mfa: "call", want: mfas[3]},
+		{mfa: "voice", want: mfas[3]},
+		{mfa: "office", want: mfas[4]},
+		{mfa: "TwoWayVoiceMobile", want: mfas[3]},
+		{mfa: "Auto", want: mfas[2]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mfa, func(t *testing.T) {
+			ac := Client{idpAccount: &cfg.IDPAccount{MFA: tt.mfa, MFAAliases: "office=TwoWayVoiceOffice"}}
+			require.Equal(t, tt.want, ac.selectMfa(mfas))
+		})
+	}
+
+	// a configured alias takes precedence over the built in one
+	ac := Client{idpAccount: &cfg.IDPAccount{MFA: "push", MFAAliases: "push=PhoneAppOTP"}}
+	require.Equal(t, mfas[1], ac.selectMfa(mfas))
+}
+
+func Test_selectMfa(t *testing.T) {
+	mfas := []userProof{
+		{AuthMethodID: "PhoneAppNotification", Display: "+XX XXXXXXX12"},
+		{AuthMethodID: "OneWaySMS", Display: "+XX XXXXXXX34", IsDefault: true},
+		{AuthMethodID: "OneWaySMS", Display: "+XX XXXXXXX56"},
+	}
+
+	tests := []struct {
+		name     string
+		mfa      string
+		mfaPhone string
+		want     userProof
+	}{
+		{name: "Auto picks default", mfa: "Auto", want: mfas[1]},
+		{name: "Auto with phone", mfa: "Auto", mfaPhone: "56", want: mfas[2]},
+		{name: "method with phone", mfa: "OneWaySMS", mfaPhone: "X56", want: mfas[2]},
+		{name: "method with other phone", mfa: "OneWaySMS", mfaPhone: "34", want: mfas[1]},
+		{name: "method with unknown phone", mfa: "OneWaySMS", mfaPhone: "99", want: mfas[1]},
+		{name: "single method", mfa: "PhoneAppNotification", want: mfas[0]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := Client{idpAccount: &cfg.IDPAccount{MFA: tt.mfa, MFAPhone: tt.mfaPhone}}
+			require.Equal(t, tt.want, ac.selectMfa(mfas))
+		})
+	}
+
+	t.Run("prompt for phone", func(t *testing.T) {
+		pr := &mocks.Prompter{}
+		prompter.SetPrompter(pr)
+		pr.Mock.On("Choose", "Select a phone number", []string{"+XX XXXXXXX34", "+XX XXXXXXX56"}).Return(1)
+
+		ac := Client{idpAccount: &cfg.IDPAccount{MFA: "OneWaySMS"}}
+		require.Equal(t, mfas[2], ac.selectMfa(mfas))
+		pr.Mock.AssertExpectations(t)
+	})
+}
+
+func Test_processMfaMethods(t *testing.T) {
+	tests := []struct {
+		authMethodID string
+		wantCode     bool
+	}{
+		{authMethodID: "ConsolidatedTelephony", wantCode: true},
+		{authMethodID: "OneWaySMS", wantCode: true},
+		{authMethodID: "CompanionAppsNotification", wantCode: false},
+		{authMethodID: "TwoWayVoiceMobile", wantCode: false},
+		{authMethodID: "SomethingNew", wantCode: false},
 	}
-	if variableFixture.UrlGetCredentialType != "" {
-		fixtureData.UrlGetCredentialType = scheme + host + variableFixture.UrlGetCredentialType
-	} else {
-		fixtureData.UrlGetCredentialType = ""
+	for _, tt := range tests {
+		t.Run(tt.authMethodID, func(t *testing.T) {
+			var got mfaRequest
+			ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/beginAuth":
+					_, _ = fmt.Fprintf(w, `{"Success":true,"AuthMethodId":%q,"Retry":false}`, tt.authMethodID)
+				case "/endAuth":
+					require.Nil(t, json.NewDecoder(r.Body).Decode(&got))
+					_, _ = fmt.Fprintf(w, `{"Success":true,"AuthMethodId":%q,"Retry":false}`, tt.authMethodID)
+				case "/processAuth":
+					_, _ = w.Write([]byte("OK"))
+				default:
+					http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				}
+			}))
+			defer ts.Close()
+
+			pr := &mocks.Prompter{}
+			prompter.SetPrompter(pr)
+			pr.Mock.On("StringRequired", "Enter verification code").Return("000000")
+
+			ac, _ := setupTestClient(t, ts)
+			ac.idpAccount.MFA = tt.authMethodID
+			convergedResponse := &ConvergedResponse{
+				URLBeginAuth: ts.URL + "/beginAuth",
+				URLEndAuth:   ts.URL + "/endAuth",
+				URLPost:      ts.URL + "/processAuth",
+			}
+			mfas := []userProof{{AuthMethodID: tt.authMethodID}}
+
+			_, err := ac.processMfa(mfas, convergedResponse)
+			require.Nil(t, err)
+			require.Equal(t, tt.authMethodID, got.AuthMethodID)
+			if tt.wantCode {
+				require.Equal(t, "000000", got.AdditionalAuthData)
+				pr.Mock.AssertCalled(t, "StringRequired", "Enter verification code")
+			} else {
+				require.Empty(t, got.AdditionalAuthData)
+				pr.Mock.AssertNotCalled(t, "StringRequired", "Enter verification code")
+			}
+		})
 	}
-	if variableFixture.UrlPost != "" {
-		fixtureData.UrlPost = scheme + host + variableFixture.UrlPost
-	} else {
-		fixtureData.UrlPost = ""
+}
+
+func Test_processMfaOrigin(t *testing.T) {
+	origins := map[string]string{}
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origins[r.URL.Path] = r.Header.Get("Origin")
+		_, _ = w.Write([]byte(`{"Success":true}`))
+	}))
+	defer ts.Close()
+
+	convergedResponse := &ConvergedResponse{URLBeginAuth: ts.URL + "/beginAuth", URLEndAuth: ts.URL + "/endAuth"}
+	mfa := userProof{AuthMethodID: "PhoneAppNotification"}
+
+	t.Run("derived from the host", func(t *testing.T) {
+		ac, _ := setupTestClient(t, ts)
+
+		_, err := ac.processMfaBeginAuth(mfa, convergedResponse)
+		require.Nil(t, err)
+		_, err = ac.processMfaEndAuth(mfaRequest{AuthMethodID: mfa.AuthMethodID, Method: "EndAuth"}, convergedResponse)
+		require.Nil(t, err)
+		require.Equal(t, ts.URL, origins["/beginAuth"])
+		require.Equal(t, ts.URL, origins["/endAuth"])
+	})
+
+	t.Run("configured", func(t *testing.T) {
+		ac, _ := setupTestClient(t, ts)
+		ac.idpAccount.Origin = "https://login.microsoftonline.com/"
+
+		_, err := ac.processMfaBeginAuth(mfa, convergedResponse)
+		require.Nil(t, err)
+		_, err = ac.processMfaEndAuth(mfaRequest{AuthMethodID: mfa.AuthMethodID, Method: "EndAuth"}, convergedResponse)
+		require.Nil(t, err)
+		require.Equal(t, "https://login.microsoftonline.com", origins["/beginAuth"])
+		require.Equal(t, "https://login.microsoftonline.com", origins["/endAuth"])
+	})
+
+	t.Run("not an origin", func(t *testing.T) {
+		_, err := New(&cfg.IDPAccount{URL: ts.URL, Origin: "https://login.microsoftonline.com/common/login"})
+		require.EqualError(t, err, "origin https://login.microsoftonline.com/common/login isn't a scheme and host, e.g. https://login.microsoftonline.com")
+	})
+}
+
+// syncBuffer a buffer the log can be written to while a test server reads it
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func Test_processConvergedTFAPushEarly(t *testing.T) {
+	for _, early := range []bool{true, false} {
+		t.Run(fmt.Sprintf("early %v", early), func(t *testing.T) {
+			var logs syncBuffer
+			log.SetOutput(&logs)
+			defer log.SetOutput(os.Stderr)
+
+			var promptedFirst bool
+			var endAuths int
+			ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/beginAuth":
+					promptedFirst = strings.Contains(logs.String(), "Phone approval required.")
+					time.Sleep(200 * time.Millisecond)
+					_, _ = w.Write([]byte(`{"Success":true,"ResultValue":"Success","AuthMethodId":"PhoneAppNotification","Entropy":42}`))
+				case "/endAuth":
+					endAuths++
+					_, _ = fmt.Fprintf(w, `{"Success":%v,"ResultValue":"Success","AuthMethodId":"PhoneAppNotification","Retry":true}`, endAuths > 1)
+				case "/processAuth":
+					_, _ = w.Write([]byte("OK"))
+				default:
+					http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				}
+			}))
+			defer ts.Close()
+
+			var slept []time.Duration
+			sleep = func(d time.Duration) { slept = append(slept, d) }
+			defer func() { sleep = time.Sleep }()
+
+			ac, _ := setupTestClient(t, ts)
+			ac.idpAccount.MFA = "PhoneAppNotification"
+			ac.idpAccount.MFAInitialDelay = 1
+			ac.idpAccount.MFAPushEarly = early
+			page := fmt.Sprintf(`$Config={"arrUserProofs":[{"authMethodId":"PhoneAppNotification","display":"Pixel","isDefault":true}],"urlBeginAuth":"%[1]s/beginAuth","urlEndAuth":"%[1]s/endAuth","urlPost":"%[1]s/processAuth","oPerAuthPollingInterval":{"PhoneAppNotification":1}};`, ts.URL)
+
+			_, err := ac.processConvergedTFA(nil, page)
+			require.Nil(t, err)
+			require.True(t, ac.mfaPerformed)
+			// the login only went ahead once the push was approved
+			require.Equal(t, 2, endAuths)
+			require.Contains(t, logs.String(), "Entropy is: 42")
+
+			require.Equal(t, early, promptedFirst)
+			require.Len(t, slept, 2)
+			if early {
+				// the wait before the first poll overlaps BeginAuth
+				require.LessOrEqual(t, slept[0], 850*time.Millisecond)
+			} else {
+				require.Equal(t, time.Second, slept[0])
+			}
+		})
 	}
-	if variableFixture.UrlBeginAuth != "" {
-		fixtureData.UrlBeginAuth = scheme + host + variableFixture.UrlBeginAuth
-	} else {
-		fixtureData.UrlBeginAuth = ""
+}
+
+func Test_processMfaInitialDelay(t *testing.T) {
+	tests := []struct {
+		name         string
+		authMethodID string
+		initialDelay int
+		want         []time.Duration
+	}{
+		{name: "push waits the polling interval", authMethodID: "PhoneAppNotification", want: []time.Duration{1500 * time.Millisecond}},
+		{name: "call waits the polling interval", authMethodID: "TwoWayVoiceMobile", want: []time.Duration{1500 * time.Millisecond}},
+		{name: "configured delay", authMethodID: "PhoneAppNotification", initialDelay: 4, want: []time.Duration{4 * time.Second}},
+		{name: "disabled", authMethodID: "PhoneAppNotification", initialDelay: -1, want: []time.Duration{0}},
+		{name: "code isn't delayed", authMethodID: "OneWaySMS"},
 	}
-	if variableFixture.UrlEndAuth != "" {
-		fixtureData.UrlEndAuth = scheme + host + variableFixture.UrlEndAuth
-	} else {
-		fixtureData.UrlEndAuth = ""
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/beginAuth":
+					_, _ = fmt.Fprintf(w, `{"Success":true,"ResultValue":"Success","AuthMethodId":%q,"Retry":false}`, tt.authMethodID)
+				case "/endAuth":
+					_, _ = fmt.Fprintf(w, `{"Success":true,"ResultValue":"Success","AuthMethodId":%q,"Retry":false}`, tt.authMethodID)
+				default:
+					http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				}
+			}))
+			defer ts.Close()
+
+			var slept []time.Duration
+			sleep = func(d time.Duration) { slept = append(slept, d) }
+			defer func() { sleep = time.Sleep }()
+
+			pr := &mocks.Prompter{}
+			prompter.SetPrompter(pr)
+			pr.Mock.On("StringRequired", "Enter verification code").Return("000000")
+
+			ac, _ := setupTestClient(t, ts)
+			ac.idpAccount.MFA = tt.authMethodID
+			ac.idpAccount.MFAInitialDelay = tt.initialDelay
+			convergedResponse := &ConvergedResponse{
+				URLBeginAuth:            ts.URL + "/beginAuth",
+				URLEndAuth:              ts.URL + "/endAuth",
+				URLPost:                 ts.URL + "/processAuth",
+				OPerAuthPollingInterval: map[string]float64{tt.authMethodID: 1.5},
+			}
+			mfas := []userProof{{AuthMethodID: tt.authMethodID}}
+
+			_, err := ac.processMfa(mfas, convergedResponse)
+			require.Nil(t, err)
+			require.Equal(t, tt.want, slept)
+		})
 	}
-	if variableFixture.UrlProcessAuth != "" {
-		fixtureData.UrlProcessAuth = scheme + host + variableFixture.UrlProcessAuth
-	} else {
-		fixtureData.UrlProcessAuth = ""
+}
+
+func Test_processMfaDenied(t *testing.T) {
+	polls := 0
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/beginAuth":
+			_, _ = w.Write([]byte(`{"Success":true,"ResultValue":"Success","AuthMethodId":"PhoneAppNotification","Retry":false}`))
+		case "/endAuth":
+			polls++
+			if polls == 1 {
+				_, _ = w.Write([]byte(`{"Success":false,"ResultValue":"AuthenticationPending","AuthMethodId":"PhoneAppNotification","Retry":true}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"Success":false,"ResultValue":"PhoneAppDenied","AuthMethodId":"PhoneAppNotification","Retry":true}`))
+		default:
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		}
+	}))
+	defer ts.Close()
+
+	ac, _ := setupTestClient(t, ts)
+	ac.idpAccount.MFA = "Auto"
+	convergedResponse := &ConvergedResponse{
+		URLBeginAuth:            ts.URL + "/beginAuth",
+		URLEndAuth:              ts.URL + "/endAuth",
+		URLPost:                 ts.URL + "/processAuth",
+		OPerAuthPollingInterval: map[string]float64{"PhoneAppNotification": 0},
 	}
-	if variableFixture.UrlHiddenForm != "" {
-		fixtureData.UrlHiddenForm = scheme + host + variableFixture.UrlHiddenForm
-	} else {
-		fixtureData.UrlHiddenForm = ""
+	mfas := []userProof{{AuthMethodID: "PhoneAppNotification", IsDefault: true}}
+
+	_, err := ac.processMfa(mfas, convergedResponse)
+	require.Equal(t, ErrMfaDenied, err)
+	require.Equal(t, 2, polls)
+}
+
+func Test_processMfaRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		retries    int
+		endAuth    []string
+		wantErr    string
+		wantBegins int
+	}{
+		{
+			name:    "transient failure retried",
+			retries: 1,
+			endAuth: []string{
+				`{"Success":false,"ResultValue":"PhoneAppNoResponse","AuthMethodId":"PhoneAppNotification","Retry":false}`,
+				`{"Success":true,"ResultValue":"Success","AuthMethodId":"PhoneAppNotification","Retry":false}`,
+			},
+			wantBegins: 2,
+		},
+		{
+			name:    "retries disabled",
+			retries: 0,
+			endAuth: []string{
+				`{"Success":false,"ResultValue":"PhoneAppNoResponse","AuthMethodId":"PhoneAppNotification","Retry":false}`,
+			},
+			wantErr:    "MFA result PhoneAppNoResponse: MFA request was not answered",
+			wantBegins: 1,
+		},
+		{
+			name:    "retries exhausted",
+			retries: 1,
+			endAuth: []string{
+				`{"Success":false,"ResultValue":"UserVoiceAuthFailedCallWentToVoicemail","AuthMethodId":"PhoneAppNotification","Retry":false}`,
+				`{"Success":false,"ResultValue":"PhoneAppNoResponse","AuthMethodId":"PhoneAppNotification","Retry":false}`,
+			},
+			wantErr:    "MFA result PhoneAppNoResponse: MFA request was not answered",
+			wantBegins: 2,
+		},
+		{
+			name:    "wrong code not retried",
+			retries: 3,
+			endAuth: []string{
+				`{"Success":false,"ResultValue":"OathCodeIncorrect","AuthMethodId":"PhoneAppNotification","Retry":false,"ErrCode":500121,"Message":"Incorrect code"}`,
+			},
+			wantErr:    "error processing MFA, errcode: 500121, message: Incorrect code",
+			wantBegins: 1,
+		},
 	}
-	if variableFixture.UrlSamlRequest != "" {
-		fixtureData.UrlSamlRequest = scheme + host + variableFixture.UrlSamlRequest
-	} else {
-		fixtureData.UrlSamlRequest = ""
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			begins, polls := 0, 0
+			ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/beginAuth":
+					begins++
+					_, _ = w.Write([]byte(`{"Success":true,"ResultValue":"Success","AuthMethodId":"PhoneAppNotification","Retry":false}`))
+				case "/endAuth":
+					_, _ = w.Write([]byte(tt.endAuth[polls]))
+					polls++
+				case "/processAuth":
+					_, _ = w.Write([]byte("OK"))
+				default:
+					http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				}
+			}))
+			defer ts.Close()
+
+			ac, _ := setupTestClient(t, ts)
+			ac.idpAccount.MFA = "Auto"
+			ac.idpAccount.MFARetries = tt.retries
+			convergedResponse := &ConvergedResponse{
+				URLBeginAuth:            ts.URL + "/beginAuth",
+				URLEndAuth:              ts.URL + "/endAuth",
+				URLPost:                 ts.URL + "/processAuth",
+				OPerAuthPollingInterval: map[string]float64{"PhoneAppNotification": 0},
+			}
+			mfas := []userProof{{AuthMethodID: "PhoneAppNotification", IsDefault: true}}
+
+			_, err := ac.processMfa(mfas, convergedResponse)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				require.False(t, ac.mfaPerformed)
+			} else {
+				require.Nil(t, err)
+				require.True(t, ac.mfaPerformed)
+			}
+			require.Equal(t, tt.wantBegins, begins)
+			require.Equal(t, len(tt.endAuth), polls)
+		})
 	}
-	return fixtureData
 }
 
-func genBase64Fixture(length int) string {
-	data := make([]byte, length)
-	_, _ = crand.Read(data)
-	return base64.RawURLEncoding.EncodeToString(data)
+func Test_totpCode(t *testing.T) {
+	// RFC 6238 test vectors truncated to six digits
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	tests := []struct {
+		at   int64
+		want string
+	}{
+		{at: 59, want: "287082"},
+		{at: 1111111109, want: "081804"},
+		{at: 1234567890, want: "005924"},
+		{at: 20000000000, want: "353130"},
+	}
+	for _, tt := range tests {
+		got, err := totpCode(secret, time.Unix(tt.at, 0))
+		require.Nil(t, err)
+		require.Equal(t, tt.want, got)
+	}
+
+	got, err := totpCode("gezd gnbv gy3t qojq gezd gnbv gy3t qojq", time.Unix(59, 0))
+	require.Nil(t, err)
+	require.Equal(t, "287082", got)
+
+	_, err = totpCode("not base32!", time.Unix(59, 0))
+	require.EqualError(t, err, "invalid TOTP secret: illegal base32 data at input byte 9")
 }
 
-func genHexFixture(length int) string {
-	data := make([]byte, length)
-	_, _ = crand.Read(data)
-	return hex.EncodeToString(data)
+func Test_processMfaVerificationCodes(t *testing.T) {
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	now := time.Unix(1111111109, 0)
+	timeNow = func() time.Time { return now }
+	t.Cleanup(func() { timeNow = time.Now })
+
+	newServer := func(accepted string, codes *[]string) *httptest.Server {
+		return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/beginAuth":
+				_, _ = w.Write([]byte(`{"Success":true,"ResultValue":"Success","AuthMethodId":"PhoneAppOTP","Retry":false}`))
+			case "/endAuth":
+				var mfaReq mfaRequest
+				require.Nil(t, json.NewDecoder(r.Body).Decode(&mfaReq))
+				*codes = append(*codes, mfaReq.AdditionalAuthData)
+				if mfaReq.AdditionalAuthData != accepted {
+					_, _ = w.Write([]byte(`{"Success":false,"ResultValue":"OathCodeIncorrect","AuthMethodId":"PhoneAppOTP","Retry":false,"ErrCode":500121}`))
+					return
+				}
+				_, _ = w.Write([]byte(`{"Success":true,"ResultValue":"Success","AuthMethodId":"PhoneAppOTP","Retry":false}`))
+			case "/processAuth":
+				_, _ = w.Write([]byte("OK"))
+			default:
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			}
+		}))
+	}
+	mfas := []userProof{{AuthMethodID: "PhoneAppOTP", IsDefault: true}}
+
+	t.Run("previous time step accepted", func(t *testing.T) {
+		previous, err := totpCode(secret, now.Add(-totpPeriod))
+		require.Nil(t, err)
+
+		var codes []string
+		ts := newServer(previous, &codes)
+		defer ts.Close()
+
+		pr := &mocks.Prompter{}
+		prompter.SetPrompter(pr)
+
+		ac, _ := setupTestClient(t, ts)
+		ac.idpAccount.MFA = "Auto"
+		ac.totpSecret = secret
+		convergedResponse := &ConvergedResponse{URLBeginAuth: ts.URL + "/beginAuth", URLEndAuth: ts.URL + "/endAuth", URLPost: ts.URL + "/processAuth"}
+
+		_, err = ac.processMfa(mfas, convergedResponse)
+		require.Nil(t, err)
+		require.True(t, ac.mfaPerformed)
+		require.Equal(t, []string{"081804", previous}, codes)
+		pr.Mock.AssertNotCalled(t, "StringRequired", "Enter verification code")
+	})
+
+	t.Run("prompt after time steps exhausted", func(t *testing.T) {
+		var codes []string
+		ts := newServer("123456", &codes)
+		defer ts.Close()
+
+		pr := &mocks.Prompter{}
+		prompter.SetPrompter(pr)
+		pr.Mock.On("StringRequired", "Enter verification code").Return("654321").Once()
+		pr.Mock.On("StringRequired", "Enter verification code").Return("123456").Once()
+
+		ac, _ := setupTestClient(t, ts)
+		ac.idpAccount.MFA = "Auto"
+		ac.totpSecret = secret
+		convergedResponse := &ConvergedResponse{URLBeginAuth: ts.URL + "/beginAuth", URLEndAuth: ts.URL + "/endAuth", URLPost: ts.URL + "/processAuth"}
+
+		_, err := ac.processMfa(mfas, convergedResponse)
+		require.Nil(t, err)
+		require.Len(t, codes, 5)
+		require.Equal(t, []string{"654321", "123456"}, codes[3:])
+		pr.Mock.AssertExpectations(t)
+	})
+
+	t.Run("entered codes rejected", func(t *testing.T) {
+		var codes []string
+		ts := newServer("123456", &codes)
+		defer ts.Close()
+
+		pr := &mocks.Prompter{}
+		prompter.SetPrompter(pr)
+		pr.Mock.On("StringRequired", "Enter verification code").Return("000000")
+
+		ac, _ := setupTestClient(t, ts)
+		ac.idpAccount.MFA = "Auto"
+		convergedResponse := &ConvergedResponse{URLBeginAuth: ts.URL + "/beginAuth", URLEndAuth: ts.URL + "/endAuth", URLPost: ts.URL + "/processAuth"}
+
+		_, err := ac.processMfa(mfas, convergedResponse)
+		require.EqualError(t, err, "verification code rejected 3 times")
+		require.Equal(t, []string{"000000", "000000", "000000"}, codes)
+	})
 }
 
-func genIntFixture(length int) string {
-	low := int(math.Pow(float64(10), float64(length-1)))
-	hi := low * 10
-	return strconv.Itoa(low + mrand.Intn(hi-low))
+func setupTestClient(t *testing.T, ts *httptest.Server) (Client, *creds.LoginDetails) {
+	fixtureData := genFixtureData()
+	testTransport := http.DefaultTransport.(*http.Transport).Clone()
+	testTransport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	opts := &provider.HTTPClientOptions{IsWithRetries: false}
+	ac := Client{
+		client:     &provider.HTTPClient{Client: http.Client{Transport: testTransport}, Options: opts},
+		idpAccount: &cfg.IDPAccount{URL: ts.URL, AppID: fixtureData.ApplicationId},
+	}
+	loginDetails := &creds.LoginDetails{URL: ts.URL, Username: fixtureData.UserName, Password: "test123"}
+	return ac, loginDetails
 }
 
-func genUUID() string {
-	return uuid.New().String()
+func writeFixtureBytes(t *testing.T, w http.ResponseWriter, r *http.Request, templateFile string, variableFixture FixtureData) {
+	data, err := aadtest.Render(templateFile, r.Host, variableFixture)
+	require.Nil(t, err)
+	_, _ = w.Write(data)
 }
 
 func TestAad_UnmarshallMfaResponseWithEntropy(t *testing.T) {
@@ -548,7 +2887,7 @@ func TestAad_UnmarshallMfaResponseWithoutEntropy(t *testing.T) {
 func TestAad_unmarshalEmbeddedJson(t *testing.T) {
 	for _, i := range []string{"LoginEmbeddedJsonLineBreak", "LoginEmbeddedJsonNoLineBreak", "LoginEmbeddedJsonExtraJavascript"} {
 		t.Run(i, func(t *testing.T) {
-			data, err := os.ReadFile(fmt.Sprintf("testdata/%s.html", i))
+			data, err := fs.ReadFile(aadtest.Pages, i+".html")
 			require.Nil(t, err)
 			c := Client{}
 			var v interface{}
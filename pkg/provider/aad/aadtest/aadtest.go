@@ -0,0 +1,295 @@
+// Package aadtest holds captured and scrubbed Azure AD pages for each branch of the AzureAD login flow, and a
+// scripted transport which serves them in order. Use it to test the provider against a new page variant without
+// reaching Azure AD: capture the page, scrub it, template its tokens and URLs, and script the flow around it.
+package aadtest
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"embed"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	mrand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/google/uuid"
+)
+
+//go:embed testdata
+var testdata embed.FS
+
+// Pages the page templates, named after the page or response they were captured from
+var Pages, _ = fs.Sub(testdata, "testdata")
+
+// FixtureData the values filled in the page templates. The examples are mainly url safe base64 secure random bytes
+// to illustrate payload values
+type FixtureData struct {
+	ApplicationId                         string // 31eaeb21-4b55-4390-a8fe-21a780dfedc7
+	State                                 string // Su7ku6ROOSiNe3BN16zhOYZGfQ8dC-wihtcvx4aGi9PNmAyePGemK_yT9H0CapK8HtwS83mbmlltNOknoftpDQ6gP4reH9cyEI5LufKgJ6wozu4msl0npXJZLAO14yUxUjLtxgHuAlvY91umliqPCEGHSwrKYm2piA6HZXqR5wIIK5LiSC_N7k7BOULpDE9qassFTfqTFF5kRNsrSmukREVdOZeNKr-RIPrNOASnH-nggHo-h7HiExFSJEZE8CQBG8JZ5PNcZbaQ2SZeHScKtUr8KCVyoaMdZ5xwXQ2G57VKF5DZsfQfMEPIspnbNkdqwRBHYIJZnX9JakvcKPXckEHriCTL1yN1_cLgBrPA62YBSim80GR8AMOx4Ij7lIQRTy-aLyDGpp6E3PdvTY72W51b1J5vzYl9XslyfRIWj1h_Q5cLlC03k5VJ8rIpeWgUIiEFgOZeDWQctR370JauwvJTfrOFE2yQXvXgU1zFhIvuEy3HhfoYPtlwGfLpeu1Czm-8PkMF24CdgIBRFIn2Rg4Pqt1KDDve7eKygqF79Qgiq-Hm5qGDdURKUF-Ei-Abft7pRs-A0hai27KtOCoJ9YUSoBrdLRyqLXvWkIWz5eeafRqIPlcSV32_jqbkZVJxj_jRdHrJCOSgtETyk1h_zAU_pLmhXfPuMcrIWZMbFTwGrC-xwPVRnaSGzztCVsXiiwWgtUAzzJIuNQSQ9DPpUIzdlOznwi8sVNMw51MXaPx6Qdgv-1pTJX-Hr78lJJRzaKPMBALsgoco9L-yJju7PCnBEJMOucw_J632ofAuzEOox7vfQ0dWVDg5VOOkFsqb0mWSnllFJWkk27wzBZ4-csABoSD8AkrnhnLC5ggCFNh16rPxPDejOfDvdyEV7-zXPJFgJP5rSP8n3kKb27Co10MISI0eWzHdghzbWpJSu78XBElT-5h6w_d4bdZfxgn-UxXCFz7yDQGQ5hKF-q2xx4R3uYn8Xg-5q2Es0OLJsHg5QOVYJ0DYJtcZqtlctP__BBrR3boFT-k0rytvqleuZy3ErSMBSGfCvh9C32bYgIM
+	UaId                                  string // b96e46687a7350c07d4709e1c54b87d4
+	Ctx                                   string // tkdXR5EHHAyb8jhx9XgSfRWpRASqfOc-2WnbZ6N8zxXgudxf70uzJ_izSIAcJylZcalEj4X60sW8naje072dEviyjpvUQu29mjCI80201-x4jijCexX-0_xphUkrcyDnMNFdpdjlhVeJG7ZNKKP2KxrrIDOX5fEFzUi8Sn1I4iwzJWkyOqznTQj7Na7mLhduZwcPX-slpOaNCx11x5CeyXgNmmDY5YNQxCHPsbGB6UeTMkfgBsQXpgLI-ppUuRf-wc7fYfc7pw-VifZggoEKEubdSVsjNS2tAFJKeoX6CzaJ8q2_KZh5T3HMcjhmlxNQ_tsqSb4uc69eZEdb227vk7D57n8FYjmrozMtVFX-XvrYTtbCUQZQWfRaSF14ZgkBUcqS0cQqEXJElvP2yFl8yBLsNVtB7y5pl6yjaIWAh7PzksFPRHUr6WpAmtfH1zSJguIjMpKrId4AjCXClU4y38k1QaVpXIr_H2TK0I3Se36Pc5jJ2urAeCMNSz7Dkb4ETnFoG77jbX5hmc-KsOw3y-SH1b3xgmSXryI8fC5WQnUMTRYKSP7A2GSP507O7jQKBun5lU69L4EwC78e5YuSwK9wlO53THzM_HW0Mn35uD2dGolL8X5AgK72PZkMuLNkNpmc-f2gjZmcBgBlK6A7tJW18WzUsJ0q2mXZFOJB9TVM8LIf58vt-CoggKxgTOeyL9qOVlRlUWt5Cz9HPDR_VazS0ZPeL6e3Xp8O5XzVMPKNp89U3H5BJ7EXrpGmqGasPvxugfHY5mBwA4YyoZeGr2fF9aDcnKK2PiRmUAGvo1GUfy4913uMnDff9riTjNCu9Yy-C7FyWcAl2VFhadI3PwTq3Z05038lGnFEOPsOFKJJrQ3Whtj9G1k-l7idQd3WVMwqjQ3yyGbj_Rl1ilzd0PcxNZqTZxrHA1N3Xi7BdusfvJ2BnPk-LONKfTteFrcZaylSmYtE6h7poo6I8cjTx_aHMkkXN-zg5AvcLWPwOKK_qUdjrGbiSB52G7b4yRHJnTxvNe1NgXFZC2xdDEbY8Pj9cdZzRHH-bpZebaO1MtI
+	OpenIdConnectAuthenticationProperties string // nNB2aD/pc12XrIZ8Ga9i9dI8g0/Kb4WPCLK1jIXEoYH/AFVTojIEvz5LMmVit8YETkHevIXJ+Ye/qTuhlYW4MCMs0g3GBNrtx/cS/NX0yAg08lbQYEWnq0ddhT6NhhysDq7s7PPdcCok8x/wf2LDTE5n4r53C9b+q6ArCLqD8xDb9snlTH3LSsrsgfOoa+GOOTG+5HsnC2kP+yZT2YK9Ifk+5bZVF0yVT5T2WaTVxsWva3+LNcGPYPDR56as8KJ5UvUuvR+bBInw7yX2fzFkfgC8bc8cvlGI1QRtzcTc0KLqayyplFa7XV2yhKv9wY1uEh6RigJX4FJdKzaX84juPKi/RA9rU37KUwnKdZlZ4762YzIqGrRTBwJZUHHisu1O7ooGgA+x2gQ1VY9cAkCQiq5/VgSyZ4wCJniBinwlBwxh9/thBawgHTTThpMfQSXEMWUyAGt8SoWz9FHgF9hEhte1kifXkEr7srrtUwuaxhdYvsLlZKcVZhttgbQR/js1/ZMFHEIRTPnfWZLq9atRiA==
+	Nonce                                 string // 1577836800._ekiEOvOQz4YQL8FvAZsdQ
+	SFT                                   string // vZXtKGAHg7jYK1oppkd43__si0KvHN0i02_TENgVBl_j1mYs0APdQ4bYjh3PcH-1Coouq384kZnIp2MXyS87NmOpwS_Nyb-ntXeQCPvDn0Ubiss7XvvYgq1ReeeyBCuzaE9kUoUlDnMU5D1dx_-KnFHh5evlsRrDBPLRWhG7Kt3fauAg5nvNyKXSF0DA90k8I4oMFaiaNe9ObjmkilRnPUBu3G2p1__BrsgJCGMXv9eZc2d3ANGz6ftwnTrK2OMODyjd5vXuDkQSTu1vZgbSWTkb_prS80o_B3vpvEt1Zord1xPZxTK262-oeUIpFnVjV4sSGnL_smwbA7_qHxSTwmY_1ZCbjuvJTXg1OOKS36GcqwX4h6kMHPAAGwMvvUlMXicqE4xFwF-1yOzFW7L8vPDMHxJtapY_Q94g2pVlKv3uwa0jF3Rk_RddhRZ4mzp7n319_Uq1WcgX-9lvsBoLOtadWstlvKPZ6Y4rUzESAYwOlM8OQ3HGWvvArBqd33o2MFKwqKcpXX73F07QR8qS6A
+	ClientRequestId                       string // 5ec023a2-663b-4168-9cb0-fe7c400b79fa
+	SessionId                             string // dda35067-5d88-4660-9f5f-f68f4c751cca
+	ApiCanary                             string // ype6puaxP6rNV_JtHkyBUEop77KMbSWCBsi4sJmIxLTN0z8NsvLH6ihw1MMT49eTKsCX-RIQl5_vfEllanIyaKijtOGfCHVfgUW0UZ_chdfnuokV9Q9_bUMl-43TLKlDYN0iEwVxQRyIcEYwFISHaYgY14wHe9LkRLmrQt2BlOaMtDQOT8qD-tH7urTxZ8Uj20UKT7wujO20V3_6teiL86s_V4_DDtPta2N355Pz2pFWaVfS7_2a6zf3YnY4wyEHbN_xcT2RBjo
+	Canary                                string // Llh9ry4LOBrmLXLlwgbPhxdrOcd4l5HeTPBVR9tG8vg
+	InstrumentationKey                    string // 1cc3422557e1ba83979ee678092399df-8d876a22-d379-46d2-b066-17a83683d9be-2529
+	Code                                  string // HIdSBXkPCB2Q2oLUjtCiET6Ogb7yPfRumZkWGgmWKrtfCnbKAreOR_o0GCYDBo5ebqe9OrrXLZz1OfPJDlMSR2uM_t_a5Pyw0Kf86KB2P6StMyWr-nHlY2NM7iK9c1TUCevEWhbFIdAwPgxtpt91IiG7rpoapTobUHLqpcVHNahAHE7rPkVXnFGBq6khbsCzgHk1vc2LgC79AQk1m7Mxf3KVDgglpIIVkk6NQpdc_J1pUzjX2WLHh_k_UHK4O9ygf07ELTZJz5Z16ZZJMSs5aOZhurzbOh8mGZeruaHr8FnmK_23Iqx6o_YdehMi5_GcxQjdGD1EM66X27kwghufJBRAa66nmOv3oYI1ILkY29mSnuKnEZDO715zITwdaahrOW0dqXwMR2QtutwxoEZJvJbwXWRrGW8yiNKav03a_j4duY1kVvNmOmT6gE6oaEKboWHxjGDUCCeNJ4-8mtTYnG0rVFrF8Y2-Prq4n23LrbQKfgteD_MG12eihJaQHPCjQgyIZoCcf9unWC5ty0duSNNsb0_GMWc3tGI2bfqNFSFvSvv8BYtyPTjYBhecgBodMr5haKM3pKXh0ZRAqms7hV8myViWlZtIs-pTRAXghPEUBG0Yzg1lPME-KuZOmP-RYggjzyO9IL5suoLIgacXqUI6nJA
+	IdToken                               string // Wz0fWBNb4WkJN_z-97b6LQ5nu6tNmQJC1UGQ7ewy9j7nEO7kMYwA7lA8sQdzO7piZawRLfB1Rgcu0B66RSpWND7yiQYyx99ra-4uTJLPUM7Ngw1ELjExod0nttyMc4f-4RZdWe3KkuORiHdarA27PdP1xhxChyrGdNfZtPNJSLwEvmoSMIYErVbrlhu8i0ZsS5C-zGFiWxRxl6jDDZRXeRFi-DQRDm5qeMfbUDcg6V2TV9BDilkyH_P0o5rHQ7zSjK7YZj20LyLsXXpPadEwUtkE38br2ezG9scSXrqE0UXGgu8T5DvNVBJjwGtFfOBuQrGEMQ5y6LZROMTY-m_ZqE0kevU9vekeV3dw6i9b4O7_l1fwih0Um46-gxlELv32Vb4Wgcl9mqeM1yXoIawyPMGrsqQ1CnHcTNccDj9G5UCAF2zw54sqg2e3L5Zvl-7KVsPGM-A3h241GfiWYvQ_VHpsoR1PZE1DcfkaHusvu_OB8lUAuFbLnerqLo-73rVkhNGH2YxNXWWB7hanx1zDuXEZ1G9gJNnMWQZN-pPRgYylKIL-5Fr1K3yN1Y1l4P8clESRzwA1gvZON7UuFGcn289BfeiAS-Hc6XiGOwHLd0aBLN-wtmzA_w4CnKmBieEAuz8MJGT3mjv4PXcaxEXkaqH_avo4iBnRJAp7hd5J6xQJ0t_vfWHqHEbSLomHTcM9Dk24_PuHIDJS93eJ0Jx-JYtWO0xTpB6rUc-arHyM4x38_l_3NHZRSI2_ut_FqeV1qetD7__-k7sjGxmM6BkqncjRVqQS14B-OeO15ali-VBHvUfi36GAsdQwboGnEzfa7yXmWe31P2qazPZfYa-IOkJfaj4v7wJ_kAKwqB5xfFRJvgs8gl3KHEOQHnC3V3oNXf6vY2RpgBO0b5cmmkJblEtRVChyABU0U1djjT_REw1S97mKsnJJIBA2iPyUHMTsk6jGddx6DHj86sD497yhN4TinSloJTlsrMlH1LlYaZrFmLG2qmBylL4_cE9m8-sxlIuJYPbGcDXRHuTiEwR8XHM9LGMwf9rhMOVIjt8XyXUbmED0Pt7uy4t75mzP2YAUfwdohnFNXzV-ZbaUTMVQurSNh_RAL6gLFbjsXc8cmJ1-5PdR9ohrhszN9oYZTTW-9OZ2TGk0anh9APqoKIecORBHYxdVmnJAxIZIB2cKLfqD74kMFlfkAYmJSb1yLV3Hfgv2EJYDxY-neRhopjm7-R52ESx38d7JaZL7ubAuUi7NqNN-CX8UXzZ6_GBvVLYtQf80ARnQew07fygQZ8mR8k7NAZqAvnN4ebItVabQ0vtzcEii_dRr242J38XRM_dClEipbLEluoUVM1-E9hMnhDKqHu0IHT0m5y7asYYsdF-QCGU2FxDTQ0QSKPcyDoZASP74-UIk6S26an4FIM7Ojc9__1Pu3DQgPYvKNxw7mv5FYXPStJm-MhAiTXo1LZGN2Po3wYLfWbhVm9q6bEFdy0-e8UqUT-tXyk3AwwC-LpfpkmmJiotH3mmtIWoZZ3dN2UaZz2tyJJaSD7yPcH-elgIn5mwv90DF1XvOgpB51GvHElc0lUykqoRPLQeEWMYKCX0fPnQ-si21nUx1ko6nZcnvFlkR06Ik41vWBSDpb0NbFXx-Jz94TPREUkUqfZspK3vLsG0UPj1bawWa6dFXEgmdys4mzZurEZGLbiiFnHO8N47qtjZul6l53_92ZFsj0MOBNgPp4qWIXi1PhJ3PJSSbnrR8rW-l3uBArTW56TlxsP7exr6TMn3C7ZfzO7G2tD1ifEiZ_0qGj80nn7ltrkfZZlc6HsrQri4LiQ4NgU85ikofugB7F42W07-9HDEJsyCuG6qdDY33EiufsdmNPb-mogeN2ELL9NSiQ1zjRjkjG8bcls-hMJbjP_GDXvjce6k_QdPK3fvyxgXvqRBGIwwXxDXmnSCn8vLiY8c20F_SyBXFfRmNtGCu-cGeoPFDX766DXPod5JYb2RABKCbJN7wE8wans4cH_nZHS_1QQyWtjkxStrFC141DUR6PIzKxO4J2KNeMqX4fk5fhHZPriZtkJHuRaRU_Lx6TlMU6n23KdrwJJWhmTN7UUxXzQvCgVO2GE6YdxDlFtVC6X7vO0rZAStqXCGK3Hq1jE1aFfpIFakl9JuBaPege6sYGdM5dwQHaGY7rlqOxVatsVG0pmE89o8QLiFJSz_0v9BVHM2_G1cl2797Kfm1QRSD8Hqt1Iq7ruD9VdQLlFN0mwc3Dt0RdRWlcxHdyFVjZj08vhiUoAhRsjMljdwRldcW8Y8SbZ7HpgifL2PZKKBFcJ8575ytN7Ft2w8QqBi6kRMqxPGa07HsL7AngavD_CXhrxKneES8xDuPzIFCleYWy9yKXVFrAHJUic4J174D57v6DtgNfHbvUaqJWX7qwlNIjeCqaPcj82GH0RYAqVeJShFhGqNw0VwyMMYhotBQdFJQkRBtllPnshj4Pw6TuwSxtVyDvSkfZmOA65vkduk1D4uEBEVt4CdiZgTMzEESD4Pt_LvfBHe4YFHaTU9J7Y3Wj7m44xlj9WL10XM2V8jGPypXuskv46-T-rdZdfgRzRMjM7r-5vlYCli-48YrbB47Z1scJ18lMTeE1G-0E6473JZjg4TGtAhYwFm_AcbsMlX1XLc
+	SessionState                          string // d2371e2d-9bcd-4647-abf3-aa2eace51a9f
+	UrlFederationRedirect                 string // https://sts.exampledomain.com/adfs/ls/?example-parameter=example-value
+	UrlSkipMfaRegistration                string // https://login.microsoftonline.com/common/resume?ctx={{.Ctx}}\u0026flowtoken={{.SFT}}\u0026skipmfaregistration=1
+	UrlSkipPasswordChange                 string // https://login.microsoftonline.com/common/resume?ctx={{.Ctx}}\u0026flowtoken={{.SFT}}\u0026skippasswordchange=1
+	UrlGetCredentialType                  string // https://login.microsoftonline.com/common/GetCredentialType?mkt=en-US
+	UrlPost                               string // https://login.microsoftonline.com/common/login
+	UrlBeginAuth                          string // https://login.microsoftonline.com/common/SAS/BeginAuth
+	UrlEndAuth                            string // https://login.microsoftonline.com/common/SAS/EndAuth
+	UrlProcessAuth                        string // https://login.microsoftonline.com/common/SAS/ProcessAuth
+	UrlHiddenForm                         string // https://account.activedirectory.windowsazure.com/
+	UrlSamlRequest                        string // https://login.microsoftonline.com/{{.ApplicationId}}/saml2?SAMLRequest={{.SAMLRequestPayload}}
+	TenantId                              string // 0cfbdd7a-1d78-47ea-b458-8aa3c2558727
+	SosId                                 string // 7f55cb4c-c904-4255-8d26-faa8da77c492
+	ProofUpToken                          string // UVrFbiiZj6kdD6oWm4k87CkipgjEbKhlq_dKoMTo8p0TRCf4utimEAnOizRQ7qAoHaotT08os5kctHfJhXw7dkactSsYjtYo9Lt_1vlPPmZ8i0FtfrwjMeztp0sMY6PHkfRO_sWIHR2bsvIpjaKqqNTJ8PZCuwNmfR8Tx2Jdud3F1FcUgkF3-MG5omxJR7oaueRn1SvnjR-sWEleKptBqLTFnVwNeY8kVfpiKV4liNACZkWc9N5CJRC7HO4aLHVUkKcWaCERUZWeaHh0Bdk_aHSZFll1C6yBv0v4IIJfTQuCOdRMXmqvSpxpRUcwgZ7vdY6krAYUAV8SG926Fptr3if69AM5GHxKN4AlyNNJZ5ghv0yqwI4aGTg1vsanq0q8ZE80TOCBZdMz39Tr_J5MKMW2HO7lEMPtZYBCYwz3Z4nzbgWo9aB65GcxNcnzXgBMeiwjgxQphpFahbj89Rc8H0PWbN4Yhh-aDlv_UMwd2lp1I98hxdEn-8uA56xCE4l1647RuwSiCIfzE_6dYxXm8Q
+	UserName                              string // exampleuser@exampledomain.com
+	UserNameUrlEncoded                    string // exampleuser%40exampledomain.com
+	SErrorCode                            string // 50058
+	Claims                                string // eyJhY2Nlc3NfdG9rZW4iOnsibmJmIjp7ImVzc2VudGlhbCI6dHJ1ZSwidmFsdWUiOiIxNjA0MTA2NjUxIn19fQ==
+}
+
+var (
+	once        sync.Once
+	fixtureData *FixtureData
+)
+
+// NewFixtureData generate the example values, these are generated once so the pages of a flow and the
+// assertions of a test agree on them
+func NewFixtureData() *FixtureData {
+	once.Do(func() {
+		fixtureData = &FixtureData{
+			ApplicationId:                         genUUID(),
+			State:                                 genBase64Fixture(800),
+			UaId:                                  genHexFixture(16),
+			Ctx:                                   genBase64Fixture(800),
+			OpenIdConnectAuthenticationProperties: genBase64Fixture(400),
+			Nonce:                                 "1577836800" + "." + genBase64Fixture(16),
+			SFT:                                   genBase64Fixture(400),
+			ClientRequestId:                       genUUID(),
+			SessionId:                             genUUID(),
+			ApiCanary:                             genBase64Fixture(200),
+			Canary:                                genBase64Fixture(32),
+			InstrumentationKey:                    genHexFixture(16) + "-" + genUUID() + "-" + genIntFixture(4),
+			Code:                                  genBase64Fixture(500),
+			IdToken:                               genBase64Fixture(2000),
+			SessionState:                          genUUID(),
+			TenantId:                              genUUID(),
+			SosId:                                 genUUID(),
+			ProofUpToken:                          genBase64Fixture(400),
+			UserName:                              "exampleuser@exampledomain.com",
+			UserNameUrlEncoded:                    "exampleuser%40exampledomain.com",
+		}
+	})
+	return fixtureData
+}
+
+// responseFixtures the example values with the URLs of variableFixture, which are paths, made absolute on the host
+func responseFixtures(host string, variableFixture FixtureData) *FixtureData {
+	const scheme = "https://"
+	fixtureData := *NewFixtureData()
+	fixtureData.SErrorCode = variableFixture.SErrorCode
+	fixtureData.Claims = variableFixture.Claims
+	if variableFixture.UrlFederationRedirect != "" {
+		fixtureData.UrlFederationRedirect = scheme + host + variableFixture.UrlFederationRedirect
+	} else {
+		fixtureData.UrlFederationRedirect = ""
+	}
+	if variableFixture.UrlSkipMfaRegistration != "" {
+		fixtureData.UrlSkipMfaRegistration = scheme + host + variableFixture.UrlSkipMfaRegistration
+	} else {
+		fixtureData.UrlSkipMfaRegistration = ""
+	}
+	if variableFixture.UrlSkipPasswordChange != "" {
+		fixtureData.UrlSkipPasswordChange = scheme + host + variableFixture.UrlSkipPasswordChange
+	} else {
+		fixtureData.UrlSkipPasswordChange = ""
+	}
+	if variableFixture.UrlGetCredentialType != "" {
+		fixtureData.UrlGetCredentialType = scheme + host + variableFixture.UrlGetCredentialType
+	} else {
+		fixtureData.UrlGetCredentialType = ""
+	}
+	if variableFixture.UrlPost != "" {
+		fixtureData.UrlPost = scheme + host + variableFixture.UrlPost
+	} else {
+		fixtureData.UrlPost = ""
+	}
+	if variableFixture.UrlBeginAuth != "" {
+		fixtureData.UrlBeginAuth = scheme + host + variableFixture.UrlBeginAuth
+	} else {
+		fixtureData.UrlBeginAuth = ""
+	}
+	if variableFixture.UrlEndAuth != "" {
+		fixtureData.UrlEndAuth = scheme + host + variableFixture.UrlEndAuth
+	} else {
+		fixtureData.UrlEndAuth = ""
+	}
+	if variableFixture.UrlProcessAuth != "" {
+		fixtureData.UrlProcessAuth = scheme + host + variableFixture.UrlProcessAuth
+	} else {
+		fixtureData.UrlProcessAuth = ""
+	}
+	if variableFixture.UrlHiddenForm != "" {
+		fixtureData.UrlHiddenForm = scheme + host + variableFixture.UrlHiddenForm
+	} else {
+		fixtureData.UrlHiddenForm = ""
+	}
+	if variableFixture.UrlSamlRequest != "" {
+		fixtureData.UrlSamlRequest = scheme + host + variableFixture.UrlSamlRequest
+	} else {
+		fixtureData.UrlSamlRequest = ""
+	}
+	return &fixtureData
+}
+
+func genBase64Fixture(length int) string {
+	data := make([]byte, length)
+	_, _ = crand.Read(data)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func genHexFixture(length int) string {
+	data := make([]byte, length)
+	_, _ = crand.Read(data)
+	return hex.EncodeToString(data)
+}
+
+func genIntFixture(length int) string {
+	low := int(math.Pow(float64(10), float64(length-1)))
+	hi := low * 10
+	return strconv.Itoa(low + mrand.Intn(hi-low))
+}
+
+func genUUID() string {
+	return uuid.New().String()
+}
+
+// Render fill the page template with the example values and the URLs of data, which are paths on the host
+func Render(name string, host string, data FixtureData) ([]byte, error) {
+	tmpl, err := template.ParseFS(Pages, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, responseFixtures(host, data)); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Step a request the flow is expected to make and the page returned for it
+type Step struct {
+	Method string                    // matches any method when empty
+	Path   string                    // the path of the request, without the query
+	Page   string                    // the template rendered as the response body, empty for none
+	Data   FixtureData               // the URLs of the page, as paths on the host of the request
+	Status int                       // defaults to 200
+	Header http.Header               // added to the response, e.g. a Location for a redirect
+	Check  func(*http.Request) error // optional check of the request, e.g. of the form posted
+}
+
+// String the method and path the step expects
+func (s Step) String() string {
+	return strings.TrimSpace(s.Method + " " + s.Path)
+}
+
+// Transport an http.RoundTripper which answers the requests with the pages of the steps, in order. A request
+// which isn't the next step fails, so the test shows where the flow went another way
+type Transport struct {
+	mu       sync.Mutex
+	steps    []Step
+	next     int
+	Requests []*http.Request
+}
+
+// NewTransport script the flow with the steps
+func NewTransport(steps ...Step) *Transport {
+	return &Transport{steps: steps}
+}
+
+// RoundTrip answer the request with the next step
+func (tr *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	tr.Requests = append(tr.Requests, req)
+
+	if tr.next >= len(tr.steps) {
+		return nil, fmt.Errorf("aadtest: unexpected request %s %s after the last step", req.Method, req.URL.Path)
+	}
+	step := tr.steps[tr.next]
+	if req.URL.Path != step.Path || (step.Method != "" && req.Method != step.Method) {
+		return nil, fmt.Errorf("aadtest: unexpected request %s %s, step %d expects %s", req.Method, req.URL.Path, tr.next+1, step)
+	}
+	tr.next++
+
+	if step.Check != nil {
+		if err := step.Check(req); err != nil {
+			return nil, fmt.Errorf("aadtest: step %d %s: %w", tr.next, step.Path, err)
+		}
+	}
+
+	var body []byte
+	if step.Page != "" {
+		var err error
+		body, err = Render(step.Page, req.URL.Host, step.Data)
+		if err != nil {
+			return nil, fmt.Errorf("aadtest: step %d %s: %w", tr.next, step.Path, err)
+		}
+	}
+
+	status := step.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	header := http.Header{}
+	for name, values := range step.Header {
+		header[name] = values
+	}
+	if header.Get("Content-Type") == "" && strings.HasSuffix(step.Page, ".json") {
+		header.Set("Content-Type", "application/json")
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// Done return an error unless every step was requested
+func (tr *Transport) Done() error {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	if tr.next < len(tr.steps) {
+		return fmt.Errorf("aadtest: the flow stopped before step %d %s", tr.next+1, tr.steps[tr.next])
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package aadtest
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransport(t *testing.T) {
+	tr := NewTransport(
+		Step{Method: "GET", Path: "/start", Page: "HiddenForm.html", Data: FixtureData{UrlHiddenForm: "/next"}},
+		Step{Method: "POST", Path: "/next", Status: http.StatusFound, Header: http.Header{"Location": {"/done"}}},
+		Step{Path: "/done"},
+	)
+	client := &http.Client{Transport: tr, CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	res, err := client.Get("https://login.example.test/start")
+	require.Nil(t, err)
+	body, err := io.ReadAll(res.Body)
+	require.Nil(t, err)
+	require.Contains(t, string(body), `action="https://login.example.test/next"`)
+	require.Contains(t, string(body), NewFixtureData().Code)
+
+	// a request which isn't the next step fails
+	_, err = client.Get("https://login.example.test/next")
+	require.ErrorContains(t, err, "aadtest: unexpected request GET /next, step 2 expects POST /next")
+
+	res, err = client.Post("https://login.example.test/next", "text/plain", strings.NewReader(""))
+	require.Nil(t, err)
+	require.Equal(t, http.StatusFound, res.StatusCode)
+	require.Equal(t, "/done", res.Header.Get("Location"))
+
+	require.EqualError(t, tr.Done(), "aadtest: the flow stopped before step 3 /done")
+
+	_, err = client.Get("https://login.example.test/done")
+	require.Nil(t, err)
+	require.Nil(t, tr.Done())
+	require.Len(t, tr.Requests, 4)
+
+	_, err = client.Get("https://login.example.test/done")
+	require.ErrorContains(t, err, "after the last step")
+}
@@ -0,0 +1,60 @@
+package provider
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/pkg/errors"
+)
+
+// ErrFormNotFound returned when a page doesn't contain a form with an action to submit to
+var ErrFormNotFound = errors.New("unable to locate form submit URL")
+
+// SubmitForm build the request which submits the form found in the document, the values of the named inputs
+// are prefilled from the page before the overrides are applied and the action is resolved against the base URL.
+// When the page has several forms the last one with an action is used, forms without a method are posted.
+func SubmitForm(doc *goquery.Document, baseURL *url.URL, overrides url.Values) (*http.Request, error) {
+	form := doc.Find("form[action]").Last()
+	if form.Length() == 0 {
+		return nil, ErrFormNotFound
+	}
+
+	action, err := url.Parse(form.AttrOr("action", ""))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse form action")
+	}
+	if baseURL != nil {
+		action = baseURL.ResolveReference(action)
+	}
+
+	formValues := url.Values{}
+	form.Find("input").Each(func(i int, s *goquery.Selection) {
+		name, ok := s.Attr("name")
+		if !ok {
+			return
+		}
+		value, ok := s.Attr("value")
+		if !ok {
+			return
+		}
+		formValues.Set(name, value)
+	})
+	for name, values := range overrides {
+		formValues[name] = values
+	}
+
+	if strings.EqualFold(form.AttrOr("method", "POST"), "GET") {
+		action.RawQuery = formValues.Encode()
+		return http.NewRequest("GET", action.String(), nil)
+	}
+
+	req, err := http.NewRequest("POST", action.String(), strings.NewReader(formValues.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	return req, nil
+}
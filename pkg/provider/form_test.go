@@ -0,0 +1,77 @@
+package provider
+
+import (
+	"io"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/stretchr/testify/require"
+)
+
+func formDocument(t *testing.T, html string) *goquery.Document {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(html))
+	require.Nil(t, err)
+	return doc
+}
+
+func TestSubmitForm(t *testing.T) {
+	doc := formDocument(t, `<html><body>
+<form method="post" action="/adfs/ls/?client-request-id=123">
+<input type="hidden" name="Context" value="abc" />
+<input type="text" name="UserName" value="" />
+<input type="password" name="Password" />
+<input type="submit" value="Sign in" />
+</form>
+</body></html>`)
+	baseURL, _ := url.Parse("https://sts.example.com/adfs/ls/idpinitiatedsignon")
+
+	req, err := SubmitForm(doc, baseURL, url.Values{"UserName": {"user@example.com"}, "Password": {"secret"}})
+	require.Nil(t, err)
+	require.Equal(t, "POST", req.Method)
+	require.Equal(t, "https://sts.example.com/adfs/ls/?client-request-id=123", req.URL.String())
+	require.Equal(t, "application/x-www-form-urlencoded", req.Header.Get("Content-Type"))
+
+	body, err := io.ReadAll(req.Body)
+	require.Nil(t, err)
+	values, err := url.ParseQuery(string(body))
+	require.Nil(t, err)
+	require.Equal(t, url.Values{
+		"Context":  {"abc"},
+		"UserName": {"user@example.com"},
+		"Password": {"secret"},
+	}, values)
+}
+
+func TestSubmitFormGet(t *testing.T) {
+	doc := formDocument(t, `<form method="GET" action="https://idp.example.com/search"><input name="q" value="saml" /></form>`)
+
+	req, err := SubmitForm(doc, nil, nil)
+	require.Nil(t, err)
+	require.Equal(t, "GET", req.Method)
+	require.Equal(t, "https://idp.example.com/search?q=saml", req.URL.String())
+	require.Nil(t, req.Body)
+}
+
+func TestSubmitFormLastFormWithAction(t *testing.T) {
+	doc := formDocument(t, `<form action="https://idp.example.com/first"><input name="a" value="1" /></form>
+<form><input name="b" value="2" /></form>
+<form name="hiddenform" action="https://idp.example.com/second"><input name="c" value="3" /></form>`)
+
+	req, err := SubmitForm(doc, nil, nil)
+	require.Nil(t, err)
+	require.Equal(t, "POST", req.Method)
+	require.Equal(t, "https://idp.example.com/second", req.URL.String())
+
+	body, err := io.ReadAll(req.Body)
+	require.Nil(t, err)
+	require.Equal(t, "c=3", string(body))
+}
+
+func TestSubmitFormNotFound(t *testing.T) {
+	doc := formDocument(t, `<html><body><form><input name="a" value="1" /></form></body></html>`)
+
+	_, err := SubmitForm(doc, nil, nil)
+	require.Equal(t, ErrFormNotFound, err)
+}
@@ -2,12 +2,18 @@ package provider
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
 	"runtime"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/avast/retry-go"
@@ -54,6 +60,219 @@ func NewDefaultTransport(skipVerify bool) *http.Transport {
 	}
 }
 
+// InsecureConfirmationEnvVar environment variable which must be set to true before skip verify takes effect
+// on accounts which require confirmation
+const InsecureConfirmationEnvVar = "I_UNDERSTAND_INSECURE"
+
+// ErrInsecureNotConfirmed returned when skip verify is set without the confirmation the account requires
+var ErrInsecureNotConfirmed = errors.New("skip verify is set but " + InsecureConfirmationEnvVar + "=true is not, refusing to disable TLS verification")
+
+var (
+	insecureWarning       sync.Once
+	insecureWarningOutput io.Writer = os.Stderr
+)
+
+// CheckSkipVerify warn once on stderr when TLS verification is disabled, when confirmation is required skip
+// verify is refused unless I_UNDERSTAND_INSECURE=true is also set in the environment
+func CheckSkipVerify(skipVerify bool, requireConfirmation bool) error {
+	if !skipVerify {
+		return nil
+	}
+
+	if requireConfirmation && os.Getenv(InsecureConfirmationEnvVar) != "true" {
+		return ErrInsecureNotConfirmed
+	}
+
+	insecureWarning.Do(func() {
+		fmt.Fprintln(insecureWarningOutput, "WARNING: TLS certificate verification is disabled, connections to the IdP and AWS can be intercepted")
+	})
+
+	return nil
+}
+
+// ApplyTimeouts set the configured dial and response header timeouts on the transport, these apply to each request
+// on its own so a stalled request fails without putting a limit on the whole login, which may include waiting on MFA
+func ApplyTimeouts(tr *http.Transport, idpAccount *cfg.IDPAccount) {
+	if idpAccount.DialTimeout > 0 {
+		tr.DialContext = (&net.Dialer{
+			Timeout:   time.Duration(idpAccount.DialTimeout) * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+	}
+	if idpAccount.ResponseHeaderTimeout > 0 {
+		tr.ResponseHeaderTimeout = time.Duration(idpAccount.ResponseHeaderTimeout) * time.Second
+	}
+}
+
+// systemCertPool a copy of the system roots, replaced in tests
+var systemCertPool = x509.SystemCertPool
+
+// ApplyProxyAndCA send the requests through the configured proxy_url and only trust the certificates in the configured
+// ca_bundle, or with ca_bundle_append the system roots as well, when these aren't set the proxy from the environment
+// and the system roots are left in place
+func ApplyProxyAndCA(tr *http.Transport, idpAccount *cfg.IDPAccount) error {
+	if idpAccount.ProxyURL != "" {
+		proxyURL, err := url.Parse(idpAccount.ProxyURL)
+		if err != nil {
+			return errors.Wrap(err, "error parsing proxy_url")
+		}
+		tr.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if idpAccount.CABundle != "" {
+		data, err := os.ReadFile(idpAccount.CABundle)
+		if err != nil {
+			return errors.Wrap(err, "error reading ca_bundle")
+		}
+		pool := x509.NewCertPool()
+		if idpAccount.CABundleAppend {
+			systemPool, err := systemCertPool()
+			if err != nil {
+				return errors.Wrap(err, "error loading the system roots to append ca_bundle to")
+			}
+			pool = systemPool.Clone()
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return errors.Errorf("no certificates found in ca_bundle %s", idpAccount.CABundle)
+		}
+		if tr.TLSClientConfig == nil {
+			tr.TLSClientConfig = &tls.Config{}
+		}
+		tr.TLSClientConfig.RootCAs = pool
+	}
+
+	return nil
+}
+
+// ApplyTLSRenegotiation set whether the server may ask to renegotiate the TLS session from the configured
+// tls_renegotiation, freely when it isn't set, this only applies to TLS 1.2 and earlier
+func ApplyTLSRenegotiation(tr *http.Transport, idpAccount *cfg.IDPAccount) error {
+	var mode tls.RenegotiationSupport
+	switch idpAccount.TLSRenegotiation {
+	case "", "freely":
+		mode = tls.RenegotiateFreelyAsClient
+	case "once":
+		mode = tls.RenegotiateOnceAsClient
+	case "never":
+		mode = tls.RenegotiateNever
+	default:
+		return errors.Errorf("unknown tls_renegotiation %s, valid options are: never, once, freely", idpAccount.TLSRenegotiation)
+	}
+
+	if tr.TLSClientConfig == nil {
+		tr.TLSClientConfig = &tls.Config{}
+	}
+	tr.TLSClientConfig.Renegotiation = mode
+
+	return nil
+}
+
+// NewAWSHTTPClient build a client for the STS and IAM calls with the proxy, CA bundle, TLS verification, timeouts and
+// HTTP/2 settings of the account, so these reach AWS the same way the requests to the IdP are sent
+func NewAWSHTTPClient(idpAccount *cfg.IDPAccount) (*http.Client, error) {
+	tr := NewDefaultTransport(idpAccount.SkipVerify)
+	if err := ApplyProxyAndCA(tr, idpAccount); err != nil {
+		return nil, err
+	}
+	ApplyTimeouts(tr, idpAccount)
+	if idpAccount.DisableHTTP2 {
+		DisableHTTP2(tr)
+	}
+
+	return &http.Client{Transport: tr}, nil
+}
+
+// DisableHTTP2 force HTTP/1.1 on the transport, for proxies which break HTTP/2 streams mid flow
+func DisableHTTP2(tr *http.Transport) {
+	tr.ForceAttemptHTTP2 = false
+	tr.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+}
+
+// headerRoundTripper sets a fixed set of headers on every request, including those made while following redirects
+type headerRoundTripper struct {
+	headers http.Header
+	next    http.RoundTripper
+}
+
+// NewHeaderRoundTripper wrap the transport so the supplied headers are added to all outgoing requests
+func NewHeaderRoundTripper(next http.RoundTripper, headers http.Header) http.RoundTripper {
+	if len(headers) == 0 {
+		return next
+	}
+	return &headerRoundTripper{headers: headers, next: next}
+}
+
+// RoundTrip add the headers to a copy of the request then hand it to the wrapped transport
+func (rt *headerRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for name, values := range rt.headers {
+		req.Header[name] = values
+	}
+	return rt.next.RoundTrip(req)
+}
+
+// traceRoundTripper logs how long each stage of a request took, from the DNS lookup to the first response byte
+type traceRoundTripper struct {
+	next http.RoundTripper
+}
+
+// requestTimings the time taken by each stage of a request, stages which didn't happen such as the DNS
+// lookup for an IP address or the handshake on a reused connection are left as zero
+type requestTimings struct {
+	DNS       time.Duration
+	Connect   time.Duration
+	TLS       time.Duration
+	FirstByte time.Duration
+	Reused    bool
+}
+
+// NewTraceRoundTripper wrap the transport so the timings of every request are logged, this is only done when
+// enabled with TRACE_HTTP=true as the timings are of little use outside of diagnosing a slow network
+func NewTraceRoundTripper(next http.RoundTripper) http.RoundTripper {
+	if !dump.TraceEnable() {
+		return next
+	}
+	return &traceRoundTripper{next: next}
+}
+
+// RoundTrip attach a client trace to the request and log the timings once the response headers arrive
+func (rt *traceRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req, timings := traceRequest(req)
+
+	res, err := rt.next.RoundTrip(req)
+
+	logrus.WithField("http", "trace").WithFields(logrus.Fields{
+		"URL":       req.URL.String(),
+		"dns":       timings.DNS,
+		"connect":   timings.Connect,
+		"tls":       timings.TLS,
+		"firstByte": timings.FirstByte,
+		"reused":    timings.Reused,
+	}).Info("HTTP Trace")
+
+	return res, err
+}
+
+// traceRequest return a copy of the request which records the stage timings as the request progresses
+func traceRequest(req *http.Request) (*http.Request, *requestTimings) {
+	timings := &requestTimings{}
+	var start, dnsStart, connectStart, tlsStart time.Time
+
+	trace := &httptrace.ClientTrace{
+		GetConn:              func(string) { start = time.Now() },
+		GotConn:              func(info httptrace.GotConnInfo) { timings.Reused = info.Reused },
+		DNSStart:             func(httptrace.DNSStartInfo) { dnsStart = time.Now() },
+		DNSDone:              func(httptrace.DNSDoneInfo) { timings.DNS = time.Since(dnsStart) },
+		ConnectStart:         func(string, string) { connectStart = time.Now() },
+		ConnectDone:          func(string, string, error) { timings.Connect = time.Since(connectStart) },
+		TLSHandshakeStart:    func() { tlsStart = time.Now() },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { timings.TLS = time.Since(tlsStart) },
+		GotFirstResponseByte: func() { timings.FirstByte = time.Since(start) },
+	}
+
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace)), timings
+}
+
 func BuildHttpClientOpts(account *cfg.IDPAccount) *HTTPClientOptions {
 	opts := &HTTPClientOptions{}
 	atmt, atmtErr := strconv.ParseUint(account.HttpAttemptsCount, 10, 0)
@@ -1,11 +1,30 @@
 package provider
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/require"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
 )
 
 func TestClientDoGetOK(t *testing.T) {
@@ -72,3 +91,279 @@ func TestClientDoResponseCheck(t *testing.T) {
 	require.Error(t, err)
 	require.Equal(t, 400, res.StatusCode)
 }
+
+func TestTraceRoundTripper(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("OK"))
+	}))
+	defer ts.Close()
+
+	tr := NewDefaultTransport(true)
+	require.Equal(t, tr, NewTraceRoundTripper(tr))
+
+	t.Setenv("TRACE_HTTP", "true")
+	hook := test.NewLocal(logrus.StandardLogger())
+	defer logrus.StandardLogger().ReplaceHooks(logrus.LevelHooks{})
+
+	hc, err := NewHTTPClient(NewTraceRoundTripper(tr), &HTTPClientOptions{IsWithRetries: false})
+	require.Nil(t, err)
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	require.Nil(t, err)
+
+	res, err := hc.Do(req)
+	require.Nil(t, err)
+	require.Equal(t, 200, res.StatusCode)
+
+	entry := hook.LastEntry()
+	require.NotNil(t, entry)
+	require.Equal(t, "HTTP Trace", entry.Message)
+	require.Equal(t, ts.URL, entry.Data["URL"])
+	require.NotZero(t, entry.Data["connect"])
+	require.NotZero(t, entry.Data["tls"])
+	require.NotZero(t, entry.Data["firstByte"])
+	require.Equal(t, false, entry.Data["reused"])
+}
+
+func TestApplyTimeoutsResponseHeader(t *testing.T) {
+	const stall = 1500 * time.Millisecond
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slowBody" {
+			// the headers arrive straight away, only the body is slow
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+		}
+		select {
+		case <-time.After(stall):
+		case <-r.Context().Done():
+			return
+		}
+		_, _ = w.Write([]byte("OK"))
+	}))
+	defer ts.Close()
+
+	tr := NewDefaultTransport(false)
+	ApplyTimeouts(tr, &cfg.IDPAccount{ResponseHeaderTimeout: 1})
+	require.Equal(t, time.Second, tr.ResponseHeaderTimeout)
+
+	hc, err := NewHTTPClient(tr, &HTTPClientOptions{IsWithRetries: false})
+	require.Nil(t, err)
+
+	req, err := http.NewRequest("GET", ts.URL+"/stallHeaders", nil)
+	require.Nil(t, err)
+	_, err = hc.Do(req)
+	require.ErrorContains(t, err, "timeout awaiting response headers")
+
+	req, err = http.NewRequest("GET", ts.URL+"/slowBody", nil)
+	require.Nil(t, err)
+	res, err := hc.Do(req)
+	require.Nil(t, err)
+	body, err := io.ReadAll(res.Body)
+	require.Nil(t, err)
+	require.Equal(t, "OK", string(body))
+}
+
+func TestApplyTimeoutsUnset(t *testing.T) {
+	tr := NewDefaultTransport(false)
+	ApplyTimeouts(tr, &cfg.IDPAccount{})
+	require.Zero(t, tr.ResponseHeaderTimeout)
+	require.NotNil(t, tr.DialContext)
+}
+
+func TestDisableHTTP2(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("OK"))
+	}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	get := func(tr *http.Transport) string {
+		res, err := (&http.Client{Transport: tr}).Get(ts.URL)
+		require.Nil(t, err)
+		defer res.Body.Close()
+		return res.Proto
+	}
+
+	tr := NewDefaultTransport(true)
+	tr.ForceAttemptHTTP2 = true
+	require.Equal(t, "HTTP/2.0", get(tr))
+
+	tr = NewDefaultTransport(true)
+	tr.ForceAttemptHTTP2 = true
+	DisableHTTP2(tr)
+	require.Equal(t, "HTTP/1.1", get(tr))
+}
+
+func TestApplyProxyAndCA(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("OK"))
+	}))
+	defer ts.Close()
+
+	caBundle := filepath.Join(t.TempDir(), "ca.pem")
+	require.Nil(t, os.WriteFile(caBundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0600))
+
+	tr := NewDefaultTransport(false)
+	require.Nil(t, ApplyProxyAndCA(tr, &cfg.IDPAccount{}))
+	_, err := (&http.Client{Transport: tr}).Get(ts.URL)
+	require.NotNil(t, err)
+
+	tr = NewDefaultTransport(false)
+	require.Nil(t, ApplyProxyAndCA(tr, &cfg.IDPAccount{CABundle: caBundle}))
+	res, err := (&http.Client{Transport: tr}).Get(ts.URL)
+	require.Nil(t, err)
+	res.Body.Close()
+
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		_, _ = w.Write([]byte("OK"))
+	}))
+	defer proxy.Close()
+
+	tr = NewDefaultTransport(false)
+	require.Nil(t, ApplyProxyAndCA(tr, &cfg.IDPAccount{ProxyURL: proxy.URL}))
+	res, err = (&http.Client{Transport: tr}).Get("http://idp.example.invalid/login")
+	require.Nil(t, err)
+	res.Body.Close()
+	require.Equal(t, "http://idp.example.invalid/login", proxied)
+
+	err = ApplyProxyAndCA(NewDefaultTransport(false), &cfg.IDPAccount{CABundle: filepath.Join(t.TempDir(), "missing.pem")})
+	require.ErrorContains(t, err, "error reading ca_bundle")
+
+	require.Nil(t, os.WriteFile(caBundle, []byte("not a certificate"), 0600))
+	err = ApplyProxyAndCA(NewDefaultTransport(false), &cfg.IDPAccount{CABundle: caBundle})
+	require.EqualError(t, err, "no certificates found in ca_bundle "+caBundle)
+}
+
+// newInternalTLSServer start a server with a certificate of its own, as signed by an internal CA
+func newInternalTLSServer(t *testing.T) *httptest.Server {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Internal CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(t, err)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("OK"))
+	}))
+	ts.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	ts.StartTLS()
+	return ts
+}
+
+func TestApplyProxyAndCAAppend(t *testing.T) {
+	// the default certificate of httptest stands in for one signed by a system root
+	public := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("OK"))
+	}))
+	defer public.Close()
+	internal := newInternalTLSServer(t)
+	defer internal.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(public.Certificate())
+	systemCertPool = func() (*x509.CertPool, error) { return roots, nil }
+	t.Cleanup(func() { systemCertPool = x509.SystemCertPool })
+
+	caBundle := filepath.Join(t.TempDir(), "ca.pem")
+	require.Nil(t, os.WriteFile(caBundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: internal.Certificate().Raw}), 0600))
+
+	get := func(tr *http.Transport, url string) error {
+		res, err := (&http.Client{Transport: tr}).Get(url)
+		if err == nil {
+			res.Body.Close()
+		}
+		return err
+	}
+
+	// the ca_bundle alone replaces the system roots
+	tr := NewDefaultTransport(false)
+	require.Nil(t, ApplyProxyAndCA(tr, &cfg.IDPAccount{CABundle: caBundle}))
+	require.Nil(t, get(tr, internal.URL))
+	require.NotNil(t, get(tr, public.URL))
+
+	tr = NewDefaultTransport(false)
+	require.Nil(t, ApplyProxyAndCA(tr, &cfg.IDPAccount{CABundle: caBundle, CABundleAppend: true}))
+	require.Nil(t, get(tr, internal.URL))
+	require.Nil(t, get(tr, public.URL))
+
+	// the system roots themselves are left as they were
+	tr = NewDefaultTransport(false)
+	tr.TLSClientConfig.RootCAs = roots
+	require.NotNil(t, get(tr, internal.URL))
+}
+
+func TestApplyTLSRenegotiation(t *testing.T) {
+	modes := map[string]tls.RenegotiationSupport{
+		"":       tls.RenegotiateFreelyAsClient,
+		"freely": tls.RenegotiateFreelyAsClient,
+		"once":   tls.RenegotiateOnceAsClient,
+		"never":  tls.RenegotiateNever,
+	}
+	for setting, mode := range modes {
+		tr := NewDefaultTransport(false)
+		require.Nil(t, ApplyTLSRenegotiation(tr, &cfg.IDPAccount{TLSRenegotiation: setting}))
+		require.Equal(t, mode, tr.TLSClientConfig.Renegotiation, setting)
+	}
+
+	tr := &http.Transport{}
+	require.Nil(t, ApplyTLSRenegotiation(tr, &cfg.IDPAccount{TLSRenegotiation: "never"}))
+	require.Equal(t, tls.RenegotiateNever, tr.TLSClientConfig.Renegotiation)
+
+	err := ApplyTLSRenegotiation(NewDefaultTransport(false), &cfg.IDPAccount{TLSRenegotiation: "sometimes"})
+	require.EqualError(t, err, "unknown tls_renegotiation sometimes, valid options are: never, once, freely")
+}
+
+func captureInsecureWarning(t *testing.T) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	output := insecureWarningOutput
+	insecureWarning = sync.Once{}
+	insecureWarningOutput = buf
+	t.Cleanup(func() {
+		insecureWarning = sync.Once{}
+		insecureWarningOutput = output
+	})
+	return buf
+}
+
+func TestCheckSkipVerifyWarnsOnce(t *testing.T) {
+	buf := captureInsecureWarning(t)
+
+	require.Nil(t, CheckSkipVerify(false, false))
+	require.Empty(t, buf.String())
+
+	require.Nil(t, CheckSkipVerify(true, false))
+	require.Nil(t, CheckSkipVerify(true, false))
+	require.Equal(t, 1, strings.Count(buf.String(), "WARNING: TLS certificate verification is disabled"))
+}
+
+func TestCheckSkipVerifyConfirmation(t *testing.T) {
+	buf := captureInsecureWarning(t)
+
+	t.Setenv(InsecureConfirmationEnvVar, "")
+	require.Equal(t, ErrInsecureNotConfirmed, CheckSkipVerify(true, true))
+	require.Empty(t, buf.String())
+
+	t.Setenv(InsecureConfirmationEnvVar, "yes")
+	require.Equal(t, ErrInsecureNotConfirmed, CheckSkipVerify(true, true))
+
+	t.Setenv(InsecureConfirmationEnvVar, "true")
+	require.Nil(t, CheckSkipVerify(true, true))
+	require.Contains(t, buf.String(), "WARNING")
+
+	// nothing to confirm when verification stays on
+	t.Setenv(InsecureConfirmationEnvVar, "")
+	require.Nil(t, CheckSkipVerify(false, true))
+}
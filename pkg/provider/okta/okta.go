@@ -201,7 +201,7 @@ func (oc *Client) createSession(loginDetails *creds.LoginDetails, sessionToken s
 
 	oktaSessionCookie := gjson.Get(resp, "id").String()
 
-	err = credentials.SaveCredentials(loginDetails.URL+"/sessionCookie", loginDetails.Username, oktaSessionCookie)
+	err = credentials.SaveCredentials(credentials.SessionCookieURL(loginDetails.URL, loginDetails.ConfigScope), loginDetails.Username, oktaSessionCookie)
 	if err != nil {
 		return "", "", fmt.Errorf("error storing okta session token | err: %v", err)
 	}
@@ -0,0 +1,119 @@
+package provider
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
+)
+
+// DefaultRequestLogMaxSize the size in bytes the request log may grow to before it's rotated
+const DefaultRequestLogMaxSize = 1024 * 1024
+
+// RequestLog appends a line for each request made to the IdP to the request_log file of the account, to audit which
+// endpoints a login hits. Only the method, the URL without its query, fragment or user info, which carry tokens and
+// credentials, the status and the step of the flow are written. Once the file reaches its maximum size it's moved to
+// the same path with .1 appended, replacing the previous one, and a new file is started.
+type RequestLog struct {
+	mu      sync.Mutex
+	path    string
+	account string
+	maxSize int64
+	step    string
+}
+
+// NewRequestLog the request log of the account, nil when request_log isn't set
+func NewRequestLog(idpAccount *cfg.IDPAccount) *RequestLog {
+	if idpAccount.RequestLog == "" {
+		return nil
+	}
+
+	maxSize := int64(idpAccount.RequestLogMaxSize)
+	if maxSize <= 0 {
+		maxSize = DefaultRequestLogMaxSize
+	}
+
+	return &RequestLog{path: idpAccount.RequestLog, account: idpAccount.Name, maxSize: maxSize}
+}
+
+// SetStep set the step of the flow the following requests are made from
+func (l *RequestLog) SetStep(step string) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.step = step
+}
+
+// RoundTripper wrap the transport so every request it makes is logged, the transport is returned as is when
+// there's no request log
+func (l *RequestLog) RoundTripper(next http.RoundTripper) http.RoundTripper {
+	if l == nil {
+		return next
+	}
+	return &requestLogRoundTripper{next: next, log: l}
+}
+
+type requestLogRoundTripper struct {
+	next http.RoundTripper
+	log  *RequestLog
+}
+
+// RoundTrip make the request then log it with the status of the response, or error when there isn't one
+func (rt *requestLogRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := rt.next.RoundTrip(req)
+
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(res.StatusCode)
+	}
+	rt.log.write(req, status)
+
+	return res, err
+}
+
+func (l *RequestLog) write(req *http.Request, status string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	reqURL := *req.URL
+	reqURL.User = nil
+	reqURL.RawQuery = ""
+	reqURL.ForceQuery = false
+	reqURL.Fragment = ""
+	reqURL.RawFragment = ""
+
+	line := fmt.Sprintf("time=%s account=%q step=%q method=%s url=%q status=%s\n",
+		time.Now().UTC().Format(time.RFC3339), l.account, l.step, req.Method, reqURL.String(), status)
+
+	if err := l.rotate(int64(len(line))); err != nil {
+		logrus.WithError(err).Debug("unable to rotate the request log")
+	}
+
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		logrus.WithError(err).Debug("unable to open the request log")
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(line); err != nil {
+		logrus.WithError(err).Debug("unable to write to the request log")
+	}
+}
+
+// rotate move the log aside when the line would take it over its maximum size
+func (l *RequestLog) rotate(size int64) error {
+	fi, err := os.Stat(l.path)
+	if err != nil || fi.Size() == 0 || fi.Size()+size <= l.maxSize {
+		return nil
+	}
+	return os.Rename(l.path, l.path+".1")
+}
@@ -0,0 +1,82 @@
+package provider
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/versent/saml2aws/v2/pkg/cfg"
+)
+
+type failingRoundTripper struct{}
+
+func (failingRoundTripper) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestRequestLog(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("OK"))
+	}))
+	defer ts.Close()
+
+	path := filepath.Join(t.TempDir(), "requests.log")
+	requestLog := NewRequestLog(&cfg.IDPAccount{Name: "work", RequestLog: path})
+	client := &http.Client{Transport: requestLog.RoundTripper(NewDefaultTransport(false))}
+
+	requestLog.SetStep("ConvergedSignIn")
+	tokenURL := strings.Replace(ts.URL, "http://", "http://user:secret@", 1) + "/login?login_hint=user%40example.com&code=token#state"
+	res, err := client.Post(tokenURL, "application/x-www-form-urlencoded", strings.NewReader("passwd=secret"))
+	require.Nil(t, err)
+	res.Body.Close()
+
+	requestLog.SetStep("ConvergedTFA")
+	_, err = (&http.Client{Transport: requestLog.RoundTripper(failingRoundTripper{})}).Get("https://login.example.test/beginAuth")
+	require.NotNil(t, err)
+
+	data, err := os.ReadFile(path)
+	require.Nil(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	require.Len(t, lines, 2)
+	require.Regexp(t, `^time=\S+Z account="work" step="ConvergedSignIn" method=POST url="`+ts.URL+`/login" status=200$`, lines[0])
+	require.Regexp(t, `^time=\S+Z account="work" step="ConvergedTFA" method=GET url="https://login.example.test/beginAuth" status=error$`, lines[1])
+	require.NotContains(t, string(data), "secret")
+	require.NotContains(t, string(data), "token")
+	require.NotContains(t, string(data), "example.com")
+
+	fi, err := os.Stat(path)
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+}
+
+func TestRequestLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "requests.log")
+	requestLog := NewRequestLog(&cfg.IDPAccount{RequestLog: path, RequestLogMaxSize: 200})
+	client := &http.Client{Transport: requestLog.RoundTripper(failingRoundTripper{})}
+
+	for i := 0; i < 3; i++ {
+		_, _ = client.Get("https://login.example.test/common/login")
+	}
+
+	rotated, err := os.ReadFile(path + ".1")
+	require.Nil(t, err)
+	current, err := os.ReadFile(path)
+	require.Nil(t, err)
+	require.Equal(t, 1, strings.Count(string(rotated), "\n"))
+	require.Equal(t, 1, strings.Count(string(current), "\n"))
+	require.LessOrEqual(t, len(current), 200)
+}
+
+func TestRequestLogUnset(t *testing.T) {
+	requestLog := NewRequestLog(&cfg.IDPAccount{})
+	require.Nil(t, requestLog)
+
+	tr := NewDefaultTransport(false)
+	require.Equal(t, http.RoundTripper(tr), requestLog.RoundTripper(tr))
+	requestLog.SetStep("start")
+}
@@ -162,3 +162,25 @@ func (p *SAMLCacheProvider) WriteRaw(samlAssertion string) error {
 
 	return nil
 }
+
+// Delete remove the cache file, it is not an error if it doesn't exist
+func (p *SAMLCacheProvider) Delete() error {
+
+	var cache_path string
+	var err error
+	if p.Filename == "" {
+		cache_path, err = locateCacheFile(p.Account)
+		if err != nil {
+			return errors.Wrap(err, "Could not retrieve cache file path")
+		}
+	} else {
+		cache_path = p.Filename
+	}
+
+	err = os.Remove(cache_path)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "Could not remove the cache file")
+	}
+
+	return nil
+}
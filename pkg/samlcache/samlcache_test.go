@@ -84,6 +84,28 @@ func TestCanRead(t *testing.T) {
 
 }
 
+func TestCanDelete(t *testing.T) {
+
+	_ = os.WriteFile("example_cache", []byte("testing output"), 0700)
+
+	p := SAMLCacheProvider{
+		Filename: "example_cache",
+	}
+
+	if err := p.Delete(); err != nil {
+		t.Error("Could not delete cache:", err)
+	}
+
+	if _, err := os.Stat("example_cache"); !os.IsNotExist(err) {
+		t.Error("The cache file was not removed:", err)
+	}
+
+	if err := p.Delete(); err != nil {
+		t.Error("Deleting a missing cache should not fail:", err)
+	}
+
+}
+
 type AssertionTemplateData struct {
 	ExpiryRFC3339Time string
 }
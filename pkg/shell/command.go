@@ -0,0 +1,25 @@
+package shell
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+// runWithTimeout run the command and return its combined output, the command is killed when it hasn't
+// finished within the timeout
+func runWithTimeout(cs []string, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, cs[0], cs[1:]...)
+	// don't wait on children of the shell which still hold the output open after it was killed
+	cmd.WaitDelay = time.Second
+
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return string(out), fmt.Errorf("command timed out after %v", timeout)
+	}
+	return string(out), err
+}
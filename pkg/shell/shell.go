@@ -4,8 +4,12 @@
 package shell
 
 import (
+	"math"
 	"os"
 	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
 )
 
 // ExecShellCmd exec shell command using the default shell
@@ -13,6 +17,24 @@ func ExecShellCmd(cmdline []string, envVars []string) error {
 	return prepCmd(cmdline, envVars).Run()
 }
 
+// RunCommand run the command line using sh and return its combined output, the command is killed when it
+// hasn't finished within the timeout
+func RunCommand(cmdline string, timeout time.Duration) (string, error) {
+	return runWithTimeout([]string{"sh", "-c", cmdline}, timeout)
+}
+
+// RemoveAfter remove the file once the ttl has passed, from a process of its own in a new session so it's
+// removed even once saml2aws and the terminal it was started from have exited
+func RemoveAfter(path string, ttl time.Duration) error {
+	seconds := strconv.Itoa(int(math.Ceil(ttl.Seconds())))
+	cmd := exec.Command("sh", "-c", `sleep "$1" && rm -f "$2"`, "sh", seconds, path)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	return cmd.Process.Release()
+}
+
 func prepCmd(cs []string, envVars []string) *exec.Cmd {
 	cmd := exec.Command(cs[0], cs[1:]...)
 	cmd.Stdin = os.Stdin
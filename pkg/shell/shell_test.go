@@ -4,8 +4,11 @@
 package shell
 
 import (
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -41,3 +44,34 @@ func TestPrepCmdShell(t *testing.T) {
 	assert.Equal(t, "some123 one two\n", out.String(), "var evaled, spaces squashed")
 
 }
+
+func TestRunCommand(t *testing.T) {
+	out, err := RunCommand("echo connected; echo warning >&2", time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, "connected\nwarning\n", out)
+
+	out, err = RunCommand("echo no route to vpn; exit 3", time.Second)
+	assert.EqualError(t, err, "exit status 3")
+	assert.Equal(t, "no route to vpn\n", out)
+
+	started := time.Now()
+	_, err = RunCommand("sleep 10", 100*time.Millisecond)
+	assert.EqualError(t, err, "command timed out after 100ms")
+	assert.Less(t, time.Since(started), 5*time.Second)
+}
+
+func TestRemoveAfter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "it's credentials")
+	assert.Nil(t, os.WriteFile(path, []byte("export AWS_ACCESS_KEY_ID=id\n"), 0600))
+
+	started := time.Now()
+	assert.Nil(t, RemoveAfter(path, 500*time.Millisecond))
+
+	_, err := os.Stat(path)
+	assert.Nil(t, err, "removed before the ttl")
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(path)
+		return os.IsNotExist(err)
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.GreaterOrEqual(t, time.Since(started), 500*time.Millisecond)
+}
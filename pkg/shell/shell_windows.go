@@ -1,8 +1,13 @@
 package shell
 
 import (
+	"math"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 // ExecShellCmd exec shell command using the cmd shell
@@ -18,3 +23,22 @@ func ExecShellCmd(cmdline []string, envVars []string) error {
 
 	return cmd.Run()
 }
+
+// RunCommand run the command line using the cmd shell and return its combined output, the command is killed
+// when it hasn't finished within the timeout
+func RunCommand(cmdline string, timeout time.Duration) (string, error) {
+	return runWithTimeout([]string{"cmd", "/C", cmdline}, timeout)
+}
+
+// RemoveAfter remove the file once the ttl has passed, from a process of its own so it's removed even once
+// saml2aws and the console it was started from have exited
+func RemoveAfter(path string, ttl time.Duration) error {
+	seconds := strconv.Itoa(int(math.Ceil(ttl.Seconds())))
+	script := "Start-Sleep -Seconds " + seconds + "; Remove-Item -Force -LiteralPath '" + strings.ReplaceAll(path, "'", "''") + "'"
+	cmd := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", script)
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP, HideWindow: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	return cmd.Process.Release()
+}
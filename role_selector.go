@@ -0,0 +1,51 @@
+package saml2aws
+
+import (
+	"log"
+
+	"github.com/pkg/errors"
+)
+
+// RoleSelector choose the role to assume from the accounts and roles extracted from the saml assertion,
+// this allows integrators to replace the built in prompt with their own picker
+type RoleSelector func(accounts []*AWSAccount) (*AWSRole, error)
+
+// ActiveRoleSelector is by default the cli prompt which asks again until a role is chosen
+var ActiveRoleSelector RoleSelector = promptUntilRoleSelected
+
+// SetRoleSelector configure an alternate role selector to the default one
+func SetRoleSelector(selector RoleSelector) {
+	ActiveRoleSelector = selector
+}
+
+// SelectAWSRole ask the active role selector to choose one of the roles in the accounts, the choice
+// must be one of the roles which were offered
+func SelectAWSRole(accounts []*AWSAccount) (*AWSRole, error) {
+	role, err := ActiveRoleSelector(accounts)
+	if err != nil {
+		return nil, errors.Wrap(err, "Role selection failed")
+	}
+	if role == nil {
+		return nil, errors.New("No role was selected")
+	}
+
+	for _, account := range accounts {
+		for _, awsRole := range account.Roles {
+			if awsRole.RoleARN == role.RoleARN {
+				return awsRole, nil
+			}
+		}
+	}
+
+	return nil, errors.Errorf("Selected role %s is not in the saml assertion", role.RoleARN)
+}
+
+func promptUntilRoleSelected(accounts []*AWSAccount) (*AWSRole, error) {
+	for {
+		role, err := PromptForAWSRoleSelection(accounts)
+		if err == nil {
+			return role, nil
+		}
+		log.Println("Error selecting role. Try again.")
+	}
+}
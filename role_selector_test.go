@@ -0,0 +1,68 @@
+package saml2aws
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testRoleAccounts() []*AWSAccount {
+	return []*AWSAccount{
+		{
+			Name: "Account: account-alias (000000000001)",
+			Roles: []*AWSRole{
+				{
+					Name:         "Development",
+					RoleARN:      "arn:aws:iam::000000000001:role/Development",
+					PrincipalARN: "arn:aws:iam::000000000001:saml-provider/test-idp",
+				},
+				{
+					Name:         "Production",
+					RoleARN:      "arn:aws:iam::000000000001:role/Production",
+					PrincipalARN: "arn:aws:iam::000000000001:saml-provider/test-idp",
+				},
+			},
+		},
+	}
+}
+
+func TestSelectAWSRoleCustomSelector(t *testing.T) {
+	defer SetRoleSelector(ActiveRoleSelector)
+
+	accounts := testRoleAccounts()
+
+	var offered []*AWSAccount
+	SetRoleSelector(func(accounts []*AWSAccount) (*AWSRole, error) {
+		offered = accounts
+		return &AWSRole{RoleARN: "arn:aws:iam::000000000001:role/Production"}, nil
+	})
+
+	role, err := SelectAWSRole(accounts)
+	assert.Nil(t, err)
+	assert.Equal(t, accounts, offered)
+	assert.Equal(t, accounts[0].Roles[1], role)
+	assert.Equal(t, "arn:aws:iam::000000000001:saml-provider/test-idp", role.PrincipalARN)
+}
+
+func TestSelectAWSRoleUnknownRole(t *testing.T) {
+	defer SetRoleSelector(ActiveRoleSelector)
+
+	SetRoleSelector(func(accounts []*AWSAccount) (*AWSRole, error) {
+		return &AWSRole{RoleARN: "arn:aws:iam::000000000002:role/Production"}, nil
+	})
+
+	_, err := SelectAWSRole(testRoleAccounts())
+	assert.EqualError(t, err, "Selected role arn:aws:iam::000000000002:role/Production is not in the saml assertion")
+}
+
+func TestSelectAWSRoleSelectorError(t *testing.T) {
+	defer SetRoleSelector(ActiveRoleSelector)
+
+	SetRoleSelector(func(accounts []*AWSAccount) (*AWSRole, error) {
+		return nil, errors.New("cancelled")
+	})
+
+	_, err := SelectAWSRole(testRoleAccounts())
+	assert.EqualError(t, err, "Role selection failed: cancelled")
+}
@@ -2,10 +2,14 @@ package saml2aws
 
 import (
 	"fmt"
+	"net/url"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/beevik/etree"
+	"github.com/versent/saml2aws/v2/pkg/awspartition"
 )
 
 const (
@@ -13,9 +17,23 @@ const (
 	attributeStatementTag = "AttributeStatement"
 	attributeTag          = "Attribute"
 	attributeValueTag     = "AttributeValue"
+	audienceTag           = "Audience"
+	issuerTag             = "Issuer"
 	responseTag           = "Response"
+
+	// DefaultRoleAttributeName the attribute AWS uses to pass the roles in the assertion
+	DefaultRoleAttributeName = "https://aws.amazon.com/SAML/Attributes/Role"
+
+	// RoleSessionNameAttributeName the attribute AWS uses as the session name of the assumed role
+	RoleSessionNameAttributeName = "https://aws.amazon.com/SAML/Attributes/RoleSessionName"
 )
 
+// roleSessionNameRegexp the character and length constraints AWS places on a role session name
+var roleSessionNameRegexp = regexp.MustCompile(`^[\w+=,.@-]{2,64}$`)
+
+// awsAudiences the entity IDs of AWS as a service provider in the commercial, GovCloud and China partitions
+var awsAudiences = []string{"urn:amazon:webservices", "urn:amazon:webservices:govcloud", "urn:amazon:webservices:cn"}
+
 // ErrMissingElement is the error type that indicates an element and/or attribute is
 // missing. It provides a structured error that can be more appropriately acted
 // upon.
@@ -53,26 +71,51 @@ func ExtractSessionDuration(data []byte) (int64, error) {
 	// log.Printf("tag: %s", assertionElement.Tag)
 
 	//Get the actual assertion attributes
-	attributeStatement := assertionElement.FindElement(childPath(assertionElement.Space, attributeStatementTag))
+	attributeStatement := assertionElement.FindElement(childPath(attributeStatementTag))
 	if attributeStatement == nil {
 		return 0, ErrMissingElement{Tag: attributeStatementTag}
 	}
 
-	attributes := attributeStatement.FindElements(childPath(assertionElement.Space, attributeTag))
+	attributes := attributeStatement.FindElements(childPath(attributeTag))
 
 	for _, attribute := range attributes {
 		if attribute.SelectAttrValue("Name", "") != "https://aws.amazon.com/SAML/Attributes/SessionDuration" {
 			continue
 		}
-		atributeValues := attribute.FindElements(childPath(assertionElement.Space, attributeValueTag))
+		atributeValues := attribute.FindElements(childPath(attributeValueTag))
 		for _, attrValue := range atributeValues {
-			return strconv.ParseInt(attrValue.Text(), 10, 64)
+			return strconv.ParseInt(strings.TrimSpace(attrValue.Text()), 10, 64)
 		}
 	}
 
 	return 0, nil
 }
 
+// ExtractRoleSessionName this will attempt to extract the role session name from the assertion,
+// an empty string is returned if the attribute isn't present
+// see https://aws.amazon.com/SAML/Attributes/RoleSessionName
+func ExtractRoleSessionName(data []byte) (string, error) {
+
+	values, err := extractAttributeValues(data, RoleSessionNameAttributeName)
+	if err != nil {
+		return "", err
+	}
+
+	if len(values) == 0 {
+		return "", nil
+	}
+
+	return values[0], nil
+}
+
+// ValidateRoleSessionName check the role session name against the constraints enforced by AWS
+func ValidateRoleSessionName(name string) error {
+	if !roleSessionNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid role session name %q, must be 2-64 characters from [a-zA-Z0-9+=,.@_-]", name)
+	}
+	return nil
+}
+
 // ExtractDestinationURL will find the Destination URL to POST the SAML assertion to.
 // This is necessary to support AWS instances with custom endpoints such as GovCloud and AWS China without requiring
 // hardcoded endpoints on the saml2aws side.
@@ -106,6 +149,53 @@ func ExtractDestinationURL(data []byte) (string, error) {
 	return destination, nil
 }
 
+// VerifyDestination check the assertion is addressed to the expected sign in URL, so an assertion meant for
+// another service provider is never posted to AWS. The scheme and host are compared case insensitively and a
+// trailing slash is ignored. When no URL is expected the SAML endpoint of any AWS sign in host is accepted,
+// including the regional ones such as https://us-east-1.signin.aws.amazon.com/saml.
+func VerifyDestination(data []byte, expected string) error {
+	destination, err := ExtractDestinationURL(data)
+	if err != nil {
+		return err
+	}
+
+	if expected == "" {
+		if !isAWSSignInURL(destination) {
+			return fmt.Errorf("SAML assertion is addressed to %s, which isn't an AWS sign in endpoint", destination)
+		}
+		return nil
+	}
+
+	if !sameURL(destination, expected) {
+		return fmt.Errorf("SAML assertion is addressed to %s, expected %s", destination, expected)
+	}
+
+	return nil
+}
+
+func sameURL(a, b string) bool {
+	ua, errA := url.Parse(strings.TrimSuffix(a, "/"))
+	ub, errB := url.Parse(strings.TrimSuffix(b, "/"))
+	if errA != nil || errB != nil {
+		return a == b
+	}
+	return strings.EqualFold(ua.Scheme, ub.Scheme) && strings.EqualFold(ua.Host, ub.Host) && ua.Path == ub.Path && ua.RawQuery == ub.RawQuery
+}
+
+// isAWSSignInURL whether the URL is the SAML endpoint of an AWS sign in host, compared like sameURL does
+func isAWSSignInURL(rawURL string) bool {
+	u, err := url.Parse(strings.TrimSuffix(rawURL, "/"))
+	if err != nil || !strings.EqualFold(u.Scheme, "https") || u.Path != "/saml" || u.RawQuery != "" {
+		return false
+	}
+	return isAWSSignInHost(strings.ToLower(u.Host))
+}
+
+// isAWSSignInHost whether the host is one of the AWS sign in hosts or a regional one of them
+func isAWSSignInHost(host string) bool {
+	return awspartition.ForHost(host) != nil
+}
+
 // ExtractMFATokenExpiryTime returns the duration of MFA token
 // This is done by looking at the SubjectConfirmationData's NotOnOrAfter attribute
 func ExtractMFATokenExpiryTime(data []byte) (time.Time, error) {
@@ -133,14 +223,209 @@ func ExtractMFATokenExpiryTime(data []byte) (time.Time, error) {
 	return time.Parse(time.RFC3339, ValidUntilString)
 }
 
+// ExtractSessionNotOnOrAfter returns the SessionNotOnOrAfter of the AuthnStatement, the time STS sessions assumed
+// with the assertion end at the latest, the zero time is returned when the IdP doesn't limit the session
+func ExtractSessionNotOnOrAfter(data []byte) (time.Time, error) {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		return time.Time{}, err
+	}
+
+	authnStatementElement := doc.FindElement(".//AuthnStatement")
+	if authnStatementElement == nil {
+		return time.Time{}, nil
+	}
+
+	sessionNotOnOrAfter := authnStatementElement.SelectAttrValue("SessionNotOnOrAfter", "")
+	if sessionNotOnOrAfter == "" {
+		return time.Time{}, nil
+	}
+
+	return time.Parse(time.RFC3339, sessionNotOnOrAfter)
+}
+
+// ExtractAuthnInstant returns the AuthnInstant of the AuthnStatement, the time the IdP authenticated the user,
+// which is well before the assertion was issued when an existing IdP session was used. The zero time is returned
+// when the assertion doesn't say
+func ExtractAuthnInstant(data []byte) (time.Time, error) {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		return time.Time{}, err
+	}
+
+	authnStatementElement := doc.FindElement(".//AuthnStatement")
+	if authnStatementElement == nil {
+		return time.Time{}, nil
+	}
+
+	authnInstant := authnStatementElement.SelectAttrValue("AuthnInstant", "")
+	if authnInstant == "" {
+		return time.Time{}, nil
+	}
+
+	return time.Parse(time.RFC3339, authnInstant)
+}
+
+// VerifyAuthnInstant check the user authenticated at the IdP no longer than maxAge before now
+func VerifyAuthnInstant(data []byte, maxAge time.Duration, now time.Time) error {
+	authnInstant, err := ExtractAuthnInstant(data)
+	if err != nil {
+		return err
+	}
+	if authnInstant.IsZero() {
+		return fmt.Errorf("SAML assertion doesn't say when you authenticated")
+	}
+
+	if age := now.Sub(authnInstant); age > maxAge {
+		return fmt.Errorf("SAML assertion is from an authentication at %s, %v ago which is more than %v", authnInstant.Format(time.RFC3339), age.Round(time.Second), maxAge)
+	}
+
+	return nil
+}
+
+// IsAWSAudience whether the audience is AWS, either one of its entity IDs or the SAML endpoint of a sign in host
+func IsAWSAudience(audience string) bool {
+	for _, awsAudience := range awsAudiences {
+		if audience == awsAudience {
+			return true
+		}
+	}
+
+	u, err := url.Parse(audience)
+	if err != nil || u.Scheme != "https" || u.Path != "/saml" {
+		return false
+	}
+	return isAWSSignInHost(u.Host)
+}
+
+// VerifyAudience check the assertion is restricted to the expected audience, or to AWS when none is expected, which
+// otherwise only shows as an InvalidIdentityToken from STS. An assertion without an audience restriction passes.
+func VerifyAudience(data []byte, expected string) error {
+	audiences, err := ExtractAudiences(data)
+	if err != nil {
+		return err
+	}
+	if len(audiences) == 0 {
+		return nil
+	}
+
+	for _, audience := range audiences {
+		if expected != "" && audience == expected || expected == "" && IsAWSAudience(audience) {
+			return nil
+		}
+	}
+
+	if expected == "" {
+		expected = strings.Join(awsAudiences, ", ")
+	}
+	return fmt.Errorf("SAML assertion is for audience %s instead of %s", strings.Join(audiences, ", "), expected)
+}
+
+// AssertionAttribute a named attribute and its values from the assertion
+type AssertionAttribute struct {
+	Name   string
+	Values []string
+}
+
+// ExtractIssuer returns the issuer of the assertion
+func ExtractIssuer(data []byte) (string, error) {
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		return "", err
+	}
+
+	assertionElement := doc.FindElement(".//Assertion")
+	if assertionElement == nil {
+		return "", ErrMissingAssertion
+	}
+
+	issuerElement := assertionElement.FindElement(childPath(issuerTag))
+	if issuerElement == nil {
+		return "", ErrMissingElement{Tag: issuerTag}
+	}
+
+	return issuerElement.Text(), nil
+}
+
+// ExtractAudiences returns the audiences the assertion is restricted to
+func ExtractAudiences(data []byte) ([]string, error) {
+
+	audiences := []string{}
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		return audiences, err
+	}
+
+	assertionElement := doc.FindElement(".//Assertion")
+	if assertionElement == nil {
+		return nil, ErrMissingAssertion
+	}
+
+	for _, audience := range assertionElement.FindElements(".//" + audienceTag) {
+		audiences = append(audiences, strings.TrimSpace(audience.Text()))
+	}
+
+	return audiences, nil
+}
+
+// ExtractAttributes returns all the attributes in the assertion in document order
+func ExtractAttributes(data []byte) ([]AssertionAttribute, error) {
+
+	attrs := []AssertionAttribute{}
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		return attrs, err
+	}
+
+	assertionElement := doc.FindElement(".//Assertion")
+	if assertionElement == nil {
+		return nil, ErrMissingAssertion
+	}
+
+	attributeStatement := assertionElement.FindElement(childPath(attributeStatementTag))
+	if attributeStatement == nil {
+		return nil, ErrMissingElement{Tag: attributeStatementTag}
+	}
+
+	attributes := attributeStatement.FindElements(childPath(attributeTag))
+	for _, attribute := range attributes {
+		attr := AssertionAttribute{Name: attribute.SelectAttrValue("Name", "")}
+		for _, attrValue := range attribute.FindElements(childPath(attributeValueTag)) {
+			attr.Values = append(attr.Values, strings.TrimSpace(attrValue.Text()))
+		}
+		attrs = append(attrs, attr)
+	}
+
+	return attrs, nil
+}
+
 // ExtractAwsRoles given an assertion document extract the aws roles
 func ExtractAwsRoles(data []byte) ([]string, error) {
+	return ExtractAwsRolesWithAttribute(data, DefaultRoleAttributeName)
+}
+
+// ExtractAwsRolesWithAttribute given an assertion document extract the aws roles from the named
+// attribute, this is used by federations which don't use the standard AWS role attribute
+func ExtractAwsRolesWithAttribute(data []byte, attributeName string) ([]string, error) {
+
+	if attributeName == "" {
+		attributeName = DefaultRoleAttributeName
+	}
 
-	awsroles := []string{}
+	return extractAttributeValues(data, attributeName)
+}
+
+// extractAttributeValues given an assertion document extract all the values of the named attribute
+func extractAttributeValues(data []byte, attributeName string) ([]string, error) {
+
+	values := []string{}
 
 	doc := etree.NewDocument()
 	if err := doc.ReadFromBytes(data); err != nil {
-		return awsroles, err
+		return values, err
 	}
 
 	// log.Printf("root tag: %s", doc.Root().Tag)
@@ -153,31 +438,29 @@ func ExtractAwsRoles(data []byte) ([]string, error) {
 	// log.Printf("tag: %s", assertionElement.Tag)
 
 	//Get the actual assertion attributes
-	attributeStatement := assertionElement.FindElement(childPath(assertionElement.Space, attributeStatementTag))
+	attributeStatement := assertionElement.FindElement(childPath(attributeStatementTag))
 	if attributeStatement == nil {
 		return nil, ErrMissingElement{Tag: attributeStatementTag}
 	}
 
 	// log.Printf("tag: %s", attributeStatement.Tag)
 
-	attributes := attributeStatement.FindElements(childPath(assertionElement.Space, attributeTag))
+	attributes := attributeStatement.FindElements(childPath(attributeTag))
 	for _, attribute := range attributes {
-		if attribute.SelectAttrValue("Name", "") != "https://aws.amazon.com/SAML/Attributes/Role" {
+		if attribute.SelectAttrValue("Name", "") != attributeName {
 			continue
 		}
-		atributeValues := attribute.FindElements(childPath(assertionElement.Space, attributeValueTag))
+		atributeValues := attribute.FindElements(childPath(attributeValueTag))
 		for _, attrValue := range atributeValues {
-			awsroles = append(awsroles, attrValue.Text())
+			values = append(values, strings.TrimSpace(attrValue.Text()))
 		}
 	}
 
-	return awsroles, nil
+	return values, nil
 }
 
-func childPath(space, tag string) string {
-	if space == "" {
-		return "./" + tag
-	}
-	//log.Printf("query = %s", "./"+space+":"+tag)
-	return "./" + space + ":" + tag
+// childPath select the child elements with the tag whatever their prefix, IdPs don't agree on the prefix of the
+// assertion namespace and some mix several prefixes, or a default namespace, for it within an assertion
+func childPath(tag string) string {
+	return "./" + tag
 }
@@ -3,9 +3,12 @@ package saml2aws
 import (
 	"fmt"
 	"sort"
+	"strings"
 
 	"github.com/versent/saml2aws/v2/pkg/cfg"
 	"github.com/versent/saml2aws/v2/pkg/creds"
+	"github.com/versent/saml2aws/v2/pkg/metrics"
+	"github.com/versent/saml2aws/v2/pkg/provider"
 	"github.com/versent/saml2aws/v2/pkg/provider/aad"
 	"github.com/versent/saml2aws/v2/pkg/provider/adfs"
 	"github.com/versent/saml2aws/v2/pkg/provider/adfs2"
@@ -30,26 +33,65 @@ import (
 // ProviderList list of providers with their MFAs
 type ProviderList map[string][]string
 
-// MFAsByProvider a list of providers with their respective supported MFAs
-var MFAsByProvider = ProviderList{
-	"AzureAD":       []string{"Auto", "PhoneAppOTP", "PhoneAppNotification", "OneWaySMS"},
-	"ADFS":          []string{"Auto", "VIP", "Azure", "Defender"},
-	"ADFS2":         []string{"Auto", "RSA"}, // nothing automatic about ADFS 2.x
-	"Ping":          []string{"Auto"},        // automatically detects PingID
-	"PingOne":       []string{"Auto"},        // automatically detects PingID
-	"JumpCloud":     []string{"Auto", "TOTP", "WEBAUTHN", "DUO", "PUSH"},
-	"Okta":          []string{"Auto", "PUSH", "DUO", "SMS", "TOTP", "OKTA", "FIDO", "YUBICO TOKEN:HARDWARE", "SYMANTEC"}, // automatically detects DUO, SMS, ToTP, and FIDO
-	"OneLogin":      []string{"Auto", "OLP", "SMS", "TOTP", "YUBIKEY"},                                                   // automatically detects OneLogin Protect, SMS and ToTP
-	"Authentik":     []string{"Auto"},
-	"KeyCloak":      []string{"Auto"}, // automatically detects ToTP
-	"GoogleApps":    []string{"Auto"}, // automatically detects ToTP
-	"Shibboleth":    []string{"Auto", "None"},
-	"F5APM":         []string{"Auto"},
-	"Akamai":        []string{"Auto", "DUO", "SMS", "EMAIL", "TOTP"},
-	"ShibbolethECP": []string{"auto", "phone", "push", "passcode"},
-	"NetIQ":         []string{"Auto", "Privileged"},
-	"Browser":       []string{"Auto"},
-	"Auth0":         []string{"Auto"},
+// MFAsByProvider a list of providers with their respective supported MFAs, this is filled in as providers are registered
+var MFAsByProvider = ProviderList{}
+
+// ProviderFactory create the SAML client of a provider for the idp account
+type ProviderFactory func(idpAccount *cfg.IDPAccount) (SAMLClient, error)
+
+type providerRegistration struct {
+	factory  ProviderFactory
+	checkMFA bool
+}
+
+var providers = map[string]providerRegistration{}
+
+func init() {
+	RegisterProvider("AzureAD", aad.MFAMethods(), func(idpAccount *cfg.IDPAccount) (SAMLClient, error) { return aad.New(idpAccount) })
+	RegisterProvider("ADFS", []string{"Auto", "VIP", "Azure", "Defender"}, func(idpAccount *cfg.IDPAccount) (SAMLClient, error) { return adfs.New(idpAccount) })
+	// nothing automatic about ADFS 2.x
+	RegisterProvider("ADFS2", []string{"Auto", "RSA"}, func(idpAccount *cfg.IDPAccount) (SAMLClient, error) { return adfs2.New(idpAccount) })
+	// automatically detects PingID
+	RegisterProvider("Ping", []string{"Auto"}, func(idpAccount *cfg.IDPAccount) (SAMLClient, error) { return pingfed.New(idpAccount) })
+	// automatically detects PingID
+	RegisterProvider("PingOne", []string{"Auto"}, func(idpAccount *cfg.IDPAccount) (SAMLClient, error) { return pingone.New(idpAccount) })
+	RegisterProvider("JumpCloud", []string{"Auto", "TOTP", "WEBAUTHN", "DUO", "PUSH"}, func(idpAccount *cfg.IDPAccount) (SAMLClient, error) { return jumpcloud.New(idpAccount) })
+	// automatically detects DUO, SMS, ToTP, and FIDO
+	RegisterProvider("Okta", []string{"Auto", "PUSH", "DUO", "SMS", "TOTP", "OKTA", "FIDO", "YUBICO TOKEN:HARDWARE", "SYMANTEC"}, func(idpAccount *cfg.IDPAccount) (SAMLClient, error) { return okta.New(idpAccount) })
+	// automatically detects OneLogin Protect, SMS and ToTP
+	RegisterProvider("OneLogin", []string{"Auto", "OLP", "SMS", "TOTP", "YUBIKEY"}, func(idpAccount *cfg.IDPAccount) (SAMLClient, error) { return onelogin.New(idpAccount) })
+	RegisterProvider("Authentik", []string{"Auto"}, func(idpAccount *cfg.IDPAccount) (SAMLClient, error) { return authentik.New(idpAccount) })
+	// automatically detects ToTP
+	RegisterProvider("KeyCloak", []string{"Auto"}, func(idpAccount *cfg.IDPAccount) (SAMLClient, error) { return keycloak.New(idpAccount) })
+	// automatically detects ToTP
+	RegisterProvider("GoogleApps", []string{"Auto"}, func(idpAccount *cfg.IDPAccount) (SAMLClient, error) { return googleapps.New(idpAccount) })
+	RegisterProvider("Shibboleth", []string{"Auto", "None"}, func(idpAccount *cfg.IDPAccount) (SAMLClient, error) { return shibboleth.New(idpAccount) })
+	RegisterProvider("ShibbolethECP", []string{"auto", "phone", "push", "passcode"}, func(idpAccount *cfg.IDPAccount) (SAMLClient, error) { return shibbolethecp.New(idpAccount) })
+	RegisterProvider("F5APM", []string{"Auto"}, func(idpAccount *cfg.IDPAccount) (SAMLClient, error) { return f5apm.New(idpAccount) })
+	RegisterProvider("Akamai", []string{"Auto", "DUO", "SMS", "EMAIL", "TOTP"}, func(idpAccount *cfg.IDPAccount) (SAMLClient, error) { return akamai.New(idpAccount) })
+	RegisterProvider("NetIQ", []string{"Auto", "Privileged"}, func(idpAccount *cfg.IDPAccount) (SAMLClient, error) { return netiq.New(idpAccount, idpAccount.MFA) })
+	RegisterProvider("Auth0", []string{"Auto"}, func(idpAccount *cfg.IDPAccount) (SAMLClient, error) { return auth0.New(idpAccount) })
+
+	// the browser is offered with its one MFA but whatever is configured is accepted, the shell isn't offered at all
+	registerProvider("Browser", []string{"Auto"}, false, func(idpAccount *cfg.IDPAccount) (SAMLClient, error) { return browser.New(idpAccount) })
+	registerProvider("Shell", nil, false, func(idpAccount *cfg.IDPAccount) (SAMLClient, error) { return shell.New(idpAccount) })
+}
+
+// RegisterProvider make a provider available under the name, this is how the built in providers are added and lets
+// external code add its own IdP flows. The MFAs are offered when configuring an account and the configured MFA must
+// be one of them, when none are given the MFA isn't checked and the provider isn't offered. Registering an existing
+// name replaces that provider.
+func RegisterProvider(name string, mfas []string, factory ProviderFactory) {
+	registerProvider(name, mfas, len(mfas) > 0, factory)
+}
+
+func registerProvider(name string, mfas []string, checkMFA bool, factory ProviderFactory) {
+	if len(mfas) > 0 {
+		MFAsByProvider[name] = mfas
+	} else {
+		delete(MFAsByProvider, name)
+	}
+	providers[name] = providerRegistration{factory: factory, checkMFA: checkMFA}
 }
 
 // Names get a list of provider names
@@ -87,105 +129,51 @@ func invalidMFA(provider string, mfa string) bool {
 	return !MFAsByProvider.stringInSlice(mfa, supportedMfas)
 }
 
+// resolveMFA the MFA of the account as checked against those of its provider, AzureAD accepts aliases such as push
+// which stand for the ID of a method
+func resolveMFA(idpAccount *cfg.IDPAccount) string {
+	if idpAccount.Provider != "AzureAD" {
+		return idpAccount.MFA
+	}
+	aliases, err := idpAccount.MFAAliasMap()
+	if err != nil {
+		return idpAccount.MFA
+	}
+	return aad.ResolveMFA(idpAccount.MFA, aliases)
+}
+
 // SAMLClient client interface
 type SAMLClient interface {
 	Authenticate(loginDetails *creds.LoginDetails) (string, error)
 	Validate(loginDetails *creds.LoginDetails) error
 }
 
-// NewSAMLClient create a new SAML client
+// MFAReporter is implemented by SAML clients which are able to tell whether the last authentication involved MFA, as
+// opposed to being completed by an existing session
+type MFAReporter interface {
+	MFAPerformed() bool
+}
+
+// NewSAMLClient create a new SAML client using the provider registered under the account's provider name
 func NewSAMLClient(idpAccount *cfg.IDPAccount) (SAMLClient, error) {
-	switch idpAccount.Provider {
-	case "AzureAD":
-		if invalidMFA(idpAccount.Provider, idpAccount.MFA) {
-			return nil, fmt.Errorf("Invalid MFA type: %v for %v provider", idpAccount.MFA, idpAccount.Provider)
-		}
-		return aad.New(idpAccount)
-	case "ADFS":
-		if invalidMFA(idpAccount.Provider, idpAccount.MFA) {
-			return nil, fmt.Errorf("Invalid MFA type: %v for %v provider", idpAccount.MFA, idpAccount.Provider)
-		}
-		return adfs.New(idpAccount)
-	case "ADFS2":
-		if invalidMFA(idpAccount.Provider, idpAccount.MFA) {
-			return nil, fmt.Errorf("Invalid MFA type: %v for %v provider", idpAccount.MFA, idpAccount.Provider)
-		}
-		return adfs2.New(idpAccount)
-	case "Ping":
-		if invalidMFA(idpAccount.Provider, idpAccount.MFA) {
-			return nil, fmt.Errorf("Invalid MFA type: %v for %v provider", idpAccount.MFA, idpAccount.Provider)
-		}
-		return pingfed.New(idpAccount)
-	case "PingOne":
-		if invalidMFA(idpAccount.Provider, idpAccount.MFA) {
-			return nil, fmt.Errorf("Invalid MFA type: %v for %v provider", idpAccount.MFA, idpAccount.Provider)
-		}
-		return pingone.New(idpAccount)
-	case "JumpCloud":
-		if invalidMFA(idpAccount.Provider, idpAccount.MFA) {
-			return nil, fmt.Errorf("Invalid MFA type: %v for %v provider", idpAccount.MFA, idpAccount.Provider)
-		}
-		return jumpcloud.New(idpAccount)
-	case "Okta":
-		if invalidMFA(idpAccount.Provider, idpAccount.MFA) {
-			return nil, fmt.Errorf("Invalid MFA type: %v for %v provider", idpAccount.MFA, idpAccount.Provider)
-		}
-		return okta.New(idpAccount)
-	case "OneLogin":
-		if invalidMFA(idpAccount.Provider, idpAccount.MFA) {
-			return nil, fmt.Errorf("Invalid MFA type: %v for %v provider", idpAccount.MFA, idpAccount.Provider)
-		}
-		return onelogin.New(idpAccount)
-	case "Authentik":
-		if invalidMFA(idpAccount.Provider, idpAccount.MFA) {
-			return nil, fmt.Errorf("Invalid MFA type: %v for %v provider", idpAccount.MFA, idpAccount.Provider)
-		}
-		return authentik.New(idpAccount)
-	case "KeyCloak":
-		if invalidMFA(idpAccount.Provider, idpAccount.MFA) {
-			return nil, fmt.Errorf("Invalid MFA type: %v for %v provider", idpAccount.MFA, idpAccount.Provider)
-		}
-		return keycloak.New(idpAccount)
-	case "GoogleApps":
-		if invalidMFA(idpAccount.Provider, idpAccount.MFA) {
-			return nil, fmt.Errorf("Invalid MFA type: %v for %v provider", idpAccount.MFA, idpAccount.Provider)
-		}
-		return googleapps.New(idpAccount)
-	case "Shibboleth":
-		if invalidMFA(idpAccount.Provider, idpAccount.MFA) {
-			return nil, fmt.Errorf("Invalid MFA type: %v for %v provider", idpAccount.MFA, idpAccount.Provider)
-		}
-		return shibboleth.New(idpAccount)
-	case "ShibbolethECP":
-		if invalidMFA(idpAccount.Provider, idpAccount.MFA) {
-			return nil, fmt.Errorf("Invalid MFA type: %v for %v provider", idpAccount.MFA, idpAccount.Provider)
-		}
-		return shibbolethecp.New(idpAccount)
-	case "F5APM":
-		if invalidMFA(idpAccount.Provider, idpAccount.MFA) {
-			return nil, fmt.Errorf("Invalid MFA type: %v for %v provider", idpAccount.MFA, idpAccount.Provider)
-		}
-		return f5apm.New(idpAccount)
-	case "Akamai":
-		if invalidMFA(idpAccount.Provider, idpAccount.MFA) {
-			return nil, fmt.Errorf("Invalid MFA type: %v for %v provider", idpAccount.MFA, idpAccount.Provider)
-		}
-		return akamai.New(idpAccount)
-	case "Shell":
-		return shell.New(idpAccount)
-	case "NetIQ":
-		if invalidMFA(idpAccount.Provider, idpAccount.MFA) {
-			return nil, fmt.Errorf("Invalid MFA type: %v for %v provider", idpAccount.MFA, idpAccount.Provider)
-		}
-		return netiq.New(idpAccount, idpAccount.MFA)
-	case "Browser":
-		return browser.New(idpAccount)
-	case "Auth0":
-		if invalidMFA(idpAccount.Provider, idpAccount.MFA) {
-			return nil, fmt.Errorf("Invalid MFA type: %v for %v provider", idpAccount.MFA, idpAccount.Provider)
-		}
-		return auth0.New(idpAccount)
-	default:
+	registration, ok := providers[idpAccount.Provider]
+	if !ok {
 		return nil, fmt.Errorf("Invalid provider: %v", idpAccount.Provider)
 	}
+
+	if registration.checkMFA && invalidMFA(idpAccount.Provider, resolveMFA(idpAccount)) {
+		return nil, fmt.Errorf("Invalid MFA type: %v for %v provider, valid options are: %s", idpAccount.MFA, idpAccount.Provider, strings.Join(MFAsByProvider.Mfas(idpAccount.Provider), ", "))
+	}
+
+	if err := provider.CheckSkipVerify(idpAccount.SkipVerify, idpAccount.RequireInsecureConfirm); err != nil {
+		return nil, err
+	}
+
+	client, err := registration.factory(idpAccount)
+	if err != nil || !metrics.Enabled() {
+		return client, err
+	}
+
+	// only wrapped when recording so the client can still be asserted to its own type otherwise
+	return &instrumentedClient{SAMLClient: client, provider: idpAccount.Provider}, nil
 }
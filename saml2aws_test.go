@@ -35,6 +35,19 @@ func TestProviderAzureADInvalidMFA(t *testing.T) {
 	}
 	_, err := NewSAMLClient(account)
 	assert.ErrorContains(t, err, "Invalid MFA type: ")
+
+	account.MFA = "Authenticator"
+	_, err = NewSAMLClient(account)
+	assert.ErrorContains(t, err, "Invalid MFA type: Authenticator for AzureAD provider, valid options are: Auto, CompanionAppsNotification, ")
+
+	account.MFA = "Push"
+	_, err = NewSAMLClient(account)
+	assert.Nil(t, err)
+
+	account.MFA = "office"
+	account.MFAAliases = "office=TwoWayVoiceOffice"
+	_, err = NewSAMLClient(account)
+	assert.Nil(t, err)
 }
 
 func TestProviderAzureADMFA(t *testing.T) {
@@ -48,3 +61,58 @@ func TestProviderAzureADMFA(t *testing.T) {
 	err = client.Validate(loginDetails)
 	assert.Nil(t, err)
 }
+
+type fakeSAMLClient struct {
+	account      *cfg.IDPAccount
+	authenticate func(loginDetails *creds.LoginDetails) (string, error)
+}
+
+func (c *fakeSAMLClient) Authenticate(loginDetails *creds.LoginDetails) (string, error) {
+	return c.authenticate(loginDetails)
+}
+
+func (c *fakeSAMLClient) Validate(loginDetails *creds.LoginDetails) error {
+	return nil
+}
+
+func TestRegisterProvider(t *testing.T) {
+	defer func() {
+		delete(providers, "Custom")
+		delete(MFAsByProvider, "Custom")
+	}()
+
+	var gotDetails *creds.LoginDetails
+	RegisterProvider("Custom", []string{"Auto", "Token"}, func(idpAccount *cfg.IDPAccount) (SAMLClient, error) {
+		return &fakeSAMLClient{account: idpAccount, authenticate: func(loginDetails *creds.LoginDetails) (string, error) {
+			gotDetails = loginDetails
+			return "assertion", nil
+		}}, nil
+	})
+	require.Contains(t, MFAsByProvider.Names(), "Custom")
+
+	account := &cfg.IDPAccount{Provider: "Custom", MFA: "Token"}
+	client, err := NewSAMLClient(account)
+	require.Nil(t, err)
+	require.Equal(t, account, client.(*fakeSAMLClient).account)
+
+	loginDetails := &creds.LoginDetails{Username: "user"}
+	assertion, err := client.Authenticate(loginDetails)
+	require.Nil(t, err)
+	require.Equal(t, "assertion", assertion)
+	require.Equal(t, loginDetails, gotDetails)
+
+	_, err = NewSAMLClient(&cfg.IDPAccount{Provider: "Custom", MFA: "PUSH"})
+	assert.ErrorContains(t, err, "Invalid MFA type: PUSH for Custom provider")
+}
+
+func TestRegisterProviderWithoutMFAs(t *testing.T) {
+	defer delete(providers, "Custom")
+
+	RegisterProvider("Custom", nil, func(idpAccount *cfg.IDPAccount) (SAMLClient, error) {
+		return &fakeSAMLClient{account: idpAccount}, nil
+	})
+	require.NotContains(t, MFAsByProvider.Names(), "Custom")
+
+	_, err := NewSAMLClient(&cfg.IDPAccount{Provider: "Custom", MFA: "anything"})
+	require.Nil(t, err)
+}
@@ -2,6 +2,7 @@ package saml2aws
 
 import (
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -17,6 +18,29 @@ func TestExtractAwsRoles(t *testing.T) {
 	assert.Len(t, roles, 2)
 }
 
+func TestExtractAwsRolesPrefixes(t *testing.T) {
+	data, err := os.ReadFile("testdata/assertion_prefixes.xml")
+	assert.Nil(t, err)
+
+	roles, err := ExtractAwsRoles(data)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"arn:aws:iam::123123123123:role/Admin,arn:aws:iam::123123123123:saml-provider/ExampleIdP",
+		"arn:aws:iam::123123123123:saml-provider/ExampleIdP , arn:aws:iam::123123123123:role/ReadOnly",
+	}, roles)
+
+	awsRoles, err := ParseAWSRoles(roles)
+	assert.Nil(t, err)
+	assert.Equal(t, []*AWSRole{
+		{RoleARN: "arn:aws:iam::123123123123:role/Admin", PrincipalARN: "arn:aws:iam::123123123123:saml-provider/ExampleIdP"},
+		{RoleARN: "arn:aws:iam::123123123123:role/ReadOnly", PrincipalARN: "arn:aws:iam::123123123123:saml-provider/ExampleIdP"},
+	}, awsRoles)
+
+	duration, err := ExtractSessionDuration(data)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(7200), duration)
+}
+
 func TestExtractAwsRolesFail(t *testing.T) {
 	data, err := os.ReadFile("testdata/notxml.xml")
 	assert.Nil(t, err)
@@ -25,6 +49,74 @@ func TestExtractAwsRolesFail(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestExtractAwsRolesWithAttribute(t *testing.T) {
+	data, err := os.ReadFile("testdata/assertion_custom_role.xml")
+	assert.Nil(t, err)
+
+	roles, err := ExtractAwsRolesWithAttribute(data, "https://idp.example.com/claims/aws-role")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"arn:aws:iam::123123123123:saml-provider/ExampleADFS,arn:aws:iam::123123123123:role/AWS-Admin-CloudOPSBuild",
+		"arn:aws:iam::123123123123:saml-provider/ExampleADFS,arn:aws:iam::123123123123:role/AWS-Admin-CloudOPSNonProd",
+	}, roles)
+
+	// the standard attribute is not present in this assertion
+	roles, err = ExtractAwsRoles(data)
+	assert.Nil(t, err)
+	assert.Len(t, roles, 0)
+}
+
+func TestExtractAwsRolesWithAttributeDefault(t *testing.T) {
+	data, err := os.ReadFile("testdata/assertion.xml")
+	assert.Nil(t, err)
+
+	roles, err := ExtractAwsRolesWithAttribute(data, "")
+	assert.Nil(t, err)
+	assert.Len(t, roles, 2)
+}
+
+func TestExtractRoleSessionName(t *testing.T) {
+	data, err := os.ReadFile("testdata/assertion.xml")
+	assert.Nil(t, err)
+
+	name, err := ExtractRoleSessionName(data)
+	assert.Nil(t, err)
+	assert.Equal(t, "wolfeidau@example.com", name)
+
+	data = []byte(strings.Replace(string(data), "Attributes/RoleSessionName", "Attributes/SomethingElse", 1))
+
+	name, err = ExtractRoleSessionName(data)
+	assert.Nil(t, err)
+	assert.Equal(t, "", name)
+}
+
+func TestValidateRoleSessionName(t *testing.T) {
+	assert.Nil(t, ValidateRoleSessionName("wolfeidau@example.com"))
+	assert.Nil(t, ValidateRoleSessionName("user_name+tag=a,b.c-d"))
+	assert.Error(t, ValidateRoleSessionName("a"))
+	assert.Error(t, ValidateRoleSessionName("has space"))
+	assert.Error(t, ValidateRoleSessionName("EXAMPLE\\wolfeidau"))
+	assert.Error(t, ValidateRoleSessionName(strings.Repeat("a", 65)))
+}
+
+func TestExtractIssuerAudiencesAttributes(t *testing.T) {
+	data, err := os.ReadFile("testdata/assertion.xml")
+	assert.Nil(t, err)
+
+	issuer, err := ExtractIssuer(data)
+	assert.Nil(t, err)
+	assert.Equal(t, "http://id.example.com/adfs/services/trust", issuer)
+
+	audiences, err := ExtractAudiences(data)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"urn:amazon:webservices"}, audiences)
+
+	attributes, err := ExtractAttributes(data)
+	assert.Nil(t, err)
+	assert.Len(t, attributes, 3)
+	assert.Equal(t, AssertionAttribute{Name: "https://aws.amazon.com/SAML/Attributes/SessionDuration", Values: []string{"28800"}}, attributes[2])
+}
+
 func TestExtractSessionDuration(t *testing.T) {
 	data, err := os.ReadFile("testdata/assertion.xml")
 	assert.Nil(t, err)
@@ -68,6 +160,31 @@ func TestExtractDestinationURL2(t *testing.T) {
 	assert.Equal(t, "https://signin.aws.amazon.com/saml", destination)
 }
 
+func TestVerifyDestination(t *testing.T) {
+	data, err := os.ReadFile("testdata/assertion.xml")
+	assert.Nil(t, err)
+
+	assert.Nil(t, VerifyDestination(data, "https://signin.aws.amazon.com/saml"))
+	assert.Nil(t, VerifyDestination(data, "https://SIGNIN.aws.amazon.com/saml/"))
+	assert.EqualError(t, VerifyDestination(data, "https://signin.amazonaws-us-gov.com/saml"), "SAML assertion is addressed to https://signin.aws.amazon.com/saml, expected https://signin.amazonaws-us-gov.com/saml")
+	assert.Error(t, VerifyDestination(data, "https://signin.aws.amazon.com.evil.example/saml"))
+
+	// any AWS sign in endpoint when none is expected
+	assert.Nil(t, VerifyDestination(data, ""))
+	for _, destination := range []string{"https://us-east-1.signin.aws.amazon.com/saml", "https://signin.amazonaws-us-gov.com/saml", "https://signin.amazonaws.cn/saml/"} {
+		regional := []byte(strings.ReplaceAll(string(data), "https://signin.aws.amazon.com/saml", destination))
+		assert.Nil(t, VerifyDestination(regional, ""), destination)
+	}
+	for _, destination := range []string{"https://signin.aws.amazon.com.evil.example/saml", "https://evil.example/saml", "https://signin.aws.amazon.com/other"} {
+		other := []byte(strings.ReplaceAll(string(data), "https://signin.aws.amazon.com/saml", destination))
+		assert.EqualError(t, VerifyDestination(other, ""), "SAML assertion is addressed to "+destination+", which isn't an AWS sign in endpoint")
+	}
+
+	data, err = os.ReadFile("testdata/notxml.xml")
+	assert.Nil(t, err)
+	assert.Error(t, VerifyDestination(data, "https://signin.aws.amazon.com/saml"))
+}
+
 func TestExtractMFATokenDuration(t *testing.T) {
 	data, err := os.ReadFile("testdata/assertion.xml")
 	assert.Nil(t, err)
@@ -95,3 +212,88 @@ func TestExtractMFATokenDuration2(t *testing.T) {
 	t.Log(err)
 	assert.NotNil(t, err)
 }
+
+func TestExtractSessionNotOnOrAfter(t *testing.T) {
+	data, err := os.ReadFile("testdata/assertion.xml")
+	assert.Nil(t, err)
+
+	sessionNotOnOrAfter, err := ExtractSessionNotOnOrAfter(data)
+	assert.Nil(t, err)
+	assert.True(t, sessionNotOnOrAfter.IsZero())
+
+	limited := strings.Replace(string(data), `<AuthnStatement `, `<AuthnStatement SessionNotOnOrAfter="2016-09-10T10:54:39.227Z" `, 1)
+	sessionNotOnOrAfter, err = ExtractSessionNotOnOrAfter([]byte(limited))
+	assert.Nil(t, err)
+	assert.Equal(t, "2016-09-10T10:54:39Z", sessionNotOnOrAfter.Format(time.RFC3339))
+}
+
+func TestExtractAuthnInstant(t *testing.T) {
+	data, err := os.ReadFile("testdata/assertion.xml")
+	assert.Nil(t, err)
+	withAuthnInstant := func(value string) []byte {
+		return []byte(strings.Replace(string(data), `AuthnInstant="2016-09-10T02:54:39.227Z"`, value, 1))
+	}
+
+	authnInstant, err := ExtractAuthnInstant(data)
+	assert.Nil(t, err)
+	assert.Equal(t, "2016-09-10T02:54:39Z", authnInstant.Format(time.RFC3339))
+
+	authnInstant, err = ExtractAuthnInstant(withAuthnInstant(`AuthnInstant="2016-09-10T12:54:39+10:00"`))
+	assert.Nil(t, err)
+	assert.Equal(t, "2016-09-10T02:54:39Z", authnInstant.UTC().Format(time.RFC3339))
+
+	authnInstant, err = ExtractAuthnInstant(withAuthnInstant(``))
+	assert.Nil(t, err)
+	assert.True(t, authnInstant.IsZero())
+
+	_, err = ExtractAuthnInstant(withAuthnInstant(`AuthnInstant="yesterday"`))
+	assert.NotNil(t, err)
+}
+
+func TestIsAWSAudience(t *testing.T) {
+	assert.True(t, IsAWSAudience("urn:amazon:webservices"))
+	assert.True(t, IsAWSAudience("urn:amazon:webservices:govcloud"))
+	assert.True(t, IsAWSAudience("urn:amazon:webservices:cn"))
+	assert.True(t, IsAWSAudience("https://signin.aws.amazon.com/saml"))
+	assert.True(t, IsAWSAudience("https://us-east-2.signin.aws.amazon.com/saml"))
+	assert.True(t, IsAWSAudience("https://signin.amazonaws.cn/saml"))
+	assert.False(t, IsAWSAudience("urn:amazon:webservices:other"))
+	assert.False(t, IsAWSAudience("https://signin.aws.amazon.com.example.com/saml"))
+	assert.False(t, IsAWSAudience("http://signin.aws.amazon.com/saml"))
+	assert.False(t, IsAWSAudience("https://id.example.com/saml"))
+}
+
+func TestVerifyAudience(t *testing.T) {
+	data, err := os.ReadFile("testdata/assertion.xml")
+	assert.Nil(t, err)
+
+	assert.Nil(t, VerifyAudience(data, ""))
+	assert.Nil(t, VerifyAudience(data, "urn:amazon:webservices"))
+
+	err = VerifyAudience(data, "https://signin.aws.amazon.com/saml")
+	assert.EqualError(t, err, "SAML assertion is for audience urn:amazon:webservices instead of https://signin.aws.amazon.com/saml")
+
+	// the identifier of another app at the IdP
+	otherApp := strings.Replace(string(data), "<Audience>urn:amazon:webservices</Audience>", "<Audience>\n  https://app.example.com/\n</Audience>", 1)
+	err = VerifyAudience([]byte(otherApp), "")
+	assert.EqualError(t, err, "SAML assertion is for audience https://app.example.com/ instead of urn:amazon:webservices, urn:amazon:webservices:govcloud, urn:amazon:webservices:cn")
+	assert.Nil(t, VerifyAudience([]byte(otherApp), "https://app.example.com/"))
+
+	unrestricted := strings.Replace(string(data), "<Audience>urn:amazon:webservices</Audience>", "", 1)
+	assert.Nil(t, VerifyAudience([]byte(unrestricted), ""))
+}
+
+func TestVerifyAuthnInstant(t *testing.T) {
+	data, err := os.ReadFile("testdata/assertion.xml")
+	assert.Nil(t, err)
+	authnInstant := time.Date(2016, 9, 10, 2, 54, 39, 227000000, time.UTC)
+
+	assert.Nil(t, VerifyAuthnInstant(data, time.Hour, authnInstant.Add(59*time.Minute)))
+
+	err = VerifyAuthnInstant(data, time.Hour, authnInstant.Add(25*time.Hour))
+	assert.EqualError(t, err, "SAML assertion is from an authentication at 2016-09-10T02:54:39Z, 25h0m0s ago which is more than 1h0m0s")
+
+	withoutAuthnInstant := strings.Replace(string(data), `AuthnInstant="2016-09-10T02:54:39.227Z"`, ``, 1)
+	err = VerifyAuthnInstant([]byte(withoutAuthnInstant), time.Hour, authnInstant)
+	assert.EqualError(t, err, "SAML assertion doesn't say when you authenticated")
+}